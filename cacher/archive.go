@@ -0,0 +1,489 @@
+package cacher
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/mholt/archiver/v4"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// paxChecksumKey is the PAX record in which the checksum of a regular file's
+	// content is stored.
+	paxChecksumKey = "GCSCACHER.blake2b256"
+
+	// paxXattrPrefix is the prefix of PAX records holding extended attributes, as
+	// used by GNU tar and Go's archive/tar.
+	paxXattrPrefix = "SCHILY.xattr."
+
+	// paxSchemaKey, paxFormatKey, and paxCompressionKey are the records of the
+	// PAX global header Save writes at the start of the archive, so Restore can
+	// reject archives it does not understand before extracting anything. The
+	// compression is informational, since it is detected from the stream.
+	paxSchemaKey      = "GCSCACHER.schema"
+	paxFormatKey      = "GCSCACHER.format"
+	paxCompressionKey = "GCSCACHER.compression"
+
+	// archiveSchema is the version of the archive layout written by Save. It
+	// must be incremented whenever older versions would restore an archive
+	// incorrectly. Archives without a global header predate it and are restored
+	// as schema 1.
+	archiveSchema = 1
+
+	// archiveFormat is the format recorded in the global header.
+	archiveFormat = "tar"
+
+	// globalHeaderPeek is the number of decompressed bytes examined for a global
+	// header before extracting.
+	globalHeaderPeek = 4 << 10
+
+	// ustarNameSize and ustarPrefixSize are the sizes of the name and prefix
+	// fields of a USTAR header. Link targets only have a name field.
+	ustarNameSize   = 100
+	ustarPrefixSize = 155
+)
+
+// fitsUSTAR returns true if name fits in the name field of a USTAR header, or
+// can be split at a slash into its prefix and name fields. A name up to 256
+// bytes long can still be too long, if no slash splits it into parts that fit.
+func fitsUSTAR(name string) bool {
+	if len(name) <= ustarNameSize {
+		return true
+	}
+
+	// The slash separating the fields is not stored, and the trailing slash of
+	// a directory cannot be the separator
+	end := len(name) - 1
+	if end > ustarPrefixSize {
+		end = ustarPrefixSize
+	}
+	idx := strings.LastIndex(name[:end+1], "/")
+	if idx == len(name)-1 {
+		idx = strings.LastIndex(name[:idx], "/")
+	}
+	return idx > 0 && len(name)-idx-1 <= ustarNameSize
+}
+
+// gzipMagic is the magic number at the beginning of gzip streams.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// detectCompression returns the compression of the object, based on its
+// content type or the leading bytes of its content. Objects created by tools
+// which stored plain tar.gz caches use gzip; everything else is assumed to be
+// zstd, decompressed with zs. The reader is only peeked, not advanced.
+func detectCompression(attrs *storage.ObjectAttrs, br *bufio.Reader, zs archiver.Zstd) (archiver.Compression, error) {
+	switch attrs.ContentType {
+	case "application/gzip", "application/x-gzip", "application/x-gtar", "application/x-tgz":
+		return archiver.Gz{}, nil
+	}
+
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, gzipMagic) {
+		return archiver.Gz{}, nil
+	}
+	return zs, nil
+}
+
+// archiveOptions controls how the tar stream is written.
+type archiveOptions struct {
+	// checksums records the checksum of each regular file in a PAX record.
+	checksums bool
+
+	// format is the format of the tar headers. The zero value picks the most
+	// compact format able to represent each header.
+	format tar.Format
+
+	// accessTimes records the access time of each entry.
+	accessTimes bool
+
+	// deterministic normalizes the headers, so identical content always produces
+	// an identical archive.
+	deterministic bool
+
+	// storeUncompressed are the file name patterns of regular files whose
+	// content bypasses a zstd compressor.
+	storeUncompressed []string
+
+	// manifest appends a ContentsManifest of the regular files to the archive.
+	manifest bool
+
+	// now is the modification time of the entries which do not come from disk,
+	// like the contents manifest.
+	now time.Time
+}
+
+// archiveStats describes a written archive.
+type archiveStats struct {
+	// files is the number of entries in the archive.
+	files int64
+
+	// size is the total size of the file content, before compression.
+	size int64
+}
+
+// writeArchive writes the files as a tar stream to w, compressed with the given
+// compressor. It is the equivalent of archiver.CompressedArchive.Archive, but
+// gives control over the tar headers.
+func (c *Cacher) writeArchive(ctx context.Context, w io.Writer, compressor archiver.Compressor, files []archiver.File, opts *archiveOptions) (archiveStats, error) {
+	var stats archiveStats
+	if opts == nil {
+		opts = new(archiveOptions)
+	}
+
+	// Only zstd can switch to stored data mid-stream
+	var cw io.WriteCloser
+	var frames *frameWriter
+	var err error
+	if _, ok := compressor.(archiver.Zstd); ok && len(opts.storeUncompressed) > 0 {
+		frames, err = newFrameWriter(w, compressor)
+		cw = frames
+	} else {
+		cw, err = compressor.OpenWriter(w)
+	}
+	if err != nil {
+		return stats, fmt.Errorf("failed to create compressor: %w", err)
+	}
+
+	tw := tar.NewWriter(cw)
+
+	// The USTAR and GNU formats cannot hold a global header
+	if opts.format == tar.FormatUnknown || opts.format == tar.FormatPAX {
+		if err := tw.WriteHeader(globalHeader(compressor)); err != nil {
+			tw.Close()
+			cw.Close()
+			return stats, fmt.Errorf("failed to write global header: %w", err)
+		}
+	}
+
+	var contents *ContentsManifest
+	if opts.manifest {
+		contents = new(ContentsManifest)
+	}
+
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			tw.Close()
+			cw.Close()
+			return stats, err
+		}
+
+		// A manifest left by an earlier restore is replaced by the new one
+		if contents != nil && f.NameInArchive == ContentsManifestName {
+			continue
+		}
+
+		n, err := writeTarEntry(tw, f, opts, frames, contents)
+		if err != nil {
+			tw.Close()
+			cw.Close()
+			return stats, fmt.Errorf("file %s: %w", f.NameInArchive, err)
+		}
+		stats.files++
+		stats.size += n
+	}
+
+	if contents != nil {
+		if err := writeContentsManifest(tw, contents, opts); err != nil {
+			tw.Close()
+			cw.Close()
+			return stats, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		cw.Close()
+		return stats, fmt.Errorf("failed to close tar writer: %w", err)
+	}
+	if err := cw.Close(); err != nil {
+		return stats, fmt.Errorf("failed to close compressor: %w", err)
+	}
+	return stats, nil
+}
+
+// globalHeader returns the PAX global header describing an archive compressed
+// with compressor.
+func globalHeader(compressor archiver.Compressor) *tar.Header {
+	records := map[string]string{
+		paxSchemaKey: strconv.Itoa(archiveSchema),
+		paxFormatKey: archiveFormat,
+	}
+	if named, ok := compressor.(interface{ Name() string }); ok {
+		records[paxCompressionKey] = strings.TrimPrefix(named.Name(), ".")
+	}
+
+	return &tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: records,
+	}
+}
+
+// checkGlobalHeader returns an error wrapping ErrUnsupportedArchive if the PAX
+// global header hdr describes an archive this version cannot restore. Global
+// headers from other tools, like git, carry none of the records and pass.
+func checkGlobalHeader(hdr *tar.Header) error {
+	if v, ok := hdr.PAXRecords[paxSchemaKey]; ok {
+		schema, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%w: invalid schema %q", ErrUnsupportedArchive, v)
+		}
+		if schema > archiveSchema {
+			return fmt.Errorf("%w: schema %d is newer than the supported schema %d, a newer version is required to restore it",
+				ErrUnsupportedArchive, schema, archiveSchema)
+		}
+	}
+
+	if v, ok := hdr.PAXRecords[paxFormatKey]; ok && v != archiveFormat {
+		return fmt.Errorf("%w: format %q", ErrUnsupportedArchive, v)
+	}
+	return nil
+}
+
+// extractArchive decompresses r and passes each entry of the tar stream to
+// handler, like archiver.CompressedArchive.Extract. Since archiver skips global
+// headers, a global header at the start is read first and checked with
+// checkGlobalHeader.
+func extractArchive(ctx context.Context, r io.Reader, decompressor archiver.Decompressor, handler archiver.FileHandler) error {
+	rc, err := decompressor.OpenReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to create decompressor: %w", err)
+	}
+	defer rc.Close()
+
+	// A short or unreadable start is left for the extraction to report
+	br := bufio.NewReaderSize(rc, globalHeaderPeek)
+	if peeked, _ := br.Peek(globalHeaderPeek); len(peeked) > 0 {
+		hdr, err := tar.NewReader(bytes.NewReader(peeked)).Next()
+		if err == nil && hdr.Typeflag == tar.TypeXGlobalHeader {
+			if err := checkGlobalHeader(hdr); err != nil {
+				return err
+			}
+		}
+	}
+	return archiver.Tar{}.Extract(ctx, br, nil, handler)
+}
+
+// writeTarEntry writes the header and, for regular files, the content of f. It
+// returns the number of content bytes written. If frames is set, content
+// matching the storeUncompressed patterns is written to it uncompressed. If
+// contents is set, regular files are recorded in it.
+func writeTarEntry(tw *tar.Writer, f archiver.File, opts *archiveOptions, frames *frameWriter, contents *ContentsManifest) (int64, error) {
+	hdr, err := tar.FileInfoHeader(f, f.LinkTarget)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create header: %w", err)
+	}
+	hdr.Name = f.NameInArchive
+
+	// Access and change times can only be encoded as PAX or GNU records, and are
+	// otherwise dropped by the tar writer for headers without a format. Access
+	// times are kept by forcing PAX when requested.
+	switch {
+	case opts.format != tar.FormatUnknown:
+		hdr.Format = opts.format
+		if !opts.accessTimes {
+			hdr.AccessTime = time.Time{}
+		}
+		hdr.ChangeTime = time.Time{}
+	case opts.accessTimes && !hdr.AccessTime.IsZero():
+		hdr.Format = tar.FormatPAX
+		hdr.ChangeTime = time.Time{}
+	}
+
+	// Times and ownership vary between machines and checkouts
+	if opts.deterministic {
+		hdr.ModTime = time.Unix(0, 0)
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+	}
+
+	// Carry over any records gathered while walking the disk
+	if partial, ok := f.Header.(*tar.Header); ok && partial != nil && len(partial.PAXRecords) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(partial.PAXRecords)+1)
+		for k, v := range partial.PAXRecords {
+			hdr.PAXRecords[k] = v
+		}
+	}
+
+	if (opts.checksums || contents != nil) && hdr.Typeflag == tar.TypeReg {
+		sum, err := checksumFile(f)
+		if err != nil {
+			return 0, err
+		}
+		if opts.checksums {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string, 1)
+			}
+			hdr.PAXRecords[paxChecksumKey] = sum
+		}
+		if contents != nil {
+			contents.add(hdr.Name, hdr.Size, f.Mode(), sum)
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		// Without a forced format, long paths are written as PAX records. USTAR
+		// has to reject them, since the tar writer never truncates.
+		if opts.format == tar.FormatUSTAR && (!fitsUSTAR(hdr.Name) || len(hdr.Linkname) > ustarNameSize) {
+			return 0, fmt.Errorf("path is too long for the USTAR format, use PAX or GNU for long paths: %w", err)
+		}
+		return 0, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	// Only regular files have a body
+	if hdr.Typeflag != tar.TypeReg {
+		return 0, nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open: %w", err)
+	}
+	defer rc.Close()
+
+	// The header is written by now, so only the content is stored. The padding
+	// after it is written along with the next header, compressed again.
+	stored := frames != nil && hdr.Size > 0 && matchAny(opts.storeUncompressed, hdr.Name)
+	if stored {
+		if err := frames.storeRaw(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.Copy(tw, rc)
+	if err != nil {
+		return n, fmt.Errorf("failed to write data: %w", err)
+	}
+
+	if stored {
+		if err := frames.compress(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// checksumFile returns the checksum of the content of f.
+func checksumFile(f archiver.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to open: %w", err)
+	}
+	defer rc.Close()
+
+	sum, err := checksum(rc)
+	if err != nil {
+		return "", fmt.Errorf("failed to checksum: %w", err)
+	}
+	return sum, nil
+}
+
+// verifyFile compares the checksum of the file on disk at pth against the one
+// recorded in hdr.
+func verifyFile(pth string, hdr *tar.Header) error {
+	want, ok := hdr.PAXRecords[paxChecksumKey]
+	if !ok {
+		return fmt.Errorf("%s: no checksum recorded in archive (was it saved with checksums?)", pth)
+	}
+
+	f, err := os.Open(pth)
+	if err != nil {
+		return fmt.Errorf("%s: failed to open for verification: %w", pth, err)
+	}
+	defer f.Close()
+
+	got, err := checksum(f)
+	if err != nil {
+		return fmt.Errorf("%s: failed to checksum: %w", pth, err)
+	}
+
+	if got != want {
+		return fmt.Errorf("%s: checksum mismatch (expected %s, got %s)", pth, want, got)
+	}
+	return nil
+}
+
+// restoreXattrs applies the extended attributes recorded in hdr to the file at
+// pth. Attributes the filesystem does not support, or the process is not
+// permitted to set, are skipped.
+func (c *Cacher) restoreXattrs(pth string, hdr *tar.Header) error {
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, paxXattrPrefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(k, paxXattrPrefix)
+		if err := setXattr(pth, name, v); err != nil {
+			if xattrUnsupported(err) {
+				c.log("skipping extended attribute %s on %s: %s", name, pth, err)
+				continue
+			}
+			return fmt.Errorf("%s: setting extended attribute %s: %w", pth, name, err)
+		}
+	}
+	return nil
+}
+
+// contentHash returns a hash identifying the archived content of the files:
+// their names, modes, link targets, and the content of regular files.
+// Modification times are not included, so regenerated but identical files hash
+// the same.
+func contentHash(files []archiver.File) (string, error) {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create hash: %w", err)
+	}
+
+	for _, f := range files {
+		// The size delimits the content; directory sizes vary by filesystem
+		if !f.Mode().IsRegular() {
+			fmt.Fprintf(h, "%s\x00%o\x00%s\x00", f.NameInArchive, f.Mode(), f.LinkTarget)
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00%d\x00", f.NameInArchive, f.Mode(), f.Size())
+
+		if err := hashContent(h, f); err != nil {
+			return "", fmt.Errorf("file %s: %w", f.NameInArchive, err)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashContent writes the content of f to w.
+func hashContent(w io.Writer, f archiver.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open: %w", err)
+	}
+	defer rc.Close()
+
+	if _, err := copyBuffered(w, rc); err != nil {
+		return fmt.Errorf("failed to read: %w", err)
+	}
+	return nil
+}
+
+// checksum returns the hex-encoded blake2b-256 digest of r.
+func checksum(r io.Reader) (string, error) {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create hash: %w", err)
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
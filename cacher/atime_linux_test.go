@@ -0,0 +1,80 @@
+package cacher
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fileTimes returns the access and modification time of the file at pth.
+func fileTimes(tb testing.TB, pth string) (atime, mtime time.Time) {
+	tb.Helper()
+
+	fi, err := os.Stat(pth)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	return time.Unix(st.Atim.Unix()), fi.ModTime()
+}
+
+func TestCacher_Restore_accessTimes(t *testing.T) {
+	t.Parallel()
+
+	atime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	cases := []struct {
+		name       string
+		saveAtimes bool
+		times      bool
+		atimes     bool
+		expAtime   bool
+		expMtime   bool
+	}{
+		{name: "both", saveAtimes: true, times: true, atimes: true, expAtime: true, expMtime: true},
+		{name: "access_only", saveAtimes: true, atimes: true, expAtime: true},
+		{name: "modification_only", saveAtimes: true, times: true, expMtime: true},
+		{name: "not_recorded", times: true, atimes: true, expMtime: true},
+		{name: "neither", saveAtimes: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			src := testFiles(t, map[string][]byte{"sub/lib.txt": []byte("library")})
+			for _, name := range []string{"sub/lib.txt", "sub"} {
+				if err := os.Chtimes(filepath.Join(src, name), atime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c, _ := newTestCacher(t)
+			dst := t.TempDir()
+			if _, err := roundTrip(t, c, src, SaveRequest{
+				PreserveAccessTimes: tc.saveAtimes,
+			}, RestoreRequest{
+				Dir:                 dst,
+				PreserveTimes:       tc.times,
+				PreserveAccessTimes: tc.atimes,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range []string{"sub/lib.txt", "sub"} {
+				gotAtime, gotMtime := fileTimes(t, filepath.Join(dst, filepath.Base(src), name))
+				if gotAtime.Equal(atime) != tc.expAtime {
+					t.Errorf("%s: expected recorded access time %t, got %s", name, tc.expAtime, gotAtime)
+				}
+				if gotMtime.Equal(mtime) != tc.expMtime {
+					t.Errorf("%s: expected recorded modification time %t, got %s", name, tc.expMtime, gotMtime)
+				}
+			}
+		})
+	}
+}
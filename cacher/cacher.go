@@ -4,391 +4,2812 @@ package cacher
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"runtime"
-
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
 	"github.com/mholt/archiver/v4"
 
 	"cloud.google.com/go/storage"
-	"golang.org/x/crypto/blake2b"
 	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
 )
 
 const (
-	contentType  = "application/x-zstd-compressed-tar"
-	cacheControl = "public,max-age=600"
+	contentType     = "application/x-zstd-compressed-tar"
+	blobContentType = "application/zstd"
+	cacheControl    = "public,max-age=600"
+
+	// attrsTimeout is the maximum time to wait for a single object metadata lookup.
+	attrsTimeout = 10 * time.Second
+
+	// defaultRetryAttempts and defaultRetryBackoff control how transient storage
+	// failures are retried unless configured with Retries.
+	defaultRetryAttempts = 3
+	defaultRetryBackoff  = 500 * time.Millisecond
+
+	// defaultHeartbeatInterval is how often progress is logged during transfers
+	// unless configured with Heartbeat.
+	defaultHeartbeatInterval = 30 * time.Second
+
+	// maxKeyLength is the longest object name storage accepts, in bytes.
+	maxKeyLength = 1024
+
+	// defaultReadBufferSize is the default size of the buffer Restore reads the
+	// object through.
+	defaultReadBufferSize = 1 << 20
+
+	// maxListConcurrency is the maximum number of keys searched concurrently
+	// when looking for a cached object.
+	maxListConcurrency = 8
+
+	// maxSaveConcurrency is the maximum number of saves SaveAll runs
+	// concurrently.
+	maxSaveConcurrency = 4
+
+	// defaultZstdMaxWindow is the default largest zstd window size accepted when
+	// decompressing.
+	defaultZstdMaxWindow = 1 << 31
+
+	// metadataUncompressedSize and metadataFileCount are the object metadata keys
+	// in which Save records the size of the file content and the number of
+	// entries in the archive.
+	metadataUncompressedSize = "gcs-cacher-uncompressed-size"
+	metadataFileCount        = "gcs-cacher-file-count"
+
+	// metadataContentHash is the object metadata key in which Save records the
+	// hash of the archived content, when deduplicating.
+	metadataContentHash = "gcs-cacher-content-hash"
 )
 
+// validPredefinedACLs are the predefined ACLs supported by Cloud Storage.
+var validPredefinedACLs = map[string]bool{
+	"authenticatedRead":      true,
+	"bucketOwnerFullControl": true,
+	"bucketOwnerRead":        true,
+	"private":                true,
+	"projectPrivate":         true,
+	"publicRead":             true,
+}
+
 // Cacher is responsible for saving and restoring caches.
 type Cacher struct {
-	client *storage.Client
+	client     *storage.Client
+	ownsClient bool
+	closeOnce  sync.Once
+	closeErr   error
+
+	debug           bool
+	hashFileTimeout time.Duration
+	hashSkipMissing bool
+	hashAllowEmpty  bool
+	hashSymlinks    HashSymlinkPolicy
+	hashAlgorithm   HashAlgorithm
+	retryAttempts   int
+	retryBackoff    time.Duration
+
+	memoryRestoreLimit int64
+	transfers          chan struct{}
+	tempDir            string
+	zstdMaxWindow      uint64
+	heartbeatInterval  time.Duration
+	keyPrefix          string
+	saveTimeout        time.Duration
+	restoreTimeout     time.Duration
+	localCacheDir      string
+	clock              func() time.Time
+	skipSpecialFiles   bool
+}
+
+// New creates a new cacher capable of saving and restoring the cache. The
+// caller should call Close when finished to release the storage client.
+func New(ctx context.Context, opts ...Option) (*Cacher, error) {
+	cfg := new(config)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	client, err := storage.NewClient(ctx, cfg.clientOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	return &Cacher{
+		client:            client,
+		ownsClient:        true,
+		retryAttempts:     defaultRetryAttempts,
+		retryBackoff:      defaultRetryBackoff,
+		heartbeatInterval: defaultHeartbeatInterval,
+		skipSpecialFiles:  true,
+		clock:             cfg.clock,
+	}, nil
+}
+
+// NewWithClient creates a new cacher that uses the given storage client. The
+// client remains owned by the caller, who is responsible for closing it; Close
+// on the returned cacher does not close it. Options which configure the client,
+// like WithEndpoint, have no effect; the others, like WithClock, apply as they
+// do to New.
+func NewWithClient(client *storage.Client, opts ...Option) *Cacher {
+	cfg := new(config)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &Cacher{
+		client:            client,
+		retryAttempts:     defaultRetryAttempts,
+		retryBackoff:      defaultRetryBackoff,
+		heartbeatInterval: defaultHeartbeatInterval,
+		skipSpecialFiles:  true,
+		clock:             cfg.clock,
+	}
+}
+
+// Close releases the underlying storage client, unless it was provided via
+// NewWithClient. It is safe to call Close multiple times; subsequent calls
+// return the result of the first.
+func (c *Cacher) Close() error {
+	c.closeOnce.Do(func() {
+		if !c.ownsClient {
+			return
+		}
+
+		c.log("closing storage client")
+		if err := c.client.Close(); err != nil {
+			c.closeErr = fmt.Errorf("failed to close storage client: %w", err)
+		}
+	})
+	return c.closeErr
+}
+
+// now returns the current time from the configured clock.
+func (c *Cacher) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock()
+}
+
+// Debug enables or disables debugging for the cacher.
+func (c *Cacher) Debug(val bool) {
+	c.debug = val
+}
+
+// SkipSpecialFiles controls what Save does with sockets, named pipes, and
+// devices in the directories, such as a socket left behind by a daemon. When
+// enabled, the default, they are skipped with a debug log, since they have no
+// content to cache and reading a named pipe would block the save. When
+// disabled, Save returns an error instead.
+func (c *Cacher) SkipSpecialFiles(val bool) {
+	c.skipSpecialFiles = val
+}
+
+// KeyPrefix namespaces every key under prefix, for example a per-team "teamA/"
+// in a shared bucket. The prefix is prepended to the keys of all saves,
+// restores, lookups, listings, and deletions before they reach storage, so
+// callers keep using unprefixed keys. Keys reported back, like
+// RestoreResult.Key, are unprefixed; object names are the full names in
+// storage.
+func (c *Cacher) KeyPrefix(prefix string) {
+	c.keyPrefix = prefix
+}
+
+// objectName returns the name in storage of the given key.
+func (c *Cacher) objectName(key string) string {
+	return c.keyPrefix + key
+}
+
+// objectNames returns the names in storage of the given keys.
+func (c *Cacher) objectNames(keys []string) []string {
+	names := make([]string, len(keys))
+	for idx, key := range keys {
+		names[idx] = c.objectName(key)
+	}
+	return names
+}
+
+// Retries configures how transient storage failures, such as a flaky metadata
+// lookup, are retried. Each retry waits twice as long as the previous one,
+// starting at backoff. The total number of attempts is always at least one.
+func (c *Cacher) Retries(attempts int, backoff time.Duration) {
+	c.retryAttempts = attempts
+	c.retryBackoff = backoff
+}
+
+// ZstdMaxWindow sets the largest zstd window size accepted when decompressing,
+// in bytes. Caches compressed by other tools with long-distance matching, like
+// "zstd --long=31", use windows larger than the decoder's own default. The
+// memory for the window is only allocated when a cache declares it, but then
+// restoring that cache needs as much. Zero uses the default of 2 GiB, which
+// covers every window the zstd CLI produces.
+func (c *Cacher) ZstdMaxWindow(n uint64) {
+	c.zstdMaxWindow = n
+}
+
+// zstdDecoder returns the zstd compression configured for decompressing.
+func (c *Cacher) zstdDecoder() archiver.Zstd {
+	window := c.zstdMaxWindow
+	if window == 0 {
+		window = defaultZstdMaxWindow
+	}
+
+	return archiver.Zstd{
+		DecoderOptions: []zstd.DOption{
+			zstd.WithDecoderMaxWindow(window),
+		},
+	}
+}
+
+// Heartbeat enables logging a message with the number of bytes transferred so
+// far at the given interval while saving or restoring, even without debug
+// logging. This keeps log-based hang detectors in CI systems from killing long
+// transfers. It defaults to 30 seconds, and an interval of zero disables it.
+func (c *Cacher) Heartbeat(interval time.Duration) {
+	c.heartbeatInterval = interval
+}
+
+// TempDir sets the directory in which temporary files are staged, such as on a
+// large scratch volume instead of a small default tmpfs. It returns an error if
+// the directory does not exist or is not writable. An empty dir uses the
+// default from os.TempDir.
+func (c *Cacher) TempDir(dir string) error {
+	if dir != "" {
+		f, err := os.CreateTemp(dir, ".gcs-cacher-check-")
+		if err != nil {
+			return fmt.Errorf("temporary directory is not writable: %w", err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	c.tempDir = dir
+	return nil
+}
+
+// createTemp creates a new temporary file in the configured temporary
+// directory. The caller is responsible for removing it.
+func (c *Cacher) createTemp(pattern string) (*os.File, error) {
+	f, err := os.CreateTemp(c.tempDir, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	return f, nil
+}
+
+// MaxConcurrentTransfers limits the number of saves and restores running at the
+// same time across all goroutines sharing the cacher. Further calls block until
+// a running one finishes or their context is done. This bounds quota and
+// memory usage, since each upload buffers a large chunk. A reader returned by
+// RestoreReader holds its slot until it is closed. Values less than one mean no
+// limit, which is the default. It must not be called while transfers are in
+// progress.
+func (c *Cacher) MaxConcurrentTransfers(n int) {
+	if n < 1 {
+		c.transfers = nil
+		return
+	}
+	c.transfers = make(chan struct{}, n)
+}
+
+// SaveTimeout limits how long a single Save, SaveReader, or Upload may take,
+// including waiting for a transfer slot, independent of the deadline of the
+// context passed in. A save which runs out of time fails with an error wrapping
+// ErrTimeout, which tells it apart from the caller cancelling the context. A
+// value of zero, the default, means no limit.
+func (c *Cacher) SaveTimeout(d time.Duration) {
+	c.saveTimeout = d
+}
+
+// RestoreTimeout limits how long a single Restore, RestoreToMemory, or Download
+// may take, like SaveTimeout. It does not apply to reading a RestoreReader,
+// which is controlled by the caller.
+func (c *Cacher) RestoreTimeout(d time.Duration) {
+	c.restoreTimeout = d
+}
+
+// withOperationTimeout derives a context which is done after timeout, or
+// returns ctx unchanged for a timeout of zero. The returned function must be
+// called with the error of the operation once it is done. It releases the
+// context and, if the operation failed because it ran out of time rather than
+// because ctx was done, wraps the error with ErrTimeout.
+func withOperationTimeout(ctx context.Context, op string, timeout time.Duration) (context.Context, func(err error) error) {
+	if timeout <= 0 {
+		return ctx, func(err error) error { return err }
+	}
+
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	return opCtx, func(err error) error {
+		timedOut := opCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+		if err != nil && timedOut {
+			return fmt.Errorf("%w: %s took longer than %s: %v", ErrTimeout, op, timeout, err)
+		}
+		return err
+	}
+}
+
+// acquireTransfer waits for a transfer slot and returns a function releasing
+// it.
+func (c *Cacher) acquireTransfer(ctx context.Context) (func(), error) {
+	sem := c.transfers
+	if sem == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	default:
+	}
+
+	c.log("waiting for a transfer slot")
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to wait for a transfer slot: %w", ctx.Err())
+	}
+}
+
+// SaveRequest is used as input to the Save operation.
+type SaveRequest struct {
+	// Bucket is the name of the bucket from which to cache.
+	Bucket string
+
+	// Key is the cache key.
+	Key string
+
+	// Dir is the directory on disk to cache. It is stored in the archive under
+	// its base name, or its path relative to BasePath.
+	Dir string
+
+	// Dirs is a map of additional directories on disk to cache, to the name each
+	// is stored under in the archive (for example "/tmp/build-out" to
+	// "artifacts"). An empty name uses the base name of the directory, or its
+	// path relative to BasePath. At least one of Dir or Dirs is required. Restore
+	// recreates the same structure under its target directory.
+	Dirs map[string]string
+
+	// BasePath, if set, keeps the layout of the directories relative to it in
+	// the archive, instead of storing each under its base name. For example, Dir
+	// "/src/app/build" with BasePath "/src" is stored as "app/build", which
+	// restoring into "/src" puts back in place. It only applies to Dir and to
+	// Dirs with an empty name; explicit names are used as is. Every such
+	// directory must be inside BasePath. Restore with StripComponents flattens
+	// the layout again.
+	BasePath string
+
+	// FollowSymlinks dereferences symlinks and archives the content they point
+	// to instead of the link itself. This is useful when restoring onto a
+	// filesystem where the link targets do not exist. Note that content reachable
+	// through multiple links is stored once per link, so the archive can be
+	// significantly larger. Symlink loops are detected and skipped.
+	FollowSymlinks bool
+
+	// ResolveRoot resolves symbolic links in the paths of Dir and Dirs once,
+	// before walking, such as a workspace mounted behind a symlink. Without it,
+	// a root which is itself a symlink is archived as a link, unless
+	// FollowSymlinks is set. The names in the archive are still derived from
+	// the paths as given, so they do not depend on where the link points.
+	ResolveRoot bool
+
+	// Checksums records the checksum of each regular file in the archive, which
+	// allows restoring with Verify. This reads every file twice.
+	Checksums bool
+
+	// EmbedManifest appends a ContentsManifest of the archived regular files,
+	// with their size, mode, and checksum, to the archive as
+	// ContentsManifestName, so it is restored along with the files. A file of
+	// that name at the top of the archive, like one written by an earlier
+	// restore with WriteManifest, is replaced. This reads every file twice.
+	EmbedManifest bool
+
+	// PreserveXattrs records the extended attributes of each file and directory,
+	// such as SELinux labels or capabilities, in the archive. Extended attributes
+	// are only supported on Linux and are skipped elsewhere.
+	PreserveXattrs bool
+
+	// PreserveAccessTimes records the access time of each entry in the archive,
+	// in addition to the modification time, for restoring with
+	// PreserveAccessTimes. It is stored as a PAX record, so it cannot be combined
+	// with the USTAR TarFormat. Reading the files while archiving does not update
+	// the recorded times, since they are read from disk first.
+	PreserveAccessTimes bool
+
+	// MaxSize is the maximum size of the compressed archive, in bytes. Once the
+	// streamed bytes exceed it, the upload is aborted without creating an object
+	// and ErrMaxSizeExceeded is returned. This guards against a misconfigured Dir
+	// uploading far more than intended. Zero means no limit.
+	MaxSize int64
+
+	// CustomTime sets the custom time of the object. Paired with a bucket
+	// lifecycle rule using daysSinceCustomTime, this makes ephemeral caches expire
+	// automatically. It must not be in the past unless AllowPastCustomTime is set.
+	CustomTime time.Time
+
+	// AllowPastCustomTime permits a CustomTime in the past.
+	AllowPastCustomTime bool
+
+	// ReplaceIfNewer overwrites an existing object when the newest modification
+	// time of any file being cached is after the object's last update, instead
+	// of always skipping. This refreshes stale caches without re-uploading
+	// unchanged ones. File times come from the local clock and the update time
+	// from the storage service, so clock skew between the two can cause a changed
+	// source to be skipped or an unchanged one to be re-uploaded. Times are
+	// compared as absolute instants, so time zones do not matter.
+	ReplaceIfNewer bool
+
+	// SkipExistenceCheck skips looking up whether the object already exists
+	// before saving, which saves a round trip when keys are expected to be new,
+	// for example because they include a unique hash. The upload still only
+	// creates the object if it does not exist yet; if it does, the save is
+	// skipped as usual and Uploaded is false, but only once the archive has been
+	// built and, depending on its size, partly or fully uploaded. With ShardSize
+	// or ComposeSize, the precondition is only checked once all parts are
+	// uploaded; the parts have names unique to the upload, so those of the
+	// existing cache are left alone and only the new ones are deleted. It
+	// cannot be combined with ReplaceIfNewer.
+	SkipExistenceCheck bool
+
+	// FailOnEmpty returns ErrNoFiles instead of uploading an empty archive when
+	// the directories contain nothing but other directories. This surfaces build
+	// steps which silently produced no output. A directory which does not exist
+	// is always an error.
+	FailOnEmpty bool
+
+	// TarFormat forces the format of the tar headers, for compatibility with
+	// other extractors. USTAR is the most widely supported, but cannot represent
+	// paths longer than 100 bytes unless a slash splits them into parts of at
+	// most 155 and 100 bytes, link targets longer than 100 bytes, or Checksums
+	// and PreserveXattrs; Save fails on such paths rather than truncating them.
+	// GNU supports long paths but not the PAX records used by Checksums and
+	// PreserveXattrs. PAX supports everything. The default picks USTAR for each
+	// header where possible and PAX otherwise.
+	// Archives in the USTAR and GNU formats also lack the global header which
+	// lets Restore reject archives written by incompatible newer versions.
+	TarFormat tar.Format
+
+	// Format overrides how the archive is compressed, such as with
+	// archiver.Gz or a custom archiver.Compression. It defaults to zstd. Only
+	// tar archives are supported, so Archival must be nil or archiver.Tar,
+	// whose options are ignored in favor of the ones of the request. Restore
+	// recognizes gzip by itself; archives with any other compression can only
+	// be restored with the same Format.
+	Format archiver.CompressedArchive
+
+	// Deterministic produces byte-identical archives for identical content, for
+	// example to compare caches by their MD5. Entries are always sorted by path;
+	// this also sets every modification time to the Unix epoch and drops access
+	// times and ownership. Restoring with PreserveTimes then sets that time. It
+	// cannot be combined with PreserveAccessTimes.
+	Deterministic bool
+
+	// StoreUncompressed are file name patterns, like "*.png", of regular files
+	// whose content is stored without compression, which saves the CPU time of
+	// recompressing data that is already compressed. PrecompressedPatterns lists
+	// common formats. Patterns use the syntax of filepath.Match and are matched
+	// against the base name. The archive is still a valid tar.zst stream: it is
+	// split in several zstd frames, with stored content in frames of raw blocks,
+	// which decoders read as one stream. Each switch starts a new compressed
+	// frame, which loses the compression context of the previous one and costs
+	// some ratio for many small matched files.
+	StoreUncompressed []string
+
+	// TeeTo is the path of a local file to which the exact bytes uploaded are
+	// also written, for inspecting the archive offline. Failing to write it does
+	// not fail the save; the file is removed and a warning is logged instead.
+	TeeTo string
+
+	// ShardSize, if set, splits the compressed archive into part objects of at
+	// most this many bytes. A small manifest object listing the parts is
+	// written to the key once all parts are uploaded, and Restore reads the
+	// parts back in order. Parts are named like "key.0123456789abcdef.part0000"
+	// rather than "key.part0000": the random upload ID keeps a save which
+	// replaces the cache, or races with another save, from overwriting the
+	// parts a restore is reading. ListKeys and Prune group parts named either
+	// way under their key. The archive is written to one part at a time, and
+	// full parts are finalized in the background while the next one is
+	// written, as many at once as MaxConcurrentTransfers allows or four if it
+	// is unlimited. Parts are never matched by Restore directly.
+	ShardSize int64
+
+	// ComposeSize, if set, uploads the compressed archive as temporary part
+	// objects of at most this many bytes, which are then composed into a single
+	// object at the key and deleted. This exceeds the 5 TiB limit of a single
+	// upload, and the result restores like any other object. Compose requests
+	// take at most 32 sources, so more parts are composed in rounds through
+	// intermediate objects. Composite objects have no MD5, so Restore cannot
+	// verify it. It cannot be combined with ShardSize.
+	ComposeSize int64
+
+	// DedupePrefix, if set, avoids uploading content which is already cached
+	// under a different key, such as one with a timestamp in it. Save computes a
+	// hash of the files to archive, which reads each of them, and records it in
+	// the object metadata. Before uploading, it looks for the newest object with
+	// this prefix and the same hash and, if found, copies it to the key within
+	// storage instead. Content saved under its ContentAddressedKey with this
+	// prefix is found without searching.
+	DedupePrefix string
+
+	// PredefinedACL applies a predefined ACL to the created objects, one of
+	// "authenticatedRead", "bucketOwnerFullControl", "bucketOwnerRead",
+	// "private", "projectPrivate", or "publicRead". The default uses the bucket's
+	// default object ACL. Note that "publicRead" makes the cache downloadable by
+	// anyone on the internet, so it must never contain secrets. ACLs cannot be
+	// set on buckets with uniform bucket-level access.
+	PredefinedACL string
+
+	// EventBasedHold places an event-based hold on the created objects, which
+	// keeps them from being deleted or replaced, including by ReplaceIfNewer,
+	// until the hold is released with ReleaseHold. For a sharded cache, the
+	// parts are held too, once the manifest is written. Held objects still count
+	// towards storage costs, and lifecycle rules cannot delete them.
+	EventBasedHold bool
+
+	// WalkConcurrency is the number of directories read concurrently while
+	// gathering the files to archive, which speeds up large trees on
+	// high-latency filesystems. The archive is identical to a serial walk.
+	// Values less than two walk serially.
+	WalkConcurrency int
+
+	// MaxFileSize skips regular files larger than this many bytes while
+	// gathering the files to archive, like a stray core dump, and archives
+	// everything else. Unlike MaxSize, it never fails the save. A followed
+	// symlink counts with the size of its target. Zero means no limit.
+	MaxFileSize int64
+
+	// Events, if set, receives progress and lifecycle events. Events are sent
+	// without blocking and dropped if the channel is full. Completed is always
+	// the last event and nothing is sent after the call returns; the channel is
+	// not closed.
+	Events chan<- Event
+}
+
+// SaveResult is the result of a Save operation.
+type SaveResult struct {
+	// Uploaded is true if an object was written, either by uploading or, with
+	// DedupePrefix, by copying. It is false if the save was skipped because the
+	// object already existed.
+	Uploaded bool
+
+	// ObjectName is the name of the object for the key.
+	ObjectName string
+
+	// UncompressedSize is the total size of the file content read from disk, in
+	// bytes.
+	UncompressedSize int64
+
+	// CompressedSize is the size of the compressed archive written to storage, in
+	// bytes.
+	CompressedSize int64
+
+	// CompressionRatio is UncompressedSize divided by CompressedSize, or zero if
+	// nothing was written.
+	CompressionRatio float64
+
+	// CopiedFrom is the name of the object with identical content which was
+	// copied to the key instead of uploading, when using DedupePrefix. The sizes
+	// are not set in that case.
+	CopiedFrom string
+}
+
+// Validate checks the request for errors without performing any IO, as of the
+// current time. Save performs the same checks before doing anything else, but
+// as of the clock of the cacher; use ValidateSave to check a request the same
+// way.
+func (i *SaveRequest) Validate() error {
+	return i.validate(time.Now())
+}
+
+// ValidateSave checks the request for errors without performing any IO, as of
+// the time of the clock given by WithClock, exactly like Save does.
+func (c *Cacher) ValidateSave(i *SaveRequest) error {
+	return i.validate(c.now())
+}
+
+// validate checks the request for errors, as of the time now.
+func (i *SaveRequest) validate(now time.Time) error {
+	if i == nil {
+		return validationErrorf("missing cache options")
+	}
+
+	if i.Bucket == "" {
+		return validationErrorf("missing bucket")
+	}
+
+	if len(i.roots()) == 0 {
+		return validationErrorf("missing directory")
+	}
+
+	if i.BasePath != "" {
+		for dir, name := range i.roots() {
+			if name == "" {
+				return validationErrorf("directory %s is not inside base path %s", dir, i.BasePath)
+			}
+		}
+	}
+
+	if err := validateKey(i.Key); err != nil {
+		return err
+	}
+
+	if i.DedupePrefix != "" {
+		if err := validateKey(i.DedupePrefix); err != nil {
+			return err
+		}
+	}
+
+	if i.PredefinedACL != "" && !validPredefinedACLs[i.PredefinedACL] {
+		return validationErrorf("invalid predefined ACL %q", i.PredefinedACL)
+	}
+
+	for _, pattern := range i.StoreUncompressed {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return validationErrorf("invalid uncompressed pattern %q: %s", pattern, err)
+		}
+	}
+
+	if i.ShardSize > 0 && i.ComposeSize > 0 {
+		return validationErrorf("shard size and compose size are mutually exclusive")
+	}
+
+	if i.SkipExistenceCheck && i.ReplaceIfNewer {
+		return validationErrorf("skip existence check and replace if newer are mutually exclusive")
+	}
+
+	if i.Deterministic && i.PreserveAccessTimes {
+		return validationErrorf("deterministic and preserve access times are mutually exclusive")
+	}
+
+	if err := checkFormat(i.Format); err != nil {
+		return err
+	}
+
+	if i.PreserveAccessTimes && i.TarFormat == tar.FormatUSTAR {
+		return validationErrorf("access times cannot be preserved in the USTAR format")
+	}
+
+	if !i.CustomTime.IsZero() && !i.AllowPastCustomTime && i.CustomTime.Before(now) {
+		return validationErrorf("custom time %s is in the past", i.CustomTime.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// validateKey checks that key is usable as an object name or prefix. Storage
+// rejects control characters and invalid UTF-8, and leading or trailing
+// whitespace is almost always a mistake which makes a prefix match far more
+// objects than intended.
+func validateKey(key string) error {
+	if key == "" {
+		return validationErrorf("missing key")
+	}
+
+	if strings.TrimSpace(key) == "" {
+		return validationErrorf("key %q is only whitespace", key)
+	}
+
+	if strings.TrimSpace(key) != key {
+		return validationErrorf("key %q has leading or trailing whitespace", key)
+	}
+
+	if !utf8.ValidString(key) {
+		return validationErrorf("key %q is not valid UTF-8", key)
+	}
+
+	if len(key) > maxKeyLength {
+		return validationErrorf("key is longer than %d bytes", maxKeyLength)
+	}
+
+	if key == "." || key == ".." {
+		return validationErrorf("key %q is not a valid object name", key)
+	}
+
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return validationErrorf("key %q contains control character %U", key, r)
+		}
+	}
+	return nil
+}
+
+// validateKeys checks that there is at least one key and that each is valid and
+// at least minLength bytes long.
+func validateKeys(keys []string, minLength int) error {
+	if len(keys) < 1 {
+		return validationErrorf("expected at least one cache key")
+	}
+
+	for _, key := range keys {
+		if err := validateKey(key); err != nil {
+			return err
+		}
+		if len(key) < minLength {
+			return validationErrorf("key %q is shorter than the minimum of %d bytes", key, minLength)
+		}
+	}
+	return nil
+}
+
+// roots returns the directories to archive, mapped to their name in the
+// archive.
+func (i *SaveRequest) roots() map[string]string {
+	roots := make(map[string]string, len(i.Dirs)+1)
+	for k, v := range i.Dirs {
+		roots[k] = v
+	}
+	if i.Dir != "" {
+		roots[i.Dir] = ""
+	}
+
+	// Directories outside of the base path keep an empty name, which Validate
+	// rejects
+	if i.BasePath != "" {
+		for dir, name := range roots {
+			if name == "" {
+				roots[dir] = relativeName(i.BasePath, dir)
+			}
+		}
+	}
+	return roots
+}
+
+// checkFormat returns a validation error if the archive format of f is not tar.
+func checkFormat(f archiver.CompressedArchive) error {
+	switch f.Archival.(type) {
+	case nil, archiver.Tar, *archiver.Tar:
+		return nil
+	default:
+		return validationErrorf("unsupported archive format %s, only tar is supported", f.Archival.Name())
+	}
+}
+
+// formatContentType returns the content type of an archive compressed with
+// compressor. Restore recognizes gzip by its content type.
+func formatContentType(compressor archiver.Compressor) string {
+	switch compressor.(type) {
+	case archiver.Gz, *archiver.Gz:
+		return "application/gzip"
+	default:
+		return contentType
+	}
+}
+
+// relativeName returns the slash-separated path of dir relative to base, or an
+// empty string if dir is not inside base.
+func relativeName(base, dir string) string {
+	rel, err := filepath.Rel(base, dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Save caches the given directory in storage.
+func (c *Cacher) Save(ctx context.Context, i *SaveRequest) (result SaveResult, retErr error) {
+	if i == nil {
+		retErr = validationErrorf("missing cache options")
+		return
+	}
+	defer func() {
+		sendEvent(i.Events, Completed{Err: retErr})
+	}()
+
+	ctx, finish := withOperationTimeout(ctx, "save", c.saveTimeout)
+	defer func() {
+		retErr = finish(retErr)
+	}()
+
+	if err := c.ValidateSave(i); err != nil {
+		retErr = err
+		return
+	}
+
+	bucket := i.Bucket
+	roots := i.roots()
+	key := c.objectName(i.Key)
+	result.ObjectName = key
+
+	// Walk the real directories, keeping the names derived from the given paths
+	if i.ResolveRoot {
+		resolved := make(map[string]string, len(roots))
+		for dir, name := range roots {
+			if name == "" {
+				name = filepath.Base(dir)
+			}
+			realDir, err := resolveRoot(dir)
+			if err != nil {
+				retErr = err
+				return
+			}
+			if hasTrailingSeparator(dir) && !hasTrailingSeparator(realDir) {
+				realDir += string(filepath.Separator)
+			}
+			if realDir != dir {
+				c.log("resolved %s to %s", dir, realDir)
+			}
+			resolved[realDir] = name
+		}
+		roots = resolved
+	}
+
+	// Wait for a transfer slot, if limited
+	release, err := c.acquireTransfer(ctx)
+	if err != nil {
+		retErr = err
+		return
+	}
+	defer release()
+
+	// Check if the object already exists. If it already exists, we do not want to
+	// waste time overwriting the cache.
+	var existing *storage.ObjectAttrs
+	if !i.SkipExistenceCheck {
+		existing, err = c.existing(ctx, c.client.Bucket(bucket).Object(key))
+		if err != nil {
+			retErr = err
+			return
+		}
+		if existing != nil && !i.ReplaceIfNewer {
+			c.log("cached object already exists, skipping")
+			return
+		}
+	}
+
+	// Gather the files to archive before opening the writer, so a failure here
+	// does not leave an empty object behind.
+	files, err := c.filesFromDisk(roots, &walkOptions{
+		followSymlinks: i.FollowSymlinks,
+		xattrs:         i.PreserveXattrs,
+		concurrency:    i.WalkConcurrency,
+		maxFileSize:    i.MaxFileSize,
+		skipSpecial:    c.skipSpecialFiles,
+	})
+	if err != nil {
+		retErr = fmt.Errorf("failed to list files: %w", err)
+		return
+	}
+	if i.FailOnEmpty && !hasFiles(files) {
+		retErr = ErrNoFiles
+		return
+	}
+
+	// Only overwrite an existing object if the source has changed since. The
+	// generation precondition ensures a concurrent save is not clobbered.
+	conds := storage.Conditions{DoesNotExist: true}
+	if existing != nil {
+		newest := newestModTime(files)
+		if !newest.After(existing.Updated) {
+			c.log("cached object is newer than source (%s), skipping", newest.Format(time.RFC3339))
+			return
+		}
+
+		if existing.EventBasedHold || existing.TemporaryHold {
+			retErr = fmt.Errorf("cannot replace %s: %w", i.Key, ErrObjectHeld)
+			return
+		}
+
+		c.log("source is newer than cached object (%s), replacing", newest.Format(time.RFC3339))
+		conds = storage.Conditions{GenerationMatch: existing.Generation}
+	}
+
+	compressor := archiver.Compressor(archiver.Zstd{})
+	if i.Format.Compression != nil {
+		compressor = i.Format.Compression
+	}
+
+	attrs := storage.ObjectAttrs{
+		ContentType:    formatContentType(compressor),
+		CacheControl:   cacheControl,
+		CustomTime:     i.CustomTime,
+		PredefinedACL:  i.PredefinedACL,
+		EventBasedHold: i.EventBasedHold,
+		Metadata: map[string]string{
+			metadataUncompressedSize: strconv.FormatInt(contentSize(files), 10),
+			metadataFileCount:        strconv.Itoa(len(files)),
+		},
+	}
+
+	// Copy identical content cached under another key instead of uploading it
+	// again, if requested
+	if i.DedupePrefix != "" {
+		hash, err := contentHash(files)
+		if err != nil {
+			retErr = fmt.Errorf("failed to hash content: %w", err)
+			return
+		}
+		attrs.Metadata[metadataContentHash] = hash
+
+		src, err := c.findContentHash(ctx, c.client.Bucket(bucket), c.objectName(i.DedupePrefix), hash, key)
+		if err != nil {
+			retErr = err
+			return
+		}
+		if src != nil {
+			c.log("content is identical to %s, copying", src.Name)
+			if err := c.copyObject(ctx, src, c.client.Bucket(bucket).Object(key).If(conds), &attrs); err != nil {
+				if i.SkipExistenceCheck && isPreconditionFailed(err) {
+					c.log("cached object already exists, skipping")
+					return
+				}
+				retErr = err
+				return
+			}
+			result.Uploaded = true
+			result.CopiedFrom = src.Name
+			return
+		}
+	}
+
+	// Create the storage writer. The upload is aborted by cancelling its context,
+	// which happens on any failure so that no partial object is left behind.
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress := c.uploadProgress(i.Events)
+
+	obj := c.client.Bucket(bucket).Object(key)
+	var dst io.Writer
+	if i.ShardSize > 0 || i.ComposeSize > 0 {
+		// Parts are uploaded first and the manifest or composite object is
+		// written to the key once they are all finalized
+		size := i.ShardSize
+		if i.ComposeSize > 0 {
+			size = i.ComposeSize
+		}
+
+		shards, err := c.newShardWriter(uploadCtx, c.client.Bucket(bucket), key, size, attrs, progress)
+		if err != nil {
+			retErr = err
+			return
+		}
+		defer func() {
+			if retErr != nil {
+				c.log("aborting upload")
+				cancel()
+				shards.abort()
+				return
+			}
+
+			finish := shards.finish
+			if i.ComposeSize > 0 {
+				finish = shards.compose
+			}
+			if err := finish(ctx, obj.If(conds)); err != nil {
+				if i.SkipExistenceCheck && isPreconditionFailed(err) {
+					c.log("cached object already exists, skipping")
+					return
+				}
+				retErr = err
+				return
+			}
+			result.Uploaded = true
+		}()
+		dst = shards
+	} else {
+		gcsw := obj.If(conds).NewWriter(uploadCtx)
+		defer func() {
+			if retErr != nil {
+				c.abortUpload(obj, gcsw, cancel)
+
+				// Large uploads already surface the precondition while writing
+				if i.SkipExistenceCheck && isPreconditionFailed(retErr) {
+					c.log("cached object already exists, skipping")
+					retErr = nil
+				}
+				return
+			}
+
+			c.log("closing gcs writer")
+			if cerr := gcsw.Close(); cerr != nil {
+				if i.SkipExistenceCheck && isPreconditionFailed(cerr) {
+					c.log("cached object already exists, skipping")
+					return
+				}
+				if retErr != nil {
+					retErr = fmt.Errorf("%v: %w", retErr, &StorageError{Msg: "failed to close gcs writer", Err: cerr})
+					return
+				}
+				retErr = &StorageError{Msg: "failed to close gcs writer", Err: cerr}
+				return
+			}
+			result.Uploaded = true
+		}()
+
+		gcsw.ChunkSize = 128_000_000
+		gcsw.ObjectAttrs.ContentType = attrs.ContentType
+		gcsw.ObjectAttrs.CacheControl = attrs.CacheControl
+		gcsw.ObjectAttrs.CustomTime = attrs.CustomTime
+		gcsw.ObjectAttrs.Metadata = attrs.Metadata
+		gcsw.ObjectAttrs.PredefinedACL = attrs.PredefinedACL
+		gcsw.ObjectAttrs.EventBasedHold = attrs.EventBasedHold
+		gcsw.ProgressFunc = progress
+		dst = gcsw
+	}
+	sendEvent(i.Events, UploadStarted{Bucket: bucket, Key: key})
+
+	// Copy the uploaded bytes to a local file, if requested. Failing to write it
+	// must not affect the upload, so errors are only reported once done.
+	out := dst
+	if i.TeeTo != "" {
+		f, err := os.Create(i.TeeTo)
+		if err != nil {
+			retErr = fmt.Errorf("failed to create tee file: %w", err)
+			return
+		}
+
+		tee := &bestEffortWriter{w: f}
+		defer func() {
+			if err := f.Close(); err != nil && tee.err == nil {
+				tee.err = err
+			}
+			if tee.err != nil {
+				c.warn("failed to write tee file %s, removing it: %s", i.TeeTo, tee.err)
+				os.Remove(i.TeeTo)
+			}
+		}()
+		out = io.MultiWriter(dst, tee)
+	}
+
+	// Count the compressed bytes and enforce the maximum size on them
+	counter := &countingWriter{w: out}
+	var w io.Writer = counter
+	if i.MaxSize > 0 {
+		w = &limitWriter{w: counter, limit: i.MaxSize}
+	}
+
+	// Write the tar.zst stream
+	stopHeartbeat := c.startHeartbeat("uploading", counter.count)
+	stats, err := c.writeArchive(ctx, w, compressor, files, &archiveOptions{
+		checksums:         i.Checksums,
+		format:            i.TarFormat,
+		accessTimes:       i.PreserveAccessTimes,
+		deterministic:     i.Deterministic,
+		storeUncompressed: i.StoreUncompressed,
+		manifest:          i.EmbedManifest,
+		now:               c.now(),
+	})
+	stopHeartbeat()
+	if err != nil {
+		retErr = fmt.Errorf("failed to create archive: %w", err)
+		return
+	}
+
+	result.UncompressedSize = stats.size
+	result.CompressedSize = counter.count()
+	if result.CompressedSize > 0 {
+		result.CompressionRatio = float64(stats.size) / float64(result.CompressedSize)
+	}
+	c.log("compressed %d bytes to %d bytes (ratio %.2f)",
+		result.UncompressedSize, result.CompressedSize, result.CompressionRatio)
+
+	return
+}
+
+// SaveAll saves several independent caches concurrently, such as dependencies
+// and build outputs under their own keys. At most a few saves run at once, and
+// each also waits for a transfer slot when MaxConcurrentTransfers is set. The
+// results are in the same order as reqs. A failed save does not stop the
+// others: when any fail, the error is a *SaveAllError with the error of each
+// request, and the results of the others are still valid.
+func (c *Cacher) SaveAll(ctx context.Context, reqs []*SaveRequest) ([]SaveResult, error) {
+	results := make([]SaveResult, len(reqs))
+	errs := make([]error, len(reqs))
+
+	sem := make(chan struct{}, maxSaveConcurrency)
+	var wg sync.WaitGroup
+	for idx, req := range reqs {
+		idx, req := idx, req
+		if req == nil {
+			errs[idx] = validationErrorf("missing request at index %d", idx)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[idx] = fmt.Errorf("failed to save %s: %w", req.Key, ctx.Err())
+				return
+			}
+			defer func() { <-sem }()
+
+			result, err := c.Save(ctx, req)
+			if err != nil {
+				errs[idx] = fmt.Errorf("failed to save %s: %w", req.Key, err)
+				return
+			}
+			results[idx] = result
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return results, &SaveAllError{Errs: errs}
+		}
+	}
+	return results, nil
+}
+
+// SymlinkPolicy controls how Restore handles symbolic links which are absolute
+// or point outside of the restore directory. Such links are a security concern
+// for untrusted caches, and absolute links often break on a different machine.
+type SymlinkPolicy int
+
+const (
+	// SymlinkSkipEscaping skips absolute and escaping links with a warning. This
+	// is the default.
+	SymlinkSkipEscaping SymlinkPolicy = iota
+
+	// SymlinkAllow creates all links as recorded in the archive.
+	SymlinkAllow
+
+	// SymlinkRewriteRelative treats absolute link targets as relative to the
+	// restore directory and rewrites them into relative links. Relative links
+	// which escape the restore directory are skipped with a warning.
+	SymlinkRewriteRelative
+
+	// SymlinkError fails the restore on an absolute or escaping link.
+	SymlinkError
+)
+
+// WindowsSymlinkMode controls how Restore handles symbolic links which cannot
+// be created because the account lacks the privilege, as is common for
+// non-administrators on Windows without developer mode.
+type WindowsSymlinkMode int
+
+const (
+	// WindowsSymlinkError fails the restore. This is the default.
+	WindowsSymlinkError WindowsSymlinkMode = iota
+
+	// WindowsSymlinkCopy writes the content of the link target, which must be a
+	// regular file inside the restore directory, as a regular file in place of
+	// the link. Links to directories or outside of the restore directory are
+	// skipped with a warning.
+	WindowsSymlinkCopy
+
+	// WindowsSymlinkSkip skips the link with a warning.
+	WindowsSymlinkSkip
+)
+
+// RestoreRequest is used as input to the Restore operation.
+type RestoreRequest struct {
+	// Bucket is the name of the bucket from which to cache.
+	Bucket string
+
+	// Buckets is an ordered list of additional buckets to search after Bucket,
+	// such as replicas in other regions. The next bucket is tried when none of
+	// the keys match or the search fails. At least one of Bucket or Buckets is
+	// required.
+	Buckets []string
+
+	// Keys is the ordered list of keys to restore.
+	Keys []string
+
+	// Dir is the directory on disk to cache. Every entry is restored inside it:
+	// absolute names in the archive, with a leading separator or drive letter,
+	// are treated as relative to Dir.
+	Dir string
+
+	// DefaultToCwd restores into the current working directory when Dir is
+	// empty. Without it, an empty Dir is an error.
+	DefaultToCwd bool
+
+	// ResolveRoot resolves symbolic links in the path of Dir once, before
+	// restoring, and restores into the real directory. Symbolic links in the
+	// archive are then checked against the real directory by SymlinkPolicy. A
+	// Dir which does not exist yet is used as is.
+	ResolveRoot bool
+
+	// StripComponents removes this many leading path components from the name
+	// of every entry before restoring it, like "tar --strip-components".
+	// Entries with fewer components are skipped. This flattens archives saved
+	// with a BasePath.
+	StripComponents int
+
+	// Remap, if set, is called with the slash-separated name of each entry,
+	// after StripComponents, and returns the name to restore it as instead, such
+	// as to restore "dist/app.js" as "public/app.js". Returning true for skip
+	// omits the entry. The returned name is normalized like every name in the
+	// archive, so it cannot escape Dir. The targets of hard links are remapped
+	// too, but those of symbolic links are not.
+	Remap func(nameInArchive string) (newPath string, skip bool)
+
+	// Clean removes the existing contents of Dir (but not Dir itself) before
+	// extracting, so stale files from a previous run do not linger. Symlinks are
+	// removed, not followed. Cleaning the filesystem root or the home directory is
+	// refused.
+	Clean bool
+
+	// NormalizeLineEndings are file name patterns, like "*.txt" or "*.sh", of
+	// text files whose line endings are converted to those of the platform as
+	// they are restored: CRLF on Windows and LF elsewhere. Patterns are matched
+	// against the base name of each file with filepath.Match. Files which match
+	// no pattern are restored byte for byte, so binary files must never match.
+	// Converted files are not checked by Verify, and Resume restores them
+	// again since their size changes.
+	NormalizeLineEndings []string
+
+	// UseReflink restores files whose content is identical to a file restored
+	// earlier as copy-on-write clones of it, which saves disk space. Identical
+	// content is recognized by the checksums recorded by Save with Checksums,
+	// so it has no effect on caches saved without them. Clones are only
+	// supported on Linux filesystems with reflinks, like btrfs and XFS;
+	// elsewhere files are written as usual.
+	UseReflink bool
+
+	// WriteManifest writes a ContentsManifest of the restored regular files,
+	// with their size, mode, and checksum, to ContentsManifestName in Dir. It
+	// replaces any manifest embedded in the archive, and does not list itself.
+	WriteManifest bool
+
+	// Verify checksums each regular file after it is written to disk and compares
+	// it against the checksum recorded in the archive, failing on mismatch. The
+	// cache must have been saved with Checksums.
+	Verify bool
+
+	// PreserveXattrs reapplies extended attributes recorded in the archive. The
+	// cache must have been saved with PreserveXattrs. Attributes the filesystem or
+	// platform does not support, or the process does not have permission to set,
+	// are skipped.
+	PreserveXattrs bool
+
+	// VersionAware selects, among the objects matching the keys, the one with the
+	// highest semantic version embedded in its name (like "deps-1.2.3-<hash>")
+	// instead of the most recently updated one. Objects without a version in
+	// their name are ignored. Ties are broken by the most recently updated.
+	VersionAware bool
+
+	// VersionPattern extracts the version from an object name when VersionAware
+	// is set. If it contains a group named "version", that group is parsed;
+	// otherwise the whole match is. The default matches major.minor.patch.
+	VersionPattern *regexp.Regexp
+
+	// VersionCompatibleWith, when set with VersionAware, only considers objects
+	// with the same major version that are not newer than this version. For
+	// example, "1.4.0" falls back to the newest 1.x version up to 1.4.0.
+	VersionCompatibleWith string
+
+	// FileFilter, if set, is called for each entry in the archive before it is
+	// written to disk. Returning skip omits the entry; skipping a directory does
+	// not skip its contents. Returning an error aborts the restore.
+	FileFilter func(f archiver.File) (skip bool, err error)
+
+	// SkipExisting leaves files and links which already exist on disk untouched
+	// instead of overwriting them, which avoids clobbering locally-modified files
+	// when layering a cache on top of a partially-populated workspace. Missing
+	// directories, files, and links are still created. It is mutually exclusive
+	// with Clean.
+	SkipExisting bool
+
+	// ExtractWorkers is the number of workers writing files concurrently. Since
+	// the archive is a sequential stream, small files are buffered in memory (up
+	// to a fixed cap) and handed off to the workers while reading continues,
+	// which speeds up restoring many small files. Values less than two extract
+	// sequentially.
+	ExtractWorkers int
+
+	// ReadBufferSize is the size of the buffer the object is read through, in
+	// bytes. Larger buffers mean fewer, larger reads from storage, which helps
+	// on high-latency connections. It defaults to 1 MiB.
+	ReadBufferSize int
+
+	// OnlyIfEmpty skips the restore entirely when Dir exists and is not empty,
+	// returning ErrDirNotEmpty without contacting storage. A missing directory
+	// counts as empty.
+	OnlyIfEmpty bool
+
+	// SymlinkPolicy controls how symbolic links which are absolute or point
+	// outside of Dir are handled. The default skips them with a warning.
+	SymlinkPolicy SymlinkPolicy
+
+	// WindowsSymlinkMode controls how symbolic links are handled when they
+	// cannot be created for lack of privilege. The default fails the restore.
+	WindowsSymlinkMode WindowsSymlinkMode
+
+	// Generation, if set, restores this exact generation of the object named by
+	// the single key, bypassing the search for the newest match (including
+	// VersionAware). Since keys can be overwritten, pinning the generation from
+	// an earlier RestoreResult guarantees the same cache across reruns.
+	Generation int64
+
+	// MinKeyLength, if set, rejects keys shorter than this many bytes. Keys are
+	// matched as prefixes, so a short key like "go" may restore a cache from an
+	// unrelated job.
+	MinKeyLength int
+
+	// MaxUncompressedSize is the maximum total size of the file content
+	// extracted, in bytes. Once exceeded, the restore is aborted with
+	// ErrMaxSizeExceeded and the files it created are removed. This guards
+	// against an archive expanding to fill the disk. Zero means no limit.
+	MaxUncompressedSize int64
+
+	// MaxCompressionRatio is the maximum ratio of the extracted file content to
+	// the size of the object, enforced like MaxUncompressedSize. Legitimate
+	// caches rarely exceed a ratio of 20. Zero means no limit.
+	MaxCompressionRatio float64
+
+	// MaxFiles is the maximum number of entries extracted, including
+	// directories and links. Once exceeded, the restore is aborted with
+	// ErrMaxFilesExceeded and the files it created are removed. This guards
+	// against an archive of many tiny entries exhausting the inodes of the
+	// filesystem before any size limit applies. Zero means no limit.
+	MaxFiles int
+
+	// PreserveSpecialBits applies the setuid, setgid, and sticky bits recorded
+	// in the archive to files and directories, which are otherwise dropped. Only
+	// a privileged process can set some of them, like setuid on a file owned by
+	// another user. It is ignored on Windows.
+	PreserveSpecialBits bool
+
+	// DefaultFileMode and DefaultDirMode are the permissions of files and
+	// directories whose mode in the archive has no permission bits, as written
+	// by some tools which do not record modes. They default to 0644 and 0755.
+	// Every restored file and directory gets its mode set explicitly after it
+	// is created, so the process umask does not affect the result.
+	DefaultFileMode os.FileMode
+	DefaultDirMode  os.FileMode
+
+	// PreserveTimes sets the modification time of restored files and directories
+	// to the one recorded in the archive, instead of the time of the restore.
+	// Symbolic links keep the time of the restore.
+	PreserveTimes bool
+
+	// PreserveAccessTimes sets the access time of restored files and
+	// directories to the one recorded in the archive, for caches saved with
+	// PreserveAccessTimes. Entries without a recorded access time are left
+	// alone. Access times are not meaningful on filesystems mounted with noatime,
+	// and are overwritten by the next read on those mounted with strictatime.
+	PreserveAccessTimes bool
+
+	// Resume continues a restore into the same Dir which was interrupted, for
+	// example by a cancelled context. Entries an earlier attempt already wrote
+	// are skipped instead of rewritten: regular files whose size and
+	// modification time match the archive, and any other entry which exists.
+	// The object is still downloaded in full, since it is a single compressed
+	// stream. Modification times are applied as with PreserveTimes, since a file
+	// only gets its time from the archive once its content is fully written.
+	Resume bool
+
+	// SkipMD5 disables comparing the MD5 of the downloaded object against the
+	// one recorded by storage. The comparison happens once the whole object is
+	// read, after extracting, so a mismatch fails the restore but leaves the
+	// extracted files in place. The parts of a sharded cache are each compared
+	// against the MD5 recorded in its manifest as they are read, except for
+	// caches saved before it was recorded. Objects saved with ComposeSize have
+	// no MD5 and are never checked.
+	SkipMD5 bool
+
+	// Format overrides the compression of the archive, instead of detecting
+	// gzip or zstd, for caches saved with a custom Format. Only tar archives are
+	// supported, so Archival must be nil or archiver.Tar.
+	Format archiver.CompressedArchive
+
+	// ContinueOnError logs and records errors writing individual entries, like
+	// a single unwritable path, and restores the rest of the archive instead of
+	// aborting on the first. An error summarizing the failures is returned at the
+	// end, along with a result listing them. Errors reading the archive and
+	// exceeding MaxUncompressedSize still abort.
+	ContinueOnError bool
+
+	// DryRun downloads and reads the archive, listing its entries in the result,
+	// without writing anything to disk. Clean is not performed either. This is
+	// useful for inspecting the contents of a cache.
+	DryRun bool
+
+	// Events, if set, receives progress and lifecycle events. Events are sent
+	// without blocking and dropped if the channel is full. Completed is always
+	// the last event and nothing is sent after the call returns; the channel is
+	// not closed.
+	Events chan<- Event
+}
+
+// RestoreResult is the result of a Restore operation.
+type RestoreResult struct {
+	// Bucket is the bucket which served the cache.
+	Bucket string
+
+	// Key is the key which matched.
+	Key string
+
+	// ObjectName is the name of the restored object.
+	ObjectName string
+
+	// Generation is the generation of the restored object.
+	Generation int64
+
+	// Files lists the entries in the archive, in order, for a DryRun. Entries
+	// skipped by FileFilter are omitted.
+	Files []FileEntry
+
+	// FailedFiles are the errors of the entries which could not be written, with
+	// ContinueOnError. Each error names the path.
+	FailedFiles []error
+
+	// FilesRestored is the number of entries other than directories which were
+	// written. Entries which failed, or were skipped by FileFilter, SkipExisting,
+	// or Resume, are not counted.
+	FilesRestored int64
+
+	// BytesRestored is the total size of the content of the written files.
+	BytesRestored int64
+
+	// Duration is the time the restore took, from the lookup to the last write.
+	Duration time.Duration
+}
+
+// FileEntry describes an entry in an archive.
+type FileEntry struct {
+	// Name is the name of the entry in the archive.
+	Name string
+
+	// Size is the size of the file content, in bytes.
+	Size int64
+
+	// Mode is the mode of the entry, including its type bits.
+	Mode os.FileMode
+
+	// LinkTarget is the target of a symbolic or hard link.
+	LinkTarget string
+}
+
+// Validate checks the request for errors without performing any IO. Restore
+// calls it before doing anything else.
+func (i *RestoreRequest) Validate() error {
+	if i == nil {
+		return validationErrorf("missing cache options")
+	}
+
+	if len(i.buckets()) == 0 {
+		return validationErrorf("missing bucket")
+	}
+
+	if i.Dir == "" && !i.DefaultToCwd {
+		return validationErrorf("missing directory")
+	}
+
+	if err := validateKeys(i.Keys, i.MinKeyLength); err != nil {
+		return err
+	}
+
+	if i.Generation != 0 && len(i.Keys) != 1 {
+		return validationErrorf("expected exactly one cache key with a generation")
+	}
+
+	if i.Clean && i.SkipExisting {
+		return validationErrorf("clean and skip existing are mutually exclusive")
+	}
+
+	if i.Clean && i.Resume {
+		return validationErrorf("clean and resume are mutually exclusive")
+	}
+
+	for _, pattern := range i.NormalizeLineEndings {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return validationErrorf("invalid line ending pattern %q: %s", pattern, err)
+		}
+	}
+
+	if err := checkFormat(i.Format); err != nil {
+		return err
+	}
+
+	if i.ReadBufferSize < 0 {
+		return validationErrorf("read buffer size must not be negative")
+	}
+
+	if i.VersionAware && i.VersionCompatibleWith != "" {
+		if _, ok := parseVersion(i.VersionCompatibleWith); !ok {
+			return validationErrorf("invalid compatible version %q", i.VersionCompatibleWith)
+		}
+	}
+	return nil
+}
+
+// buckets returns the buckets to search, in order.
+func (i *RestoreRequest) buckets() []string {
+	if i.Bucket == "" {
+		return i.Buckets
+	}
+	return append([]string{i.Bucket}, i.Buckets...)
+}
+
+// Restore restores the key from the cache into the dir on disk.
+func (c *Cacher) Restore(ctx context.Context, i *RestoreRequest) (RestoreResult, error) {
+	return c.restore(ctx, i, false)
+}
+
+// restore implements Restore. With race, the buckets are searched and
+// downloaded from concurrently instead of in order, like raceBuckets does.
+func (c *Cacher) restore(ctx context.Context, i *RestoreRequest, race bool) (result RestoreResult, retErr error) {
+	if i == nil {
+		retErr = validationErrorf("missing cache options")
+		return
+	}
+	defer func() {
+		sendEvent(i.Events, Completed{Err: retErr})
+	}()
+	start := c.now()
+
+	ctx, finish := withOperationTimeout(ctx, "restore", c.restoreTimeout)
+	defer func() {
+		retErr = finish(retErr)
+	}()
+
+	if err := i.Validate(); err != nil {
+		retErr = err
+		return
+	}
+
+	buckets := i.buckets()
+
+	dir := i.Dir
+	if dir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			retErr = fmt.Errorf("failed to get current directory: %w", err)
+			return
+		}
+		dir = cwd
+	}
+	if i.ResolveRoot {
+		realDir, err := resolveRoot(dir)
+		if err != nil {
+			retErr = err
+			return
+		}
+		if realDir != dir {
+			c.log("resolved %s to %s", dir, realDir)
+		}
+		dir = realDir
+	}
+
+	keys := c.objectNames(i.Keys)
+
+	// Skip warm workspaces before spending any time on the download
+	if i.OnlyIfEmpty {
+		empty, err := isEmptyDir(dir)
+		if err != nil {
+			retErr = fmt.Errorf("failed to check if target directory is empty: %w", err)
+			return
+		}
+		if !empty {
+			c.log("target directory %s is not empty, skipping", dir)
+			retErr = fmt.Errorf("%s: %w", dir, ErrDirNotEmpty)
+			return
+		}
+	}
+
+	// Wait for a transfer slot, if limited
+	release, err := c.acquireTransfer(ctx)
+	if err != nil {
+		retErr = err
+		return
+	}
+	defer release()
+
+	// Select candidates by the version in their name, if requested
+	var better func(candidate, best *storage.ObjectAttrs) bool
+	if i.VersionAware {
+		var compatible *version
+		if i.VersionCompatibleWith != "" {
+			// The version was checked by Validate
+			v, _ := parseVersion(i.VersionCompatibleWith)
+			compatible = &v
+		}
+		better = c.newerVersion(i.VersionPattern, compatible)
+	}
+
+	// Try to find an earlier cached item by looking for the "newest" item with
+	// the first of the provided key fallbacks that has any match as a prefix,
+	// unless a specific generation is pinned.
+	var bucket, matchedKey string
+	var match *storage.ObjectAttrs
+	var raced io.ReadCloser
+	switch {
+	case race:
+		bucket, matchedKey, match, raced, err = c.raceBuckets(ctx, buckets, keys)
+	case i.Generation != 0:
+		matchedKey = keys[0]
+		bucket, match, err = c.findGeneration(ctx, buckets, matchedKey, i.Generation)
+	default:
+		bucket, matchedKey, match, err = c.findMatchInBuckets(ctx, buckets, keys, better)
+	}
+	if err != nil {
+		retErr = err
+		return
+	}
+
+	// The download of the bucket which won a race is already open. It is closed
+	// along with the reader below, or here if the restore fails before.
+	var gcsr io.ReadCloser
+	if raced != nil {
+		defer func() {
+			if gcsr == nil {
+				raced.Close()
+			}
+		}()
+	}
+	if match == nil {
+		if i.Generation != 0 {
+			retErr = &NotFoundError{Keys: i.Keys, Generation: i.Generation}
+			return
+		}
+		retErr = &NotFoundError{Keys: i.Keys}
+		return
+	}
+	bucketHandle := c.client.Bucket(bucket)
+
+	// Remove stale files, if requested. This happens after the match is found so
+	// that a cache miss leaves the directory untouched.
+	if i.Clean && !i.DryRun {
+		c.log("cleaning target directory %s", dir)
+		if err := cleanDir(dir); err != nil {
+			retErr = fmt.Errorf("failed to clean target directory: %w", err)
+			return
+		}
+	}
+
+	// Ensure the output directory exists
+	if !i.DryRun {
+		c.log("making target directory %s", dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			retErr = fmt.Errorf("failed to make target directory: %w", err)
+			return
+		}
+	}
+
+	// Create the gcs reader, pinned to the matched generation so a concurrent
+	// overwrite cannot change what is read. A local copy of the generation is
+	// read instead, if there is one.
+	var local *localCopy
+	if raced != nil {
+		gcsr = raced
+	} else if f := c.openLocal(bucket, match); f != nil {
+		gcsr = f
+	} else {
+		gcsr, err = openArchive(ctx, bucketHandle, match, i.SkipMD5)
+		if err != nil {
+			retErr = err
+			return
+		}
+
+		if local = c.createLocal(bucket, match); local != nil {
+			defer local.discard()
+		}
+	}
+	defer func() {
+		c.log("closing gcs reader")
+		if cerr := gcsr.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: %w", retErr, &StorageError{Msg: "failed to close gcs reader", Err: cerr})
+				return
+			}
+			retErr = &StorageError{Msg: "failed to close gcs reader", Err: cerr}
+		}
+	}()
+
+	// The MD5 of the downloaded bytes is compared against the one recorded by
+	// storage, if any, to catch corruption in transit. Composite objects have
+	// none, and the parts of sharded caches are verified as they are read.
+	var src io.Reader = gcsr
+	if local != nil {
+		src = io.TeeReader(gcsr, local)
+	}
+	downloaded := src
+	var md5r *md5Reader
+	if !i.SkipMD5 && len(match.MD5) > 0 && match.ContentType != manifestContentType {
+		md5r = newMD5Reader(src, match.MD5)
+		src = md5r
+	}
+
+	// Detect the compression, so legacy tar.gz caches created by other tools
+	// can be restored too
+	progress := &progressReader{r: src, events: i.Events}
+	readBufferSize := i.ReadBufferSize
+	if readBufferSize == 0 {
+		readBufferSize = defaultReadBufferSize
+	}
+	br := bufio.NewReaderSize(progress, readBufferSize)
+	compression := i.Format.Compression
+	if compression == nil {
+		compression, err = detectCompression(match, br, c.zstdDecoder())
+		if err != nil {
+			retErr = fmt.Errorf("failed to detect compression: %w", err)
+			return
+		}
+	}
+	c.log("using %s compression", compression.Name())
+
+	ex := c.newExtractor(i, dir, extractLimit(i, compressedSize(match)))
+	stopHeartbeat := c.startHeartbeat("downloading", progress.count)
+	err = extractArchive(ctx, br, compression, ex.handler())
+	stopHeartbeat()
+
+	// Always wait for pending writes, so nothing is written after returning
+	if werr := ex.wait(); werr != nil && err == nil {
+		err = werr
+	}
+	if err != nil {
+		if errors.Is(err, ErrMaxSizeExceeded) || errors.Is(err, ErrMaxFilesExceeded) {
+			ex.removeCreated()
+		}
+		retErr = fmt.Errorf("failed to extract archive: %w", err)
+		return
+	}
+
+	// Links are copied once their targets are extracted, and directory modes
+	// and times can only be applied once everything inside is extracted
+	if err := ex.finishLinks(); err != nil {
+		retErr = err
+		return
+	}
+	if ex.contents != nil {
+		if err := ex.writeManifest(); err != nil {
+			retErr = err
+			return
+		}
+	}
+	if err := ex.finishDirs(); err != nil {
+		retErr = err
+		return
+	}
+
+	if md5r != nil {
+		if err := md5r.verify(); err != nil {
+			retErr = fmt.Errorf("failed to verify %s: %w", match.Name, err)
+			return
+		}
+	}
+
+	if local != nil {
+		local.commit(downloaded)
+	}
+
+	result.Bucket = bucket
+	result.Key = strings.TrimPrefix(matchedKey, c.keyPrefix)
+	result.ObjectName = match.Name
+	result.Generation = match.Generation
+	result.Files = ex.listed
+	result.FailedFiles = ex.failed
+	result.FilesRestored = ex.files
+	result.BytesRestored = ex.bytes
+	result.Duration = c.now().Sub(start)
+	if !i.DryRun {
+		log.Printf("restored %s files (%s) from key %s in %s",
+			formatCount(result.FilesRestored), formatBytes(result.BytesRestored), result.Key, result.Duration.Round(time.Millisecond))
+	}
+	if len(ex.failed) > 0 {
+		retErr = fmt.Errorf("failed to restore %d files, first error: %w", len(ex.failed), ex.failed[0])
+	}
+	return
+}
+
+// RestoreLatest restores the most recently updated object under prefix into
+// dir, regardless of which key created it. It is equivalent to Restore with
+// prefix as the only key, but states the intent more clearly for scratch caches.
+func (c *Cacher) RestoreLatest(ctx context.Context, bucket, prefix, dir string) (RestoreResult, error) {
+	return c.Restore(ctx, &RestoreRequest{
+		Bucket: bucket,
+		Keys:   []string{prefix},
+		Dir:    dir,
+	})
+}
+
+// RestoreFastest restores keys into dir from whichever of the buckets, each
+// holding a replica of the same caches, starts serving its match first. The
+// lookups and downloads run concurrently, and as soon as the first byte of one
+// download arrives the others are cancelled, so a slow region does not delay
+// the restore. Only the winning download is extracted, so a cancelled one
+// leaves nothing behind in dir. Failed lookups and downloads are ignored as
+// long as another bucket serves a match; otherwise the first failure is
+// returned.
+func (c *Cacher) RestoreFastest(ctx context.Context, buckets, keys []string, dir string) (RestoreResult, error) {
+	return c.restore(ctx, &RestoreRequest{
+		Buckets: buckets,
+		Keys:    keys,
+		Dir:     dir,
+	}, true)
+}
+
+// RestoreLayers restores each group of keys into dir in order, like Restore
+// does for a single group, so that later layers overwrite files from earlier
+// ones. This overlays a more specific cache, like one for a branch, on top of a
+// base cache. A layer without a match is skipped; a NotFoundError is only
+// returned if every layer misses.
+func (c *Cacher) RestoreLayers(ctx context.Context, bucket string, keyGroups [][]string, dir string) error {
+	if len(keyGroups) < 1 {
+		return validationErrorf("expected at least one layer")
+	}
+
+	var restored int
+	var allKeys []string
+	for idx, keys := range keyGroups {
+		allKeys = append(allKeys, keys...)
+
+		_, err := c.Restore(ctx, &RestoreRequest{
+			Bucket: bucket,
+			Keys:   keys,
+			Dir:    dir,
+		})
+		if err != nil {
+			var nerr *NotFoundError
+			if errors.As(err, &nerr) {
+				c.log("skipping layer %d (no cached objects among keys %q)", idx, keys)
+				continue
+			}
+			return fmt.Errorf("failed to restore layer %d: %w", idx, err)
+		}
+		restored++
+	}
+
+	if restored == 0 {
+		return &NotFoundError{Keys: allKeys}
+	}
+	return nil
+}
+
+// SaveReader caches the contents of the given reader in storage under key.
+// Unlike Save, there is no tar layer: the bytes are streamed through the zstd
+// compressor directly into storage without staging to disk. This is useful for
+// single-blob caches like a database dump piped from a subprocess.
+func (c *Cacher) SaveReader(ctx context.Context, bucket, key string, r io.Reader) (retErr error) {
+	if bucket == "" {
+		retErr = validationErrorf("missing bucket")
+		return
+	}
+
+	if err := validateKey(key); err != nil {
+		retErr = err
+		return
+	}
+
+	if r == nil {
+		retErr = validationErrorf("missing reader")
+		return
+	}
+
+	ctx, finish := withOperationTimeout(ctx, "save", c.saveTimeout)
+	defer func() {
+		retErr = finish(retErr)
+	}()
+
+	// Wait for a transfer slot, if limited
+	release, err := c.acquireTransfer(ctx)
+	if err != nil {
+		retErr = err
+		return
+	}
+	defer release()
+
+	// Check if the object already exists. If it already exists, we do not want to
+	// waste time overwriting the cache.
+	obj := c.client.Bucket(bucket).Object(c.objectName(key))
+	existing, err := c.existing(ctx, obj)
+	if err != nil {
+		retErr = err
+		return
+	}
+	if existing != nil {
+		c.log("cached object already exists, skipping")
+		return
+	}
+
+	// Create the storage writer, which is aborted on failure like in Save
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dne := storage.Conditions{DoesNotExist: true}
+	gcsw := obj.If(dne).NewWriter(uploadCtx)
+	defer func() {
+		if retErr != nil {
+			c.abortUpload(obj, gcsw, cancel)
+			return
+		}
+
+		c.log("closing gcs writer")
+		if cerr := gcsw.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: %w", retErr, &StorageError{Msg: "failed to close gcs writer", Err: cerr})
+				return
+			}
+			retErr = &StorageError{Msg: "failed to close gcs writer", Err: cerr}
+		}
+	}()
+
+	gcsw.ChunkSize = 128_000_000
+	gcsw.ObjectAttrs.ContentType = blobContentType
+	gcsw.ObjectAttrs.CacheControl = cacheControl
+	gcsw.ProgressFunc = c.uploadProgress(nil)
+
+	// Create the zstd writer
+	zw, err := archiver.Zstd{}.OpenWriter(gcsw)
+	if err != nil {
+		retErr = fmt.Errorf("failed to create zstd writer: %w", err)
+		return
+	}
+
+	if _, err := io.Copy(zw, r); err != nil {
+		zw.Close()
+		retErr = fmt.Errorf("failed to compress: %w", err)
+		return
+	}
+
+	if err := zw.Close(); err != nil {
+		retErr = fmt.Errorf("failed to close zstd writer: %w", err)
+		return
+	}
+
+	return
+}
+
+// RestoreReader finds the newest object matching one of the keys, using the
+// same fallback rules as Restore, and returns a reader that decompresses its
+// contents on the fly. It is the counterpart to SaveReader. The reader is
+// pinned to the generation of the match, so a concurrent overwrite cannot
+// change what is read, and a sharded cache is streamed part by part. The
+// caller must close the returned reader.
+func (c *Cacher) RestoreReader(ctx context.Context, bucket string, keys []string) (io.ReadCloser, error) {
+	if bucket == "" {
+		return nil, validationErrorf("missing bucket")
+	}
+
+	if err := validateKeys(keys, 0); err != nil {
+		return nil, err
+	}
+
+	// The transfer slot is held until the returned reader is closed
+	release, err := c.acquireTransfer(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketHandle := c.client.Bucket(bucket)
+
+	_, match, err := c.findMatch(ctx, bucketHandle, c.objectNames(keys), nil)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if match == nil {
+		release()
+		return nil, &NotFoundError{Keys: keys}
+	}
+
+	gcsr, err := openArchive(ctx, bucketHandle, match, false)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	zr, err := c.zstdDecoder().OpenReader(gcsr)
+	if err != nil {
+		gcsr.Close()
+		release()
+		return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+
+	return &blobReader{
+		ReadCloser: zr,
+		gcsr:       gcsr,
+		release:    release,
+		log:        c.log,
+	}, nil
+}
+
+// blobReader is a decompressing reader that also closes the underlying gcs
+// reader.
+type blobReader struct {
+	io.ReadCloser
+
+	gcsr    io.Closer
+	release func()
+	log     func(msg string, vars ...interface{})
+}
+
+// Close closes the decompressor and the gcs reader.
+func (b *blobReader) Close() (retErr error) {
+	defer b.release()
+
+	if err := b.ReadCloser.Close(); err != nil {
+		retErr = fmt.Errorf("failed to close zstd reader: %w", err)
+	}
+
+	b.log("closing gcs reader")
+	if cerr := b.gcsr.Close(); cerr != nil {
+		if retErr != nil {
+			retErr = fmt.Errorf("%v: %w", retErr, &StorageError{Msg: "failed to close gcs reader", Err: cerr})
+			return
+		}
+		retErr = &StorageError{Msg: "failed to close gcs reader", Err: cerr}
+	}
+	return
+}
+
+// Download copies the compressed archive of the object with the given key to w,
+// without extracting it, and returns the number of bytes copied. Unlike
+// Restore, the key must match the object exactly. For a sharded cache, the
+// parts are copied in order, which gives the same bytes as an unsharded save.
+// The MD5 recorded by storage, if any, is verified once everything is copied.
+func (c *Cacher) Download(ctx context.Context, bucket, key string, w io.Writer) (n int64, retErr error) {
+	if bucket == "" {
+		retErr = validationErrorf("missing bucket")
+		return
+	}
+
+	if err := validateKey(key); err != nil {
+		retErr = err
+		return
+	}
+
+	if w == nil {
+		retErr = validationErrorf("missing writer")
+		return
+	}
+
+	ctx, finish := withOperationTimeout(ctx, "download", c.restoreTimeout)
+	defer func() {
+		retErr = finish(retErr)
+	}()
+
+	// Wait for a transfer slot, if limited
+	release, err := c.acquireTransfer(ctx)
+	if err != nil {
+		retErr = err
+		return
+	}
+	defer release()
+
+	bucketHandle := c.client.Bucket(bucket)
+	attrs, err := c.existing(ctx, bucketHandle.Object(c.objectName(key)))
+	if err != nil {
+		retErr = err
+		return
+	}
+	if attrs == nil {
+		retErr = &NotFoundError{Keys: []string{key}}
+		return
+	}
+
+	gcsr, err := openArchive(ctx, bucketHandle, attrs, false)
+	if err != nil {
+		retErr = err
+		return
+	}
+	defer func() {
+		c.log("closing gcs reader")
+		if cerr := gcsr.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: %w", retErr, &StorageError{Msg: "failed to close gcs reader", Err: cerr})
+				return
+			}
+			retErr = &StorageError{Msg: "failed to close gcs reader", Err: cerr}
+		}
+	}()
 
-	debug bool
-}
+	var src io.Reader = gcsr
+	var md5r *md5Reader
+	if len(attrs.MD5) > 0 && attrs.ContentType != manifestContentType {
+		md5r = newMD5Reader(gcsr, attrs.MD5)
+		src = md5r
+	}
 
-// New creates a new cacher capable of saving and restoring the cache.
-func New(ctx context.Context) (*Cacher, error) {
-	client, err := storage.NewClient(ctx,
-		option.WithUserAgent("gcs-cacher/1.0"))
+	n, err = copyBuffered(w, src)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create storage client: %w", err)
+		retErr = fmt.Errorf("failed to download %s: %w", attrs.Name, err)
+		return
 	}
 
-	return &Cacher{
-		client: client,
-	}, nil
+	if md5r != nil {
+		if err := md5r.verify(); err != nil {
+			retErr = fmt.Errorf("failed to verify %s: %w", attrs.Name, err)
+			return
+		}
+	}
+	return
 }
 
-// Debug enables or disables debugging for the cacher.
-func (c *Cacher) Debug(val bool) {
-	c.debug = val
-}
+// ReleaseHold releases the event-based hold on the object with the given key,
+// and on its parts for a sharded cache, such as one placed by Save with
+// EventBasedHold. The key must match the object exactly. The object can then be
+// deleted or replaced again, unless a retention policy of the bucket still
+// applies.
+func (c *Cacher) ReleaseHold(ctx context.Context, bucket, key string) error {
+	if bucket == "" {
+		return validationErrorf("missing bucket")
+	}
+	if err := validateKey(key); err != nil {
+		return err
+	}
 
-// SaveRequest is used as input to the Save operation.
-type SaveRequest struct {
-	// Bucket is the name of the bucket from which to cache.
-	Bucket string
+	bucketHandle := c.client.Bucket(bucket)
+	attrs, err := c.existing(ctx, bucketHandle.Object(c.objectName(key)))
+	if err != nil {
+		return err
+	}
+	if attrs == nil {
+		return &NotFoundError{Keys: []string{key}}
+	}
 
-	// Key is the cache key.
-	Key string
+	if attrs.ContentType == manifestContentType {
+		m, err := readManifest(ctx, bucketHandle, attrs)
+		if err != nil {
+			return err
+		}
+		if err := setPartHolds(ctx, bucketHandle, m.Parts, false); err != nil {
+			return err
+		}
+	}
 
-	// Dir is the directory on disk to cache.
-	Dir string
+	c.log("releasing hold on %s", attrs.Name)
+	obj := bucketHandle.Object(attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation})
+	if _, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{EventBasedHold: false}); err != nil {
+		return &StorageError{Msg: "failed to release hold on " + attrs.Name, Err: err}
+	}
+	return nil
 }
 
-// Save caches the given directory in storage.
-func (c *Cacher) Save(ctx context.Context, i *SaveRequest) (retErr error) {
-	if i == nil {
-		retErr = fmt.Errorf("missing cache options")
+// Upload stores the bytes of r, which must already be a compressed archive as
+// Save creates it, under key without re-archiving them, and returns the number
+// of bytes uploaded. This is the inverse of Download, for example for migrating
+// caches from another store. Archives compressed with gzip are recognized by
+// their leading bytes and stored with a gzip content type. Like Save, nothing
+// is uploaded and zero is returned if the object already exists.
+func (c *Cacher) Upload(ctx context.Context, bucket, key string, r io.Reader) (n int64, retErr error) {
+	if bucket == "" {
+		retErr = validationErrorf("missing bucket")
 		return
 	}
 
-	bucket := i.Bucket
-	if bucket == "" {
-		retErr = fmt.Errorf("missing bucket")
+	if err := validateKey(key); err != nil {
+		retErr = err
 		return
 	}
 
-	dir := i.Dir
-	if dir == "" {
-		retErr = fmt.Errorf("missing directory")
+	if r == nil {
+		retErr = validationErrorf("missing reader")
 		return
 	}
 
-	key := i.Key
-	if key == "" {
-		retErr = fmt.Errorf("missing key")
+	ctx, finish := withOperationTimeout(ctx, "upload", c.saveTimeout)
+	defer func() {
+		retErr = finish(retErr)
+	}()
+
+	// Wait for a transfer slot, if limited
+	release, err := c.acquireTransfer(ctx)
+	if err != nil {
+		retErr = err
 		return
 	}
+	defer release()
 
 	// Check if the object already exists. If it already exists, we do not want to
 	// waste time overwriting the cache.
-	attrs, err := c.client.Bucket(bucket).Object(key).Attrs(ctx)
-	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
-		retErr = fmt.Errorf("failed to check if cached object exists: %w", err)
+	obj := c.client.Bucket(bucket).Object(c.objectName(key))
+	existing, err := c.existing(ctx, obj)
+	if err != nil {
+		retErr = err
 		return
 	}
-	if attrs != nil {
+	if existing != nil {
 		c.log("cached object already exists, skipping")
 		return
 	}
 
-	// Create the storage writer
+	br := bufio.NewReader(r)
+	objContentType := contentType
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		objContentType = "application/gzip"
+	}
+
+	// Create the storage writer, which is aborted on failure like in Save
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	dne := storage.Conditions{DoesNotExist: true}
-	gcsw := c.client.Bucket(bucket).Object(key).If(dne).NewWriter(ctx)
+	gcsw := obj.If(dne).NewWriter(uploadCtx)
 	defer func() {
+		if retErr != nil {
+			c.abortUpload(obj, gcsw, cancel)
+			return
+		}
+
 		c.log("closing gcs writer")
 		if cerr := gcsw.Close(); cerr != nil {
 			if retErr != nil {
-				retErr = fmt.Errorf("%v: failed to close gcs writer: %w", retErr, cerr)
+				retErr = fmt.Errorf("%v: %w", retErr, &StorageError{Msg: "failed to close gcs writer", Err: cerr})
 				return
 			}
-			retErr = fmt.Errorf("failed to close gcs writer: %w", cerr)
+			retErr = &StorageError{Msg: "failed to close gcs writer", Err: cerr}
 		}
 	}()
 
 	gcsw.ChunkSize = 128_000_000
-	gcsw.ObjectAttrs.ContentType = contentType
+	gcsw.ObjectAttrs.ContentType = objContentType
 	gcsw.ObjectAttrs.CacheControl = cacheControl
-	gcsw.ProgressFunc = func(soFar int64) {
-		fmt.Printf("uploaded %d bytes\n", soFar)
-	}
+	gcsw.ProgressFunc = c.uploadProgress(nil)
 
-	// Create the tar.zst writer
-	files, err := archiver.FilesFromDisk(nil, map[string]string{
-		dir: "",
-	})
+	n, err = copyBuffered(gcsw, br)
 	if err != nil {
-		return err
+		retErr = fmt.Errorf("failed to upload: %w", err)
+		return
 	}
+	return
+}
 
-	format := archiver.CompressedArchive{
-		Compression: archiver.Zstd{},
-		Archival:    archiver.Tar{},
+// FindMatch runs only the candidate search of Restore, without downloading or
+// extracting anything. It returns the key which matched and the name of the
+// object Restore would use. On a miss, found is false and err is nil.
+func (c *Cacher) FindMatch(ctx context.Context, bucket string, keys []string) (matchedKey, objectName string, found bool, err error) {
+	if bucket == "" {
+		err = validationErrorf("missing bucket")
+		return
 	}
 
-	err = format.Archive(ctx, gcsw, files)
-	if err != nil {
-		return err
+	if err = validateKeys(keys, 0); err != nil {
+		return
 	}
 
-	return
+	matchedKey, match, err := c.findMatch(ctx, c.client.Bucket(bucket), c.objectNames(keys), nil)
+	if err != nil || match == nil {
+		return
+	}
+	return strings.TrimPrefix(matchedKey, c.keyPrefix), match.Name, true, nil
 }
 
-// RestoreRequest is used as input to the Restore operation.
-type RestoreRequest struct {
-	// Bucket is the name of the bucket from which to cache.
-	Bucket string
+// CacheInfo describes a cached object.
+type CacheInfo struct {
+	// CompressedSize is the size of the object in storage, in bytes. For a
+	// sharded cache, it is the total size of its parts.
+	CompressedSize int64
 
-	// Keys is the ordered list of keys to restore.
-	Keys []string
+	// UncompressedSize is the total size of the file content in the archive, in
+	// bytes, which approximates the disk space needed to restore it. It is -1 if
+	// the object was not saved with this information.
+	UncompressedSize int64
 
-	// Dir is the directory on disk to cache.
-	Dir string
+	// FileCount is the number of entries in the archive, including directories
+	// and links. It is -1 if the object was not saved with this information.
+	FileCount int64
+
+	// Created is the time the object was created.
+	Created time.Time
 }
 
-// Restore restores the key from the cache into the dir on disk.
-func (c *Cacher) Restore(ctx context.Context, i *RestoreRequest) (retErr error) {
-	if i == nil {
-		retErr = fmt.Errorf("missing cache options")
-		return
-	}
+// CacheInfo returns information about the object with the given key, without
+// downloading it. This is useful for checking that there is enough disk space
+// before restoring. Unlike Restore, the key must match the object exactly. If
+// there is no such object, the error is a *NotFoundError.
+func (c *Cacher) CacheInfo(ctx context.Context, bucket, key string) (CacheInfo, error) {
+	var info CacheInfo
 
-	bucket := i.Bucket
 	if bucket == "" {
-		retErr = fmt.Errorf("missing bucket")
-		return
+		return info, validationErrorf("missing bucket")
 	}
 
-	dir := i.Dir
-	if dir == "" {
-		retErr = fmt.Errorf("missing directory")
-		return
+	if err := validateKey(key); err != nil {
+		return info, err
 	}
 
-	keys := i.Keys
-	if len(keys) < 1 {
-		retErr = fmt.Errorf("expected at least one cache key")
-		return
+	attrs, err := c.existing(ctx, c.client.Bucket(bucket).Object(c.objectName(key)))
+	if err != nil {
+		return info, err
+	}
+	if attrs == nil {
+		return info, &NotFoundError{Keys: []string{key}}
 	}
 
-	// Get the bucket handle
-	bucketHandle := c.client.Bucket(bucket)
+	info.CompressedSize = compressedSize(attrs)
+	info.UncompressedSize = parseMetadataInt(attrs.Metadata, metadataUncompressedSize)
+	info.FileCount = parseMetadataInt(attrs.Metadata, metadataFileCount)
+	info.Created = attrs.Created
+	return info, nil
+}
 
-	// Try to find an earlier cached item by looking for the "newest" item with
-	// one of the provided key fallbacks as a prefix.
-	var match *storage.ObjectAttrs
-	for _, key := range keys {
-		c.log("searching for objects with prefix %s", key)
+// parseMetadataInt returns the integer stored under key in the object metadata,
+// or -1 if it is missing or invalid.
+func parseMetadataInt(metadata map[string]string, key string) int64 {
+	v, ok := metadata[key]
+	if !ok {
+		return -1
+	}
 
-		it := bucketHandle.Objects(ctx, &storage.Query{
-			Prefix: key,
-		})
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
 
-		for {
-			attrs, err := it.Next()
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				retErr = fmt.Errorf("failed to list %s: %w", key, err)
-				return
-			}
+// abortUpload aborts an in-progress upload by cancelling its context. If the
+// object was created regardless, it is deleted on a best-effort basis. The
+// deletion is conditioned on the generation the writer created, so that an
+// object written concurrently by someone else is left alone.
+func (c *Cacher) abortUpload(obj *storage.ObjectHandle, gcsw *storage.Writer, cancel context.CancelFunc) {
+	c.log("aborting upload")
+	cancel()
+	if err := gcsw.Close(); err != nil {
+		c.log("aborted gcs writer: %s", err)
+	}
 
-			c.log("found object %s", key)
+	attrs := gcsw.Attrs()
+	if attrs == nil {
+		return
+	}
 
-			if match == nil || attrs.Updated.After(match.Updated) {
-				c.log("setting %s as best candidate", key)
-				match = attrs
-				continue
+	// The caller's context may be what caused the abort, so use a fresh one
+	ctx, done := context.WithTimeout(context.Background(), attrsTimeout)
+	defer done()
+
+	c.log("deleting partial object %s", attrs.Name)
+	conds := storage.Conditions{GenerationMatch: attrs.Generation}
+	if err := obj.If(conds).Delete(ctx); err != nil {
+		c.log("failed to delete partial object %s: %s", attrs.Name, err)
+	}
+}
+
+// findMatchInBuckets runs findMatch against each bucket in order, moving on to
+// the next bucket on a miss or an error. It returns the bucket and key which
+// matched. If no bucket matches, the last error is returned, or nil if all
+// buckets missed.
+func (c *Cacher) findMatchInBuckets(ctx context.Context, buckets, keys []string, better func(candidate, best *storage.ObjectAttrs) bool) (string, string, *storage.ObjectAttrs, error) {
+	var lastErr error
+	for _, bucket := range buckets {
+		key, match, err := c.findMatch(ctx, c.client.Bucket(bucket), keys, better)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", "", nil, err
 			}
+			c.log("failed to search bucket %s, trying next: %s", bucket, err)
+			lastErr = fmt.Errorf("bucket %s: %w", bucket, err)
+			continue
 		}
+		if match == nil {
+			c.log("no cached objects in bucket %s", bucket)
+			continue
+		}
+		return bucket, key, match, nil
 	}
+	return "", "", nil, lastErr
+}
 
-	// Ensure we found one
-	if match == nil {
-		retErr = fmt.Errorf("failed to find cached objects among keys %q", keys)
-		return
+// raceBuckets looks up keys in each bucket concurrently and starts downloading
+// each match, returning the bucket whose download delivers its first byte
+// first, along with the open reader. The other lookups and downloads are
+// cancelled. The first error is returned if no bucket serves a match, or nil if
+// none has one.
+func (c *Cacher) raceBuckets(ctx context.Context, buckets, keys []string) (string, string, *storage.ObjectAttrs, io.ReadCloser, error) {
+	type download struct {
+		idx   int
+		key   string
+		match *storage.ObjectAttrs
+		r     io.ReadCloser
+		err   error
 	}
 
-	// Ensure the output directory exists
-	c.log("making target directory %s", dir)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		retErr = fmt.Errorf("failed to make target directory: %w", err)
-		return
+	// Buffered, so downloads finishing after the winner do not block
+	downloads := make(chan download, len(buckets))
+	cancels := make([]context.CancelFunc, len(buckets))
+	for idx, bucket := range buckets {
+		idx, bucket := idx, bucket
+
+		dctx, cancel := context.WithCancel(ctx)
+		cancels[idx] = cancel
+		go func() {
+			d := download{idx: idx}
+			handle := c.client.Bucket(bucket)
+			d.key, d.match, d.err = c.findMatch(dctx, handle, keys, nil)
+			if d.err == nil && d.match != nil {
+				d.r, d.err = openFirstByte(dctx, handle, d.match, cancel)
+			}
+			downloads <- d
+		}()
 	}
 
-	// Create the gcs reader
-	gcsr, err := bucketHandle.Object(match.Name).NewReader(ctx)
+	var firstErr error
+	for remaining := len(buckets); remaining > 0; remaining-- {
+		d := <-downloads
+		bucket := buckets[d.idx]
+		if d.err != nil {
+			cancels[d.idx]()
+			c.log("download from bucket %s failed: %s", bucket, d.err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("bucket %s: %w", bucket, d.err)
+			}
+			continue
+		}
+		if d.match == nil {
+			cancels[d.idx]()
+			c.log("no cached objects in bucket %s", bucket)
+			continue
+		}
+
+		// The winner's context is cancelled when its reader is closed
+		for idx, cancel := range cancels {
+			if idx != d.idx {
+				cancel()
+			}
+		}
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				if loser := <-downloads; loser.r != nil {
+					loser.r.Close()
+				}
+			}
+		}(remaining - 1)
+
+		c.log("restoring from bucket %s, which started serving first", bucket)
+		return bucket, d.key, d.match, d.r, nil
+	}
+	return "", "", nil, nil, firstErr
+}
+
+// openFirstByte opens the archive of match and waits for its first byte. The
+// returned reader calls cancel when it is closed, or openFirstByte does if it
+// fails.
+func openFirstByte(ctx context.Context, bucket *storage.BucketHandle, match *storage.ObjectAttrs, cancel context.CancelFunc) (io.ReadCloser, error) {
+	r, err := openArchive(ctx, bucket, match, false)
 	if err != nil {
-		retErr = fmt.Errorf("failed to create object reader: %w", err)
-		return
+		cancel()
+		return nil, err
 	}
-	defer func() {
-		c.log("closing gcs reader")
-		if cerr := gcsr.Close(); cerr != nil {
-			if retErr != nil {
-				retErr = fmt.Errorf("%v: failed to close gcs reader: %w", retErr, cerr)
-				return
+
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		r.Close()
+		cancel()
+		return nil, &StorageError{Msg: "failed to read object", Err: err}
+	}
+	return &racedReader{Reader: br, r: r, cancel: cancel}, nil
+}
+
+// racedReader is the reader of a download which won a race. Closing it cancels
+// the context of the download.
+type racedReader struct {
+	*bufio.Reader
+	r      io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer.
+func (r *racedReader) Close() error {
+	defer r.cancel()
+	return r.r.Close()
+}
+
+// findGeneration looks up the given generation of the object named key in each
+// bucket in order, moving on to the next bucket if it is missing or the lookup
+// fails. It returns the bucket which has it. If no bucket has it, the last
+// error is returned, or nil if it is missing everywhere.
+func (c *Cacher) findGeneration(ctx context.Context, buckets []string, key string, generation int64) (string, *storage.ObjectAttrs, error) {
+	var lastErr error
+	for _, bucket := range buckets {
+		attrs, err := c.existing(ctx, c.client.Bucket(bucket).Object(key).Generation(generation))
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", nil, err
 			}
-			retErr = fmt.Errorf("failed to close gcs reader: %w", cerr)
+			c.log("failed to look up generation in bucket %s, trying next: %s", bucket, err)
+			lastErr = fmt.Errorf("bucket %s: %w", bucket, err)
+			continue
 		}
-	}()
+		if attrs == nil {
+			c.log("no generation %d of %s in bucket %s", generation, key, bucket)
+			continue
+		}
+		return bucket, attrs, nil
+	}
+	return "", nil, lastErr
+}
 
-	format := archiver.CompressedArchive{
-		Compression: archiver.Zstd{},
-		Archival:    archiver.Tar{},
+// existing returns the attributes of the given object, or nil if it does not
+// exist. Each lookup is bounded by a short timeout, and failures other than the
+// object not existing are retried with backoff.
+func (c *Cacher) existing(ctx context.Context, obj *storage.ObjectHandle) (*storage.ObjectAttrs, error) {
+	attempts := c.retryAttempts
+	if attempts < 1 {
+		attempts = 1
 	}
-	fileList := []string(nil)
+	backoff := c.retryBackoff
 
-	handler := func(ctx context.Context, f archiver.File) error {
-		hdr, ok := f.Header.(*tar.Header)
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		attrsCtx, cancel := context.WithTimeout(ctx, attrsTimeout)
+		attrs, err := obj.Attrs(attrsCtx)
+		cancel()
 
-		if !ok {
-			return nil
+		if err == nil {
+			return attrs, nil
 		}
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, nil
+		}
+		lastErr = err
 
-		var fpath = filepath.Join(dir, f.NameInArchive)
-
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(fpath, 0755); err != nil {
-				return fmt.Errorf("failed to make directory %s: %w", fpath, err)
-			}
-			return nil
+		if attempt == attempts || ctx.Err() != nil {
+			break
+		}
 
-		case tar.TypeReg, tar.TypeRegA, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
-			if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
-				return fmt.Errorf("failed to make directory %s: %w", filepath.Dir(fpath), err)
-			}
+		c.log("failed to check if cached object exists (attempt %d of %d), retrying in %s: %s",
+			attempt, attempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to check if cached object exists: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return nil, &StorageError{Msg: "failed to check if cached object exists", Err: lastErr}
+}
 
-			out, err := os.Create(fpath)
-			if err != nil {
-				return fmt.Errorf("%s: creating new file: %v", fpath, err)
-			}
-			defer out.Close()
+// findMatch finds an earlier cached item by looking for the "newest" item with
+// one of the provided keys as a prefix. The first key with any match wins, so
+// an object under a preferred key wins over a fresher object under a later
+// fallback key. It returns the key which matched and the matching object, or
+// nil if no objects match.
+//
+// Keys are listed concurrently, but the result is the same as searching them
+// in order: an error listing a key only fails the search if no earlier key
+// matched.
+//
+// If better is non-nil, it replaces the default "newest" comparison and reports
+// whether candidate should replace the current best, which is nil for the first
+// candidate. It must be safe for concurrent use.
+func (c *Cacher) findMatch(ctx context.Context, bucketHandle *storage.BucketHandle, keys []string, better func(candidate, best *storage.ObjectAttrs) bool) (string, *storage.ObjectAttrs, error) {
+	if better == nil {
+		better = newer
+	}
 
-			err = out.Chmod(f.Mode())
-			if err != nil && runtime.GOOS != "windows" {
-				return fmt.Errorf("%s: changing file mode: %v", fpath, err)
-			}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-			in, err := f.Open()
-			if err != nil {
-				return fmt.Errorf("%s: opening file: %v", fpath, err)
-			}
+	matches := make([]*storage.ObjectAttrs, len(keys))
+	errs := make([]error, len(keys))
 
-			_, err = io.Copy(out, in)
-			if err != nil {
-				return fmt.Errorf("%s: writing file: %v", fpath, err)
-			}
-			return nil
+	sem := make(chan struct{}, maxListConcurrency)
+	var wg sync.WaitGroup
+	for idx, key := range keys {
+		idx, key := idx, key
 
-		case tar.TypeSymlink:
-			if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
-				return fmt.Errorf("failed to make directory %s: %w", filepath.Dir(fpath), err)
-			}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-			err = os.Symlink(hdr.Linkname, fpath)
-			if err != nil {
-				return fmt.Errorf("%s: making symbolic link for: %v", fpath, err)
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[idx] = fmt.Errorf("failed to list %s: %w", key, ctx.Err())
+				return
 			}
-			return nil
+			defer func() { <-sem }()
 
-		case tar.TypeLink:
-			if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
-				return fmt.Errorf("failed to make directory %s: %w", filepath.Dir(fpath), err)
-			}
+			matches[idx], errs[idx] = c.findKeyMatch(ctx, bucketHandle, key, better)
+		}()
+	}
+	wg.Wait()
 
-			err = os.Link(filepath.Join(fpath, hdr.Linkname), fpath)
-			if err != nil {
-				return fmt.Errorf("%s: making symbolic link for: %v", fpath, err)
-			}
-			return nil
+	for idx, key := range keys {
+		if errs[idx] != nil {
+			return "", nil, errs[idx]
+		}
 
-		case tar.TypeXGlobalHeader:
-			return nil // ignore the pax global header from git-generated tarballs
-		default:
-			return fmt.Errorf("%s: unknown type flag: %c", hdr.Name, hdr.Typeflag)
+		if match := matches[idx]; match != nil {
+			c.log("using %s from key %s", match.Name, key)
+			return key, match, nil
 		}
 	}
 
-	format.Extract(ctx, gcsr, fileList, handler)
-
-	return
+	return "", nil, nil
 }
 
-// HashGlob hashes the files matched by the given glob.
-func (c *Cacher) HashGlob(pattern string) (string, error) {
-	matches, err := filepath.Glob(pattern)
-	if err != nil {
-		return "", fmt.Errorf("failed to glob: %w", err)
+// findKeyMatch returns the best object with key as a prefix, or nil if there
+// are none.
+func (c *Cacher) findKeyMatch(ctx context.Context, bucketHandle *storage.BucketHandle, key string, better func(candidate, best *storage.ObjectAttrs) bool) (*storage.ObjectAttrs, error) {
+	c.log("searching for objects with prefix %s", key)
+
+	var match *storage.ObjectAttrs
+
+	it := bucketHandle.Objects(ctx, &storage.Query{
+		Prefix: key,
+	})
+
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, &StorageError{Msg: "failed to list " + key, Err: err}
+		}
+
+		c.log("found object %s", attrs.Name)
+
+		if _, ok := attrs.Metadata[metadataShardOf]; ok {
+			c.log("skipping %s (part of a sharded cache)", attrs.Name)
+			continue
+		}
+
+		if better(attrs, match) {
+			c.log("setting %s as best candidate", attrs.Name)
+			match = attrs
+			continue
+		}
 	}
-	return c.HashFiles(matches)
+	return match, nil
 }
 
-// HashFiles hashes the list of file and returns the hex-encoded SHA256.
-func (c *Cacher) HashFiles(files []string) (string, error) {
-	h, err := blake2b.New(16, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create hash: %w", err)
+// ContentAddressedKey returns the key of the content with the given
+// hex-encoded digest under prefix, like one returned by HashFiles or recorded
+// by Save with DedupePrefix. The key is the prefix, "cas/", the first two
+// characters of the digest, a slash, and the full digest:
+//
+//	go-cas/3f/3f9a...
+//
+// The two character directory spreads the names of content stored under the
+// same prefix across the key space, which storage handles better than
+// sequential names. The same digest always produces the same key, and the full
+// digest keeps keys of different content apart. Save with a DedupePrefix checks
+// the content-addressed key under it first, before searching the prefix.
+func ContentAddressedKey(prefix, digest string) string {
+	digest = strings.ToLower(digest)
+	if len(digest) < 2 {
+		return prefix + "cas/" + digest
 	}
+	return prefix + "cas/" + digest[:2] + "/" + digest
+}
 
-	hashOne := func(name string, h hash.Hash) (retErr error) {
-		c.log("opening %s", name)
-		f, err := os.Open(name)
+// findContentHash returns the newest object with the given prefix and content
+// hash, other than the object named key, or nil if there are none. The
+// content-addressed key under the prefix is checked first, which avoids listing
+// the prefix when the content is stored there.
+func (c *Cacher) findContentHash(ctx context.Context, bucketHandle *storage.BucketHandle, prefix, hash, key string) (*storage.ObjectAttrs, error) {
+	if name := ContentAddressedKey(prefix, hash); name != key {
+		attrs, err := c.existing(ctx, bucketHandle.Object(name))
 		if err != nil {
-			retErr = fmt.Errorf("failed to open file: %w", err)
-			return
+			return nil, err
 		}
-		defer func() {
-			c.log("closing %s", name)
-			if cerr := f.Close(); cerr != nil {
-				if retErr != nil {
-					retErr = fmt.Errorf("%v: failed to close file: %w", retErr, cerr)
-					return
-				}
-				retErr = fmt.Errorf("failed to close file: %w", cerr)
-			}
-		}()
+		if attrs != nil && attrs.Metadata[metadataContentHash] == hash {
+			return attrs, nil
+		}
+	}
 
-		c.log("stating %s", name)
-		stat, err := f.Stat()
+	c.log("searching for objects with prefix %s and content hash %s", prefix, hash)
+
+	var match *storage.ObjectAttrs
+
+	it := bucketHandle.Objects(ctx, &storage.Query{
+		Prefix: prefix,
+	})
+
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
 		if err != nil {
-			retErr = fmt.Errorf("failed to stat file: %w", err)
-			return
+			return nil, &StorageError{Msg: "failed to list " + prefix, Err: err}
 		}
 
-		if stat.IsDir() {
-			c.log("skipping %s (is a directory)", name)
-			return
+		if attrs.Name == key || attrs.Metadata[metadataContentHash] != hash {
+			continue
 		}
 
-		c.log("hashing %s", name)
-		if _, err := io.Copy(h, f); err != nil {
-			retErr = fmt.Errorf("failed to hash: %w", err)
-			return
+		if newer(attrs, match) {
+			match = attrs
 		}
+	}
+	return match, nil
+}
 
-		return
+// copyObject copies the src object to dst within storage, keeping its content
+// type and metadata but applying the custom time and ACL of attrs.
+func (c *Cacher) copyObject(ctx context.Context, src *storage.ObjectAttrs, dst *storage.ObjectHandle, attrs *storage.ObjectAttrs) error {
+	copier := dst.CopierFrom(c.client.Bucket(src.Bucket).Object(src.Name).Generation(src.Generation))
+	copier.ContentType = src.ContentType
+	copier.CacheControl = src.CacheControl
+	copier.Metadata = src.Metadata
+	copier.CustomTime = attrs.CustomTime
+	copier.PredefinedACL = attrs.PredefinedACL
+	copier.EventBasedHold = attrs.EventBasedHold
+
+	if _, err := copier.Run(ctx); err != nil {
+		return &StorageError{Msg: "failed to copy " + src.Name, Err: err}
+	}
+	return nil
+}
+
+// newer reports whether candidate was updated more recently than best.
+func newer(candidate, best *storage.ObjectAttrs) bool {
+	return best == nil || candidate.Updated.After(best.Updated)
+}
+
+// isEmptyDir returns true if dir does not exist or has no entries.
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := f.Readdirnames(1); err != nil {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// resolveRoot returns dir with all symbolic links resolved. A directory which
+// does not exist is returned unchanged.
+func resolveRoot(dir string) (string, error) {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dir, nil
+		}
+		return "", fmt.Errorf("failed to resolve %s: %w", dir, err)
+	}
+	return realDir, nil
+}
+
+// cleanDir removes the contents of dir, but not dir itself. It refuses to clean
+// the filesystem root or the user's home directory. If dir does not exist, it
+// returns nil.
+func cleanDir(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", dir, err)
+	}
+
+	if filepath.Dir(abs) == abs {
+		return fmt.Errorf("refusing to clean %s", abs)
+	}
+	if home, err := os.UserHomeDir(); err == nil && filepath.Clean(home) == abs {
+		return fmt.Errorf("refusing to clean home directory %s", abs)
 	}
 
-	for _, name := range files {
-		if err := hashOne(name, h); err != nil {
-			return "", fmt.Errorf("failed to hash %s: %w", name, err)
+	entries, err := os.ReadDir(abs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return fmt.Errorf("failed to read %s: %w", abs, err)
 	}
 
-	dig := h.Sum(nil)
-	return fmt.Sprintf("%x", dig), nil
+	// RemoveAll does not follow symlinks, so links pointing outside of dir are
+	// removed without touching their targets.
+	for _, entry := range entries {
+		pth := filepath.Join(abs, entry.Name())
+		if err := os.RemoveAll(pth); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", pth, err)
+		}
+	}
+	return nil
 }
 
 func (c *Cacher) log(msg string, vars ...interface{}) {
@@ -396,3 +2817,7 @@ func (c *Cacher) log(msg string, vars ...interface{}) {
 		log.Printf(msg, vars...)
 	}
 }
+
+func (c *Cacher) warn(msg string, vars ...interface{}) {
+	log.Printf("[WARN] "+msg, vars...)
+}
@@ -0,0 +1,4873 @@
+package cacher
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/mholt/archiver/v4"
+	"google.golang.org/api/option"
+)
+
+func TestCacher_CacheInfo(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		key      string
+		exp      CacheInfo
+		notFound bool
+		invalid  bool
+	}{
+		{
+			name: "found",
+			key:  "cache",
+			exp:  CacheInfo{CompressedSize: 4, UncompressedSize: 10, FileCount: 2},
+		},
+		{
+			name: "without_metadata",
+			key:  "plain",
+			exp:  CacheInfo{CompressedSize: 3, UncompressedSize: -1, FileCount: -1},
+		},
+		{
+			name:     "missing",
+			key:      "missing",
+			notFound: true,
+		},
+		{
+			name:     "prefix_only",
+			key:      "cach",
+			notFound: true,
+		},
+		{
+			name:    "invalid_key",
+			key:     "",
+			invalid: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			fs.put("bucket", "cache", []byte("data"), &fakeObject{Metadata: map[string]string{
+				metadataUncompressedSize: "10",
+				metadataFileCount:        "2",
+			}})
+			fs.put("bucket", "plain", []byte("abc"), nil)
+
+			info, err := c.CacheInfo(context.Background(), "bucket", tc.key)
+
+			var nerr *NotFoundError
+			if got := errors.As(err, &nerr); got != tc.notFound {
+				t.Fatalf("expected not found %t, got %v", tc.notFound, err)
+			}
+			if tc.notFound && (len(nerr.Keys) != 1 || nerr.Keys[0] != tc.key) {
+				t.Errorf("expected keys [%s], got %q", tc.key, nerr.Keys)
+			}
+			var verr *ValidationError
+			if got := errors.As(err, &verr); got != tc.invalid {
+				t.Fatalf("expected validation error %t, got %v", tc.invalid, err)
+			}
+			if err != nil {
+				return
+			}
+
+			info.Created = tc.exp.Created
+			if info != tc.exp {
+				t.Errorf("expected %+v, got %+v", tc.exp, info)
+			}
+		})
+	}
+}
+
+func TestCacher_clock(t *testing.T) {
+	t.Parallel()
+
+	past := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	future := time.Now().Add(100 * 365 * 24 * time.Hour)
+
+	cases := []struct {
+		name       string
+		clock      time.Time
+		customTime time.Time
+		err        bool
+	}{
+		{
+			// Valid as of the clock, even though it is in the past
+			name:       "before_clock",
+			clock:      past,
+			customTime: past.Add(time.Hour),
+		},
+		{
+			name:       "after_clock",
+			clock:      future,
+			customTime: future.Add(-time.Hour),
+			err:        true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t, WithClock(func() time.Time { return tc.clock }))
+			src := testFiles(t, map[string][]byte{"data": []byte("content")})
+			req := &SaveRequest{
+				Bucket:     "bucket",
+				Key:        "cache",
+				Dir:        src,
+				CustomTime: tc.customTime,
+			}
+
+			if err := c.ValidateSave(req); (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+
+			_, err := c.Save(context.Background(), req)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+			if tc.err {
+				return
+			}
+
+			got, err := time.Parse(time.RFC3339, fs.get("bucket", "cache").CustomTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tc.customTime) {
+				t.Errorf("expected custom time %s, got %s", tc.customTime, got)
+			}
+		})
+	}
+}
+
+func TestCacher_RestoreFastest(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		delays   map[string]time.Duration
+		missing  string
+		exp      string
+		notFound bool
+	}{
+		{
+			// The slow bucket answers the lookup first, but the fast one starts
+			// serving the download first
+			name: "slow_download",
+			delays: map[string]time.Duration{
+				"json:fast":     100 * time.Millisecond,
+				"download:slow": time.Minute,
+			},
+			exp: "fast",
+		},
+		{
+			name: "slow_lookup",
+			delays: map[string]time.Duration{
+				"json:slow": time.Minute,
+			},
+			exp: "fast",
+		},
+		{
+			name: "missing_in_fast",
+			delays: map[string]time.Duration{
+				"json:slow": 100 * time.Millisecond,
+			},
+			missing: "fast",
+			exp:     "slow",
+		},
+		{
+			name:     "missing_everywhere",
+			missing:  "*",
+			notFound: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			for _, bucket := range []string{"slow", "fast"} {
+				if tc.missing == bucket || tc.missing == "*" {
+					continue
+				}
+				src := testFiles(t, map[string][]byte{"data": []byte(bucket)})
+				if _, err := c.Save(context.Background(), &SaveRequest{
+					Bucket: bucket,
+					Key:    "cache",
+					Dir:    src,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for kind, d := range tc.delays {
+				parts := strings.SplitN(kind, ":", 2)
+				fs.setBucketDelay(parts[1], parts[0], d)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			dir := t.TempDir()
+			result, err := c.RestoreFastest(ctx, []string{"slow", "fast"}, []string{"cache"}, dir)
+			var nerr *NotFoundError
+			if got := errors.As(err, &nerr); got != tc.notFound {
+				t.Fatalf("expected not found %t, got %v", tc.notFound, err)
+			}
+			if tc.notFound {
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Bucket != tc.exp {
+				t.Errorf("expected bucket %s, got %s", tc.exp, result.Bucket)
+			}
+			// Each bucket was saved from its own directory
+			matches, err := filepath.Glob(filepath.Join(dir, "*", "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches) != 1 {
+				t.Fatalf("expected exactly one restored file, got %q", matches)
+			}
+			got, err := ioutil.ReadFile(matches[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.exp {
+				t.Errorf("expected content of %s, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestCacher_RestoreReader(t *testing.T) {
+	t.Parallel()
+
+	content := randomBytes(20000)
+	var compressed bytes.Buffer
+	zw, err := archiver.Zstd{}.OpenWriter(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// sharded stores the compressed content as a sharded cache, optionally
+	// overwriting one of its parts afterwards
+	sharded := func(overwrite bool) func(fs *fakeStorage) {
+		return func(fs *fakeStorage) {
+			b := compressed.Bytes()
+			shardOf := &fakeObject{Metadata: map[string]string{metadataShardOf: "cache-1"}}
+
+			var m manifest
+			for idx, part := range [][]byte{b[:len(b)/3], b[len(b)/3 : len(b)/2], b[len(b)/2:]} {
+				name := fmt.Sprintf("cache-1.0123456789abcdef.part%04d", idx)
+				generation := fs.put("bucket", name, part, shardOf)
+				m.Parts = append(m.Parts, manifestPart{Name: name, Generation: generation, Size: int64(len(part))})
+			}
+			if overwrite {
+				fs.put("bucket", m.Parts[1].Name, []byte("overwritten"), shardOf)
+			}
+
+			mb, err := json.Marshal(&m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs.put("bucket", "cache-1", mb, &fakeObject{ContentType: manifestContentType})
+		}
+	}
+
+	cases := []struct {
+		name     string
+		setup    func(fs *fakeStorage)
+		notFound bool
+		err      bool
+	}{
+		{
+			name: "blob",
+			setup: func(fs *fakeStorage) {
+				fs.put("bucket", "cache-1", compressed.Bytes(), &fakeObject{ContentType: blobContentType})
+			},
+		},
+		{
+			name:  "sharded",
+			setup: sharded(false),
+		},
+		{
+			// The parts are pinned to the generations in the manifest
+			name:  "overwritten_part",
+			setup: sharded(true),
+			err:   true,
+		},
+		{
+			name:     "missing",
+			setup:    func(fs *fakeStorage) {},
+			notFound: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			tc.setup(fs)
+
+			r, err := c.RestoreReader(context.Background(), "bucket", []string{"cache-"})
+			var nerr *NotFoundError
+			if got := errors.As(err, &nerr); got != tc.notFound {
+				t.Fatalf("expected not found %t, got %v", tc.notFound, err)
+			}
+			if tc.notFound {
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			got, err := ioutil.ReadAll(r)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+			if tc.err {
+				return
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("expected %d bytes of content, got %d bytes", len(content), len(got))
+			}
+		})
+	}
+}
+
+func TestCacher_SaveAll(t *testing.T) {
+	t.Parallel()
+
+	c, fs := newTestCacher(t)
+	ctx := context.Background()
+
+	var reqs []*SaveRequest
+	for idx := 0; idx < 6; idx++ {
+		src := testFiles(t, map[string][]byte{"data": randomBytes(100 * (idx + 1))})
+		reqs = append(reqs, &SaveRequest{Bucket: "bucket", Key: fmt.Sprintf("cache-%d", idx), Dir: src})
+	}
+	fs.put("bucket", "cache-1", []byte("existing"), nil)
+	reqs[3].Bucket = ""
+	reqs = append(reqs, nil)
+
+	results, err := c.SaveAll(ctx, reqs)
+	var serr *SaveAllError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected a SaveAllError, got %v", err)
+	}
+	if len(results) != len(reqs) || len(serr.Errs) != len(reqs) {
+		t.Fatalf("expected %d results and errors, got %d and %d", len(reqs), len(results), len(serr.Errs))
+	}
+
+	for idx, result := range results {
+		err := serr.Errs[idx]
+		var verr *ValidationError
+		switch idx {
+		case 3, 6:
+			if !errors.As(err, &verr) {
+				t.Errorf("expected a validation error for request %d, got %v", idx, err)
+			}
+			continue
+		case 1:
+			if err != nil || result.Uploaded {
+				t.Errorf("expected request 1 to be skipped, got %+v, %v", result, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("expected request %d to succeed, got %v", idx, err)
+			continue
+		}
+		if !result.Uploaded || result.ObjectName != reqs[idx].Key {
+			t.Errorf("expected request %d to upload %s, got %+v", idx, reqs[idx].Key, result)
+		}
+		if exp := int64(100 * (idx + 1)); result.UncompressedSize != exp {
+			t.Errorf("expected request %d to have %d bytes, got %d", idx, exp, result.UncompressedSize)
+		}
+	}
+
+	if _, err := c.SaveAll(ctx, reqs[:1]); err != nil {
+		t.Errorf("expected no error when every save succeeds, got %v", err)
+	}
+}
+
+func TestCacher_Restore_readBufferSize(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newTestCacher(t)
+	content := randomBytes(100000)
+	src := testFiles(t, map[string][]byte{"data": content})
+	if _, err := c.Save(context.Background(), &SaveRequest{Bucket: "bucket", Key: "cache", Dir: src}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		size    int
+		invalid bool
+	}{
+		{name: "default", size: 0},
+		{name: "smaller_than_header", size: 16},
+		{name: "small", size: 4096},
+		{name: "large", size: 4 << 20},
+		{name: "negative", size: -1, invalid: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			_, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket:         "bucket",
+				Keys:           []string{"cache"},
+				Dir:            dir,
+				ReadBufferSize: tc.size,
+			})
+			var verr *ValidationError
+			if got := errors.As(err, &verr); got != tc.invalid {
+				t.Fatalf("expected validation error %t, got %v", tc.invalid, err)
+			}
+			if tc.invalid {
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(src), "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("expected %d bytes of content, got %d bytes", len(content), len(got))
+			}
+		})
+	}
+}
+
+// slowTransport delays every read of a response body, like a high-latency
+// connection, and counts the reads.
+type slowTransport struct {
+	delay time.Duration
+	reads int64
+}
+
+func (t *slowTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &slowBody{ReadCloser: resp.Body, t: t}
+	return resp, nil
+}
+
+type slowBody struct {
+	io.ReadCloser
+	t *slowTransport
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	atomic.AddInt64(&b.t.reads, 1)
+	time.Sleep(b.t.delay)
+	return b.ReadCloser.Read(p)
+}
+
+func BenchmarkCacher_Restore_readBufferSize(b *testing.B) {
+	const size = 4 << 20
+
+	_, srv := newTestServer(b, nil)
+	newCacher := func(opts ...option.ClientOption) *Cacher {
+		client, err := storage.NewClient(context.Background(),
+			append([]option.ClientOption{option.WithEndpoint(srv.URL + "/storage/v1/")}, opts...)...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { client.Close() })
+		return NewWithClient(client)
+	}
+
+	// Only the download goes through the slow transport
+	src := testFiles(b, map[string][]byte{"data": randomBytes(size)})
+	if _, err := newCacher(option.WithoutAuthentication()).Save(context.Background(), &SaveRequest{
+		Bucket: "bucket",
+		Key:    "cache",
+		Dir:    src,
+	}); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bufSize := range []int{4 << 10, 64 << 10, 1 << 20} {
+		bufSize := bufSize
+
+		b.Run(fmt.Sprintf("%dKiB", bufSize>>10), func(b *testing.B) {
+			slow := &slowTransport{delay: 100 * time.Microsecond}
+			c := newCacher(option.WithHTTPClient(&http.Client{Transport: slow}))
+
+			b.ReportAllocs()
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Restore(context.Background(), &RestoreRequest{
+					Bucket:         "bucket",
+					Keys:           []string{"cache"},
+					Dir:            b.TempDir(),
+					ReadBufferSize: bufSize,
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&slow.reads))/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestCacher_Save_trailingSeparator(t *testing.T) {
+	t.Parallel()
+
+	src := testFiles(t, map[string][]byte{"data": []byte("content")})
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(src, link); err != nil {
+		t.Skipf("cannot make symbolic links: %s", err)
+	}
+	sep := string(filepath.Separator)
+
+	cases := []struct {
+		name    string
+		dir     string
+		resolve bool
+		exp     string
+	}{
+		{name: "base_name", dir: src, exp: filepath.Base(src) + "/data"},
+		{name: "separator", dir: src + sep, exp: "data"},
+		{name: "resolved", dir: link, resolve: true, exp: "link/data"},
+		{name: "resolved_separator", dir: link + sep, resolve: true, exp: "data"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			if _, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:      "bucket",
+				Key:         "cache",
+				Dir:         tc.dir,
+				ResolveRoot: tc.resolve,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			assertRestores(t, c, "cache", tc.exp, []byte("content"))
+		})
+	}
+}
+
+func TestCacher_Restore_md5(t *testing.T) {
+	t.Parallel()
+
+	wrong := md5.Sum([]byte("something else"))
+
+	cases := []struct {
+		name    string
+		save    SaveRequest
+		corrupt func(tb testing.TB, fs *fakeStorage)
+		skipMD5 bool
+		err     string
+	}{
+		{
+			name: "single",
+		},
+		{
+			name: "single_mismatch",
+			corrupt: func(tb testing.TB, fs *fakeStorage) {
+				fs.update(tb, "bucket", "cache", func(obj *fakeObject) {
+					obj.MD5Hash = base64.StdEncoding.EncodeToString(wrong[:])
+				})
+			},
+			err: "MD5 mismatch",
+		},
+		{
+			name: "single_mismatch_skipped",
+			corrupt: func(tb testing.TB, fs *fakeStorage) {
+				fs.update(tb, "bucket", "cache", func(obj *fakeObject) {
+					obj.MD5Hash = base64.StdEncoding.EncodeToString(wrong[:])
+				})
+			},
+			skipMD5: true,
+		},
+		{
+			name: "sharded",
+			save: SaveRequest{ShardSize: 1000},
+		},
+		{
+			name:    "sharded_mismatch",
+			save:    SaveRequest{ShardSize: 1000},
+			corrupt: corruptPartMD5(wrong[:]),
+			err:     "MD5 mismatch",
+		},
+		{
+			name:    "sharded_mismatch_skipped",
+			save:    SaveRequest{ShardSize: 1000},
+			corrupt: corruptPartMD5(wrong[:]),
+			skipMD5: true,
+		},
+		{
+			// Composite objects have no MD5 to compare against
+			name: "composed",
+			save: SaveRequest{ComposeSize: 1000},
+			corrupt: func(tb testing.TB, fs *fakeStorage) {
+				if obj := fs.get("bucket", "cache"); obj.MD5Hash != "" {
+					tb.Errorf("expected a composite object without an MD5, got %s", obj.MD5Hash)
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			content := randomBytes(5000)
+			save := tc.save
+			save.Bucket, save.Key, save.Dir = "bucket", "cache", testFiles(t, map[string][]byte{"data": content})
+			if _, err := c.Save(context.Background(), &save); err != nil {
+				t.Fatal(err)
+			}
+			if tc.corrupt != nil {
+				tc.corrupt(t, fs)
+			}
+
+			dir := t.TempDir()
+			_, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket:  "bucket",
+				Keys:    []string{"cache"},
+				Dir:     dir,
+				SkipMD5: tc.skipMD5,
+			})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(save.Dir), "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("expected %d bytes of content, got %d bytes", len(content), len(got))
+			}
+		})
+	}
+}
+
+// corruptPartMD5 returns a function replacing the MD5 of the second part in the
+// manifest of the sharded cache "cache".
+func corruptPartMD5(sum []byte) func(tb testing.TB, fs *fakeStorage) {
+	return func(tb testing.TB, fs *fakeStorage) {
+		fs.update(tb, "bucket", "cache", func(obj *fakeObject) {
+			var m manifest
+			if err := json.Unmarshal(obj.data, &m); err != nil {
+				tb.Fatal(err)
+			}
+			if len(m.Parts) < 2 || len(m.Parts[1].MD5) == 0 {
+				tb.Fatalf("expected parts with an MD5, got %+v", m.Parts)
+			}
+			m.Parts[1].MD5 = sum
+
+			b, err := json.Marshal(&m)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			obj.data, obj.Size = b, strconv.Itoa(len(b))
+		})
+	}
+}
+
+// roundTrip saves src with the options of save, under the key "cache" in the
+// bucket "bucket", and restores it with the options of restore. The bucket, key,
+// and Dir of save default to those; restore must set its Dir.
+func roundTrip(tb testing.TB, c *Cacher, src string, save SaveRequest, restore RestoreRequest) (RestoreResult, error) {
+	tb.Helper()
+
+	if save.Bucket == "" {
+		save.Bucket = "bucket"
+	}
+	if save.Key == "" {
+		save.Key = "cache"
+	}
+	if save.Dir == "" && len(save.Dirs) == 0 {
+		save.Dir = src
+	}
+	if _, err := c.Save(context.Background(), &save); err != nil {
+		tb.Fatal(err)
+	}
+
+	if restore.Bucket == "" && len(restore.Buckets) == 0 {
+		restore.Bucket = "bucket"
+	}
+	if len(restore.Keys) == 0 {
+		restore.Keys = []string{save.Key}
+	}
+	return c.Restore(context.Background(), &restore)
+}
+
+func TestCacher_Save_emptyDirectories(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		dirs []string
+	}{
+		{name: "top_level", dirs: []string{"tmp"}},
+		{name: "nested", dirs: []string{"a/b/logs"}},
+		{name: "next_to_files", dirs: []string{"files/empty"}},
+		{name: "none", dirs: nil},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"files/data": []byte("content")})
+			for _, dir := range tc.dirs {
+				if err := os.MkdirAll(filepath.Join(src, filepath.FromSlash(dir)), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dst := t.TempDir()
+			if _, err := roundTrip(t, c, src, SaveRequest{}, RestoreRequest{Dir: dst}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, dir := range append(tc.dirs, "files") {
+				fi, err := os.Stat(filepath.Join(dst, filepath.Base(src), filepath.FromSlash(dir)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !fi.IsDir() {
+					t.Errorf("expected %s to be a directory, got %s", dir, fi.Mode())
+				}
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_clean(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		clean bool
+		stale bool
+	}{
+		{name: "clean", clean: true, stale: false},
+		{name: "keep", clean: false, stale: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"data": []byte("content")})
+
+			// The link points outside of the directory, and cleaning must not
+			// follow it
+			outside := testFiles(t, map[string][]byte{"keep": []byte("outside")})
+			dst := testFiles(t, map[string][]byte{"stale/file": []byte("stale")})
+			if err := os.Symlink(outside, filepath.Join(dst, "link")); err != nil {
+				t.Skipf("cannot make symbolic links: %s", err)
+			}
+
+			if _, err := roundTrip(t, c, src, SaveRequest{}, RestoreRequest{Dir: dst, Clean: tc.clean}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range []string{"stale/file", "link"} {
+				_, err := os.Lstat(filepath.Join(dst, filepath.FromSlash(name)))
+				if got := err == nil; got != tc.stale {
+					t.Errorf("expected %s to exist %t, got %v", name, tc.stale, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(outside, "keep")); err != nil {
+				t.Errorf("expected the target of the link to be left alone, got %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dst, filepath.Base(src), "data")); err != nil {
+				t.Errorf("expected the cache to be restored, got %v", err)
+			}
+		})
+	}
+}
+
+// rewriteArchive rewrites the zstd-compressed archive of the object name as if
+// it had been saved differently: fn is called with each header, which it may
+// change, and the content of the entry, and returns the content to write. The
+// object keeps a valid MD5.
+func rewriteArchive(tb testing.TB, fs *fakeStorage, name string, fn func(hdr *tar.Header, content []byte) []byte) {
+	tb.Helper()
+
+	fs.update(tb, "bucket", name, func(obj *fakeObject) {
+		zr, err := archiver.Zstd{}.OpenReader(bytes.NewReader(obj.data))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		defer zr.Close()
+
+		var buf bytes.Buffer
+		zw, err := archiver.Zstd{}.OpenWriter(&buf)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tr, tw := tar.NewReader(zr), tar.NewWriter(zw)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				tb.Fatal(err)
+			}
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				tb.Fatal(err)
+			}
+
+			content = fn(hdr, content)
+			hdr.Size = int64(len(content))
+			if err := tw.WriteHeader(hdr); err != nil {
+				tb.Fatal(err)
+			}
+			if _, err := tw.Write(content); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			tb.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			tb.Fatal(err)
+		}
+
+		sum := md5.Sum(buf.Bytes())
+		obj.data, obj.Size = buf.Bytes(), strconv.Itoa(buf.Len())
+		obj.MD5Hash = base64.StdEncoding.EncodeToString(sum[:])
+	})
+}
+
+func TestCacher_Restore_verify(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		checksums bool
+		corrupt   bool
+		verify    bool
+		err       string
+	}{
+		{name: "valid", checksums: true, verify: true},
+		{name: "corrupted", checksums: true, corrupt: true, verify: true, err: "b.txt: checksum mismatch"},
+		{name: "corrupted_unverified", checksums: true, corrupt: true},
+		{name: "no_checksums", verify: true, err: "no checksum recorded"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{
+				"a.txt": []byte("first"),
+				"b.txt": []byte("second"),
+			})
+			if _, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:    "bucket",
+				Key:       "cache",
+				Dir:       src,
+				Checksums: tc.checksums,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// The content changes after the checksum was recorded, keeping the
+			// size, like corruption on disk would
+			if tc.corrupt {
+				rewriteArchive(t, fs, "cache", func(hdr *tar.Header, content []byte) []byte {
+					if strings.HasSuffix(hdr.Name, "/b.txt") {
+						return []byte("SECOND")
+					}
+					return content
+				})
+			}
+
+			dst := t.TempDir()
+			_, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket: "bucket",
+				Keys:   []string{"cache"},
+				Dir:    dst,
+				Verify: tc.verify,
+			})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCacher_Close(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		ownsClient bool
+	}{
+		{name: "owned", ownsClient: true},
+		{name: "injected", ownsClient: false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			c.ownsClient = tc.ownsClient
+
+			for i := 0; i < 2; i++ {
+				if err := c.Close(); err != nil {
+					t.Fatalf("close %d: %s", i, err)
+				}
+			}
+
+			// A client provided by the caller is still theirs to use
+			if !tc.ownsClient {
+				if _, err := c.Upload(context.Background(), "bucket", "after", bytes.NewReader([]byte("data"))); err != nil {
+					t.Fatal(err)
+				}
+				if obj := fs.get("bucket", "after"); obj == nil || string(obj.data) != "data" {
+					t.Errorf("expected the object to be uploaded, got %v", obj)
+				}
+			}
+		})
+	}
+}
+
+func TestCacher_Save_dirs(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		dirs map[string]string
+		exp  map[string]string
+	}{
+		{
+			name: "named",
+			dirs: map[string]string{"build-out": "artifacts", "go-build": "gocache"},
+			exp:  map[string]string{"artifacts/out.bin": "out", "gocache/entry": "entry"},
+		},
+		{
+			name: "nested_names",
+			dirs: map[string]string{"build-out": "cache/artifacts", "go-build": "cache/go"},
+			exp:  map[string]string{"cache/artifacts/out.bin": "out", "cache/go/entry": "entry"},
+		},
+		{
+			name: "base_name",
+			dirs: map[string]string{"build-out": "", "go-build": "gocache"},
+			exp:  map[string]string{"build-out/out.bin": "out", "gocache/entry": "entry"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{
+				"build-out/out.bin": []byte("out"),
+				"go-build/entry":    []byte("entry"),
+			})
+
+			dirs := make(map[string]string, len(tc.dirs))
+			for dir, name := range tc.dirs {
+				dirs[filepath.Join(src, dir)] = name
+			}
+
+			dst := t.TempDir()
+			if _, err := roundTrip(t, c, src, SaveRequest{Dirs: dirs}, RestoreRequest{Dir: dst}); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]string)
+			if err := filepath.Walk(dst, func(pth string, fi os.FileInfo, err error) error {
+				if err != nil || fi.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(dst, pth)
+				if err != nil {
+					return err
+				}
+				content, err := ioutil.ReadFile(pth)
+				if err != nil {
+					return err
+				}
+				got[filepath.ToSlash(rel)] = string(content)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %v, got %v", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestCacher_Save_existenceRetries(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		attempts int
+		failures int
+		err      bool
+	}{
+		{name: "no_failures", attempts: 3, failures: 0},
+		{name: "recovers", attempts: 3, failures: 2},
+		{name: "exhausted", attempts: 3, failures: 3, err: true},
+		{name: "no_retries", attempts: 1, failures: 1, err: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			c.Retries(tc.attempts, 0)
+
+			// The client would otherwise retry the failures itself
+			c.client.SetRetry(storage.WithPolicy(storage.RetryNever))
+			fs.setFailures(http.MethodGet, "/storage/v1/b/bucket/o/cache", tc.failures, http.StatusServiceUnavailable)
+
+			src := testFiles(t, map[string][]byte{"data": []byte("content")})
+			_, err := c.Save(context.Background(), &SaveRequest{
+				Bucket: "bucket",
+				Key:    "cache",
+				Dir:    src,
+			})
+			if tc.err {
+				var serr *StorageError
+				if !errors.As(err, &serr) {
+					t.Fatalf("expected a storage error, got %v", err)
+				}
+				if got := fs.names("bucket"); len(got) != 0 {
+					t.Errorf("expected nothing to be uploaded, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fs.get("bucket", "cache") == nil {
+				t.Errorf("expected the cache to be uploaded")
+			}
+		})
+	}
+}
+
+// saveAt saves a small cache under key and backdates it to updated, so tests
+// can control which object is the newest.
+func saveAt(tb testing.TB, c *Cacher, fs *fakeStorage, key string, updated time.Time) {
+	tb.Helper()
+
+	src := testFiles(tb, map[string][]byte{"key": []byte(key)})
+	if _, err := c.Save(context.Background(), &SaveRequest{
+		Bucket: "bucket",
+		Key:    key,
+		Dir:    src,
+	}); err != nil {
+		tb.Fatal(err)
+	}
+	fs.update(tb, "bucket", key, func(obj *fakeObject) {
+		obj.Updated = updated.UTC().Format(time.RFC3339Nano)
+	})
+}
+
+func TestCacher_Restore_keyOrder(t *testing.T) {
+	t.Parallel()
+
+	// Objects are saved in order, each one newer than the last
+	cases := []struct {
+		name    string
+		objects []string
+		keys    []string
+		exp     string
+		key     string
+	}{
+		{
+			name:    "first_key_wins_over_newer",
+			objects: []string{"deps-main-a", "deps-b"},
+			keys:    []string{"deps-main-", "deps-"},
+			exp:     "deps-main-a",
+			key:     "deps-main-",
+		},
+		{
+			name:    "newest_under_first_key",
+			objects: []string{"deps-main-a", "deps-main-b", "deps-c"},
+			keys:    []string{"deps-main-", "deps-"},
+			exp:     "deps-main-b",
+			key:     "deps-main-",
+		},
+		{
+			name:    "falls_back_on_miss",
+			objects: []string{"deps-a", "deps-b"},
+			keys:    []string{"deps-main-", "deps-"},
+			exp:     "deps-b",
+			key:     "deps-",
+		},
+		{
+			name:    "later_key_skipped",
+			objects: []string{"build-a", "deps-b", "deps-c"},
+			keys:    []string{"deps-", "build-"},
+			exp:     "deps-c",
+			key:     "deps-",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			start := time.Now().Add(-time.Hour)
+			for idx, name := range tc.objects {
+				saveAt(t, c, fs, name, start.Add(time.Duration(idx)*time.Minute))
+			}
+
+			result, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket: "bucket",
+				Keys:   tc.keys,
+				Dir:    t.TempDir(),
+				DryRun: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.ObjectName != tc.exp {
+				t.Errorf("expected %s, got %s", tc.exp, result.ObjectName)
+			}
+			if result.Key != tc.key {
+				t.Errorf("expected key %s, got %s", tc.key, result.Key)
+			}
+		})
+	}
+}
+
+func TestCacher_Save_maxSize(t *testing.T) {
+	t.Parallel()
+
+	// Random content does not compress, so the archive is larger than it
+	content := randomBytes(256 * 1024)
+
+	cases := []struct {
+		name    string
+		maxSize int64
+		shard   int64
+		compose int64
+		err     error
+	}{
+		{name: "no_limit"},
+		{name: "under_limit", maxSize: 1024 * 1024},
+		{name: "exceeded", maxSize: 16 * 1024, err: ErrMaxSizeExceeded},
+		{name: "exceeded_sharded", maxSize: 64 * 1024, shard: 16 * 1024, err: ErrMaxSizeExceeded},
+		{name: "exceeded_composed", maxSize: 64 * 1024, compose: 16 * 1024, err: ErrMaxSizeExceeded},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"data": content})
+			_, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:      "bucket",
+				Key:         "cache",
+				Dir:         src,
+				MaxSize:     tc.maxSize,
+				ShardSize:   tc.shard,
+				ComposeSize: tc.compose,
+			})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+
+			names := fs.names("bucket")
+			if tc.err != nil {
+				if len(names) != 0 {
+					t.Errorf("expected no objects to be left, got %q", names)
+				}
+				return
+			}
+			if len(names) != 1 || names[0] != "cache" {
+				t.Errorf("expected the cache to be uploaded, got %q", names)
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_legacyGzip(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		contentType string
+	}{
+		{name: "no_content_type"},
+		{name: "octet_stream", contentType: "application/octet-stream"},
+		{name: "gzip", contentType: "application/gzip"},
+		{name: "gtar", contentType: "application/x-gtar"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// A plain tar.gz as written by other tools, without a global header
+			c, fs := newTestCacher(t)
+			fs.put("bucket", "legacy", testArchive(t, []testEntry{
+				dirEntry("deps"),
+				fileEntry("deps/lib.txt", "library"),
+			}), &fakeObject{ContentType: tc.contentType})
+
+			assertRestores(t, c, "legacy", "deps/lib.txt", []byte("library"))
+		})
+	}
+}
+
+func TestCacher_Save_compressionRatio(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		files      map[string][]byte
+		compresses bool
+	}{
+		{
+			name: "compressible",
+			files: map[string][]byte{
+				"a.txt":     bytes.Repeat([]byte("a"), 64*1024),
+				"sub/b.txt": bytes.Repeat([]byte("b"), 32*1024),
+			},
+			compresses: true,
+		},
+		{
+			name:  "random",
+			files: map[string][]byte{"data": randomBytes(64 * 1024)},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			result, err := c.Save(context.Background(), &SaveRequest{
+				Bucket: "bucket",
+				Key:    "cache",
+				Dir:    testFiles(t, tc.files),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var size int64
+			for _, content := range tc.files {
+				size += int64(len(content))
+			}
+			if result.UncompressedSize != size {
+				t.Errorf("expected uncompressed size %d, got %d", size, result.UncompressedSize)
+			}
+			if got := int64(len(fs.get("bucket", "cache").data)); result.CompressedSize != got {
+				t.Errorf("expected compressed size %d, got %d", got, result.CompressedSize)
+			}
+			if got := float64(result.UncompressedSize) / float64(result.CompressedSize); result.CompressionRatio != got {
+				t.Errorf("expected ratio %f, got %f", got, result.CompressionRatio)
+			}
+			if compresses := result.CompressedSize < result.UncompressedSize; compresses != tc.compresses {
+				t.Errorf("expected compression: %t, got %d of %d bytes", tc.compresses, result.CompressedSize, result.UncompressedSize)
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_onlyIfEmpty(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		setup func(tb testing.TB, dir string)
+		err   error
+	}{
+		{
+			name:  "missing",
+			setup: func(tb testing.TB, dir string) {},
+		},
+		{
+			name: "empty",
+			setup: func(tb testing.TB, dir string) {
+				if err := os.Mkdir(dir, 0755); err != nil {
+					tb.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "not_empty",
+			setup: func(tb testing.TB, dir string) {
+				if err := os.MkdirAll(filepath.Join(dir, "fresh"), 0755); err != nil {
+					tb.Fatal(err)
+				}
+			},
+			err: ErrDirNotEmpty,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			saveAt(t, c, fs, "cache", time.Now())
+
+			dir := filepath.Join(t.TempDir(), "workspace")
+			tc.setup(t, dir)
+
+			fs.mu.Lock()
+			before := fs.requests
+			fs.mu.Unlock()
+
+			_, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket:      "bucket",
+				Keys:        []string{"cache"},
+				Dir:         dir,
+				OnlyIfEmpty: true,
+			})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+
+			fs.mu.Lock()
+			requests := fs.requests - before
+			fs.mu.Unlock()
+			if tc.err != nil {
+				if requests != 0 {
+					t.Errorf("expected no requests to the bucket, got %d", requests)
+				}
+				return
+			}
+			if entries, err := os.ReadDir(dir); err != nil || len(entries) == 0 {
+				t.Errorf("expected the cache to be restored, got %d entries (%v)", len(entries), err)
+			}
+		})
+	}
+}
+
+func TestCacher_findMatch_concurrent(t *testing.T) {
+	t.Parallel()
+
+	// More keys than are listed at once
+	var keys []string
+	for i := 0; i < 2*maxListConcurrency+3; i++ {
+		keys = append(keys, fmt.Sprintf("key%02d-", i))
+	}
+
+	cases := []struct {
+		name    string
+		objects []string
+		exp     string
+	}{
+		{name: "none"},
+		{name: "last_key", objects: []string{"key18-a"}, exp: "key18-a"},
+		{name: "first_of_many", objects: []string{"key03-a", "key01-a", "key17-a", "key01-b"}, exp: "key01-b"},
+		{name: "first_key", objects: []string{"key05-a", "key00-a"}, exp: "key00-a"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			start := time.Now().Add(-time.Hour)
+			for idx, name := range tc.objects {
+				fs.put("bucket", name, []byte(name), &fakeObject{
+					Updated: start.Add(time.Duration(idx) * time.Minute).UTC().Format(time.RFC3339Nano),
+				})
+			}
+
+			// Searching the keys one at a time is the reference
+			ctx := context.Background()
+			bucketHandle := c.client.Bucket("bucket")
+			var expKey string
+			for _, key := range keys {
+				match, err := c.findKeyMatch(ctx, bucketHandle, key, newer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if match != nil {
+					expKey = key
+					break
+				}
+			}
+
+			for i := 0; i < 5; i++ {
+				key, match, err := c.findMatch(ctx, bucketHandle, keys, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if key != expKey {
+					t.Fatalf("expected key %q, got %q", expKey, key)
+				}
+
+				var got string
+				if match != nil {
+					got = match.Name
+				}
+				if got != tc.exp {
+					t.Fatalf("expected %q, got %q", tc.exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCacher_findMatch_cancelled(t *testing.T) {
+	t.Parallel()
+
+	c, fs := newTestCacher(t)
+	fs.setDelay(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	keys := make([]string, 2*maxListConcurrency)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%02d-", i)
+	}
+
+	start := time.Now()
+	if _, _, err := c.findMatch(ctx, c.client.Bucket("bucket"), keys, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected all searches to stop promptly, took %s", elapsed)
+	}
+}
+
+func TestCacher_FindMatch(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		bucket string
+		keys   []string
+		key    string
+		object string
+		found  bool
+		err    bool
+	}{
+		{name: "exact", bucket: "bucket", keys: []string{"deps-abc"}, key: "deps-abc", object: "deps-abc", found: true},
+		{name: "prefix", bucket: "bucket", keys: []string{"deps-"}, key: "deps-", object: "deps-def", found: true},
+		{name: "fallback", bucket: "bucket", keys: []string{"build-", "deps-a"}, key: "deps-a", object: "deps-abc", found: true},
+		{name: "miss", bucket: "bucket", keys: []string{"build-"}},
+		{name: "missing_bucket", keys: []string{"deps-"}, err: true},
+		{name: "missing_keys", bucket: "bucket", err: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			fs.put("bucket", "deps-abc", []byte("abc"), &fakeObject{Updated: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)})
+			fs.put("bucket", "deps-def", []byte("def"), nil)
+
+			fs.mu.Lock()
+			before := fs.requests
+			fs.mu.Unlock()
+
+			key, object, found, err := c.FindMatch(context.Background(), tc.bucket, tc.keys)
+			if tc.err {
+				var verr *ValidationError
+				if !errors.As(err, &verr) {
+					t.Fatalf("expected a validation error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != tc.key || object != tc.object || found != tc.found {
+				t.Errorf("expected (%q, %q, %t), got (%q, %q, %t)", tc.key, tc.object, tc.found, key, object, found)
+			}
+
+			// Only listing requests are made
+			fs.mu.Lock()
+			requests := fs.requests - before
+			fs.mu.Unlock()
+			if requests > len(tc.keys) {
+				t.Errorf("expected at most %d requests, got %d", len(tc.keys), requests)
+			}
+		})
+	}
+}
+
+func TestCacher_Save_customTime(t *testing.T) {
+	t.Parallel()
+
+	future := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	past := time.Now().Add(-24 * time.Hour).UTC().Truncate(time.Second)
+
+	cases := []struct {
+		name       string
+		customTime time.Time
+		allowPast  bool
+		err        bool
+	}{
+		{name: "unset"},
+		{name: "future", customTime: future},
+		{name: "past", customTime: past, err: true},
+		{name: "past_allowed", customTime: past, allowPast: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			_, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:              "bucket",
+				Key:                 "cache",
+				Dir:                 testFiles(t, map[string][]byte{"data": []byte("content")}),
+				CustomTime:          tc.customTime,
+				AllowPastCustomTime: tc.allowPast,
+			})
+			if tc.err {
+				var verr *ValidationError
+				if !errors.As(err, &verr) {
+					t.Fatalf("expected a validation error, got %v", err)
+				}
+				if got := fs.names("bucket"); len(got) != 0 {
+					t.Errorf("expected nothing to be uploaded, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			raw := fs.get("bucket", "cache").CustomTime
+			if tc.customTime.IsZero() {
+				if raw != "" {
+					t.Errorf("expected no custom time, got %s", raw)
+				}
+				return
+			}
+			got, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tc.customTime) {
+				t.Errorf("expected custom time %s, got %s", tc.customTime, got)
+			}
+		})
+	}
+}
+
+func TestCacher_Save_replaceIfNewer(t *testing.T) {
+	t.Parallel()
+
+	updated := time.Now().Add(-time.Hour).UTC()
+
+	cases := []struct {
+		name     string
+		replace  bool
+		modTime  time.Time
+		uploaded bool
+		exp      string
+	}{
+		{name: "newer_source", replace: true, modTime: updated.Add(time.Minute), uploaded: true, exp: "new"},
+		{name: "older_source", replace: true, modTime: updated.Add(-time.Minute), exp: "old"},
+		{name: "same_time", replace: true, modTime: updated, exp: "old"},
+		{name: "newer_without_option", replace: false, modTime: updated.Add(time.Minute), exp: "old"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"sub/data": []byte("old")})
+			if _, err := c.Save(context.Background(), &SaveRequest{Bucket: "bucket", Key: "cache", Dir: src}); err != nil {
+				t.Fatal(err)
+			}
+			fs.update(t, "bucket", "cache", func(obj *fakeObject) {
+				obj.Updated = updated.Format(time.RFC3339Nano)
+			})
+			generation := fs.get("bucket", "cache").Generation
+
+			// Only the file changed; the directories are older than the object
+			pth := filepath.Join(src, "sub", "data")
+			if err := ioutil.WriteFile(pth, []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{pth, filepath.Join(src, "sub"), src} {
+				mtime := tc.modTime
+				if p != pth {
+					mtime = updated.Add(-time.Hour)
+				}
+				if err := os.Chtimes(p, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:         "bucket",
+				Key:            "cache",
+				Dir:            src,
+				ReplaceIfNewer: tc.replace,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Uploaded != tc.uploaded {
+				t.Errorf("expected uploaded %t, got %t", tc.uploaded, result.Uploaded)
+			}
+			if replaced := fs.get("bucket", "cache").Generation != generation; replaced != tc.uploaded {
+				t.Errorf("expected replaced %t, got %t", tc.uploaded, replaced)
+			}
+			assertRestores(t, c, "cache", filepath.Base(src)+"/sub/data", []byte(tc.exp))
+		})
+	}
+}
+
+func TestCacher_Save_failOnEmpty(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		failOnEmpty bool
+		setup       func(tb testing.TB, dir string)
+		err         error
+		uploaded    bool
+	}{
+		{
+			name:        "empty",
+			failOnEmpty: true,
+			setup:       func(tb testing.TB, dir string) {},
+			err:         ErrNoFiles,
+		},
+		{
+			name:        "only_directories",
+			failOnEmpty: true,
+			setup: func(tb testing.TB, dir string) {
+				if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+					tb.Fatal(err)
+				}
+			},
+			err: ErrNoFiles,
+		},
+		{
+			name:        "not_empty",
+			failOnEmpty: true,
+			setup: func(tb testing.TB, dir string) {
+				if err := ioutil.WriteFile(filepath.Join(dir, "data"), []byte("content"), 0644); err != nil {
+					tb.Fatal(err)
+				}
+			},
+			uploaded: true,
+		},
+		{
+			name:        "empty_allowed",
+			failOnEmpty: false,
+			setup:       func(tb testing.TB, dir string) {},
+			uploaded:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := t.TempDir()
+			tc.setup(t, src)
+
+			_, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:      "bucket",
+				Key:         "cache",
+				Dir:         src,
+				FailOnEmpty: tc.failOnEmpty,
+			})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if uploaded := fs.get("bucket", "cache") != nil; uploaded != tc.uploaded {
+				t.Errorf("expected uploaded %t, got %t", tc.uploaded, uploaded)
+			}
+		})
+	}
+
+	// A missing directory is a different error
+	t.Run("missing", func(t *testing.T) {
+		t.Parallel()
+
+		c, _ := newTestCacher(t)
+		_, err := c.Save(context.Background(), &SaveRequest{
+			Bucket:      "bucket",
+			Key:         "cache",
+			Dir:         filepath.Join(t.TempDir(), "missing"),
+			FailOnEmpty: true,
+		})
+		if err == nil || errors.Is(err, ErrNoFiles) {
+			t.Errorf("expected an error other than %v, got %v", ErrNoFiles, err)
+		}
+	})
+}
+
+func TestCacher_Save_abort(t *testing.T) {
+	t.Parallel()
+
+	const insertPath = "/upload/storage/v1/b/bucket/o"
+
+	cases := []struct {
+		name    string
+		shard   int64
+		compose int64
+		// failAfter fails the upload after this many objects were inserted;
+		// otherwise the save is cancelled once an object was inserted.
+		failAfter int
+		cancel    bool
+	}{
+		{name: "single_failed", failAfter: 0},
+		{name: "sharded_failed", shard: 32 * 1024, failAfter: 3},
+		{name: "composed_failed", compose: 32 * 1024, failAfter: 3},
+		{name: "single_cancelled", cancel: true},
+		{name: "sharded_cancelled", shard: 32 * 1024, cancel: true},
+		{name: "composed_cancelled", compose: 32 * 1024, cancel: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			c.client.SetRetry(storage.WithPolicy(storage.RetryNever))
+			src := testFiles(t, map[string][]byte{"data": randomBytes(256 * 1024)})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			switch {
+			case !tc.cancel:
+				fs.setFailuresAfter(http.MethodPost, insertPath, tc.failAfter, 1000, http.StatusBadRequest)
+			case tc.shard == 0 && tc.compose == 0:
+				// A single upload is only stored once complete, so it is
+				// cancelled while in flight
+				fs.setDelay(time.Second)
+				time.AfterFunc(50*time.Millisecond, cancel)
+			default:
+				// Slow down the requests so the save is cancelled while parts
+				// are still being uploaded
+				fs.setDelay(10 * time.Millisecond)
+				go func() {
+					for ctx.Err() == nil {
+						if len(fs.names("bucket")) > 0 {
+							cancel()
+							return
+						}
+						time.Sleep(time.Millisecond)
+					}
+				}()
+			}
+
+			_, err := c.Save(ctx, &SaveRequest{
+				Bucket:      "bucket",
+				Key:         "cache",
+				Dir:         src,
+				ShardSize:   tc.shard,
+				ComposeSize: tc.compose,
+			})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tc.cancel && !errors.Is(err, context.Canceled) {
+				t.Errorf("expected %v, got %v", context.Canceled, err)
+			}
+
+			// Cleanup of parts finalized in the background can finish after
+			// the save returns
+			fs.setDelay(0)
+			var names []string
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if names = fs.names("bucket"); len(names) == 0 {
+					break
+				}
+			}
+			if len(names) != 0 {
+				t.Errorf("expected no objects to be left, got %q", names)
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_buckets(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		bucket  string
+		buckets []string
+		saved   []string
+		failing []string
+		exp     string
+	}{
+		{name: "primary_hit", bucket: "primary", buckets: []string{"secondary"}, saved: []string{"primary", "secondary"}, exp: "primary"},
+		{name: "primary_miss", bucket: "primary", buckets: []string{"secondary"}, saved: []string{"secondary"}, exp: "secondary"},
+		{name: "primary_outage", bucket: "primary", buckets: []string{"secondary"}, saved: []string{"primary", "secondary"}, failing: []string{"primary"}, exp: "secondary"},
+		{name: "only_buckets", buckets: []string{"primary", "secondary", "tertiary"}, saved: []string{"tertiary"}, exp: "tertiary"},
+		{name: "all_miss", bucket: "primary", buckets: []string{"secondary"}},
+		{name: "all_failing", bucket: "primary", buckets: []string{"secondary"}, saved: []string{"primary", "secondary"}, failing: []string{"primary", "secondary"}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			c.client.SetRetry(storage.WithPolicy(storage.RetryNever))
+			for _, bucket := range tc.saved {
+				src := testFiles(t, map[string][]byte{"from": []byte(bucket)})
+				if _, err := c.Save(context.Background(), &SaveRequest{Bucket: bucket, Key: "cache", Dir: src}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, bucket := range tc.failing {
+				fs.setFailures(http.MethodGet, "/storage/v1/b/"+bucket+"/o", 1000, http.StatusServiceUnavailable)
+			}
+
+			result, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket:  tc.bucket,
+				Buckets: tc.buckets,
+				Keys:    []string{"cache"},
+				Dir:     t.TempDir(),
+				DryRun:  true,
+			})
+			switch {
+			case len(tc.failing) > 0 && tc.exp == "":
+				var serr *StorageError
+				if !errors.As(err, &serr) {
+					t.Fatalf("expected a storage error, got %v", err)
+				}
+			case tc.exp == "":
+				var nerr *NotFoundError
+				if !errors.As(err, &nerr) {
+					t.Fatalf("expected a not found error, got %v", err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case result.Bucket != tc.exp:
+				t.Errorf("expected bucket %s, got %s", tc.exp, result.Bucket)
+			}
+		})
+	}
+}
+
+// archiveHeaders returns the headers of the zstd-compressed archive of the
+// object name.
+func archiveHeaders(tb testing.TB, fs *fakeStorage, name string) []*tar.Header {
+	tb.Helper()
+
+	zr, err := archiver.Zstd{}.OpenReader(bytes.NewReader(fs.get("bucket", name).data))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer zr.Close()
+
+	var hdrs []*tar.Header
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return hdrs
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		hdrs = append(hdrs, hdr)
+	}
+}
+
+func TestCacher_Save_tarFormat(t *testing.T) {
+	t.Parallel()
+
+	// Longer than the 256 bytes USTAR can represent
+	long := strings.Repeat(strings.Repeat("d", 60)+"/", 5) + "file.txt"
+
+	cases := []struct {
+		name   string
+		format tar.Format
+		path   string
+		exp    tar.Format
+		err    bool
+	}{
+		{name: "default_short", path: "short.txt", exp: tar.FormatUSTAR},
+		{name: "default_long", path: long, exp: tar.FormatPAX},
+		{name: "ustar_short", format: tar.FormatUSTAR, path: "short.txt", exp: tar.FormatUSTAR},
+		{name: "ustar_long", format: tar.FormatUSTAR, path: long, err: true},
+		{name: "gnu_long", format: tar.FormatGNU, path: long, exp: tar.FormatGNU},
+		{name: "pax_long", format: tar.FormatPAX, path: long, exp: tar.FormatPAX},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{tc.path: []byte("content")})
+			_, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:    "bucket",
+				Key:       "cache",
+				Dir:       src,
+				TarFormat: tc.format,
+			})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if got := fs.names("bucket"); len(got) != 0 {
+					t.Errorf("expected nothing to be uploaded, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, hdr := range archiveHeaders(t, fs, "cache") {
+				if hdr.Typeflag == tar.TypeReg && hdr.Format&tc.exp == 0 {
+					t.Errorf("expected %s to be in format %s, got %s", hdr.Name, tc.exp, hdr.Format)
+				}
+			}
+			assertRestores(t, c, "cache", filepath.Base(src)+"/"+tc.path, []byte("content"))
+		})
+	}
+}
+
+func TestCacher_Save_longPaths(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links require privileges on windows")
+	}
+
+	// Longer than the 256 bytes of USTAR names and the 100 bytes of its link
+	// targets, like deeply nested node_modules
+	deep := strings.Repeat("node_modules/"+strings.Repeat("p", 40)+"/", 6)
+	target := strings.Repeat("../", 40) + "target"
+
+	cases := []struct {
+		name   string
+		format tar.Format
+		link   bool
+		err    string
+	}{
+		{name: "default_name"},
+		{name: "default_link_target", link: true},
+		{name: "gnu_name", format: tar.FormatGNU},
+		{name: "ustar_name", format: tar.FormatUSTAR, err: "too long for the USTAR format"},
+		{name: "ustar_link_target", format: tar.FormatUSTAR, link: true, err: "too long for the USTAR format"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"short": []byte("short")})
+			if tc.link {
+				if err := os.Symlink(target, filepath.Join(src, "link")); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				pth := filepath.Join(src, filepath.FromSlash(deep), "index.js")
+				if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(pth, []byte("module.exports = {}"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dst := t.TempDir()
+			if tc.err != "" {
+				_, err := c.Save(context.Background(), &SaveRequest{Bucket: "bucket", Key: "cache", Dir: src, TarFormat: tc.format})
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				if got := fs.names("bucket"); len(got) != 0 {
+					t.Errorf("expected nothing to be uploaded, got %q", got)
+				}
+				return
+			}
+
+			if _, err := roundTrip(t, c, src,
+				SaveRequest{TarFormat: tc.format},
+				RestoreRequest{Dir: dst, SymlinkPolicy: SymlinkAllow}); err != nil {
+				t.Fatal(err)
+			}
+
+			exp, got := listTree(t, src), listTree(t, filepath.Join(dst, filepath.Base(src)))
+			if !reflect.DeepEqual(got, exp) {
+				t.Errorf("expected %q, got %q", exp, got)
+			}
+		})
+	}
+}
+
+// inFlight counts the requests being served at once, and the most seen.
+type inFlight struct {
+	mu       sync.Mutex
+	cur, max int
+	next     http.Handler
+}
+
+func (f *inFlight) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.cur++
+	if f.cur > f.max {
+		f.max = f.cur
+	}
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.cur--
+		f.mu.Unlock()
+	}()
+	f.next.ServeHTTP(w, r)
+}
+
+func TestCacher_MaxConcurrentTransfers(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		limit int
+		// min is the fewest concurrent requests expected, to check the
+		// transfers actually overlap without a limit
+		min int
+	}{
+		{name: "one", limit: 1},
+		{name: "two", limit: 2},
+		{name: "unlimited", limit: 0, min: 2},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			flight := &inFlight{}
+			fs, srv := newTestServer(t, func(h http.Handler) http.Handler {
+				flight.next = h
+				return flight
+			})
+			fs.setDelay(20 * time.Millisecond)
+
+			client, err := storage.NewClient(context.Background(),
+				option.WithEndpoint(srv.URL+"/storage/v1/"),
+				option.WithoutAuthentication())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			c := NewWithClient(client)
+			c.Retries(1, 0)
+			c.MaxConcurrentTransfers(tc.limit)
+			fs.put("bucket", "restored", testArchive(t, []testEntry{fileEntry("f", "content")}), nil)
+
+			const transfers = 8
+			errCh := make(chan error, transfers)
+			var wg sync.WaitGroup
+			for i := 0; i < transfers; i++ {
+				i := i
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					if i%2 == 0 {
+						_, err := c.Restore(context.Background(), &RestoreRequest{
+							Bucket: "bucket",
+							Keys:   []string{"restored"},
+							Dir:    t.TempDir(),
+						})
+						errCh <- err
+						return
+					}
+					_, err := c.Save(context.Background(), &SaveRequest{
+						Bucket: "bucket",
+						Key:    fmt.Sprintf("saved%d", i),
+						Dir:    testFiles(t, map[string][]byte{"f": []byte("content")}),
+					})
+					errCh <- err
+				}()
+			}
+			wg.Wait()
+			close(errCh)
+			for err := range errCh {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			flight.mu.Lock()
+			defer flight.mu.Unlock()
+			if tc.limit > 0 && flight.max > tc.limit {
+				t.Errorf("expected at most %d concurrent requests, got %d", tc.limit, flight.max)
+			}
+			if flight.max < tc.min {
+				t.Errorf("expected at least %d concurrent requests, got %d", tc.min, flight.max)
+			}
+		})
+	}
+
+	t.Run("cancelled_wait", func(t *testing.T) {
+		t.Parallel()
+
+		c, fs := newTestCacher(t)
+		c.MaxConcurrentTransfers(1)
+		fs.setDelay(time.Second)
+
+		go c.Save(context.Background(), &SaveRequest{
+			Bucket: "bucket",
+			Key:    "slow",
+			Dir:    testFiles(t, map[string][]byte{"f": []byte("content")}),
+		})
+		time.Sleep(50 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := c.Save(ctx, &SaveRequest{
+			Bucket: "bucket",
+			Key:    "waiting",
+			Dir:    testFiles(t, map[string][]byte{"f": []byte("content")}),
+		})
+		if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "transfer slot") {
+			t.Errorf("expected to time out waiting for a transfer slot, got %v", err)
+		}
+	})
+}
+
+func TestCacher_Restore_generation(t *testing.T) {
+	t.Parallel()
+
+	// Each overwrite replaces the previous generation of the key, which the
+	// bucket keeps
+	c, fs := newTestCacher(t)
+	fs.versioning = true
+	contents := []string{"first", "second", "third"}
+	generations := make([]int64, len(contents))
+	for idx, content := range contents {
+		generations[idx] = fs.put("bucket", "cache", testArchive(t, []testEntry{fileEntry("data", content)}), nil)
+	}
+
+	cases := []struct {
+		name       string
+		generation int64
+		exp        string
+	}{
+		{name: "latest", exp: "third"},
+		{name: "first", generation: generations[0], exp: "first"},
+		{name: "second", generation: generations[1], exp: "second"},
+		{name: "current", generation: generations[2], exp: "third"},
+		{name: "missing", generation: generations[2] + 1000},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Restoring a generation is repeatable
+			for i := 0; i < 2; i++ {
+				dst := t.TempDir()
+				result, err := c.Restore(context.Background(), &RestoreRequest{
+					Bucket:     "bucket",
+					Keys:       []string{"cache"},
+					Dir:        dst,
+					Generation: tc.generation,
+				})
+				if tc.exp == "" {
+					var nerr *NotFoundError
+					if !errors.As(err, &nerr) || nerr.Generation != tc.generation {
+						t.Fatalf("expected a not found error for generation %d, got %v", tc.generation, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.generation != 0 && result.Generation != tc.generation {
+					t.Errorf("expected generation %d, got %d", tc.generation, result.Generation)
+				}
+
+				got, err := ioutil.ReadFile(filepath.Join(dst, "data"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != tc.exp {
+					t.Errorf("expected %q, got %q", tc.exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCacher_RestoreLatest(t *testing.T) {
+	t.Parallel()
+
+	// Objects are put in order, each one newer than the last
+	cases := []struct {
+		name    string
+		objects []string
+		prefix  string
+		exp     string
+	}{
+		{name: "newest_wins", objects: []string{"scratch-b", "scratch-c", "scratch-a"}, prefix: "scratch-", exp: "scratch-a"},
+		{name: "nested_prefix", objects: []string{"scratch-main-a", "scratch-b"}, prefix: "scratch-", exp: "scratch-b"},
+		{name: "other_prefix_ignored", objects: []string{"scratch-a", "other-b"}, prefix: "scratch-", exp: "scratch-a"},
+		{name: "miss", objects: []string{"other-a"}, prefix: "scratch-"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			start := time.Now().Add(-time.Hour)
+			for idx, name := range tc.objects {
+				fs.put("bucket", name, testArchive(t, []testEntry{fileEntry("name", name)}), &fakeObject{
+					Updated: start.Add(time.Duration(idx) * time.Minute).UTC().Format(time.RFC3339Nano),
+				})
+			}
+
+			dst := t.TempDir()
+			result, err := c.RestoreLatest(context.Background(), "bucket", tc.prefix, dst)
+			if tc.exp == "" {
+				var nerr *NotFoundError
+				if !errors.As(err, &nerr) {
+					t.Fatalf("expected a not found error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.ObjectName != tc.exp {
+				t.Errorf("expected %s, got %s", tc.exp, result.ObjectName)
+			}
+			if got, err := ioutil.ReadFile(filepath.Join(dst, "name")); err != nil || string(got) != tc.exp {
+				t.Errorf("expected the content of %s, got %q (%v)", tc.exp, got, err)
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_compressionBomb(t *testing.T) {
+	t.Parallel()
+
+	// 32 MiB of zeros compress to a tiny object
+	c, fs := newTestCacher(t)
+	src := testFiles(t, map[string][]byte{
+		"a.txt":    []byte("first"),
+		"zero.bin": make([]byte, 32<<20),
+	})
+	if _, err := c.Save(context.Background(), &SaveRequest{Bucket: "bucket", Key: "bomb", Dir: src}); err != nil {
+		t.Fatal(err)
+	}
+	if size := len(fs.get("bucket", "bomb").data); size > 64<<10 {
+		t.Fatalf("expected a small object, got %d bytes", size)
+	}
+
+	cases := []struct {
+		name     string
+		maxSize  int64
+		maxRatio float64
+		err      error
+	}{
+		{name: "no_limit"},
+		{name: "size_under", maxSize: 64 << 20},
+		{name: "size_exceeded", maxSize: 1 << 20, err: ErrMaxSizeExceeded},
+		{name: "ratio_exceeded", maxRatio: 20, err: ErrMaxSizeExceeded},
+		{name: "ratio_under", maxRatio: 1 << 20},
+		{name: "lowest_wins", maxSize: 64 << 20, maxRatio: 20, err: ErrMaxSizeExceeded},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dst := t.TempDir()
+			_, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket:              "bucket",
+				Keys:                []string{"bomb"},
+				Dir:                 dst,
+				MaxUncompressedSize: tc.maxSize,
+				MaxCompressionRatio: tc.maxRatio,
+			})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if tc.err == nil {
+				return
+			}
+
+			// The files created before the limit was hit are removed again,
+			// while directories are left in place
+			for _, line := range listTree(t, dst) {
+				if !strings.Contains(line, "/ ") {
+					t.Errorf("expected no files to be left, got %q", line)
+				}
+			}
+		})
+	}
+}
+
+func TestCacher_Save_teeTo(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		compose int64
+		content []byte
+	}{
+		{name: "small", content: []byte("content")},
+		{name: "random", content: randomBytes(128 * 1024)},
+		{name: "composed", compose: 32 * 1024, content: randomBytes(128 * 1024)},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			tee := filepath.Join(t.TempDir(), "cache.tar.zst")
+			if _, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:      "bucket",
+				Key:         "cache",
+				Dir:         testFiles(t, map[string][]byte{"data": tc.content}),
+				TeeTo:       tee,
+				ComposeSize: tc.compose,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(tee)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exp := fs.get("bucket", "cache").data; !bytes.Equal(got, exp) {
+				t.Errorf("expected the %d uploaded bytes, got %d bytes", len(exp), len(got))
+			}
+		})
+	}
+
+	// A tee file which cannot be created fails before anything is uploaded
+	t.Run("create_failed", func(t *testing.T) {
+		t.Parallel()
+
+		c, fs := newTestCacher(t)
+		_, err := c.Save(context.Background(), &SaveRequest{
+			Bucket: "bucket",
+			Key:    "cache",
+			Dir:    testFiles(t, map[string][]byte{"data": []byte("content")}),
+			TeeTo:  t.TempDir(),
+		})
+		if err == nil || !strings.Contains(err.Error(), "tee file") {
+			t.Fatalf("expected a tee file error, got %v", err)
+		}
+		if got := fs.names("bucket"); len(got) != 0 {
+			t.Errorf("expected nothing to be uploaded, got %q", got)
+		}
+	})
+}
+
+func TestCacher_Restore_dryRun(t *testing.T) {
+	t.Parallel()
+
+	entries := []testEntry{
+		dirEntry("deps"),
+		fileEntry("deps/lib.txt", "library"),
+		symlinkEntry("deps/current", "lib.txt"),
+		hardlinkEntry("deps/copy.txt", "deps/lib.txt"),
+	}
+	exp := []FileEntry{
+		{Name: "deps", Mode: os.ModeDir | 0755},
+		{Name: "deps/lib.txt", Size: 7, Mode: 0644},
+		{Name: "deps/current", Mode: os.ModeSymlink | 0777, LinkTarget: "lib.txt"},
+		{Name: "deps/copy.txt", Mode: 0644, LinkTarget: "deps/lib.txt"},
+	}
+
+	cases := []struct {
+		name  string
+		clean bool
+		setup func(tb testing.TB, dir string)
+	}{
+		{name: "missing_dir", setup: func(tb testing.TB, dir string) {}},
+		{
+			name:  "clean_skipped",
+			clean: true,
+			setup: func(tb testing.TB, dir string) {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					tb.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, "stale"), []byte("stale"), 0644); err != nil {
+					tb.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			fs.put("bucket", "cache", testArchive(t, entries), nil)
+
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "workspace")
+			tc.setup(t, dir)
+			before := listTree(t, parent)
+
+			result, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket: "bucket",
+				Keys:   []string{"cache"},
+				Dir:    dir,
+				DryRun: true,
+				Clean:  tc.clean,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(result.Files, exp) {
+				t.Errorf("expected %+v, got %+v", exp, result.Files)
+			}
+			if after := listTree(t, parent); !reflect.DeepEqual(after, before) {
+				t.Errorf("expected nothing to be written, got %q instead of %q", after, before)
+			}
+		})
+	}
+}
+
+func TestCacher_TempDir(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		dir  func(tb testing.TB) string
+		err  bool
+	}{
+		{name: "default", dir: func(tb testing.TB) string { return "" }},
+		{name: "scratch", dir: func(tb testing.TB) string { return tb.TempDir() }},
+		{
+			name: "missing",
+			dir:  func(tb testing.TB) string { return filepath.Join(tb.TempDir(), "missing") },
+			err:  true,
+		},
+		{
+			name: "file",
+			dir: func(tb testing.TB) string {
+				return filepath.Join(testFiles(tb, map[string][]byte{"file": []byte("x")}), "file")
+			},
+			err: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			dir := tc.dir(t)
+
+			err := c.TempDir(dir)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if c.tempDir != "" {
+					t.Errorf("expected temporary directory to be unchanged, got %q", c.tempDir)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if dir != "" {
+				entries, err := os.ReadDir(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) != 0 {
+					t.Errorf("expected writability check to clean up, got %d entries", len(entries))
+				}
+			}
+
+			f, err := c.createTemp("staging-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			os.Remove(f.Name())
+
+			exp := dir
+			if exp == "" {
+				exp = os.TempDir()
+			}
+			if got := filepath.Dir(f.Name()); got != filepath.Clean(exp) {
+				t.Errorf("expected staging file in %q, got %q", exp, got)
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_defaultToCwd(t *testing.T) {
+	cases := []struct {
+		name         string
+		dir          bool
+		defaultToCwd bool
+		err          bool
+	}{
+		{name: "cwd", defaultToCwd: true},
+		{name: "explicit_dir", dir: true, defaultToCwd: true},
+		{name: "missing_dir", err: true},
+	}
+
+	// The working directory is process-wide, so these cases cannot run in
+	// parallel
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			c, fs := newTestCacher(t)
+			fs.put("bucket", "cache", testArchive(t, []testEntry{fileEntry("a.txt", "a")}), nil)
+
+			cwd, explicit := t.TempDir(), t.TempDir()
+			orig, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(cwd); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := os.Chdir(orig); err != nil {
+					t.Error(err)
+				}
+			})
+
+			req := &RestoreRequest{
+				Bucket:       "bucket",
+				Keys:         []string{"cache"},
+				DefaultToCwd: tc.defaultToCwd,
+			}
+			if tc.dir {
+				req.Dir = explicit
+			}
+
+			_, err = c.Restore(context.Background(), req)
+			if tc.err {
+				var verr *ValidationError
+				if !errors.As(err, &verr) {
+					t.Fatalf("expected validation error, got %v", err)
+				}
+				if got := listTree(t, cwd); len(got) != 0 {
+					t.Errorf("expected nothing restored, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			into, other := cwd, explicit
+			if tc.dir {
+				into, other = explicit, cwd
+			}
+			exp := []string{`a.txt -rw-r--r-- "a"`}
+			if got := listTree(t, into); !reflect.DeepEqual(got, exp) {
+				t.Errorf("expected %q, got %q", exp, got)
+			}
+			if got := listTree(t, other); len(got) != 0 {
+				t.Errorf("expected nothing in %s, got %q", other, got)
+			}
+		})
+	}
+}
+
+func TestCacher_Save_dedupe(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		firstKey  string
+		firstHash bool
+		modify    func(tb testing.TB, src string)
+		copied    bool
+	}{
+		{
+			name:      "identical",
+			firstKey:  "ci-1",
+			firstHash: true,
+			modify:    func(tb testing.TB, src string) {},
+			copied:    true,
+		},
+		{
+			name:      "touched",
+			firstKey:  "ci-1",
+			firstHash: true,
+			modify: func(tb testing.TB, src string) {
+				later := time.Now().Add(time.Hour)
+				if err := os.Chtimes(filepath.Join(src, "lib.txt"), later, later); err != nil {
+					tb.Fatal(err)
+				}
+			},
+			copied: true,
+		},
+		{
+			name:      "changed",
+			firstKey:  "ci-1",
+			firstHash: true,
+			modify: func(tb testing.TB, src string) {
+				if err := ioutil.WriteFile(filepath.Join(src, "lib.txt"), []byte("changed"), 0644); err != nil {
+					tb.Fatal(err)
+				}
+			},
+		},
+		{
+			name:      "outside_prefix",
+			firstKey:  "other-1",
+			firstHash: true,
+			modify:    func(tb testing.TB, src string) {},
+		},
+		{
+			name:     "no_recorded_hash",
+			firstKey: "ci-1",
+			modify:   func(tb testing.TB, src string) {},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"lib.txt": []byte("library")})
+
+			first := &SaveRequest{Bucket: "bucket", Key: tc.firstKey, Dir: src}
+			if tc.firstHash {
+				first.DedupePrefix = "ci-"
+			}
+			if _, err := c.Save(context.Background(), first); err != nil {
+				t.Fatal(err)
+			}
+
+			tc.modify(t, src)
+
+			result, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:       "bucket",
+				Key:          "ci-2",
+				Dir:          src,
+				DedupePrefix: "ci-",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Uploaded {
+				t.Fatal("expected the key to be written")
+			}
+
+			orig, saved := fs.get("bucket", tc.firstKey), fs.get("bucket", "ci-2")
+			if saved.Metadata[metadataContentHash] == "" {
+				t.Errorf("expected content hash to be recorded, got %v", saved.Metadata)
+			}
+
+			if !tc.copied {
+				if result.CopiedFrom != "" {
+					t.Errorf("expected a full upload, got copy from %q", result.CopiedFrom)
+				}
+				if result.CompressedSize == 0 {
+					t.Error("expected compressed size of the upload to be set")
+				}
+				return
+			}
+
+			if result.CopiedFrom != tc.firstKey {
+				t.Errorf("expected copy from %q, got %q", tc.firstKey, result.CopiedFrom)
+			}
+			// A fresh archive would differ, at least in modification times
+			if !bytes.Equal(saved.data, orig.data) {
+				t.Error("expected the existing object to be copied, got new content")
+			}
+			assertRestores(t, c, "ci-2", filepath.Base(src)+"/lib.txt", []byte("library"))
+		})
+	}
+}
+
+func TestCacher_Save_predefinedACL(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		acl     string
+		shard   int64
+		compose int64
+		dedupe  bool
+		err     bool
+	}{
+		{name: "default"},
+		{name: "public_read", acl: "publicRead"},
+		{name: "sharded", acl: "projectPrivate", shard: 1000},
+		{name: "composed", acl: "bucketOwnerRead", compose: 1000},
+		{name: "copied", acl: "publicRead", dedupe: true},
+		{name: "invalid", acl: "public-read", err: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"data": randomBytes(3000)})
+
+			req := &SaveRequest{
+				Bucket:        "bucket",
+				Key:           "cache",
+				Dir:           src,
+				PredefinedACL: tc.acl,
+				ShardSize:     tc.shard,
+				ComposeSize:   tc.compose,
+			}
+			if tc.dedupe {
+				// Save the same content under another key first, without an ACL
+				req.DedupePrefix = "cache"
+				if _, err := c.Save(context.Background(), &SaveRequest{
+					Bucket:       "bucket",
+					Key:          "cache-old",
+					Dir:          src,
+					DedupePrefix: "cache",
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := c.Save(context.Background(), req)
+			if tc.err {
+				var verr *ValidationError
+				if !errors.As(err, &verr) {
+					t.Fatalf("expected validation error, got %v", err)
+				}
+				if names := fs.names("bucket"); len(names) != 0 {
+					t.Errorf("expected nothing to be written, got %q", names)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.dedupe && result.CopiedFrom == "" {
+				t.Fatal("expected the existing object to be copied")
+			}
+
+			for _, name := range fs.names("bucket") {
+				if name == "cache-old" {
+					continue
+				}
+				if got := fs.get("bucket", name).acl; got != tc.acl {
+					t.Errorf("expected %s to have ACL %q, got %q", name, tc.acl, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCacher_Save_uploaded(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		prefix    string
+		skipCheck bool
+		shard     int64
+	}{
+		{name: "single"},
+		{name: "key_prefix", prefix: "ci/"},
+		{name: "skip_existence_check", skipCheck: true},
+		{name: "sharded", shard: 1000},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			c.KeyPrefix(tc.prefix)
+			src := testFiles(t, map[string][]byte{"data": randomBytes(3000)})
+
+			req := &SaveRequest{
+				Bucket:             "bucket",
+				Key:                "cache",
+				Dir:                src,
+				SkipExistenceCheck: tc.skipCheck,
+				ShardSize:          tc.shard,
+			}
+			exp := tc.prefix + "cache"
+
+			first, err := c.Save(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !first.Uploaded {
+				t.Error("expected the first save to upload")
+			}
+			if first.ObjectName != exp {
+				t.Errorf("expected object name %q, got %q", exp, first.ObjectName)
+			}
+			generation := fs.get("bucket", exp).Generation
+
+			second, err := c.Save(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if second.Uploaded {
+				t.Error("expected the second save to be skipped")
+			}
+			if second.ObjectName != exp {
+				t.Errorf("expected object name %q, got %q", exp, second.ObjectName)
+			}
+			if got := fs.get("bucket", exp).Generation; got != generation {
+				t.Errorf("expected generation %s to be kept, got %s", generation, got)
+			}
+		})
+	}
+}
+
+// zstdFrame returns data as a zstd frame of raw blocks declaring a window of
+// 1<<windowLog bytes, like one written by "zstd --long".
+func zstdFrame(windowLog uint, data []byte) []byte {
+	const maxBlockSize = 128 << 10
+
+	// No content size, so the window descriptor follows
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, byte(windowLog-10) << 3}
+	for {
+		n := len(data)
+		if n > maxBlockSize {
+			n = maxBlockSize
+		}
+		header := uint32(n) << 3
+		if n == len(data) {
+			header |= 1
+		}
+		frame = append(frame, byte(header), byte(header>>8), byte(header>>16))
+		frame = append(frame, data[:n]...)
+
+		data = data[n:]
+		if len(data) == 0 {
+			return frame
+		}
+	}
+}
+
+func TestCacher_Restore_zstdWindow(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := randomBytes(200 << 10)
+	if err := tw.WriteHeader(&tar.Header{Name: "data", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		windowLog uint
+		maxWindow uint64
+		err       bool
+	}{
+		// The zstd decoder only accepts up to 512 MiB by default. The window is
+		// allocated when decoding, so keep it at 1 GiB.
+		{name: "long_30", windowLog: 30},
+		{name: "over_default", windowLog: 32, err: true},
+		{name: "at_limit", windowLog: 20, maxWindow: 1 << 20},
+		{name: "over_limit", windowLog: 21, maxWindow: 1 << 20, err: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			c.ZstdMaxWindow(tc.maxWindow)
+			fs.put("bucket", "cache", zstdFrame(tc.windowLog, buf.Bytes()), nil)
+
+			dir := t.TempDir()
+			_, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket: "bucket",
+				Keys:   []string{"cache"},
+				Dir:    dir,
+			})
+			if tc.err {
+				if err == nil || !strings.Contains(err.Error(), "window size exceeded") {
+					t.Fatalf("expected window size error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(filepath.Join(dir, "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("expected %d bytes restored, got %d", len(content), len(got))
+			}
+		})
+	}
+}
+
+func TestCacher_Save_walkConcurrency(t *testing.T) {
+	t.Parallel()
+
+	clock := func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+	src := testTree(t, 4, 3)
+	if err := os.Symlink("filea", filepath.Join(src, "dira", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	c, fs := newTestCacher(t, WithClock(clock))
+	if _, err := c.Save(context.Background(), &SaveRequest{
+		Bucket:          "bucket",
+		Key:             "serial",
+		Dir:             src,
+		WalkConcurrency: 1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	exp := fs.get("bucket", "serial")
+
+	cases := []struct {
+		name        string
+		concurrency int
+	}{
+		{name: "default", concurrency: 0},
+		{name: "two", concurrency: 2},
+		{name: "many", concurrency: 32},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			key := "concurrent-" + tc.name
+			if _, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:          "bucket",
+				Key:             key,
+				Dir:             src,
+				WalkConcurrency: tc.concurrency,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			got := fs.get("bucket", key)
+			if !bytes.Equal(got.data, exp.data) {
+				t.Errorf("expected the archive of a serial walk (%d bytes), got %d different bytes", len(exp.data), len(got.data))
+			}
+			if !reflect.DeepEqual(got.Metadata, exp.Metadata) {
+				t.Errorf("expected metadata %v, got %v", exp.Metadata, got.Metadata)
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_continueOnError(t *testing.T) {
+	t.Parallel()
+
+	entries := []testEntry{
+		fileEntry("a.txt", "a"),
+		fileEntry("blocked/b.txt", "b"),
+		fileEntry("c.txt", "c"),
+	}
+
+	cases := []struct {
+		name            string
+		continueOnError bool
+	}{
+		{name: "fail_fast"},
+		{name: "continue", continueOnError: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			fs.put("bucket", "cache", testArchive(t, entries), nil)
+
+			// A file where the archive has a directory cannot be replaced
+			dir := testFiles(t, map[string][]byte{"blocked": []byte("in the way")})
+
+			result, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket:          "bucket",
+				Keys:            []string{"cache"},
+				Dir:             dir,
+				ContinueOnError: tc.continueOnError,
+			})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+
+			if !tc.continueOnError {
+				if len(result.FailedFiles) != 0 {
+					t.Errorf("expected no failed files without continuing, got %v", result.FailedFiles)
+				}
+				return
+			}
+
+			blocked := filepath.Join(dir, "blocked")
+			if len(result.FailedFiles) != 1 || !strings.Contains(result.FailedFiles[0].Error(), blocked) {
+				t.Errorf("expected one failure naming %s, got %v", blocked, result.FailedFiles)
+			}
+			if !strings.Contains(err.Error(), "failed to restore 1 files") {
+				t.Errorf("expected summary of the failures, got %v", err)
+			}
+			exp := []string{
+				`a.txt -rw-r--r-- "a"`,
+				`blocked -rw-r--r-- "in the way"`,
+				`c.txt -rw-r--r-- "c"`,
+			}
+			if got := listTree(t, dir); !reflect.DeepEqual(got, exp) {
+				t.Errorf("expected %q, got %q", exp, got)
+			}
+		})
+	}
+}
+
+func TestSaveRequest_Validate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		modify func(i *SaveRequest)
+		err    string
+	}{
+		{name: "valid", modify: func(i *SaveRequest) {}},
+		{name: "missing_bucket", modify: func(i *SaveRequest) { i.Bucket = "" }, err: "missing bucket"},
+		{name: "missing_dir", modify: func(i *SaveRequest) { i.Dir = "" }, err: "missing directory"},
+		{name: "outside_base_path", modify: func(i *SaveRequest) { i.BasePath = "/other" }, err: "is not inside base path"},
+		{name: "missing_key", modify: func(i *SaveRequest) { i.Key = "" }, err: "missing key"},
+		{name: "whitespace_key", modify: func(i *SaveRequest) { i.Key = "deps " }, err: "leading or trailing whitespace"},
+		{name: "invalid_dedupe_prefix", modify: func(i *SaveRequest) { i.DedupePrefix = "\tdeps" }, err: "leading or trailing whitespace"},
+		{name: "invalid_acl", modify: func(i *SaveRequest) { i.PredefinedACL = "public" }, err: "invalid predefined ACL"},
+		{name: "invalid_uncompressed", modify: func(i *SaveRequest) { i.StoreUncompressed = []string{"["} }, err: "invalid uncompressed pattern"},
+		{
+			name:   "shard_and_compose",
+			modify: func(i *SaveRequest) { i.ShardSize, i.ComposeSize = 1000, 1000 },
+			err:    "shard size and compose size are mutually exclusive",
+		},
+		{
+			name:   "skip_check_and_replace",
+			modify: func(i *SaveRequest) { i.SkipExistenceCheck, i.ReplaceIfNewer = true, true },
+			err:    "skip existence check and replace if newer are mutually exclusive",
+		},
+		{
+			name:   "deterministic_and_atimes",
+			modify: func(i *SaveRequest) { i.Deterministic, i.PreserveAccessTimes = true, true },
+			err:    "deterministic and preserve access times are mutually exclusive",
+		},
+		{
+			name:   "unsupported_format",
+			modify: func(i *SaveRequest) { i.Format = archiver.CompressedArchive{Archival: archiver.Zip{}} },
+			err:    "unsupported archive format",
+		},
+		{
+			name:   "ustar_atimes",
+			modify: func(i *SaveRequest) { i.PreserveAccessTimes, i.TarFormat = true, tar.FormatUSTAR },
+			err:    "access times cannot be preserved in the USTAR format",
+		},
+		{
+			name:   "past_custom_time",
+			modify: func(i *SaveRequest) { i.CustomTime = time.Now().Add(-time.Hour) },
+			err:    "is in the past",
+		},
+		{
+			name: "past_custom_time_allowed",
+			modify: func(i *SaveRequest) {
+				i.CustomTime, i.AllowPastCustomTime = time.Now().Add(-time.Hour), true
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			i := &SaveRequest{Bucket: "bucket", Key: "deps", Dir: "/workspace/deps"}
+			tc.modify(i)
+
+			err := i.Validate()
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected validation error containing %q, got %v", tc.err, err)
+			}
+
+			// Save fails the same way, before making any requests
+			c, fs := newTestCacher(t)
+			if _, serr := c.Save(context.Background(), i); serr == nil || serr.Error() != err.Error() {
+				t.Errorf("expected Save to fail with %q, got %v", err, serr)
+			}
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+			if fs.requests != 0 {
+				t.Errorf("expected no requests, got %d", fs.requests)
+			}
+		})
+	}
+
+	var nilRequest *SaveRequest
+	if err := nilRequest.Validate(); err == nil {
+		t.Error("expected error for a nil request")
+	}
+}
+
+func TestRestoreRequest_Validate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		modify func(i *RestoreRequest)
+		err    string
+	}{
+		{name: "valid", modify: func(i *RestoreRequest) {}},
+		{name: "missing_bucket", modify: func(i *RestoreRequest) { i.Bucket = "" }, err: "missing bucket"},
+		{name: "fallback_buckets", modify: func(i *RestoreRequest) { i.Bucket, i.Buckets = "", []string{"other"} }},
+		{name: "missing_dir", modify: func(i *RestoreRequest) { i.Dir = "" }, err: "missing directory"},
+		{name: "default_to_cwd", modify: func(i *RestoreRequest) { i.Dir, i.DefaultToCwd = "", true }},
+		{name: "missing_keys", modify: func(i *RestoreRequest) { i.Keys = nil }, err: "expected at least one cache key"},
+		{name: "invalid_key", modify: func(i *RestoreRequest) { i.Keys = []string{"deps", ".."} }, err: "is not a valid object name"},
+		{name: "short_key", modify: func(i *RestoreRequest) { i.MinKeyLength = 5 }, err: "shorter than the minimum of 5 bytes"},
+		{
+			name:   "generation_with_keys",
+			modify: func(i *RestoreRequest) { i.Generation, i.Keys = 1, []string{"deps", "dep"} },
+			err:    "expected exactly one cache key with a generation",
+		},
+		{
+			name:   "clean_and_skip_existing",
+			modify: func(i *RestoreRequest) { i.Clean, i.SkipExisting = true, true },
+			err:    "clean and skip existing are mutually exclusive",
+		},
+		{
+			name:   "clean_and_resume",
+			modify: func(i *RestoreRequest) { i.Clean, i.Resume = true, true },
+			err:    "clean and resume are mutually exclusive",
+		},
+		{
+			name:   "invalid_line_endings",
+			modify: func(i *RestoreRequest) { i.NormalizeLineEndings = []string{"["} },
+			err:    "invalid line ending pattern",
+		},
+		{
+			name:   "unsupported_format",
+			modify: func(i *RestoreRequest) { i.Format = archiver.CompressedArchive{Archival: archiver.Zip{}} },
+			err:    "unsupported archive format",
+		},
+		{
+			name:   "negative_buffer",
+			modify: func(i *RestoreRequest) { i.ReadBufferSize = -1 },
+			err:    "read buffer size must not be negative",
+		},
+		{
+			name:   "invalid_compatible_version",
+			modify: func(i *RestoreRequest) { i.VersionAware, i.VersionCompatibleWith = true, "latest" },
+			err:    "invalid compatible version",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			i := &RestoreRequest{Bucket: "bucket", Keys: []string{"deps"}, Dir: "/workspace/deps"}
+			tc.modify(i)
+
+			err := i.Validate()
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected validation error containing %q, got %v", tc.err, err)
+			}
+
+			// Restore fails the same way, before making any requests
+			c, fs := newTestCacher(t)
+			if _, serr := c.Restore(context.Background(), i); serr == nil || serr.Error() != err.Error() {
+				t.Errorf("expected Restore to fail with %q, got %v", err, serr)
+			}
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+			if fs.requests != 0 {
+				t.Errorf("expected no requests, got %d", fs.requests)
+			}
+		})
+	}
+
+	var nilRequest *RestoreRequest
+	if err := nilRequest.Validate(); err == nil {
+		t.Error("expected error for a nil request")
+	}
+}
+
+func TestCacher_RestoreLayers(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		layers [][]string
+		exp    []string
+		err    func(err error) bool
+	}{
+		{
+			name:   "branch_over_base",
+			layers: [][]string{{"base"}, {"branch"}},
+			exp:    []string{`a.txt -rw-r--r-- "base"`, `b.txt -rw-r--r-- "branch"`, `shared.txt -rw-r--r-- "branch"`},
+		},
+		{
+			name:   "base_over_branch",
+			layers: [][]string{{"branch"}, {"base"}},
+			exp:    []string{`a.txt -rw-r--r-- "base"`, `b.txt -rw-r--r-- "branch"`, `shared.txt -rw-r--r-- "base"`},
+		},
+		{
+			name:   "missing_layer",
+			layers: [][]string{{"base"}, {"missing", "other-"}},
+			exp:    []string{`a.txt -rw-r--r-- "base"`, `shared.txt -rw-r--r-- "base"`},
+		},
+		{
+			name:   "fallback_key",
+			layers: [][]string{{"base"}, {"branch-old", "bran"}},
+			exp:    []string{`a.txt -rw-r--r-- "base"`, `b.txt -rw-r--r-- "branch"`, `shared.txt -rw-r--r-- "branch"`},
+		},
+		{
+			name:   "all_missing",
+			layers: [][]string{{"missing"}, {"other"}},
+			err: func(err error) bool {
+				var nerr *NotFoundError
+				return errors.As(err, &nerr) && reflect.DeepEqual(nerr.Keys, []string{"missing", "other"})
+			},
+		},
+		{
+			name: "no_layers",
+			err: func(err error) bool {
+				var verr *ValidationError
+				return errors.As(err, &verr)
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			fs.put("bucket", "base", testArchive(t, []testEntry{
+				fileEntry("a.txt", "base"),
+				fileEntry("shared.txt", "base"),
+			}), nil)
+			fs.put("bucket", "branch", testArchive(t, []testEntry{
+				fileEntry("b.txt", "branch"),
+				fileEntry("shared.txt", "branch"),
+			}), nil)
+
+			dir := t.TempDir()
+			err := c.RestoreLayers(context.Background(), "bucket", tc.layers, dir)
+			if tc.err != nil {
+				if !tc.err(err) {
+					t.Fatalf("expected a matching error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := listTree(t, dir); !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_resume(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		resume bool
+	}{
+		{name: "resumed", resume: true},
+		{name: "restarted", resume: false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			files := map[string][]byte{
+				"a.bin": randomBytes(512 << 10),
+				"b.bin": randomBytes(512<<10 + 1),
+				"c.bin": randomBytes(512<<10 + 2),
+			}
+			src := testFiles(t, files)
+			mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+			for name := range files {
+				if err := os.Chtimes(filepath.Join(src, name), mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c, fs := newTestCacher(t)
+			if _, err := c.Save(context.Background(), &SaveRequest{Bucket: "bucket", Key: "cache", Dir: src}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Interrupt the first restore with a connection that drops two thirds
+			// of the way through the object
+			full := fs.get("bucket", "cache").data
+			fs.update(t, "bucket", "cache", func(obj *fakeObject) {
+				obj.data = full[:len(full)*2/3]
+			})
+			dst := t.TempDir()
+			req := &RestoreRequest{Bucket: "bucket", Keys: []string{"cache"}, Dir: dst, Resume: true}
+			if _, err := c.Restore(context.Background(), req); err == nil {
+				t.Fatal("expected the interrupted restore to fail")
+			}
+
+			// Replace the completed file with a marker of the same size and time,
+			// which is only kept if the file is skipped
+			completed := filepath.Join(dst, filepath.Base(src), "a.bin")
+			if got, err := ioutil.ReadFile(completed); err != nil || !bytes.Equal(got, files["a.bin"]) {
+				t.Fatalf("expected a.bin to be restored before the interruption, got %d bytes, %v", len(got), err)
+			}
+			marker := bytes.Repeat([]byte("m"), len(files["a.bin"]))
+			if err := ioutil.WriteFile(completed, marker, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(completed, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			fs.update(t, "bucket", "cache", func(obj *fakeObject) {
+				obj.data = full
+			})
+			req.Resume = tc.resume
+			if _, err := c.Restore(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, exp := range files {
+				if name == "a.bin" && tc.resume {
+					exp = marker
+				}
+				got, err := ioutil.ReadFile(filepath.Join(dst, filepath.Base(src), name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, exp) {
+					t.Errorf("%s: expected %d bytes of the expected content, got %d different bytes", name, len(exp), len(got))
+				}
+			}
+		})
+	}
+}
+
+func TestCacher_Save_storeUncompressed(t *testing.T) {
+	t.Parallel()
+
+	stored := randomBytes(300 << 10)
+	text := []byte(strings.Repeat("source text ", 20000))
+
+	cases := []struct {
+		name     string
+		patterns []string
+		file     string
+		verbatim bool
+	}{
+		{name: "precompressed", patterns: PrecompressedPatterns, file: "assets/logo.png", verbatim: true},
+		{name: "custom", patterns: []string{"*.bin", "other"}, file: "deps/blob.bin", verbatim: true},
+		{name: "no_match", patterns: []string{"*.png"}, file: "deps/blob.bin"},
+		{name: "none", file: "assets/logo.png"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			src := testFiles(t, map[string][]byte{
+				tc.file:      stored,
+				"a.txt":      text,
+				"deps/z.txt": text,
+			})
+
+			c, fs := newTestCacher(t)
+			result, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:            "bucket",
+				Key:               "cache",
+				Dir:               src,
+				StoreUncompressed: tc.patterns,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The text is still compressed around the stored file
+			if max := int64(len(stored)) + int64(len(text))/10; result.CompressedSize > max {
+				t.Errorf("expected at most %d compressed bytes, got %d", max, result.CompressedSize)
+			}
+			if tc.verbatim && !bytes.Contains(fs.get("bucket", "cache").data, stored[:maxZstdBlockSize]) {
+				t.Errorf("expected %s to be stored uncompressed", tc.file)
+			}
+
+			name := filepath.Base(src) + "/"
+			assertRestores(t, c, "cache", name+tc.file, stored)
+			assertRestores(t, c, "cache", name+"a.txt", text)
+			assertRestores(t, c, "cache", name+"deps/z.txt", text)
+		})
+	}
+}
+
+func TestValidateKeys(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		keys      []string
+		minLength int
+		err       string
+	}{
+		{name: "valid", keys: []string{"deps-abc", "deps-"}},
+		{name: "unicode", keys: []string{"deps-ü-€"}},
+		{name: "no_keys", keys: nil, err: "expected at least one cache key"},
+		{name: "empty", keys: []string{"deps", ""}, err: "missing key"},
+		{name: "whitespace_only", keys: []string{" \t "}, err: "is only whitespace"},
+		{name: "trailing_whitespace", keys: []string{"deps- "}, err: "leading or trailing whitespace"},
+		{name: "leading_newline", keys: []string{"\ndeps"}, err: "leading or trailing whitespace"},
+		{name: "control_char", keys: []string{"deps\x00abc"}, err: "contains control character U+0000"},
+		{name: "delete_char", keys: []string{"deps\x7fabc"}, err: "contains control character U+007F"},
+		{name: "invalid_utf8", keys: []string{"deps\xffabc"}, err: "is not valid UTF-8"},
+		{name: "dot", keys: []string{"."}, err: "is not a valid object name"},
+		{name: "dot_dot", keys: []string{".."}, err: "is not a valid object name"},
+		{name: "too_long", keys: []string{strings.Repeat("k", maxKeyLength+1)}, err: "longer than 1024 bytes"},
+		{name: "at_max_length", keys: []string{strings.Repeat("k", maxKeyLength)}},
+		{name: "at_min_length", keys: []string{"deps-"}, minLength: 5},
+		{name: "under_min_length", keys: []string{"deps-abc", "go"}, minLength: 5, err: `key "go" is shorter than the minimum of 5 bytes`},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := validateKeys(tc.keys, tc.minLength)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected validation error containing %q, got %v", tc.err, err)
+			}
+
+			// Keys are prefixes, so a bad one must fail before listing anything
+			c, fs := newTestCacher(t)
+			if _, rerr := c.Restore(context.Background(), &RestoreRequest{
+				Bucket:       "bucket",
+				Keys:         tc.keys,
+				Dir:          t.TempDir(),
+				MinKeyLength: tc.minLength,
+			}); rerr == nil || rerr.Error() != err.Error() {
+				t.Errorf("expected restore to fail with %q, got %v", err, rerr)
+			}
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+			if fs.requests != 0 {
+				t.Errorf("expected no requests, got %d", fs.requests)
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_counts(t *testing.T) {
+	t.Parallel()
+
+	// Four entries other than directories, with 7+5 bytes of content
+	entries := []testEntry{
+		dirEntry("deps"),
+		fileEntry("deps/lib.txt", "library"),
+		fileEntry("deps/other.txt", "other"),
+		symlinkEntry("deps/current", "lib.txt"),
+		hardlinkEntry("deps/copy.txt", "deps/lib.txt"),
+	}
+
+	cases := []struct {
+		name   string
+		req    RestoreRequest
+		setup  func(tb testing.TB, dir string)
+		files  int64
+		bytes  int64
+		failed int
+	}{
+		{name: "all", files: 4, bytes: 12},
+		{
+			name:  "filtered",
+			req:   RestoreRequest{FileFilter: func(f archiver.File) (bool, error) { return f.NameInArchive == "deps/other.txt", nil }},
+			files: 3,
+			bytes: 7,
+		},
+		{
+			name: "skip_existing",
+			req:  RestoreRequest{SkipExisting: true},
+			setup: func(tb testing.TB, dir string) {
+				if err := os.MkdirAll(filepath.Join(dir, "deps"), 0755); err != nil {
+					tb.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, "deps", "other.txt"), []byte("local"), 0644); err != nil {
+					tb.Fatal(err)
+				}
+			},
+			files: 3,
+			bytes: 7,
+		},
+		{
+			name: "continue_on_error",
+			req:  RestoreRequest{ContinueOnError: true},
+			setup: func(tb testing.TB, dir string) {
+				// A directory where the archive has a file cannot be replaced
+				if err := os.MkdirAll(filepath.Join(dir, "deps", "other.txt", "sub"), 0755); err != nil {
+					tb.Fatal(err)
+				}
+			},
+			files:  3,
+			bytes:  7,
+			failed: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			fs.put("bucket", "cache", testArchive(t, entries), nil)
+
+			dir := t.TempDir()
+			if tc.setup != nil {
+				tc.setup(t, dir)
+			}
+
+			req := tc.req
+			req.Bucket, req.Keys, req.Dir = "bucket", []string{"cache"}, dir
+			result, err := c.Restore(context.Background(), &req)
+			if (err != nil) != (tc.failed > 0) {
+				t.Fatalf("expected error %t, got %v", tc.failed > 0, err)
+			}
+
+			if len(result.FailedFiles) != tc.failed {
+				t.Errorf("expected %d failed files, got %v", tc.failed, result.FailedFiles)
+			}
+			if result.FilesRestored != tc.files {
+				t.Errorf("expected %d files restored, got %d", tc.files, result.FilesRestored)
+			}
+			if result.BytesRestored != tc.bytes {
+				t.Errorf("expected %d bytes restored, got %d", tc.bytes, result.BytesRestored)
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_globalHeader(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		records map[string]string
+		err     string
+	}{
+		{name: "unchanged"},
+		{name: "older_schema", records: map[string]string{paxSchemaKey: "0"}},
+		{
+			name:    "newer_schema",
+			records: map[string]string{paxSchemaKey: strconv.Itoa(archiveSchema + 1)},
+			err:     "a newer version is required",
+		},
+		{name: "invalid_schema", records: map[string]string{paxSchemaKey: "v2"}, err: `invalid schema "v2"`},
+		{name: "unknown_format", records: map[string]string{paxFormatKey: "zip"}, err: `format "zip"`},
+		{
+			// Like the global header git writes, with none of the records
+			name:    "foreign",
+			records: map[string]string{paxSchemaKey: "", paxFormatKey: "", paxCompressionKey: "", "comment": "0123abcd"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"lib.txt": []byte("library")})
+			if _, err := c.Save(context.Background(), &SaveRequest{Bucket: "bucket", Key: "cache", Dir: src}); err != nil {
+				t.Fatal(err)
+			}
+
+			hdr := archiveHeaders(t, fs, "cache")[0]
+			if hdr.Typeflag != tar.TypeXGlobalHeader {
+				t.Fatalf("expected a global header first, got %q", hdr.Typeflag)
+			}
+			exp := map[string]string{
+				paxSchemaKey:      strconv.Itoa(archiveSchema),
+				paxFormatKey:      archiveFormat,
+				paxCompressionKey: "zst",
+			}
+			if !reflect.DeepEqual(hdr.PAXRecords, exp) {
+				t.Errorf("expected records %v, got %v", exp, hdr.PAXRecords)
+			}
+
+			rewriteArchive(t, fs, "cache", func(hdr *tar.Header, content []byte) []byte {
+				if hdr.Typeflag == tar.TypeXGlobalHeader {
+					for k, v := range tc.records {
+						if v == "" {
+							delete(hdr.PAXRecords, k)
+							continue
+						}
+						hdr.PAXRecords[k] = v
+					}
+				}
+				return content
+			})
+
+			dir := t.TempDir()
+			_, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket: "bucket",
+				Keys:   []string{"cache"},
+				Dir:    dir,
+			})
+			if tc.err != "" {
+				if !errors.Is(err, ErrUnsupportedArchive) || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected unsupported archive error containing %q, got %v", tc.err, err)
+				}
+				if got := listTree(t, dir); len(got) != 0 {
+					t.Errorf("expected nothing to be extracted, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertRestores(t, c, "cache", filepath.Base(src)+"/lib.txt", []byte("library"))
+		})
+	}
+}
+
+func TestCacher_Save_basePath(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		base  string
+		dirs  bool
+		strip int
+		exp   []string
+		err   bool
+	}{
+		{name: "flattened", exp: []string{"build/", "build/out.txt"}},
+		{name: "prefixed", base: "src", exp: []string{"app/", "app/build/", "app/build/out.txt"}},
+		{name: "nested_base", base: "src/app", exp: []string{"build/", "build/out.txt"}},
+		{name: "prefixed_stripped", base: "src", strip: 1, exp: []string{"build/", "build/out.txt"}},
+		{name: "stripped_to_files", base: "src", strip: 2, exp: []string{"out.txt"}},
+		{name: "explicit_name", base: "src", dirs: true, exp: []string{"artifacts/", "artifacts/out.txt"}},
+		{name: "base_is_dir", base: "src/app/build", err: true},
+		{name: "outside_base", base: "other", err: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			root := testFiles(t, map[string][]byte{
+				"src/app/build/out.txt": []byte("output"),
+				"other/x":               []byte("x"),
+			})
+			build := filepath.Join(root, "src", "app", "build")
+
+			save := &SaveRequest{Bucket: "bucket", Key: "cache", Dir: build}
+			if tc.base != "" {
+				save.BasePath = filepath.Join(root, filepath.FromSlash(tc.base))
+			}
+			if tc.dirs {
+				save.Dir, save.Dirs = "", map[string]string{build: "artifacts"}
+			}
+
+			c, _ := newTestCacher(t)
+			_, err := c.Save(context.Background(), save)
+			if tc.err {
+				var verr *ValidationError
+				if !errors.As(err, &verr) {
+					t.Fatalf("expected validation error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dst := t.TempDir()
+			if _, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket:          "bucket",
+				Keys:            []string{"cache"},
+				Dir:             dst,
+				StripComponents: tc.strip,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, line := range listTree(t, dst) {
+				got = append(got, strings.Fields(line)[0])
+			}
+			if !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestCacher_Save_deterministic(t *testing.T) {
+	t.Parallel()
+
+	files := map[string][]byte{
+		"lib.txt":         []byte("library"),
+		"vendor/a/dep.go": []byte("package a"),
+		"vendor/b/dep.go": []byte("package b"),
+	}
+
+	cases := []struct {
+		name          string
+		deterministic bool
+		change        func(tb testing.TB, src string) string
+		identical     bool
+	}{
+		{
+			name:          "touched",
+			deterministic: true,
+			change: func(tb testing.TB, src string) string {
+				later := time.Now().Add(time.Hour)
+				for name := range files {
+					if err := os.Chtimes(filepath.Join(src, filepath.FromSlash(name)), later, later); err != nil {
+						tb.Fatal(err)
+					}
+				}
+				return src
+			},
+			identical: true,
+		},
+		{
+			name:          "fresh_checkout",
+			deterministic: true,
+			change: func(tb testing.TB, src string) string {
+				return testFiles(tb, files)
+			},
+			identical: true,
+		},
+		{
+			name:          "changed_content",
+			deterministic: true,
+			change: func(tb testing.TB, src string) string {
+				if err := ioutil.WriteFile(filepath.Join(src, "lib.txt"), []byte("LIBRARY"), 0644); err != nil {
+					tb.Fatal(err)
+				}
+				return src
+			},
+		},
+		{
+			name: "not_deterministic",
+			change: func(tb testing.TB, src string) string {
+				later := time.Now().Add(time.Hour)
+				if err := os.Chtimes(filepath.Join(src, "lib.txt"), later, later); err != nil {
+					tb.Fatal(err)
+				}
+				return src
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			save := func(key, src string) *fakeObject {
+				if _, err := c.Save(context.Background(), &SaveRequest{
+					Bucket:          "bucket",
+					Key:             key,
+					Dirs:            map[string]string{src: "deps"},
+					Deterministic:   tc.deterministic,
+					WalkConcurrency: 4,
+				}); err != nil {
+					t.Fatal(err)
+				}
+				return fs.get("bucket", key)
+			}
+
+			src := testFiles(t, files)
+			first := save("first", src)
+			second := save("second", tc.change(t, src))
+
+			if got := bytes.Equal(first.data, second.data); got != tc.identical {
+				t.Errorf("expected identical archives %t, got %t", tc.identical, got)
+			}
+			if got := first.MD5Hash == second.MD5Hash; got != tc.identical {
+				t.Errorf("expected identical MD5 %t, got %s and %s", tc.identical, first.MD5Hash, second.MD5Hash)
+			}
+
+			if !tc.deterministic {
+				return
+			}
+			for _, hdr := range archiveHeaders(t, fs, "second") {
+				if hdr.Typeflag == tar.TypeXGlobalHeader {
+					continue
+				}
+				if !hdr.ModTime.Equal(time.Unix(0, 0)) || !hdr.AccessTime.IsZero() || hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Gname != "" {
+					t.Errorf("%s: expected normalized times and ownership, got %+v", hdr.Name, hdr)
+				}
+			}
+		})
+	}
+}
+
+func TestCacher_Download(t *testing.T) {
+	t.Parallel()
+
+	errWrite := errors.New("disk full")
+
+	cases := []struct {
+		name    string
+		shard   int64
+		key     string
+		corrupt bool
+		w       func() io.Writer
+		err     func(err error) bool
+	}{
+		{name: "single", key: "cache"},
+		{name: "sharded", shard: 1000, key: "cache"},
+		{
+			name: "prefix",
+			key:  "cach",
+			err: func(err error) bool {
+				var nerr *NotFoundError
+				return errors.As(err, &nerr) && reflect.DeepEqual(nerr.Keys, []string{"cach"})
+			},
+		},
+		{
+			name: "missing",
+			key:  "other",
+			err: func(err error) bool {
+				var nerr *NotFoundError
+				return errors.As(err, &nerr) && reflect.DeepEqual(nerr.Keys, []string{"other"})
+			},
+		},
+		{
+			name:    "corrupted",
+			key:     "cache",
+			corrupt: true,
+			err: func(err error) bool {
+				return err != nil && strings.Contains(err.Error(), "failed to verify cache")
+			},
+		},
+		{
+			name: "write_fails",
+			key:  "cache",
+			w:    func() io.Writer { return &failingWriter{n: 100, err: errWrite} },
+			err:  func(err error) bool { return errors.Is(err, errWrite) },
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"data": randomBytes(3000)})
+			if _, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:    "bucket",
+				Key:       "cache",
+				Dir:       src,
+				ShardSize: tc.shard,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// The archive is the object, or the concatenation of the parts
+			var exp []byte
+			for _, name := range fs.names("bucket") {
+				if obj := fs.get("bucket", name); tc.shard == 0 || name != "cache" {
+					exp = append(exp, obj.data...)
+				}
+			}
+			if tc.corrupt {
+				fs.update(t, "bucket", "cache", func(obj *fakeObject) {
+					obj.data = append([]byte(nil), obj.data...)
+					obj.data[len(obj.data)/2] ^= 0xff
+				})
+			}
+
+			var buf bytes.Buffer
+			var w io.Writer = &buf
+			if tc.w != nil {
+				w = tc.w()
+			}
+			n, err := c.Download(context.Background(), "bucket", tc.key, w)
+			if tc.err != nil {
+				if !tc.err(err) {
+					t.Fatalf("expected a matching error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != int64(len(exp)) {
+				t.Errorf("expected %d bytes, got %d", len(exp), n)
+			}
+			if !bytes.Equal(buf.Bytes(), exp) {
+				t.Errorf("expected the uploaded bytes, got %d different bytes", buf.Len())
+			}
+		})
+	}
+}
+
+func TestCacher_Upload(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		archive     func(tb testing.TB, c *Cacher, fs *fakeStorage) []byte
+		existing    bool
+		contentType string
+	}{
+		{
+			name: "downloaded",
+			archive: func(tb testing.TB, c *Cacher, fs *fakeStorage) []byte {
+				src := testFiles(tb, map[string][]byte{"lib.txt": []byte("library")})
+				if _, err := c.Save(context.Background(), &SaveRequest{Bucket: "bucket", Key: "old", Dirs: map[string]string{src: "deps"}}); err != nil {
+					tb.Fatal(err)
+				}
+				var buf bytes.Buffer
+				if _, err := c.Download(context.Background(), "bucket", "old", &buf); err != nil {
+					tb.Fatal(err)
+				}
+				return buf.Bytes()
+			},
+			contentType: contentType,
+		},
+		{
+			name: "gzip",
+			archive: func(tb testing.TB, c *Cacher, fs *fakeStorage) []byte {
+				return testArchive(tb, []testEntry{dirEntry("deps"), fileEntry("deps/lib.txt", "library")})
+			},
+			contentType: "application/gzip",
+		},
+		{
+			name: "existing",
+			archive: func(tb testing.TB, c *Cacher, fs *fakeStorage) []byte {
+				fs.put("bucket", "cache", testArchive(tb, []testEntry{fileEntry("deps/lib.txt", "library")}), nil)
+				return testArchive(tb, []testEntry{fileEntry("deps/lib.txt", "replaced")})
+			},
+			existing: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			archive := tc.archive(t, c, fs)
+
+			n, err := c.Upload(context.Background(), "bucket", "cache", bytes.NewReader(archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			obj := fs.get("bucket", "cache")
+			if tc.existing {
+				if n != 0 {
+					t.Errorf("expected nothing to be uploaded over an existing object, got %d bytes", n)
+				}
+				if bytes.Equal(obj.data, archive) {
+					t.Error("expected the existing object to be kept")
+				}
+				assertRestores(t, c, "cache", "deps/lib.txt", []byte("library"))
+				return
+			}
+
+			if n != int64(len(archive)) {
+				t.Errorf("expected %d bytes uploaded, got %d", len(archive), n)
+			}
+			if !bytes.Equal(obj.data, archive) {
+				t.Error("expected the bytes to be stored as is")
+			}
+			if obj.ContentType != tc.contentType {
+				t.Errorf("expected content type %q, got %q", tc.contentType, obj.ContentType)
+			}
+			assertRestores(t, c, "cache", "deps/lib.txt", []byte("library"))
+		})
+	}
+}
+
+func TestCacher_Restore_windowsSymlinkMode(t *testing.T) {
+	entries := []testEntry{
+		symlinkEntry("early", "lib.txt"),
+		fileEntry("lib.txt", "library"),
+		symlinkEntry("chain", "early"),
+		dirEntry("vendor"),
+		fileEntry("vendor/dep.txt", "dependency"),
+		symlinkEntry("dirlink", "vendor"),
+		symlinkEntry("outside", "../secret"),
+	}
+	files := []string{
+		`lib.txt -rw-r--r-- "library"`,
+		`vendor/ -rwxr-xr-x`,
+		`vendor/dep.txt -rw-r--r-- "dependency"`,
+	}
+
+	cases := []struct {
+		name string
+		mode WindowsSymlinkMode
+		exp  []string
+		err  bool
+	}{
+		{name: "error", mode: WindowsSymlinkError, err: true},
+		{name: "skip", mode: WindowsSymlinkSkip, exp: files},
+		{
+			name: "copy",
+			mode: WindowsSymlinkCopy,
+			exp: []string{
+				`chain -rw-r--r-- "library"`,
+				`early -rw-r--r-- "library"`,
+				`lib.txt -rw-r--r-- "library"`,
+				`vendor/ -rwxr-xr-x`,
+				`vendor/dep.txt -rw-r--r-- "dependency"`,
+			},
+		},
+	}
+
+	// Creating links fails like it does without the privilege on Windows. The
+	// function is global, so these cases cannot run in parallel.
+	orig := symlink
+	symlink = func(oldname, newname string) error {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: errorPrivilegeNotHeld}
+	}
+	t.Cleanup(func() { symlink = orig })
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			c, fs := newTestCacher(t)
+			fs.put("bucket", "cache", testArchive(t, entries), nil)
+
+			dir := t.TempDir()
+			_, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket:             "bucket",
+				Keys:               []string{"cache"},
+				Dir:                dir,
+				WindowsSymlinkMode: tc.mode,
+			})
+			if tc.err {
+				if err == nil || !strings.Contains(err.Error(), "making symbolic link") {
+					t.Fatalf("expected symbolic link error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := listTree(t, dir); !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestContentAddressedKey(t *testing.T) {
+	t.Parallel()
+
+	digest := "3f9a0c5e1b7d24f86a0e9c3b5d7f1a2c"
+
+	cases := []struct {
+		name   string
+		prefix string
+		digest string
+		exp    string
+	}{
+		{name: "prefix", prefix: "go-", digest: digest, exp: "go-cas/3f/" + digest},
+		{name: "directory_prefix", prefix: "deps/", digest: digest, exp: "deps/cas/3f/" + digest},
+		{name: "no_prefix", digest: digest, exp: "cas/3f/" + digest},
+		{name: "upper_case", prefix: "go-", digest: strings.ToUpper(digest), exp: "go-cas/3f/" + digest},
+		{name: "short", prefix: "go-", digest: "a", exp: "go-cas/a"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := ContentAddressedKey(tc.prefix, tc.digest); got != tc.exp {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+			if again := ContentAddressedKey(tc.prefix, tc.digest); again != tc.exp {
+				t.Errorf("expected the same key again, got %q", again)
+			}
+		})
+	}
+
+	// Digests which differ anywhere, including past the directory, get
+	// different keys under the same prefix
+	seen := make(map[string]string)
+	for _, d := range []string{digest, "3f9a0c5e1b7d24f86a0e9c3b5d7f1a2d", "4f9a0c5e1b7d24f86a0e9c3b5d7f1a2c", "3f"} {
+		key := ContentAddressedKey("go-", d)
+		if other, ok := seen[key]; ok {
+			t.Errorf("expected %s and %s to get different keys, both got %s", other, d, key)
+		}
+		seen[key] = d
+	}
+}
+
+func TestCacher_Save_contentAddressed(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		// casHash is the content hash recorded on the object at the
+		// content-addressed key, where empty uses the hash of the files
+		casHash string
+		// listed also saves the files under a timestamped key in the prefix
+		listed bool
+		exp    string
+		err    bool
+	}{
+		{name: "found_without_listing", exp: "cas"},
+		{name: "other_content_at_key", casHash: "0000", listed: true, exp: "ci-1"},
+		{name: "other_content_needs_listing", casHash: "0000", err: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"lib.txt": []byte("library")})
+			save := func(key string) (SaveResult, error) {
+				return c.Save(context.Background(), &SaveRequest{
+					Bucket:       "bucket",
+					Key:          key,
+					Dir:          src,
+					DedupePrefix: "ci-",
+				})
+			}
+
+			// The probe is outside the prefix, and only records the hash
+			if _, err := save("probe"); err != nil {
+				t.Fatal(err)
+			}
+			probe := fs.get("bucket", "probe")
+			hash := probe.Metadata[metadataContentHash]
+			casKey := ContentAddressedKey("ci-", hash)
+
+			cas := *probe
+			cas.Metadata = map[string]string{metadataContentHash: hash}
+			if tc.casHash != "" {
+				cas.Metadata[metadataContentHash] = tc.casHash
+			}
+			fs.put("bucket", casKey, probe.data, &cas)
+			if tc.listed {
+				if _, err := save("ci-1"); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				// Listing the prefix fails, so the key must be found directly
+				fs.setFailures(http.MethodGet, "/storage/v1/b/bucket/o", 100, http.StatusForbidden)
+			}
+
+			result, err := save("ci-2")
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+			if tc.err {
+				if !strings.Contains(err.Error(), "failed to list ci-") {
+					t.Errorf("expected the prefix to be listed, got %v", err)
+				}
+				return
+			}
+
+			exp := tc.exp
+			if exp == "cas" {
+				exp = casKey
+			}
+			if result.CopiedFrom != exp {
+				t.Errorf("expected copy from %q, got %q", exp, result.CopiedFrom)
+			}
+		})
+	}
+}
+
+func TestCacher_Save_maxFileSize(t *testing.T) {
+	t.Parallel()
+
+	files := map[string][]byte{
+		"small":        []byte("small"),
+		"exact":        []byte("0123456789"),
+		"core":         []byte("0123456789!"),
+		"dir/small":    []byte("nested"),
+		"dir/video":    bytes.Repeat([]byte("v"), 100),
+		"fixtures/big": bytes.Repeat([]byte("b"), 100),
+	}
+
+	cases := []struct {
+		name string
+		max  int64
+		exp  []string
+		size int64
+	}{
+		{
+			name: "no_limit",
+			exp: []string{
+				`core -rw-r--r-- "0123456789!"`,
+				`dir/ -rwxr-xr-x`,
+				`dir/small -rw-r--r-- "nested"`,
+				`dir/video -rw-r--r-- "` + strings.Repeat("v", 100) + `"`,
+				`exact -rw-r--r-- "0123456789"`,
+				`fixtures/ -rwxr-xr-x`,
+				`fixtures/big -rw-r--r-- "` + strings.Repeat("b", 100) + `"`,
+				`small -rw-r--r-- "small"`,
+			},
+			size: 232,
+		},
+		{
+			// The directory of a skipped file is kept, even when it ends up
+			// empty
+			name: "limit",
+			max:  10,
+			exp: []string{
+				`dir/ -rwxr-xr-x`,
+				`dir/small -rw-r--r-- "nested"`,
+				`exact -rw-r--r-- "0123456789"`,
+				`fixtures/ -rwxr-xr-x`,
+				`small -rw-r--r-- "small"`,
+			},
+			size: 21,
+		},
+		{
+			name: "above_every_file",
+			max:  100,
+			exp: []string{
+				`core -rw-r--r-- "0123456789!"`,
+				`dir/ -rwxr-xr-x`,
+				`dir/small -rw-r--r-- "nested"`,
+				`dir/video -rw-r--r-- "` + strings.Repeat("v", 100) + `"`,
+				`exact -rw-r--r-- "0123456789"`,
+				`fixtures/ -rwxr-xr-x`,
+				`fixtures/big -rw-r--r-- "` + strings.Repeat("b", 100) + `"`,
+				`small -rw-r--r-- "small"`,
+			},
+			size: 232,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			src := testFiles(t, files)
+
+			result, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:      "bucket",
+				Key:         "cache",
+				Dir:         src + string(filepath.Separator),
+				MaxFileSize: tc.max,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.UncompressedSize != tc.size {
+				t.Errorf("expected %d bytes archived, got %d", tc.size, result.UncompressedSize)
+			}
+
+			dst := t.TempDir()
+			if _, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket: "bucket",
+				Keys:   []string{"cache"},
+				Dir:    dst,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if got := listTree(t, dst); !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestCacher_Save_resolveRoot(t *testing.T) {
+	t.Parallel()
+
+	realDir := testFiles(t, map[string][]byte{"data": []byte("content"), "sub/file": []byte("nested")})
+	if err := os.Symlink("../data", filepath.Join(realDir, "sub", "link")); err != nil {
+		t.Skipf("cannot make symbolic links: %s", err)
+	}
+	links := t.TempDir()
+	link, chain := filepath.Join(links, "link"), filepath.Join(links, "chain")
+	if err := os.Symlink(realDir, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(link, chain); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := func() time.Time { return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) }
+	save := func(tb testing.TB, dir string, resolve bool) (*fakeStorage, []string) {
+		tb.Helper()
+
+		c, fs := newTestCacher(tb, WithClock(clock))
+		if _, err := c.Save(context.Background(), &SaveRequest{
+			Bucket:        "bucket",
+			Key:           "cache",
+			Dirs:          map[string]string{dir: "workspace"},
+			ResolveRoot:   resolve,
+			Deterministic: true,
+		}); err != nil {
+			tb.Fatal(err)
+		}
+
+		var names []string
+		for _, hdr := range archiveHeaders(tb, fs, "cache") {
+			name := hdr.Name
+			if hdr.Linkname != "" {
+				name += " -> " + hdr.Linkname
+			}
+			names = append(names, name)
+		}
+		return fs, names
+	}
+	realFS, realNames := save(t, realDir, false)
+
+	cases := []struct {
+		name    string
+		dir     string
+		resolve bool
+		same    bool
+	}{
+		{name: "real", dir: realDir, resolve: true, same: true},
+		{name: "link", dir: link, resolve: true, same: true},
+		{name: "chain", dir: chain, resolve: true, same: true},
+		{name: "link_unresolved", dir: link, resolve: false, same: false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			fs, names := save(t, tc.dir, tc.resolve)
+			same := bytes.Equal(fs.get("bucket", "cache").data, realFS.get("bucket", "cache").data)
+			if same != tc.same {
+				t.Errorf("expected the archive to match the real directory: %t, got %q and %q", tc.same, names, realNames)
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_resolveRoot(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		// link makes the restore directory a link to a real directory
+		link bool
+	}{
+		{name: "link", link: true},
+		{name: "missing", link: false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"data": []byte("content")})
+			if err := os.Symlink("data", filepath.Join(src, "alias")); err != nil {
+				t.Skipf("cannot make symbolic links: %s", err)
+			}
+
+			parent := t.TempDir()
+			dir, realDir := filepath.Join(parent, "workspace"), filepath.Join(parent, "real")
+			if tc.link {
+				if err := os.Mkdir(realDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(realDir, dir); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				realDir = dir
+			}
+
+			if _, err := roundTrip(t, c, src,
+				SaveRequest{Dir: src + string(filepath.Separator)},
+				RestoreRequest{Dir: dir, ResolveRoot: true, Clean: true},
+			); err != nil {
+				t.Fatal(err)
+			}
+
+			// The files are restored into the real directory, and a link to it
+			// is kept
+			exp := []string{`alias -> data`, `data -rw-r--r-- "content"`}
+			if got := listTree(t, realDir); !reflect.DeepEqual(got, exp) {
+				t.Errorf("expected %q, got %q", exp, got)
+			}
+			fi, err := os.Lstat(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isLink := fi.Mode()&os.ModeSymlink != 0; isLink != tc.link {
+				t.Errorf("expected %s to be a link: %t, got %s", dir, tc.link, fi.Mode())
+			}
+		})
+	}
+}
+
+func TestCacher_Format(t *testing.T) {
+	t.Parallel()
+
+	gz := archiver.CompressedArchive{Compression: archiver.Gz{}}
+	bz2 := archiver.CompressedArchive{Compression: archiver.Bz2{}}
+
+	cases := []struct {
+		name        string
+		save        SaveRequest
+		restore     archiver.CompressedArchive
+		contentType string
+		magic       []byte
+		err         bool
+	}{
+		{
+			name:        "default",
+			contentType: contentType,
+			magic:       []byte{0x28, 0xb5, 0x2f, 0xfd},
+		},
+		{
+			name:        "gzip",
+			save:        SaveRequest{Format: gz},
+			contentType: "application/gzip",
+			magic:       gzipMagic,
+		},
+		{
+			name:        "gzip_restored_with_format",
+			save:        SaveRequest{Format: gz},
+			restore:     gz,
+			contentType: "application/gzip",
+			magic:       gzipMagic,
+		},
+		{
+			// The manifest has its own content type, so gzip is detected by
+			// the leading bytes of the first part
+			name:        "gzip_sharded",
+			save:        SaveRequest{Format: gz, ShardSize: 1000},
+			contentType: manifestContentType,
+			magic:       gzipMagic,
+		},
+		{
+			name:        "gzip_composed",
+			save:        SaveRequest{Format: gz, ComposeSize: 1000},
+			contentType: "application/gzip",
+			magic:       gzipMagic,
+		},
+		{
+			name:        "custom_restored_with_format",
+			save:        SaveRequest{Format: bz2},
+			restore:     bz2,
+			contentType: contentType,
+			magic:       []byte("BZh"),
+		},
+		{
+			// Only gzip is detected, everything else is assumed to be zstd
+			name:        "custom_not_detected",
+			save:        SaveRequest{Format: bz2},
+			contentType: contentType,
+			magic:       []byte("BZh"),
+			err:         true,
+		},
+		{
+			name:        "wrong_format",
+			restore:     gz,
+			contentType: contentType,
+			magic:       []byte{0x28, 0xb5, 0x2f, 0xfd},
+			err:         true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			content := randomBytes(5000)
+			src := testFiles(t, map[string][]byte{"data": content})
+
+			dst := t.TempDir()
+			_, err := roundTrip(t, c, src,
+				tc.save,
+				RestoreRequest{Dir: dst, Format: tc.restore},
+			)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+
+			if got := fs.get("bucket", "cache").ContentType; got != tc.contentType {
+				t.Errorf("expected content type %q, got %q", tc.contentType, got)
+			}
+			var buf bytes.Buffer
+			if _, err := c.Download(context.Background(), "bucket", "cache", &buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(buf.Bytes(), tc.magic) {
+				t.Errorf("expected the archive to start with %x, got %x", tc.magic, buf.Bytes()[:len(tc.magic)])
+			}
+			if tc.err {
+				return
+			}
+
+			got, err := ioutil.ReadFile(filepath.Join(dst, filepath.Base(src), "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("expected %d bytes of content, got %d bytes", len(content), len(got))
+			}
+		})
+	}
+}
+
+func TestCacher_Restore_maxFiles(t *testing.T) {
+	t.Parallel()
+
+	files := map[string][]byte{
+		"a":       []byte("a"),
+		"b":       []byte("b"),
+		"dir/c":   []byte("c"),
+		"dir/d":   []byte("d"),
+		"dir/e/f": []byte("f"),
+	}
+
+	cases := []struct {
+		name string
+		// max is relative to the number of entries in the archive, where
+		// zero means no limit
+		max     int
+		noLimit bool
+		restore RestoreRequest
+		// existing are restored beforehand, and skipped by SkipExisting
+		existing bool
+		err      bool
+	}{
+		{name: "no_limit", noLimit: true},
+		{name: "at_limit", max: 0},
+		{name: "one_over", max: -1, err: true},
+		{name: "far_over", max: -6, err: true},
+		{name: "workers", max: -1, restore: RestoreRequest{ExtractWorkers: 4}, err: true},
+		{name: "continue_on_error", max: -1, restore: RestoreRequest{ContinueOnError: true}, err: true},
+		{
+			// Files already on disk are not extracted, so they do not count
+			name:     "skip_existing",
+			max:      -5,
+			restore:  RestoreRequest{SkipExisting: true},
+			existing: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			src := testFiles(t, files)
+			if _, err := c.Save(context.Background(), &SaveRequest{
+				Bucket: "bucket",
+				Key:    "cache",
+				Dir:    src + string(filepath.Separator),
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, hdr := range archiveHeaders(t, fs, "cache") {
+				if hdr.Typeflag != tar.TypeXGlobalHeader {
+					names = append(names, hdr.Name)
+				}
+			}
+			entries := len(names)
+
+			dst := t.TempDir()
+			if tc.existing {
+				if _, err := c.Restore(context.Background(), &RestoreRequest{
+					Bucket: "bucket",
+					Keys:   []string{"cache"},
+					Dir:    dst,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			i := tc.restore
+			i.Bucket, i.Keys, i.Dir = "bucket", []string{"cache"}, dst
+			if !tc.noLimit {
+				i.MaxFiles = entries + tc.max
+			}
+			_, err := c.Restore(context.Background(), &i)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+
+			got := listTree(t, dst)
+			if !tc.err {
+				if len(got) != entries {
+					t.Errorf("expected %d entries to be restored, got %q", entries, got)
+				}
+				return
+			}
+
+			// The extraction stops at the first entry over the limit, and
+			// removes the files it created
+			if !errors.Is(err, ErrMaxFilesExceeded) {
+				t.Fatalf("expected %v, got %v", ErrMaxFilesExceeded, err)
+			}
+			exp := fmt.Sprintf("failed to extract archive: handling file: %s: %s: archive has more than %d entries",
+				strings.TrimSuffix(names[i.MaxFiles], "/"), ErrMaxFilesExceeded, i.MaxFiles)
+			if err.Error() != exp {
+				t.Errorf("expected %q, got %q", exp, err)
+			}
+			for _, line := range got {
+				if !strings.HasSuffix(line, "/ -rwxr-xr-x") {
+					t.Errorf("expected only directories to be left, got %s", line)
+				}
+			}
+		})
+	}
+}
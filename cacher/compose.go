@@ -0,0 +1,79 @@
+package cacher
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+)
+
+// maxComposeComponents is the largest number of source objects a single
+// compose request accepts.
+const maxComposeComponents = 32
+
+// compose finalizes the remaining parts and composes them, in order, into obj,
+// which then reads like any other object. Since a compose request takes at most
+// 32 sources, larger sets are first composed in rounds into intermediate
+// objects. The parts and intermediate objects are deleted afterwards.
+func (s *shardWriter) compose(ctx context.Context, obj *storage.ObjectHandle) error {
+	if s.cur != nil {
+		s.closePart()
+	}
+	s.wg.Wait()
+	defer s.deleteParts()
+
+	if err := s.error(); err != nil {
+		return err
+	}
+
+	c := s.c
+	sources := make([]*storage.ObjectHandle, len(s.parts))
+	for idx, part := range s.parts {
+		sources[idx] = s.bucket.Object(part.Name).Generation(part.Generation)
+	}
+
+	var intermediates []manifestPart
+	defer func() {
+		s.deleteObjects(intermediates)
+	}()
+
+	for round := 0; len(sources) > maxComposeComponents; round++ {
+		var next []*storage.ObjectHandle
+		for start := 0; start < len(sources); start += maxComposeComponents {
+			end := start + maxComposeComponents
+			if end > len(sources) {
+				end = len(sources)
+			}
+
+			name := fmt.Sprintf("%s.%s.compose%02d-%04d", s.key, s.id, round, len(next))
+			c.log("composing %d objects into %s", end-start, name)
+
+			composer := s.bucket.Object(name).If(storage.Conditions{DoesNotExist: true}).ComposerFrom(sources[start:end]...)
+			composer.ContentType = contentType
+			composer.Metadata = map[string]string{
+				metadataShardOf: s.key,
+			}
+			attrs, err := composer.Run(ctx)
+			if err != nil {
+				return &StorageError{Msg: "failed to compose " + name, Err: err}
+			}
+
+			intermediates = append(intermediates, manifestPart{Name: name, Generation: attrs.Generation})
+			next = append(next, s.bucket.Object(name).Generation(attrs.Generation))
+		}
+		sources = next
+	}
+
+	c.log("composing %d objects into %s", len(sources), obj.ObjectName())
+	composer := obj.ComposerFrom(sources...)
+	composer.ContentType = s.attrs.ContentType
+	composer.CacheControl = s.attrs.CacheControl
+	composer.CustomTime = s.attrs.CustomTime
+	composer.PredefinedACL = s.attrs.PredefinedACL
+	composer.EventBasedHold = s.attrs.EventBasedHold
+	composer.Metadata = s.attrs.Metadata
+	if _, err := composer.Run(ctx); err != nil {
+		return &StorageError{Msg: "failed to compose " + obj.ObjectName(), Err: err}
+	}
+	return nil
+}
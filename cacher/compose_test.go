@@ -0,0 +1,170 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// composeRecorder records the destination and number of sources of each
+// compose request before passing it on. The failAt-th compose request, counting
+// from one, fails instead.
+type composeRecorder struct {
+	mu      sync.Mutex
+	dsts    []string
+	sources []int
+	inserts int
+	failAt  int
+	next    http.Handler
+}
+
+func (cr *composeRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/") {
+		cr.mu.Lock()
+		cr.inserts++
+		cr.mu.Unlock()
+	}
+
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/compose") {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var req struct {
+			SourceObjects []json.RawMessage `json:"sourceObjects"`
+		}
+		json.Unmarshal(body, &req)
+
+		cr.mu.Lock()
+		cr.dsts = append(cr.dsts, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"), "/compose"))
+		cr.sources = append(cr.sources, len(req.SourceObjects))
+		fail := len(cr.dsts) == cr.failAt
+		cr.mu.Unlock()
+		if fail {
+			writeError(w, http.StatusServiceUnavailable, "injected failure")
+			return
+		}
+	}
+	cr.next.ServeHTTP(w, r)
+}
+
+// composeRounds returns the number of sources of each compose request needed to
+// compose parts objects, in order.
+func composeRounds(parts int) []int {
+	var sources []int
+	for parts > maxComposeComponents {
+		next := 0
+		for ; parts > 0; parts -= maxComposeComponents {
+			n := parts
+			if n > maxComposeComponents {
+				n = maxComposeComponents
+			}
+			sources = append(sources, n)
+			next++
+		}
+		parts = next
+	}
+	return append(sources, parts)
+}
+
+func TestCacher_Save_composeRounds(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		size        int
+		composeSize int64
+		failAt      int
+	}{
+		{name: "single_request", size: 20 << 10, composeSize: 1 << 10},
+		{name: "one_round", size: 40 << 10, composeSize: 1 << 10},
+		{name: "two_rounds", size: 104 << 10, composeSize: 100},
+		{name: "intermediate_fails", size: 40 << 10, composeSize: 1 << 10, failAt: 2},
+		{name: "final_fails", size: 40 << 10, composeSize: 1 << 10, failAt: 3},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cr := &composeRecorder{failAt: tc.failAt}
+			fs, srv := newTestServer(t, func(h http.Handler) http.Handler {
+				cr.next = h
+				return cr
+			})
+			client, err := storage.NewClient(context.Background(),
+				option.WithEndpoint(srv.URL+"/storage/v1/"),
+				option.WithoutAuthentication())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { client.Close() })
+			client.SetRetry(storage.WithPolicy(storage.RetryNever))
+			c := NewWithClient(client)
+			c.Retries(1, 0)
+
+			content := randomBytes(tc.size)
+			src := testFiles(t, map[string][]byte{"data": content})
+			_, err = c.Save(context.Background(), &SaveRequest{
+				Bucket:      "bucket",
+				Key:         "cache",
+				Dir:         src,
+				ComposeSize: tc.composeSize,
+			})
+
+			cr.mu.Lock()
+			dsts, sources, parts := cr.dsts, cr.sources, cr.inserts
+			cr.mu.Unlock()
+
+			if tc.failAt > 0 {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				// Parts and intermediate objects are deleted either way
+				if names := fs.names("bucket"); len(names) != 0 {
+					t.Errorf("expected no objects to be left, got %q", names)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			exp := composeRounds(parts)
+			if len(exp) == 1 && tc.name != "single_request" {
+				t.Fatalf("expected more than %d parts, got %d", maxComposeComponents, parts)
+			}
+			if !reflect.DeepEqual(sources, exp) {
+				t.Errorf("expected compose requests with %v sources for %d parts, got %v", exp, parts, sources)
+			}
+			for _, dst := range dsts[:len(dsts)-1] {
+				if !strings.HasPrefix(dst, "cache.") || !strings.Contains(dst, ".compose") {
+					t.Errorf("expected an intermediate object of the key, got %s", dst)
+				}
+			}
+			if last := dsts[len(dsts)-1]; last != "cache" {
+				t.Errorf("expected the last compose into the key, got %s", last)
+			}
+
+			if names := fs.names("bucket"); len(names) != 1 || names[0] != "cache" {
+				t.Errorf("expected only the composed object to be left, got %q", names)
+			}
+			assertRestores(t, c, "cache", filepath.Base(src)+"/data", content)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package cacher
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ContentsManifestName is the name of the contents manifest written by Save
+// with EmbedManifest and by Restore with WriteManifest, at the top of the
+// archive and the restore directory.
+const ContentsManifestName = ".gcs-cacher-manifest.json"
+
+// ContentsManifest lists the regular files of a cache, so the restored files
+// can be verified independently. The manifest never lists itself.
+type ContentsManifest struct {
+	Files []ContentsEntry `json:"files"`
+}
+
+// ContentsEntry describes a single regular file in a ContentsManifest.
+type ContentsEntry struct {
+	// Name is the slash-separated path of the file, relative to the top of the
+	// archive or restore directory.
+	Name string `json:"name"`
+
+	// Size is the size of the file content, in bytes.
+	Size int64 `json:"size"`
+
+	// Mode is the permission bits of the file, in octal.
+	Mode string `json:"mode"`
+
+	// Checksum is the hex-encoded blake2b-256 digest of the file content.
+	Checksum string `json:"checksum"`
+}
+
+// add records a file in the manifest, unless it is the manifest itself.
+func (m *ContentsManifest) add(name string, size int64, mode os.FileMode, sum string) {
+	if name == ContentsManifestName {
+		return
+	}
+	m.Files = append(m.Files, ContentsEntry{
+		Name:     name,
+		Size:     size,
+		Mode:     fmt.Sprintf("%04o", mode.Perm()),
+		Checksum: sum,
+	})
+}
+
+// marshal returns the manifest as indented JSON, with the files sorted by name.
+func (m *ContentsManifest) marshal() ([]byte, error) {
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Name < m.Files[j].Name
+	})
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal contents manifest: %w", err)
+	}
+	return append(b, '\n'), nil
+}
+
+// writeContentsManifest writes the manifest into the tar stream as a regular
+// file named ContentsManifestName.
+func writeContentsManifest(tw *tar.Writer, m *ContentsManifest, opts *archiveOptions) error {
+	b, err := m.marshal()
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ContentsManifestName,
+		Size:     int64(len(b)),
+		Mode:     0644,
+		ModTime:  opts.now,
+		Format:   opts.format,
+	}
+	if opts.deterministic {
+		hdr.ModTime = time.Unix(0, 0)
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write contents manifest header: %w", err)
+	}
+	if _, err := tw.Write(b); err != nil {
+		return fmt.Errorf("failed to write contents manifest: %w", err)
+	}
+	return nil
+}
+
+// writeManifest writes the manifest of the files restored into the restore
+// directory.
+func (e *extractor) writeManifest() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	b, err := e.contents.marshal()
+	if err != nil {
+		return err
+	}
+
+	pth := filepath.Join(e.dir, ContentsManifestName)
+	if err := ioutil.WriteFile(pth, b, 0644); err != nil {
+		return fmt.Errorf("failed to write contents manifest %s: %w", pth, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package cacher
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestCacher_contentsManifest(t *testing.T) {
+	t.Parallel()
+
+	files := map[string][]byte{
+		"a.txt":     []byte("a"),
+		"dir/b.txt": []byte("bb"),
+		"empty":     {},
+		"run.sh":    []byte("#!/bin/sh\n"),
+	}
+	stale := []byte(`{"files":[{"name":"gone"}]}`)
+
+	expected := &ContentsManifest{}
+	for _, name := range []string{"a.txt", "dir/b.txt", "empty", "run.sh"} {
+		sum := blake2b.Sum256(files[name])
+		mode := "0644"
+		if name == "run.sh" {
+			mode = "0755"
+		}
+		expected.Files = append(expected.Files, ContentsEntry{
+			Name:     name,
+			Size:     int64(len(files[name])),
+			Mode:     mode,
+			Checksum: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	cases := []struct {
+		name  string
+		stale bool
+		embed bool
+		write bool
+		// exp is the manifest expected in the restore directory, unless it
+		// keeps the stale one
+		exp        *ContentsManifest
+		keepsStale bool
+	}{
+		{name: "neither", exp: nil},
+		{name: "write", write: true, exp: expected},
+		{name: "embed", embed: true, exp: expected},
+		{name: "embed_and_write", embed: true, write: true, exp: expected},
+		{name: "stale_archived", stale: true, keepsStale: true},
+		{name: "stale_replaced_by_embed", stale: true, embed: true, exp: expected},
+		{name: "stale_replaced_by_write", stale: true, write: true, exp: expected},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			src := testFiles(t, files)
+			if err := os.Chmod(filepath.Join(src, "run.sh"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if tc.stale {
+				if err := ioutil.WriteFile(filepath.Join(src, ContentsManifestName), stale, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The trailing separator puts the files at the top of the archive,
+			// next to the manifest
+			dst := t.TempDir()
+			if _, err := roundTrip(t, c, src,
+				SaveRequest{Dir: src + string(filepath.Separator), EmbedManifest: tc.embed},
+				RestoreRequest{Dir: dst, WriteManifest: tc.write},
+			); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, content := range files {
+				got, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(content) {
+					t.Errorf("expected %s to be restored as %q, got %q", name, content, got)
+				}
+			}
+
+			b, err := ioutil.ReadFile(filepath.Join(dst, ContentsManifestName))
+			switch {
+			case tc.exp == nil && !tc.keepsStale:
+				if !os.IsNotExist(err) {
+					t.Fatalf("expected no manifest to be restored, got %v", err)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			case tc.keepsStale:
+				if string(b) != string(stale) {
+					t.Errorf("expected the stale manifest to be restored as is, got %s", b)
+				}
+				return
+			}
+
+			var got ContentsManifest
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&got, tc.exp) {
+				t.Errorf("expected manifest %+v, got %+v", tc.exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Delete deletes the cached object with the given key, and the parts of a
+// sharded cache. The key must match the object exactly. If there is no such
+// object, the error is a *NotFoundError. A cache under a hold, such as one
+// placed by Save with EventBasedHold, is not deleted and the error wraps
+// ErrObjectHeld; release the hold with ReleaseHold first.
+func (c *Cacher) Delete(ctx context.Context, bucket, key string) error {
+	if bucket == "" {
+		return validationErrorf("missing bucket")
+	}
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	bucketHandle := c.client.Bucket(bucket)
+	attrs, err := c.existing(ctx, bucketHandle.Object(c.objectName(key)))
+	if err != nil {
+		return err
+	}
+	if attrs == nil {
+		return &NotFoundError{Keys: []string{key}}
+	}
+	return c.deleteCache(ctx, bucketHandle, attrs)
+}
+
+// deleteCache deletes the object of a cache, pinned to its generation so a
+// concurrent save is never deleted, and then its parts if it is sharded. The
+// parts are deleted last, so a failure never leaves a manifest behind whose
+// parts are missing.
+func (c *Cacher) deleteCache(ctx context.Context, bucket *storage.BucketHandle, attrs *storage.ObjectAttrs) error {
+	key := strings.TrimPrefix(attrs.Name, c.keyPrefix)
+	if attrs.EventBasedHold || attrs.TemporaryHold {
+		return fmt.Errorf("cannot delete %s: %w", key, ErrObjectHeld)
+	}
+
+	var parts []manifestPart
+	if attrs.ContentType == manifestContentType {
+		m, err := readManifest(ctx, bucket, attrs)
+		if err != nil {
+			return err
+		}
+		parts = m.Parts
+	}
+
+	c.log("deleting %s", attrs.Name)
+	obj := bucket.Object(attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation})
+	if err := obj.Delete(ctx); err != nil {
+		// The hold may have been placed since the lookup, or come from a
+		// retention policy of the bucket
+		if isRetained(err) {
+			return fmt.Errorf("cannot delete %s: %w: %v", key, ErrObjectHeld, err)
+		}
+		return &StorageError{Msg: "failed to delete " + attrs.Name, Err: err}
+	}
+
+	for _, part := range parts {
+		err := bucket.Object(part.Name).Generation(part.Generation).Delete(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return &StorageError{Msg: "failed to delete part " + part.Name, Err: err}
+		}
+	}
+	return nil
+}
+
+// Prune deletes the caches under prefix which were last updated more than
+// olderThan ago, as of the clock given by WithClock, like Delete does for each,
+// and returns their keys in lexical order. An empty prefix considers the whole
+// bucket. The parts of sharded caches are deleted along with their manifest and
+// are never considered on their own. Caches under a hold are skipped, and once
+// the others are deleted, the error wraps ErrObjectHeld.
+func (c *Cacher) Prune(ctx context.Context, bucket, prefix string, olderThan time.Duration) ([]string, error) {
+	if bucket == "" {
+		return nil, validationErrorf("missing bucket")
+	}
+	if olderThan <= 0 {
+		return nil, validationErrorf("age must be positive")
+	}
+
+	cutoff := c.now().Add(-olderThan)
+	prefix = c.objectName(prefix)
+	c.log("pruning objects with prefix %s updated before %s", prefix, cutoff.Format(time.RFC3339))
+
+	bucketHandle := c.client.Bucket(bucket)
+	it := bucketHandle.Objects(ctx, &storage.Query{
+		Prefix: prefix,
+	})
+
+	// Gather the caches first, so deleting does not disturb the listing
+	var stale []*storage.ObjectAttrs
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, &StorageError{Msg: "failed to list " + prefix, Err: err}
+		}
+
+		if canonicalKey(attrs) != attrs.Name || !attrs.Updated.Before(cutoff) {
+			continue
+		}
+		stale = append(stale, attrs)
+	}
+
+	deleted := make([]string, 0, len(stale))
+	var held []string
+	for _, attrs := range stale {
+		key := strings.TrimPrefix(attrs.Name, c.keyPrefix)
+		if err := c.deleteCache(ctx, bucketHandle, attrs); err != nil {
+			if errors.Is(err, ErrObjectHeld) {
+				c.log("skipping %s (%s)", key, err)
+				held = append(held, key)
+				continue
+			}
+			return deleted, err
+		}
+		deleted = append(deleted, key)
+	}
+
+	if len(held) > 0 {
+		return deleted, fmt.Errorf("cannot delete %d caches %q: %w", len(held), held, ErrObjectHeld)
+	}
+	return deleted, nil
+}
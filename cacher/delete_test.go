@@ -0,0 +1,442 @@
+package cacher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestCacher_Delete(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		key       string
+		shardSize int64
+		notFound  bool
+	}{
+		{name: "single", key: "cache"},
+		{name: "sharded", key: "cache", shardSize: 1000},
+		{name: "missing", key: "other", notFound: true},
+		{name: "prefix_only", key: "cach", notFound: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			ctx := context.Background()
+
+			src := testFiles(t, map[string][]byte{"data": randomBytes(5000)})
+			if _, err := c.Save(ctx, &SaveRequest{
+				Bucket:    "bucket",
+				Key:       "cache",
+				Dir:       src,
+				ShardSize: tc.shardSize,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			fs.put("bucket", "cache-other", []byte("other"), nil)
+
+			err := c.Delete(ctx, "bucket", tc.key)
+			var nerr *NotFoundError
+			if got := errors.As(err, &nerr); got != tc.notFound {
+				t.Fatalf("expected not found %t, got %v", tc.notFound, err)
+			}
+			if tc.notFound {
+				if got := len(fs.names("bucket")); got < 2 {
+					t.Errorf("expected nothing to be deleted, got %q", fs.names("bucket"))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fs.names("bucket"); len(got) != 1 || got[0] != "cache-other" {
+				t.Errorf("expected only cache-other to be left, got %q", got)
+			}
+		})
+	}
+}
+
+func TestCacher_KeyPrefix(t *testing.T) {
+	t.Parallel()
+
+	c, fs := newTestCacher(t)
+	c.KeyPrefix("teamA/")
+	ctx := context.Background()
+
+	content := []byte("content")
+	src := testFiles(t, map[string][]byte{"data": content})
+	if _, err := c.Save(ctx, &SaveRequest{Bucket: "bucket", Key: "cache-1", Dir: src}); err != nil {
+		t.Fatal(err)
+	}
+	fs.put("bucket", "cache-2", []byte("unprefixed"), nil)
+
+	if got := fs.names("bucket"); len(got) != 2 || got[0] != "cache-2" || got[1] != "teamA/cache-1" {
+		t.Fatalf("expected the save to be prefixed, got %q", got)
+	}
+
+	// The prefix scan only sees the prefixed object, even though the
+	// unprefixed one is newer
+	result, err := c.Restore(ctx, &RestoreRequest{Bucket: "bucket", Keys: []string{"cache-"}, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Key != "cache-" || result.ObjectName != "teamA/cache-1" {
+		t.Errorf("expected key cache- to restore teamA/cache-1, got %s from %s", result.Key, result.ObjectName)
+	}
+	assertRestores(t, c, "cache-1", filepath.Base(src)+"/data", content)
+
+	if matched, name, found, err := c.FindMatch(ctx, "bucket", []string{"cache-"}); err != nil || !found || matched != "cache-" || name != "teamA/cache-1" {
+		t.Errorf("expected cache- to match teamA/cache-1, got %s, %s, %t, %v", matched, name, found, err)
+	}
+
+	keys, err := c.ListKeys(ctx, "bucket", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Key != "cache-1" {
+		t.Errorf("expected to list cache-1 only, got %+v", keys)
+	}
+
+	if err := c.Delete(ctx, "bucket", "cache-2"); err == nil {
+		t.Error("expected the unprefixed object not to be found")
+	}
+	if err := c.Delete(ctx, "bucket", "cache-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.names("bucket"); len(got) != 1 || got[0] != "cache-2" {
+		t.Errorf("expected only the unprefixed object to be left, got %q", got)
+	}
+}
+
+func TestCacher_Prune(t *testing.T) {
+	t.Parallel()
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name      string
+		now       time.Time
+		prefix    string
+		olderThan time.Duration
+		exp       []string
+		left      []string
+		err       bool
+	}{
+		{
+			name:      "none_stale",
+			now:       base.Add(3 * time.Hour),
+			olderThan: 24 * time.Hour,
+			exp:       []string{},
+			left:      []string{"go-new", "go-old", "ruby-old"},
+		},
+		{
+			name:      "some_stale",
+			now:       base.Add(3 * time.Hour),
+			olderThan: 2 * time.Hour,
+			exp:       []string{"go-old", "ruby-old"},
+			left:      []string{"go-new"},
+		},
+		{
+			name:      "prefix",
+			now:       base.Add(3 * time.Hour),
+			prefix:    "go-",
+			olderThan: 2 * time.Hour,
+			exp:       []string{"go-old"},
+			left:      []string{"go-new", "ruby-old"},
+		},
+		{
+			// Exactly as old as the limit is not stale yet
+			name:      "boundary",
+			now:       base.Add(2 * time.Hour),
+			olderThan: 2 * time.Hour,
+			exp:       []string{},
+			left:      []string{"go-new", "go-old", "ruby-old"},
+		},
+		{
+			name:      "invalid_age",
+			now:       base,
+			olderThan: 0,
+			err:       true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t, WithClock(func() time.Time { return tc.now }))
+			for name, updated := range map[string]time.Time{
+				"go-old":   base,
+				"go-new":   base.Add(2 * time.Hour),
+				"ruby-old": base.Add(time.Hour / 2),
+			} {
+				fs.put("bucket", name, []byte(name), &fakeObject{Updated: updated.Format(time.RFC3339Nano)})
+			}
+
+			deleted, err := c.Prune(context.Background(), "bucket", tc.prefix, tc.olderThan)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+			if tc.err {
+				return
+			}
+
+			if got, exp := strings.Join(deleted, ","), strings.Join(tc.exp, ","); got != exp {
+				t.Errorf("expected to delete %q, got %q", tc.exp, deleted)
+			}
+			if got, exp := strings.Join(fs.names("bucket"), ","), strings.Join(tc.left, ","); got != exp {
+				t.Errorf("expected %q to be left, got %q", tc.left, fs.names("bucket"))
+			}
+		})
+	}
+}
+
+func TestCacher_Prune_sharded(t *testing.T) {
+	t.Parallel()
+
+	// Far enough ahead that everything saved now is stale
+	future := time.Now().Add(48 * time.Hour)
+	c, fs := newTestCacher(t, WithClock(func() time.Time { return future }))
+
+	src := testFiles(t, map[string][]byte{"data": randomBytes(5000)})
+	if _, err := c.Save(context.Background(), &SaveRequest{
+		Bucket:    "bucket",
+		Key:       "cache",
+		Dir:       src,
+		ShardSize: 1000,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := c.Prune(context.Background(), "bucket", "", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != "cache" {
+		t.Errorf("expected to delete cache only, got %q", deleted)
+	}
+	if got := fs.names("bucket"); len(got) != 0 {
+		t.Errorf("expected the parts to be deleted too, got %q", got)
+	}
+}
+
+func TestCacher_Prune_partNames(t *testing.T) {
+	t.Parallel()
+
+	shardOf := &fakeObject{Metadata: map[string]string{metadataShardOf: "cache"}}
+
+	cases := []struct {
+		name     string
+		parts    map[string]*fakeObject
+		manifest bool
+		exp      []string
+	}{
+		{
+			// Parts saved before upload IDs were added to their names
+			name:     "legacy",
+			parts:    map[string]*fakeObject{"cache.part0000": nil, "cache.part0001": nil},
+			manifest: true,
+			exp:      []string{"cache"},
+		},
+		{
+			name:     "upload_id",
+			parts:    map[string]*fakeObject{"cache.0123456789abcdef.part0000": shardOf, "cache.0123456789abcdef.part0001": nil},
+			manifest: true,
+			exp:      []string{"cache"},
+		},
+		{
+			name:     "mixed",
+			parts:    map[string]*fakeObject{"cache.part0000": nil, "cache.0123456789abcdef.part0001": nil},
+			manifest: true,
+			exp:      []string{"cache"},
+		},
+		{
+			// Parts are never caches of their own, even without a manifest
+			name:  "orphaned",
+			parts: map[string]*fakeObject{"cache.part0000": nil, "cache.0123456789abcdef.part0001": shardOf},
+			exp:   []string{},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			future := time.Now().Add(48 * time.Hour)
+			c, fs := newTestCacher(t, WithClock(func() time.Time { return future }))
+
+			var m manifest
+			for name, attrs := range tc.parts {
+				generation := fs.put("bucket", name, []byte(name), attrs)
+				m.Parts = append(m.Parts, manifestPart{Name: name, Generation: generation})
+			}
+			if tc.manifest {
+				b, err := json.Marshal(&m)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fs.put("bucket", "cache", b, &fakeObject{ContentType: manifestContentType})
+			}
+
+			keys, err := c.ListKeys(context.Background(), "bucket", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 1 || keys[0].Key != "cache" {
+				t.Errorf("expected the objects to be listed as cache, got %+v", keys)
+			}
+
+			deleted, err := c.Prune(context.Background(), "bucket", "", 24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(deleted, ",") != strings.Join(tc.exp, ",") {
+				t.Errorf("expected to delete %q, got %q", tc.exp, deleted)
+			}
+			if got := fs.names("bucket"); tc.manifest && len(got) != 0 {
+				t.Errorf("expected the parts to be deleted with the manifest, got %q", got)
+			} else if !tc.manifest && len(got) != len(tc.parts) {
+				t.Errorf("expected the orphaned parts to be left alone, got %q", got)
+			}
+		})
+	}
+}
+
+func TestCacher_Delete_held(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		shardSize int64
+	}{
+		{name: "single"},
+		{name: "sharded", shardSize: 1000},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			ctx := context.Background()
+
+			src := testFiles(t, map[string][]byte{"data": randomBytes(5000)})
+			if _, err := c.Save(ctx, &SaveRequest{
+				Bucket:         "bucket",
+				Key:            "cache",
+				Dir:            src,
+				ShardSize:      tc.shardSize,
+				EventBasedHold: true,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			before := fs.names("bucket")
+
+			if err := c.Delete(ctx, "bucket", "cache"); !errors.Is(err, ErrObjectHeld) {
+				t.Fatalf("expected ErrObjectHeld, got %v", err)
+			}
+			if got := fs.names("bucket"); strings.Join(got, ",") != strings.Join(before, ",") {
+				t.Errorf("expected objects %q to be left, got %q", before, got)
+			}
+
+			if err := c.ReleaseHold(ctx, "bucket", "cache"); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Delete(ctx, "bucket", "cache"); err != nil {
+				t.Fatal(err)
+			}
+			if got := fs.names("bucket"); len(got) != 0 {
+				t.Errorf("expected everything to be deleted, got %q", got)
+			}
+		})
+	}
+}
+
+func TestCacher_Prune_held(t *testing.T) {
+	t.Parallel()
+
+	updated := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339Nano)
+	c, fs := newTestCacher(t)
+	fs.put("bucket", "held", []byte("held"), &fakeObject{Updated: updated, EventBasedHold: true})
+	fs.put("bucket", "stale", []byte("stale"), &fakeObject{Updated: updated})
+
+	deleted, err := c.Prune(context.Background(), "bucket", "", time.Hour)
+	if !errors.Is(err, ErrObjectHeld) {
+		t.Fatalf("expected ErrObjectHeld, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "held") {
+		t.Errorf("expected the error to name the held cache, got %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "stale" {
+		t.Errorf("expected to delete stale, got %q", deleted)
+	}
+	if got := fs.names("bucket"); len(got) != 1 || got[0] != "held" {
+		t.Errorf("expected only held to be left, got %q", got)
+	}
+}
+
+func TestIsRetained(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		err  error
+		exp  bool
+	}{
+		{
+			name: "hold",
+			err:  &googleapi.Error{Code: http.StatusForbidden, Message: "Object 'b/o' is under active Event-Based hold and cannot be deleted"},
+			exp:  true,
+		},
+		{
+			name: "retention_policy",
+			err:  &googleapi.Error{Code: http.StatusForbidden, Message: "Object 'b/o' is subject to bucket's retention policy and cannot be deleted"},
+			exp:  true,
+		},
+		{
+			name: "permission",
+			err:  &googleapi.Error{Code: http.StatusForbidden, Message: "does not have storage.objects.delete access"},
+		},
+		{
+			name: "other_code",
+			err:  &googleapi.Error{Code: http.StatusNotFound, Message: "hold"},
+		},
+		{
+			name: "wrapped",
+			err:  &StorageError{Msg: "failed", Err: &googleapi.Error{Code: http.StatusForbidden, Message: "retention"}},
+			exp:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := isRetained(tc.err); got != tc.exp {
+				t.Errorf("expected %t, got %t", tc.exp, got)
+			}
+		})
+	}
+}
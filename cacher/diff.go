@@ -0,0 +1,159 @@
+package cacher
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/mholt/archiver/v4"
+)
+
+// CacheDiff describes the differences between the regular files of two caches.
+// Each list is sorted by name.
+type CacheDiff struct {
+	// Added are the files only in the second cache.
+	Added []ContentsEntry
+
+	// Removed are the files only in the first cache.
+	Removed []ContentsEntry
+
+	// Changed are the files in both caches whose size, mode, or checksum differ.
+	Changed []ChangedEntry
+}
+
+// ChangedEntry is a file which differs between two caches.
+type ChangedEntry struct {
+	// Before is the file in the first cache.
+	Before ContentsEntry
+
+	// After is the file in the second cache.
+	After ContentsEntry
+}
+
+// Diff compares the regular files of the caches with keys keyA and keyB, by
+// name, size, mode, and checksum, without extracting them to disk. Both
+// archives are streamed in full. Like Download, the keys must match the objects
+// exactly. Checksums recorded by Save with Checksums are used as is, and
+// computed from the content otherwise. A ContentsManifestName file embedded in
+// an archive is not compared.
+func (c *Cacher) Diff(ctx context.Context, bucket, keyA, keyB string) (CacheDiff, error) {
+	var diff CacheDiff
+
+	if bucket == "" {
+		return diff, validationErrorf("missing bucket")
+	}
+	if err := validateKeys([]string{keyA, keyB}, 0); err != nil {
+		return diff, err
+	}
+
+	// Wait for a transfer slot, if limited
+	release, err := c.acquireTransfer(ctx)
+	if err != nil {
+		return diff, err
+	}
+	defer release()
+
+	a, err := c.contentsOf(ctx, bucket, keyA)
+	if err != nil {
+		return diff, err
+	}
+	b, err := c.contentsOf(ctx, bucket, keyB)
+	if err != nil {
+		return diff, err
+	}
+
+	before := make(map[string]ContentsEntry, len(a.Files))
+	for _, entry := range a.Files {
+		before[entry.Name] = entry
+	}
+
+	for _, entry := range b.Files {
+		old, ok := before[entry.Name]
+		if !ok {
+			diff.Added = append(diff.Added, entry)
+			continue
+		}
+		delete(before, entry.Name)
+
+		if old != entry {
+			diff.Changed = append(diff.Changed, ChangedEntry{Before: old, After: entry})
+		}
+	}
+	for _, entry := range before {
+		diff.Removed = append(diff.Removed, entry)
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool {
+		return diff.Added[i].Name < diff.Added[j].Name
+	})
+	sort.Slice(diff.Removed, func(i, j int) bool {
+		return diff.Removed[i].Name < diff.Removed[j].Name
+	})
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].After.Name < diff.Changed[j].After.Name
+	})
+	return diff, nil
+}
+
+// contentsOf streams the archive of the object with the given key and returns
+// a manifest of its regular files.
+func (c *Cacher) contentsOf(ctx context.Context, bucket, key string) (contents *ContentsManifest, retErr error) {
+	bucketHandle := c.client.Bucket(bucket)
+	attrs, err := c.existing(ctx, bucketHandle.Object(c.objectName(key)))
+	if err != nil {
+		retErr = err
+		return
+	}
+	if attrs == nil {
+		retErr = &NotFoundError{Keys: []string{key}}
+		return
+	}
+
+	gcsr, err := openArchive(ctx, bucketHandle, attrs, false)
+	if err != nil {
+		retErr = err
+		return
+	}
+	defer func() {
+		c.log("closing gcs reader")
+		if cerr := gcsr.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: %w", retErr, &StorageError{Msg: "failed to close gcs reader", Err: cerr})
+				return
+			}
+			retErr = &StorageError{Msg: "failed to close gcs reader", Err: cerr}
+		}
+	}()
+
+	br := bufio.NewReaderSize(gcsr, defaultReadBufferSize)
+	compression, err := detectCompression(attrs, br, c.zstdDecoder())
+	if err != nil {
+		retErr = fmt.Errorf("failed to detect compression: %w", err)
+		return
+	}
+
+	contents = new(ContentsManifest)
+	err = extractArchive(ctx, br, compression, func(ctx context.Context, f archiver.File) error {
+		hdr, ok := f.Header.(*tar.Header)
+		if !ok || (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) {
+			return nil
+		}
+
+		sum, ok := hdr.PAXRecords[paxChecksumKey]
+		if !ok {
+			var err error
+			if sum, err = checksumFile(f); err != nil {
+				return fmt.Errorf("file %s: %w", f.NameInArchive, err)
+			}
+		}
+		contents.add(entryName(f.NameInArchive), hdr.Size, f.Mode(), sum)
+		return nil
+	})
+	if err != nil {
+		retErr = fmt.Errorf("failed to read archive %s: %w", attrs.Name, err)
+		return
+	}
+	return
+}
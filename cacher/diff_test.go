@@ -0,0 +1,142 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCacher_Diff(t *testing.T) {
+	t.Parallel()
+
+	before := map[string][]byte{
+		"app/same":    []byte("same"),
+		"app/changed": []byte("before"),
+		"app/removed": []byte("removed"),
+		"app/mode":    []byte("mode"),
+	}
+	after := map[string][]byte{
+		"app/same":      []byte("same"),
+		"app/changed":   []byte("after!"),
+		"app/added":     []byte("added"),
+		"app/mode":      []byte("mode"),
+		"app/sub/added": []byte("nested"),
+	}
+
+	cases := []struct {
+		name      string
+		checksums bool
+		shardSize int64
+	}{
+		{name: "computed_checksums"},
+		{name: "recorded_checksums", checksums: true},
+		{name: "sharded", shardSize: 256},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			ctx := context.Background()
+
+			for key, files := range map[string]map[string][]byte{"before": before, "after": after} {
+				root := testFiles(t, files)
+				if key == "after" {
+					if err := os.Chmod(filepath.Join(root, "app", "mode"), 0755); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, err := c.Save(ctx, &SaveRequest{
+					Bucket:    "bucket",
+					Key:       key,
+					Dir:       filepath.Join(root, "app"),
+					Checksums: tc.checksums,
+					ShardSize: tc.shardSize,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			diff, err := c.Diff(ctx, "bucket", "before", "after")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := func(entries []ContentsEntry) string {
+				var result []string
+				for _, entry := range entries {
+					result = append(result, entry.Name)
+				}
+				return strings.Join(result, ",")
+			}
+			if got, exp := names(diff.Added), "app/added,app/sub/added"; got != exp {
+				t.Errorf("expected added %s, got %s", exp, got)
+			}
+			if got, exp := names(diff.Removed), "app/removed"; got != exp {
+				t.Errorf("expected removed %s, got %s", exp, got)
+			}
+
+			var changed []ContentsEntry
+			for _, entry := range diff.Changed {
+				if entry.Before.Name != entry.After.Name {
+					t.Errorf("expected a changed entry to keep its name, got %s and %s", entry.Before.Name, entry.After.Name)
+				}
+				changed = append(changed, entry.After)
+			}
+			if got, exp := names(changed), "app/changed,app/mode"; got != exp {
+				t.Fatalf("expected changed %s, got %s", exp, got)
+			}
+			if c := diff.Changed[0]; c.Before.Size != c.After.Size || c.Before.Checksum == c.After.Checksum {
+				t.Errorf("expected the content of the same size to differ by checksum, got %+v", c)
+			}
+			if c := diff.Changed[1]; c.Before.Mode != "0644" || c.After.Mode != "0755" {
+				t.Errorf("expected the mode to change from 0644 to 0755, got %+v", c)
+			}
+		})
+	}
+}
+
+func TestCacher_Diff_errors(t *testing.T) {
+	t.Parallel()
+
+	c, fs := newTestCacher(t)
+	fs.put("bucket", "exists", []byte("not an archive"), nil)
+
+	cases := []struct {
+		name     string
+		bucket   string
+		keyA     string
+		keyB     string
+		notFound bool
+		invalid  bool
+	}{
+		{name: "missing_bucket", keyA: "a", keyB: "b", invalid: true},
+		{name: "missing_key", bucket: "bucket", keyA: "a", invalid: true},
+		{name: "not_found", bucket: "bucket", keyA: "missing", keyB: "exists", notFound: true},
+		{name: "prefix_only", bucket: "bucket", keyA: "exist", keyB: "exists", notFound: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := c.Diff(context.Background(), tc.bucket, tc.keyA, tc.keyB)
+			var nerr *NotFoundError
+			if got := errors.As(err, &nerr); got != tc.notFound {
+				t.Errorf("expected not found %t, got %v", tc.notFound, err)
+			}
+			var verr *ValidationError
+			if got := errors.As(err, &verr); got != tc.invalid {
+				t.Errorf("expected validation error %t, got %v", tc.invalid, err)
+			}
+		})
+	}
+}
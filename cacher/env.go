@@ -0,0 +1,67 @@
+package cacher
+
+import (
+	"os"
+	"strings"
+)
+
+const (
+	// EnvBucket, EnvKey, EnvDir, and EnvRestoreKeys are the environment
+	// variables read by RequestFromEnv.
+	EnvBucket      = "GCS_CACHER_BUCKET"
+	EnvKey         = "GCS_CACHER_KEY"
+	EnvDir         = "GCS_CACHER_DIR"
+	EnvRestoreKeys = "GCS_CACHER_RESTORE_KEYS"
+)
+
+// RequestFromEnv builds requests from the environment:
+//
+//   - GCS_CACHER_BUCKET is the bucket, and is required.
+//   - GCS_CACHER_DIR is the directory to save or restore, and is required.
+//   - GCS_CACHER_KEY is the key to save with. If unset, the returned
+//     SaveRequest is nil.
+//   - GCS_CACHER_RESTORE_KEYS is a comma-separated, ordered list of keys to
+//     restore. If unset, the returned RestoreRequest is nil.
+//
+// At least one of GCS_CACHER_KEY or GCS_CACHER_RESTORE_KEYS is required. The
+// requests can be adjusted further before use.
+func RequestFromEnv() (*SaveRequest, *RestoreRequest, error) {
+	bucket := strings.TrimSpace(os.Getenv(EnvBucket))
+	if bucket == "" {
+		return nil, nil, validationErrorf("missing %s", EnvBucket)
+	}
+
+	dir := strings.TrimSpace(os.Getenv(EnvDir))
+	if dir == "" {
+		return nil, nil, validationErrorf("missing %s", EnvDir)
+	}
+
+	var save *SaveRequest
+	if key := strings.TrimSpace(os.Getenv(EnvKey)); key != "" {
+		save = &SaveRequest{
+			Bucket: bucket,
+			Key:    key,
+			Dir:    dir,
+		}
+	}
+
+	var restore *RestoreRequest
+	var keys []string
+	for _, key := range strings.Split(os.Getenv(EnvRestoreKeys), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		restore = &RestoreRequest{
+			Bucket: bucket,
+			Keys:   keys,
+			Dir:    dir,
+		}
+	}
+
+	if save == nil && restore == nil {
+		return nil, nil, validationErrorf("missing %s or %s", EnvKey, EnvRestoreKeys)
+	}
+	return save, restore, nil
+}
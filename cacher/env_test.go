@@ -0,0 +1,107 @@
+package cacher
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRequestFromEnv(t *testing.T) {
+	cases := []struct {
+		name    string
+		env     map[string]string
+		save    *SaveRequest
+		restore *RestoreRequest
+		err     bool
+	}{
+		{
+			name: "both",
+			env: map[string]string{
+				EnvBucket:      "bucket",
+				EnvDir:         "/workspace/deps",
+				EnvKey:         "deps-abc",
+				EnvRestoreKeys: "deps-abc, deps-,,",
+			},
+			save:    &SaveRequest{Bucket: "bucket", Key: "deps-abc", Dir: "/workspace/deps"},
+			restore: &RestoreRequest{Bucket: "bucket", Keys: []string{"deps-abc", "deps-"}, Dir: "/workspace/deps"},
+		},
+		{
+			name: "save_only",
+			env: map[string]string{
+				EnvBucket: " bucket ",
+				EnvDir:    "deps",
+				EnvKey:    "deps-abc",
+			},
+			save: &SaveRequest{Bucket: "bucket", Key: "deps-abc", Dir: "deps"},
+		},
+		{
+			name: "restore_only",
+			env: map[string]string{
+				EnvBucket:      "bucket",
+				EnvDir:         "deps",
+				EnvRestoreKeys: "deps-",
+			},
+			restore: &RestoreRequest{Bucket: "bucket", Keys: []string{"deps-"}, Dir: "deps"},
+		},
+		{
+			name: "missing_bucket",
+			env:  map[string]string{EnvDir: "deps", EnvKey: "deps-abc"},
+			err:  true,
+		},
+		{
+			name: "missing_dir",
+			env:  map[string]string{EnvBucket: "bucket", EnvKey: "deps-abc"},
+			err:  true,
+		},
+		{
+			name: "missing_keys",
+			env:  map[string]string{EnvBucket: "bucket", EnvDir: "deps", EnvRestoreKeys: " , "},
+			err:  true,
+		},
+	}
+
+	// The environment is process-wide, so these cases cannot run in parallel
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range []string{EnvBucket, EnvKey, EnvDir, EnvRestoreKeys} {
+				name := name
+				orig, ok := os.LookupEnv(name)
+				t.Cleanup(func() {
+					if ok {
+						os.Setenv(name, orig)
+					} else {
+						os.Unsetenv(name)
+					}
+				})
+
+				if val, ok := tc.env[name]; ok {
+					os.Setenv(name, val)
+				} else {
+					os.Unsetenv(name)
+				}
+			}
+
+			save, restore, err := RequestFromEnv()
+			if tc.err {
+				var verr *ValidationError
+				if !errors.As(err, &verr) {
+					t.Fatalf("expected validation error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(save, tc.save) {
+				t.Errorf("expected save request %+v, got %+v", tc.save, save)
+			}
+			if !reflect.DeepEqual(restore, tc.restore) {
+				t.Errorf("expected restore request %+v, got %+v", tc.restore, restore)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package cacher
+
+import (
+	"io"
+	"runtime"
+)
+
+// nativeCRLF is true if the platform uses CRLF line endings.
+var nativeCRLF = runtime.GOOS == "windows"
+
+// lineEndingWriter converts line endings to LF, or to CRLF if crlf is set,
+// while writing. Other bytes, including lone carriage returns, are written
+// unchanged.
+type lineEndingWriter struct {
+	w    io.Writer
+	crlf bool
+	buf  []byte
+
+	// cr is set if the last byte written was a carriage return. When converting
+	// to LF, it has not been written yet.
+	cr bool
+}
+
+// newLineEndingWriter creates a lineEndingWriter writing to w.
+func newLineEndingWriter(w io.Writer, crlf bool) *lineEndingWriter {
+	return &lineEndingWriter{w: w, crlf: crlf}
+}
+
+// Write converts the line endings in p and writes the result.
+func (l *lineEndingWriter) Write(p []byte) (int, error) {
+	l.buf = l.buf[:0]
+	for _, b := range p {
+		switch {
+		case l.crlf:
+			if b == '\n' && !l.cr {
+				l.buf = append(l.buf, '\r')
+			}
+			l.buf = append(l.buf, b)
+			l.cr = b == '\r'
+
+		case l.cr:
+			// A carriage return is only dropped if a line feed follows it
+			if b != '\n' {
+				l.buf = append(l.buf, '\r')
+			}
+			l.cr = b == '\r'
+			if !l.cr {
+				l.buf = append(l.buf, b)
+			}
+
+		case b == '\r':
+			l.cr = true
+
+		default:
+			l.buf = append(l.buf, b)
+		}
+	}
+
+	if _, err := l.w.Write(l.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes a carriage return held back at the end of the content.
+func (l *lineEndingWriter) Flush() error {
+	if l.crlf || !l.cr {
+		return nil
+	}
+	l.cr = false
+	_, err := l.w.Write([]byte{'\r'})
+	return err
+}
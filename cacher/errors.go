@@ -0,0 +1,150 @@
+package cacher
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	// ErrMaxSizeExceeded is returned when an archive exceeds the configured
+	// maximum size.
+	ErrMaxSizeExceeded = errors.New("maximum size exceeded")
+
+	// ErrMaxFilesExceeded is returned by Restore when an archive has more
+	// entries than the configured maximum.
+	ErrMaxFilesExceeded = errors.New("maximum number of files exceeded")
+
+	// ErrDirNotEmpty is returned by Restore with OnlyIfEmpty when the target
+	// directory already has content.
+	ErrDirNotEmpty = errors.New("directory is not empty")
+
+	// ErrNoFiles is returned by Save with FailOnEmpty when there are no files to
+	// archive.
+	ErrNoFiles = errors.New("no files to archive")
+
+	// ErrNoFilesToHash is returned by HashFiles and HashGlob when there are no
+	// files to hash, unless HashAllowEmpty is set.
+	ErrNoFilesToHash = errors.New("no files to hash")
+
+	// ErrObjectHeld is returned when an object cannot be replaced or deleted
+	// because it is under a hold, such as one placed by Save with
+	// EventBasedHold, or a retention policy of the bucket.
+	ErrObjectHeld = errors.New("object is under a hold")
+
+	// ErrTimeout is returned when an operation takes longer than the
+	// configured SaveTimeout or RestoreTimeout.
+	ErrTimeout = errors.New("operation timed out")
+
+	// ErrUnsupportedArchive is returned by Restore when the archive declares a
+	// schema or format this version does not understand, such as one written by
+	// a newer version.
+	ErrUnsupportedArchive = errors.New("unsupported archive")
+)
+
+// ValidationError is returned when a request is invalid, for example because
+// the bucket is missing. Retrying the same request will not succeed.
+type ValidationError struct {
+	Msg string
+}
+
+// Error implements error.
+func (e *ValidationError) Error() string {
+	return e.Msg
+}
+
+// validationErrorf returns a ValidationError with a formatted message.
+func validationErrorf(format string, args ...interface{}) error {
+	return &ValidationError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// NotFoundError is returned when no cached object matches the keys of a
+// restore.
+type NotFoundError struct {
+	// Keys are the keys which were searched.
+	Keys []string
+
+	// Generation is the generation which was requested, or zero.
+	Generation int64
+}
+
+// Error implements error.
+func (e *NotFoundError) Error() string {
+	if e.Generation != 0 && len(e.Keys) == 1 {
+		return fmt.Sprintf("failed to find generation %d of cached object %q", e.Generation, e.Keys[0])
+	}
+	return fmt.Sprintf("failed to find cached objects among keys %q", e.Keys)
+}
+
+// StorageError is returned when a request to Cloud Storage fails. Err is the
+// error from the storage client, which is often a *googleapi.Error and may be
+// worth retrying.
+type StorageError struct {
+	// Msg describes what was being done.
+	Msg string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements error.
+func (e *StorageError) Error() string {
+	return e.Msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// SaveAllError is returned by SaveAll when any of the saves failed.
+type SaveAllError struct {
+	// Errs are the errors of the saves, in the same order as the requests. The
+	// error of a save which succeeded is nil.
+	Errs []error
+}
+
+// Error implements error.
+func (e *SaveAllError) Error() string {
+	var msgs []string
+	for _, err := range e.Errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	return fmt.Sprintf("%d of %d saves failed: %s", len(msgs), len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// isPreconditionFailed returns true if err is a storage error for a failed
+// precondition, such as creating an object which already exists.
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+// isRetained returns true if err is a storage error for deleting an object
+// which is under a hold or retention policy. Storage reports those as
+// forbidden, so they are told apart from missing permissions by the message.
+func isRetained(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code != http.StatusForbidden {
+		return false
+	}
+	msg := strings.ToLower(gerr.Message)
+	return strings.Contains(msg, "hold") || strings.Contains(msg, "retention")
+}
+
+// errorPrivilegeNotHeld is the Windows error code ERROR_PRIVILEGE_NOT_HELD.
+const errorPrivilegeNotHeld = syscall.Errno(1314)
+
+// isPrivilegeNotHeld returns true if err is the Windows error for an operation
+// which requires a privilege the process does not have, such as creating a
+// symbolic link.
+func isPrivilegeNotHeld(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && errno == errorPrivilegeNotHeld
+}
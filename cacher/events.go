@@ -0,0 +1,163 @@
+package cacher
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is the number of bytes read between Progress events during
+// a restore.
+const progressInterval = 1 << 20
+
+// Event is a progress or lifecycle event, sent to the Events channel of a
+// request. It is one of UploadStarted, Progress, FileRestored, or Completed.
+type Event interface {
+	isEvent()
+}
+
+// UploadStarted is sent when Save starts uploading the archive.
+type UploadStarted struct {
+	// Bucket and Key identify the object being uploaded.
+	Bucket string
+	Key    string
+}
+
+// Progress is sent periodically while transferring. Bytes is the number of
+// compressed bytes uploaded or downloaded so far.
+type Progress struct {
+	Bytes int64
+}
+
+// FileRestored is sent by Restore after an entry of the archive is written to
+// disk. Name is its name in the archive.
+type FileRestored struct {
+	Name string
+}
+
+// Completed is the last event sent for an operation. Err is the error the
+// operation returned, if any.
+type Completed struct {
+	Err error
+}
+
+func (UploadStarted) isEvent() {}
+func (Progress) isEvent()      {}
+func (FileRestored) isEvent()  {}
+func (Completed) isEvent()     {}
+
+// sendEvent sends ev on ch without blocking. The event is dropped if ch is
+// full, so a slow consumer never stalls a transfer.
+func sendEvent(ch chan<- Event, ev Event) {
+	if ch == nil {
+		return
+	}
+
+	select {
+	case ch <- ev:
+	default:
+	}
+}
+
+// uploadProgress returns a ProgressFunc for a storage writer, which logs the
+// number of bytes uploaded so far and sends it as a Progress event to events,
+// which may be nil.
+func (c *Cacher) uploadProgress(events chan<- Event) func(soFar int64) {
+	return func(soFar int64) {
+		c.log("uploaded %d bytes", soFar)
+		sendEvent(events, Progress{Bytes: soFar})
+	}
+}
+
+// progressReader is an io.Reader which sends Progress events for the bytes
+// read from the underlying reader.
+type progressReader struct {
+	// n is accessed atomically, so it is first to keep it aligned.
+	n      int64
+	sent   int64
+	r      io.Reader
+	events chan<- Event
+}
+
+// Read reads from the underlying reader.
+func (p *progressReader) Read(b []byte) (int, error) {
+	read, err := p.r.Read(b)
+	n := atomic.AddInt64(&p.n, int64(read))
+	if n-p.sent >= progressInterval || (err == io.EOF && n > p.sent) {
+		p.sent = n
+		sendEvent(p.events, Progress{Bytes: n})
+	}
+	return read, err
+}
+
+// count returns the number of bytes read so far. It is safe to call
+// concurrently with Read.
+func (p *progressReader) count() int64 {
+	return atomic.LoadInt64(&p.n)
+}
+
+// startHeartbeat logs that op is still running, with the number of bytes
+// transferred so far from soFar, at the interval configured with Heartbeat. The
+// returned function stops it.
+func (c *Cacher) startHeartbeat(op string, soFar func() int64) (stop func()) {
+	interval := c.heartbeatInterval
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				log.Printf("still %s, %d bytes so far", op, soFar())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// formatCount formats n with thousands separators, like "12,438".
+func formatCount(n int64) string {
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+
+	s := strconv.FormatInt(n, 10)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// formatBytes formats n bytes in binary units, like "2.1 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,129 @@
+package cacher
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUploadProgress(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		events chan Event
+	}{
+		{name: "nil_channel"},
+		{name: "channel", events: make(chan Event, 1)},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := &Cacher{}
+			progress := c.uploadProgress(tc.events)
+			progress(42)
+
+			// A full channel never blocks the upload
+			progress(43)
+
+			if tc.events == nil {
+				return
+			}
+			ev := <-tc.events
+			if p, ok := ev.(Progress); !ok || p.Bytes != 42 {
+				t.Errorf("expected Progress{Bytes: 42}, got %#v", ev)
+			}
+		})
+	}
+}
+
+func TestCacher_heartbeat(t *testing.T) {
+	t.Parallel()
+
+	if got := NewWithClient(nil).heartbeatInterval; got != defaultHeartbeatInterval {
+		t.Errorf("expected a default interval of %s, got %s", defaultHeartbeatInterval, got)
+	}
+
+	cases := []struct {
+		name     string
+		interval time.Duration
+		fires    bool
+	}{
+		{name: "disabled", interval: 0, fires: false},
+		{name: "enabled", interval: time.Millisecond, fires: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := &Cacher{}
+			c.Heartbeat(tc.interval)
+
+			// Every heartbeat reports the bytes so far
+			var beats int64
+			stop := c.startHeartbeat("testing", func() int64 {
+				return atomic.AddInt64(&beats, 1)
+			})
+			wait := time.Second
+			if !tc.fires {
+				wait = 20 * time.Millisecond
+			}
+			deadline := time.Now().Add(wait)
+			for atomic.LoadInt64(&beats) == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			stop()
+
+			fired := atomic.LoadInt64(&beats)
+			if got := fired > 0; got != tc.fires {
+				t.Fatalf("expected heartbeats %t, got %d", tc.fires, fired)
+			}
+
+			// Nothing is logged once stopped
+			time.Sleep(10 * time.Millisecond)
+			if got := atomic.LoadInt64(&beats); got != fired {
+				t.Errorf("expected no heartbeats after stopping, got %d more", got-fired)
+			}
+		})
+	}
+}
+
+func TestFormatSummary(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		n     int64
+		count string
+		bytes string
+	}{
+		{name: "zero", n: 0, count: "0", bytes: "0 B"},
+		{name: "under_thousand", n: 999, count: "999", bytes: "999 B"},
+		{name: "thousand", n: 1000, count: "1,000", bytes: "1000 B"},
+		{name: "kibibyte", n: 1024, count: "1,024", bytes: "1.0 KiB"},
+		{name: "files", n: 12438, count: "12,438", bytes: "12.1 KiB"},
+		{name: "gibibytes", n: 2254857830, count: "2,254,857,830", bytes: "2.1 GiB"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := formatCount(tc.n); got != tc.count {
+				t.Errorf("expected count %q, got %q", tc.count, got)
+			}
+			if got := formatBytes(tc.n); got != tc.bytes {
+				t.Errorf("expected bytes %q, got %q", tc.bytes, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,1197 @@
+package cacher
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/archiver/v4"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// maxPooledFileSize is the largest file which is buffered in memory and
+	// written by the worker pool. Larger files are streamed directly from the
+	// archive.
+	maxPooledFileSize = 1 << 20
+
+	// maxPooledBytes is the maximum number of bytes buffered in memory for
+	// pending writes at any time.
+	maxPooledBytes = 64 << 20
+
+	// cISUID, cISGID, and cISVTX are the setuid, setgid, and sticky bits of the
+	// raw mode in a tar header.
+	cISUID = 04000
+	cISGID = 02000
+	cISVTX = 01000
+)
+
+// symlink creates symbolic links. It is a variable so that the handling of
+// links which cannot be created can be exercised on any platform.
+var symlink = os.Symlink
+
+// extractor writes the entries of an archive to disk.
+type extractor struct {
+	c    *Cacher
+	i    *RestoreRequest
+	dir  string
+	pool *extractPool
+
+	// realDir is dir with symbolic links resolved, and parents caches the
+	// resolved parent directories of entries. The cache is reset whenever a
+	// symbolic link is created, since the link may change how later paths
+	// resolve.
+	realDir string
+	parents map[string]string
+
+	// limit is the maximum total size of the file content to extract, or zero
+	// for no limit. When set, the paths of created files are recorded so they
+	// can be removed if it is exceeded.
+	limit     int64
+	extracted int64
+
+	// entries is the number of entries extracted, for MaxFiles.
+	entries int
+
+	mu      sync.Mutex
+	created []string
+
+	// files and bytes count the entries other than directories which were
+	// written, and the size of their content.
+	files int64
+	bytes int64
+
+	// dirs are the extracted directories, whose mode and times are applied once
+	// everything is extracted.
+	dirs []extractedDir
+
+	// links are the symbolic links to replace with a copy of their targets,
+	// for WindowsSymlinkCopy.
+	links []copiedLink
+
+	// contents records the written files, for WriteManifest.
+	contents *ContentsManifest
+
+	// clones maps the checksums of restored files to their paths, for
+	// UseReflink. noReflink is set once cloning failed.
+	clones    map[string]string
+	noReflink bool
+
+	// listed are the entries seen in a dry run.
+	listed []FileEntry
+
+	// failed are the errors of entries which could not be written, when
+	// continuing past them.
+	failed []error
+}
+
+// extractedDir is an extracted directory and its header.
+type extractedDir struct {
+	path string
+	hdr  *tar.Header
+}
+
+// copiedLink is a symbolic link at path, to be written as a copy of the file at
+// target.
+type copiedLink struct {
+	name   string
+	path   string
+	target string
+	hdr    *tar.Header
+}
+
+// newExtractor creates an extractor for the restore request, writing into dir
+// at most limit bytes of file content.
+func (c *Cacher) newExtractor(i *RestoreRequest, dir string, limit int64) *extractor {
+	realDir, err := resolveExisting(dir)
+	if err != nil {
+		realDir = filepath.Clean(dir)
+	}
+
+	e := &extractor{
+		c:       c,
+		i:       i,
+		dir:     dir,
+		realDir: realDir,
+		parents: make(map[string]string),
+		limit:   limit,
+	}
+	if i.WriteManifest {
+		e.contents = new(ContentsManifest)
+	}
+	if i.ExtractWorkers > 1 {
+		e.pool = newExtractPool(i.ExtractWorkers, maxPooledBytes)
+	}
+	return e
+}
+
+// extractLimit returns the maximum total size of the file content to extract
+// from an object of the given compressed size, or zero for no limit.
+func extractLimit(i *RestoreRequest, compressedSize int64) int64 {
+	limit := i.MaxUncompressedSize
+	if i.MaxCompressionRatio > 0 {
+		ratioLimit := int64(i.MaxCompressionRatio * float64(compressedSize))
+		if ratioLimit < 1 {
+			ratioLimit = 1
+		}
+		if limit == 0 || ratioLimit < limit {
+			limit = ratioLimit
+		}
+	}
+	return limit
+}
+
+// reserve accounts for size more bytes of extracted file content, failing if
+// that exceeds the limit. The tar reader never returns more content than the
+// header states, so checking the header is enough, except for files which grow
+// as their line endings are converted.
+func (e *extractor) reserve(size int64) error {
+	if e.limit == 0 {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.extracted += size
+	if e.extracted > e.limit {
+		return fmt.Errorf("%w: extracted files are larger than %d bytes", ErrMaxSizeExceeded, e.limit)
+	}
+	return nil
+}
+
+// countEntry accounts for one more extracted entry, failing if that exceeds
+// MaxFiles.
+func (e *extractor) countEntry() error {
+	if e.i.MaxFiles <= 0 {
+		return nil
+	}
+
+	e.entries++
+	if e.entries > e.i.MaxFiles {
+		return fmt.Errorf("%w: archive has more than %d entries", ErrMaxFilesExceeded, e.i.MaxFiles)
+	}
+	return nil
+}
+
+// track records that fpath was created, if created files are being recorded.
+func (e *extractor) track(fpath string) {
+	if e.limit == 0 && e.i.MaxFiles <= 0 {
+		return
+	}
+
+	e.mu.Lock()
+	e.created = append(e.created, fpath)
+	e.mu.Unlock()
+}
+
+// removeCreated removes the files and links created so far on a best-effort
+// basis. Directories are left in place, since they may have existed before.
+func (e *extractor) removeCreated() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.c.log("removing %d partially extracted files", len(e.created))
+	for _, fpath := range e.created {
+		if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+			e.c.log("failed to remove %s: %s", fpath, err)
+		}
+	}
+	e.created = nil
+}
+
+// handler returns the archiver.FileHandler writing the entries to disk. With
+// ContinueOnError, errors writing individual entries are recorded instead of
+// aborting the extraction.
+func (e *extractor) handler() archiver.FileHandler {
+	if !e.i.ContinueOnError {
+		return e.handle
+	}
+
+	return func(ctx context.Context, f archiver.File) error {
+		if err := e.handle(ctx, f); err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrMaxSizeExceeded) || errors.Is(err, ErrMaxFilesExceeded) {
+				return err
+			}
+			return e.check(err)
+		}
+		return nil
+	}
+}
+
+// check records err and returns nil when continuing past errors of individual
+// entries, and returns err otherwise.
+func (e *extractor) check(err error) error {
+	if !e.i.ContinueOnError {
+		return err
+	}
+
+	e.c.warn("continuing after error: %s", err)
+	e.mu.Lock()
+	e.failed = append(e.failed, err)
+	e.mu.Unlock()
+	return nil
+}
+
+// wait blocks until all pending writes have finished and returns the first
+// error encountered by any of them.
+func (e *extractor) wait() error {
+	if e.pool == nil {
+		return nil
+	}
+	return e.pool.wait()
+}
+
+// restored counts the entry with the given name and content size as written and
+// sends a FileRestored event for it.
+func (e *extractor) restored(name string, size int64) {
+	e.mu.Lock()
+	e.files++
+	e.bytes += size
+	e.mu.Unlock()
+
+	sendEvent(e.i.Events, FileRestored{Name: name})
+}
+
+// handle is an archiver.FileHandler which writes a single entry to disk.
+func (e *extractor) handle(ctx context.Context, f archiver.File) error {
+	c, i := e.c, e.i
+
+	hdr, ok := f.Header.(*tar.Header)
+
+	if !ok {
+		return nil
+	}
+
+	// Stop reading the archive as soon as a pending write fails
+	if e.pool != nil {
+		if err := e.pool.error(); err != nil {
+			return err
+		}
+	}
+
+	if i.FileFilter != nil {
+		skip, err := i.FileFilter(f)
+		if err != nil {
+			return err
+		}
+		if skip {
+			c.log("skipping %s (filtered)", f.NameInArchive)
+			return nil
+		}
+	}
+
+	if i.DryRun && hdr.Typeflag != tar.TypeXGlobalHeader {
+		e.listed = append(e.listed, FileEntry{
+			Name:       f.NameInArchive,
+			Size:       hdr.Size,
+			Mode:       f.Mode(),
+			LinkTarget: hdr.Linkname,
+		})
+		return nil
+	}
+
+	fpath, ok := e.entryPath(f.NameInArchive)
+	if !ok {
+		return nil
+	}
+
+	// Nothing is written through a symbolic link restored earlier, which could
+	// otherwise point anywhere
+	realPath, err := e.resolveParent(fpath)
+	if err != nil {
+		return err
+	}
+
+	// An archive may contain the same path more than once, in which case the
+	// last entry must win.
+	if e.pool != nil && e.pool.isPending(realPath) {
+		if err := e.pool.wait(); err != nil {
+			return err
+		}
+	}
+
+	// Directories are always created if missing, but anything else already on
+	// disk is left untouched.
+	if i.SkipExisting && hdr.Typeflag != tar.TypeDir {
+		if _, err := os.Lstat(fpath); err == nil {
+			c.log("skipping %s (already exists)", fpath)
+			return nil
+		}
+	}
+
+	// Directories are always revisited, so their attributes are reapplied
+	if i.Resume && hdr.Typeflag != tar.TypeDir && completed(fpath, hdr) {
+		c.log("skipping %s (already restored)", fpath)
+		if e.contents != nil && hdr.Typeflag == tar.TypeReg {
+			return e.recordExisting(realPath)
+		}
+		return nil
+	}
+
+	if hdr.Typeflag != tar.TypeXGlobalHeader {
+		if err := e.countEntry(); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(fpath, 0755); err != nil {
+			return fmt.Errorf("failed to make directory %s: %w", fpath, err)
+		}
+
+		if i.PreserveXattrs {
+			if err := c.restoreXattrs(fpath, hdr); err != nil {
+				return err
+			}
+		}
+
+		e.dirs = append(e.dirs, extractedDir{path: fpath, hdr: hdr})
+		sendEvent(i.Events, FileRestored{Name: f.NameInArchive})
+		return nil
+
+	case tar.TypeReg, tar.TypeRegA, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := e.reserve(hdr.Size); err != nil {
+			return err
+		}
+
+		in, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: opening file: %v", fpath, err)
+		}
+
+		// Small files are buffered and written concurrently while the archive
+		// continues to be read.
+		if e.pool != nil && hdr.Size <= maxPooledFileSize {
+			buf := make([]byte, hdr.Size)
+			if _, err := io.ReadFull(in, buf); err != nil {
+				return fmt.Errorf("%s: reading file: %v", fpath, err)
+			}
+
+			// The worker writes to the resolved path, since links created
+			// after this entry must not change where it ends up
+			mode := e.fileMode(f.Mode())
+			e.pool.submit(realPath, int64(len(buf)), func() error {
+				if err := e.writeFile(realPath, hdr, mode, bytes.NewReader(buf)); err != nil {
+					return e.check(err)
+				}
+				e.restored(f.NameInArchive, hdr.Size)
+				return nil
+			})
+			return nil
+		}
+
+		if err := e.writeFile(realPath, hdr, e.fileMode(f.Mode()), in); err != nil {
+			return err
+		}
+		e.restored(f.NameInArchive, hdr.Size)
+		return nil
+
+	case tar.TypeSymlink:
+		// Pending writes resolved their paths before the link existed, so
+		// they must finish before it can redirect them
+		if e.pool != nil {
+			if err := e.pool.wait(); err != nil {
+				return err
+			}
+		}
+
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			return fmt.Errorf("failed to make directory %s: %w", filepath.Dir(fpath), err)
+		}
+
+		linkname, ok, err := e.symlinkTarget(realPath, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		if err := removeSymlink(fpath); err != nil {
+			return err
+		}
+		err = symlink(linkname, fpath)
+		if err != nil && isPrivilegeNotHeld(err) && i.WindowsSymlinkMode != WindowsSymlinkError {
+			return e.symlinkFallback(f.NameInArchive, realPath, linkname, hdr)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: making symbolic link for: %v", fpath, err)
+		}
+		e.parents = make(map[string]string)
+		e.track(fpath)
+		e.restored(f.NameInArchive, 0)
+		return nil
+
+	case tar.TypeLink:
+		// The link target must be fully written first
+		if e.pool != nil {
+			if err := e.pool.wait(); err != nil {
+				return err
+			}
+		}
+
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			return fmt.Errorf("failed to make directory %s: %w", filepath.Dir(fpath), err)
+		}
+
+		// The target is another entry of the archive, so its name is mapped
+		// and checked the same way
+		target, ok := e.entryPath(hdr.Linkname)
+		if !ok {
+			c.log("skipping hard link %s (target %s is not restored)", fpath, hdr.Linkname)
+			return nil
+		}
+		realTarget, err := e.resolveParent(target)
+		if err != nil {
+			return err
+		}
+
+		err = os.Link(realTarget, realPath)
+		if err != nil {
+			return fmt.Errorf("%s: making hard link to %s: %v", fpath, target, err)
+		}
+		e.track(fpath)
+		e.restored(f.NameInArchive, 0)
+		return nil
+
+	case tar.TypeXGlobalHeader:
+		return nil // ignore the pax global header from git-generated tarballs
+	default:
+		return fmt.Errorf("%s: unknown type flag: %c", hdr.Name, hdr.Typeflag)
+	}
+}
+
+// completed returns true if the entry of hdr was already written to fpath by an
+// earlier restore. Regular files must have the recorded size and modification
+// time, to the second.
+func completed(fpath string, hdr *tar.Header) bool {
+	fi, err := os.Lstat(fpath)
+	if err != nil {
+		return false
+	}
+
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return true
+	}
+	return fi.Mode().IsRegular() && fi.Size() == hdr.Size && fi.ModTime().Unix() == hdr.ModTime.Unix()
+}
+
+// entryPath returns the path on disk of the entry with the given name in the
+// archive, after StripComponents and Remap. It returns false if the entry is
+// not restored.
+func (e *extractor) entryPath(nameInArchive string) (string, bool) {
+	i := e.i
+
+	name := entryName(nameInArchive)
+	if i.StripComponents > 0 {
+		var ok bool
+		if name, ok = stripComponents(name, i.StripComponents); !ok {
+			e.c.log("skipping %s (fewer than %d path components)", nameInArchive, i.StripComponents)
+			return "", false
+		}
+	}
+	if i.Remap != nil {
+		remapped, skip := i.Remap(name)
+		if skip {
+			e.c.log("skipping %s (remapped)", nameInArchive)
+			return "", false
+		}
+		name = entryName(filepath.ToSlash(remapped))
+	}
+	return filepath.Join(e.dir, filepath.FromSlash(name)), true
+}
+
+// resolveParent returns fpath with the symbolic links in its parent directory
+// resolved. It fails if that directory is outside of the restore directory,
+// such as through a link which the archive created earlier.
+func (e *extractor) resolveParent(fpath string) (string, error) {
+	parent := filepath.Dir(fpath)
+	realParent, ok := e.parents[parent]
+	if !ok {
+		var err error
+		if realParent, err = resolveExisting(parent); err != nil {
+			return "", fmt.Errorf("%s: resolving parent directory: %w", fpath, err)
+		}
+		if !within(e.realDir, realParent) {
+			return "", fmt.Errorf("%s: parent directory resolves to %s, outside of %s", fpath, realParent, e.dir)
+		}
+		e.parents[parent] = realParent
+	}
+	return filepath.Join(realParent, filepath.Base(fpath)), nil
+}
+
+// resolveExisting resolves the symbolic links in pth, which may not exist yet.
+// The missing part of the path is appended to the resolved existing part as is,
+// since it cannot contain links.
+func resolveExisting(pth string) (string, error) {
+	pth = filepath.Clean(pth)
+
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(pth)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(pth)
+		if parent == pth {
+			return "", err
+		}
+		missing = append([]string{filepath.Base(pth)}, missing...)
+		pth = parent
+	}
+}
+
+// within returns true if pth is dir or inside of it. Both must be clean.
+func within(dir, pth string) bool {
+	rel, err := filepath.Rel(dir, pth)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// removeSymlink removes the symbolic link at fpath, if there is one, so that an
+// entry replacing it is not written to the target of the link instead.
+func removeSymlink(fpath string) error {
+	fi, err := os.Lstat(fpath)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	if err := os.Remove(fpath); err != nil {
+		return fmt.Errorf("%s: removing existing symbolic link: %v", fpath, err)
+	}
+	return nil
+}
+
+// entryName normalizes the name of an archive entry into a relative path which
+// stays inside the restore directory. Archives created elsewhere may contain
+// absolute names like "/etc/foo" or "C:\Windows\foo", which are restored as
+// "etc/foo" and "Windows/foo". Backslashes are only treated as separators in
+// names with a drive letter. Parent references which would escape, like
+// "../foo", are dropped.
+func entryName(name string) string {
+	if len(name) >= 2 && name[1] == ':' && ('a' <= name[0] && name[0] <= 'z' || 'A' <= name[0] && name[0] <= 'Z') {
+		name = strings.ReplaceAll(name[2:], `\`, "/")
+	}
+
+	// Cleaning a rooted path removes leading parent references
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// stripComponents removes the first n components of the slash-separated path
+// name. It returns false if nothing remains.
+func stripComponents(name string, n int) (string, bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) <= n {
+		return "", false
+	}
+	return strings.Join(parts[n:], "/"), true
+}
+
+// symlinkTarget applies the symlink policy to a link at fpath pointing to
+// linkname. It returns the target to create the link with, or false if the link
+// should be skipped.
+func (e *extractor) symlinkTarget(fpath, linkname string) (string, bool, error) {
+	policy := e.i.SymlinkPolicy
+	if policy == SymlinkAllow {
+		return linkname, true, nil
+	}
+
+	if escapes(e.realDir, fpath, linkname) {
+		switch policy {
+		case SymlinkError:
+			return "", false, fmt.Errorf("%s: symbolic link to %s escapes %s", fpath, linkname, e.dir)
+		case SymlinkRewriteRelative:
+			if filepath.IsAbs(linkname) {
+				target := filepath.Join(e.realDir, linkname)
+				rel, err := filepath.Rel(filepath.Dir(fpath), target)
+				if err != nil {
+					return "", false, fmt.Errorf("%s: rewriting symbolic link to %s: %w", fpath, linkname, err)
+				}
+				if !escapes(e.realDir, fpath, rel) {
+					e.c.log("rewriting symbolic link %s from %s to %s", fpath, linkname, rel)
+					return rel, true, nil
+				}
+			}
+		}
+
+		e.c.warn("skipping symbolic link %s to %s (escapes %s)", fpath, linkname, e.dir)
+		return "", false, nil
+	}
+	return linkname, true, nil
+}
+
+// symlinkFallback handles a symbolic link at fpath pointing to linkname which
+// could not be created, according to the WindowsSymlinkMode.
+func (e *extractor) symlinkFallback(name, fpath, linkname string, hdr *tar.Header) error {
+	if e.i.WindowsSymlinkMode == WindowsSymlinkSkip {
+		e.c.warn("skipping symbolic link %s to %s (not permitted)", fpath, linkname)
+		return nil
+	}
+
+	if escapes(e.realDir, fpath, linkname) {
+		e.c.warn("skipping symbolic link %s to %s (not permitted, and the target is outside of %s)", fpath, linkname, e.dir)
+		return nil
+	}
+
+	// The target may come later in the archive, so it is copied at the end
+	e.links = append(e.links, copiedLink{
+		name:   name,
+		path:   fpath,
+		target: filepath.Join(filepath.Dir(fpath), linkname),
+		hdr:    hdr,
+	})
+	return nil
+}
+
+// finishLinks writes the copies of the link targets for WindowsSymlinkCopy. A
+// target may itself be a copied link, so links are copied in passes until no
+// more targets become available.
+func (e *extractor) finishLinks() error {
+	pending := e.links
+	for len(pending) > 0 {
+		var next []copiedLink
+		for _, l := range pending {
+			fi, err := os.Stat(l.target)
+			if os.IsNotExist(err) {
+				next = append(next, l)
+				continue
+			}
+			if err == nil && !fi.Mode().IsRegular() {
+				e.c.warn("skipping symbolic link %s (not permitted, and the target is not a regular file)", l.path)
+				continue
+			}
+			if err == nil {
+				err = e.copyLink(l, fi)
+			}
+			if err != nil {
+				if err := e.check(err); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(next) == len(pending) {
+			for _, l := range next {
+				e.c.warn("skipping symbolic link %s (not permitted, and the target %s does not exist)", l.path, l.target)
+			}
+			break
+		}
+		pending = next
+	}
+	return nil
+}
+
+// copyLink writes the content of the link target in place of the link.
+func (e *extractor) copyLink(l copiedLink, fi os.FileInfo) error {
+	if err := e.reserve(fi.Size()); err != nil {
+		return err
+	}
+
+	in, err := os.Open(l.target)
+	if err != nil {
+		return fmt.Errorf("%s: opening link target: %v", l.path, err)
+	}
+	defer in.Close()
+
+	// Links restored since may have changed where the path resolves
+	realPath, err := e.resolveParent(l.path)
+	if err != nil {
+		return err
+	}
+
+	e.c.log("copying %s to %s (symbolic links not permitted)", l.target, l.path)
+	if err := e.writeFile(realPath, l.hdr, fi.Mode().Perm(), in); err != nil {
+		return err
+	}
+	e.restored(l.name, fi.Size())
+	return nil
+}
+
+// escapes returns true if a symlink at fpath pointing to linkname is absolute or
+// resolves outside of dir, following the links already on disk. The parent
+// directory of fpath must already be resolved, like dir.
+func escapes(dir, fpath, linkname string) bool {
+	if filepath.IsAbs(linkname) {
+		return true
+	}
+	target, err := resolveLink(filepath.Dir(fpath), linkname, 0)
+	return err != nil || !within(filepath.Clean(dir), target)
+}
+
+// maxLinkDepth is the number of symbolic links resolveLink follows before
+// giving up, like the limit of the operating system.
+const maxLinkDepth = 40
+
+// resolveLink returns the path which linkname resolves to from the resolved
+// directory dir. Unlike joining them and calling resolveExisting, which cleans
+// the path first, a parent reference following a link on disk applies to the
+// target of that link, as it does when the link is used. The missing part of
+// the path is appended as is.
+func resolveLink(dir, linkname string, depth int) (string, error) {
+	if depth > maxLinkDepth {
+		return "", fmt.Errorf("%s: too many levels of symbolic links", linkname)
+	}
+	if filepath.IsAbs(linkname) {
+		vol := filepath.VolumeName(linkname)
+		dir, linkname = vol+string(filepath.Separator), linkname[len(vol):]
+	}
+
+	parts := strings.Split(filepath.ToSlash(linkname), "/")
+	for idx, part := range parts {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			dir = filepath.Dir(dir)
+			continue
+		}
+
+		next := filepath.Join(dir, part)
+		fi, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			return filepath.Join(append([]string{next}, parts[idx+1:]...)...), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			dir = next
+			continue
+		}
+
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if dir, err = resolveLink(dir, target, depth+1); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// writeFile creates the file at fpath with the given mode and the content of
+// in, then applies the attributes recorded in hdr. The parent directory of fpath
+// must already be resolved by resolveParent.
+func (e *extractor) writeFile(fpath string, hdr *tar.Header, mode os.FileMode, in io.Reader) error {
+	c, i := e.c, e.i
+
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return fmt.Errorf("failed to make directory %s: %w", filepath.Dir(fpath), err)
+	}
+
+	if err := removeSymlink(fpath); err != nil {
+		return err
+	}
+	out, err := os.Create(fpath)
+	if err != nil {
+		return fmt.Errorf("%s: creating new file: %v", fpath, err)
+	}
+	defer out.Close()
+	e.track(fpath)
+
+	err = out.Chmod(mode)
+	if err != nil && runtime.GOOS != "windows" {
+		return fmt.Errorf("%s: changing file mode: %v", fpath, err)
+	}
+
+	// Content identical to a file restored earlier is cloned from it, if
+	// requested and supported
+	if i.UseReflink && !e.normalizes(hdr) && e.clone(out, hdr) {
+		if e.contents != nil {
+			e.record(fpath, hdr.Size, mode, hdr.PAXRecords[paxChecksumKey])
+		}
+	} else {
+		var dst io.Writer = out
+		var h hash.Hash
+		if e.contents != nil {
+			if h, err = blake2b.New256(nil); err != nil {
+				return fmt.Errorf("failed to create hash: %w", err)
+			}
+			dst = io.MultiWriter(out, h)
+		}
+
+		// The size and checksum recorded are those of the file on disk
+		counter := &countingWriter{w: dst}
+		dst = counter
+
+		// Converted files may grow, so the bytes beyond the size in the
+		// archive are accounted for as they are written
+		var eol *lineEndingWriter
+		if e.normalizes(hdr) {
+			eol = newLineEndingWriter(&reservingWriter{w: dst, e: e, free: hdr.Size}, nativeCRLF)
+			dst = eol
+		}
+
+		if _, err := copyBuffered(dst, in); err != nil {
+			if errors.Is(err, ErrMaxSizeExceeded) {
+				return err
+			}
+			return fmt.Errorf("%s: writing file: %v", fpath, err)
+		}
+		if eol != nil {
+			if err := eol.Flush(); err != nil {
+				if errors.Is(err, ErrMaxSizeExceeded) {
+					return err
+				}
+				return fmt.Errorf("%s: writing file: %v", fpath, err)
+			}
+		}
+
+		if h != nil {
+			e.record(fpath, counter.count(), mode, fmt.Sprintf("%x", h.Sum(nil)))
+		}
+	}
+
+	// Writing clears the setuid and setgid bits, so they are applied last
+	if i.PreserveSpecialBits {
+		if err := restoreSpecialBits(fpath, hdr); err != nil {
+			return err
+		}
+	}
+
+	if i.PreserveXattrs {
+		if err := c.restoreXattrs(fpath, hdr); err != nil {
+			return err
+		}
+	}
+
+	// Normalized files differ from the archived content by design
+	if i.Verify && hdr.Typeflag == tar.TypeReg && !e.normalizes(hdr) {
+		if err := verifyFile(fpath, hdr); err != nil {
+			return err
+		}
+	}
+
+	// Verifying reads the file, so times are applied last
+	if err := e.restoreTimes(fpath, hdr); err != nil {
+		return err
+	}
+
+	if i.UseReflink && !e.normalizes(hdr) {
+		e.addCloneSource(fpath, hdr)
+	}
+	return nil
+}
+
+// reservingWriter reserves the bytes written to w beyond the first free bytes,
+// which were already reserved.
+type reservingWriter struct {
+	w    io.Writer
+	e    *extractor
+	free int64
+}
+
+// Write reserves the bytes of p which are not covered by free and writes p.
+func (r *reservingWriter) Write(p []byte) (int, error) {
+	if n := int64(len(p)); n > r.free {
+		if err := r.e.reserve(n - r.free); err != nil {
+			return 0, err
+		}
+		r.free = 0
+	} else {
+		r.free -= n
+	}
+	return r.w.Write(p)
+}
+
+// normalizes returns true if the line endings of the file of hdr are
+// converted, for NormalizeLineEndings.
+func (e *extractor) normalizes(hdr *tar.Header) bool {
+	if len(e.i.NormalizeLineEndings) == 0 {
+		return false
+	}
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return false
+	}
+	return matchAny(e.i.NormalizeLineEndings, hdr.Name)
+}
+
+// clone makes out share the content of an earlier restored file with the
+// checksum recorded in hdr, if there is one and the filesystem supports it. It
+// returns false if the content has to be written instead.
+func (e *extractor) clone(out *os.File, hdr *tar.Header) bool {
+	sum, ok := hdr.PAXRecords[paxChecksumKey]
+	if !ok || hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+		return false
+	}
+
+	e.mu.Lock()
+	src, ok := e.clones[sum]
+	unsupported := e.noReflink
+	e.mu.Unlock()
+	if !ok || unsupported {
+		return false
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return false
+	}
+	defer in.Close()
+
+	// An unsupported filesystem fails every time, so it is only tried once
+	if err := reflink(out, in); err != nil {
+		e.c.log("not cloning %s from %s: %s", out.Name(), src, err)
+		e.mu.Lock()
+		e.noReflink = true
+		e.mu.Unlock()
+		return false
+	}
+	e.c.log("cloned %s from %s", out.Name(), src)
+	return true
+}
+
+// addCloneSource records the file at fpath as the source for cloning later
+// files with the checksum recorded in hdr.
+func (e *extractor) addCloneSource(fpath string, hdr *tar.Header) {
+	sum, ok := hdr.PAXRecords[paxChecksumKey]
+	if !ok || hdr.Typeflag != tar.TypeReg {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.clones == nil {
+		e.clones = make(map[string]string)
+	}
+	if _, ok := e.clones[sum]; !ok {
+		e.clones[sum] = fpath
+	}
+}
+
+// record adds a written file to the contents manifest. Like the paths written
+// to, fpath is relative to the resolved restore directory.
+func (e *extractor) record(fpath string, size int64, mode os.FileMode, sum string) {
+	rel, err := filepath.Rel(e.realDir, fpath)
+	if err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.contents.add(filepath.ToSlash(rel), size, mode, sum)
+}
+
+// recordExisting adds a file restored by an earlier restore to the contents
+// manifest.
+func (e *extractor) recordExisting(fpath string) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return fmt.Errorf("%s: opening file: %v", fpath, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("%s: reading file info: %v", fpath, err)
+	}
+	sum, err := checksum(f)
+	if err != nil {
+		return fmt.Errorf("%s: failed to checksum: %w", fpath, err)
+	}
+	e.record(fpath, fi.Size(), fi.Mode(), sum)
+	return nil
+}
+
+// restoreTimes applies the modification and access times recorded in hdr to
+// the file at pth, as requested. Times which are not applied are left
+// unchanged.
+func (e *extractor) restoreTimes(pth string, hdr *tar.Header) error {
+	var atime, mtime time.Time
+	if e.i.PreserveTimes || e.i.Resume {
+		mtime = hdr.ModTime
+	}
+	if e.i.PreserveAccessTimes {
+		atime = hdr.AccessTime
+	}
+	if atime.IsZero() && mtime.IsZero() {
+		return nil
+	}
+
+	if err := os.Chtimes(pth, atime, mtime); err != nil {
+		return fmt.Errorf("%s: changing file times: %v", pth, err)
+	}
+	return nil
+}
+
+// finishDirs applies the recorded modes and times to the extracted
+// directories. This happens once everything is extracted, since a read-only
+// directory could not be filled and creating entries updates the modification
+// time of their directory.
+func (e *extractor) finishDirs() error {
+	for _, d := range e.dirs {
+		if err := e.finishDir(d.path, d.hdr); err != nil {
+			if err := e.check(err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// finishDir applies the mode and times recorded in hdr to the directory at pth.
+func (e *extractor) finishDir(pth string, hdr *tar.Header) error {
+	// The mode is set explicitly, so the umask does not apply
+	if err := os.Chmod(pth, e.dirMode(hdr)); err != nil && runtime.GOOS != "windows" {
+		return fmt.Errorf("%s: changing directory mode: %v", pth, err)
+	}
+
+	if e.i.PreserveSpecialBits {
+		if err := restoreSpecialBits(pth, hdr); err != nil {
+			return err
+		}
+	}
+	return e.restoreTimes(pth, hdr)
+}
+
+// fileMode returns the permissions to create a file with, given its mode in the
+// archive. A mode without any permission bits counts as missing. The setuid,
+// setgid, and sticky bits are never included, since they are only applied by
+// PreserveSpecialBits.
+func (e *extractor) fileMode(mode os.FileMode) os.FileMode {
+	if mode.Perm() != 0 {
+		return mode.Perm()
+	}
+	if e.i.DefaultFileMode.Perm() != 0 {
+		return e.i.DefaultFileMode.Perm()
+	}
+	return 0644
+}
+
+// dirMode returns the permissions of the directory of hdr. A mode without any
+// permission bits counts as missing.
+func (e *extractor) dirMode(hdr *tar.Header) os.FileMode {
+	if perm := os.FileMode(hdr.Mode).Perm(); perm != 0 {
+		return perm
+	}
+	if e.i.DefaultDirMode.Perm() != 0 {
+		return e.i.DefaultDirMode.Perm()
+	}
+	return 0755
+}
+
+// restoreSpecialBits applies the permissions in the raw mode of hdr including
+// the setuid, setgid, and sticky bits, which are otherwise not applied. It is a
+// no-op on Windows and when none of the bits are set.
+func restoreSpecialBits(pth string, hdr *tar.Header) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	var special os.FileMode
+	if hdr.Mode&cISUID != 0 {
+		special |= os.ModeSetuid
+	}
+	if hdr.Mode&cISGID != 0 {
+		special |= os.ModeSetgid
+	}
+	if hdr.Mode&cISVTX != 0 {
+		special |= os.ModeSticky
+	}
+	if special == 0 {
+		return nil
+	}
+
+	if err := os.Chmod(pth, os.FileMode(hdr.Mode).Perm()|special); err != nil {
+		return fmt.Errorf("%s: changing file mode: %v", pth, err)
+	}
+	return nil
+}
+
+// extractPool is a bounded pool of workers which write buffered files, capping
+// the total number of bytes buffered for pending writes.
+type extractPool struct {
+	workers chan struct{}
+	wg      sync.WaitGroup
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	buffered    int64
+	maxBuffered int64
+	pending     map[string]struct{}
+	err         error
+}
+
+// newExtractPool creates a pool with the given number of workers.
+func newExtractPool(workers int, maxBuffered int64) *extractPool {
+	p := &extractPool{
+		workers:     make(chan struct{}, workers),
+		maxBuffered: maxBuffered,
+		pending:     make(map[string]struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// submit runs fn on a worker once size bytes of buffer space and a worker are
+// available, blocking until then. fpath is the path fn writes.
+func (p *extractPool) submit(fpath string, size int64, fn func() error) {
+	p.mu.Lock()
+	for p.buffered > 0 && p.buffered+size > p.maxBuffered {
+		p.cond.Wait()
+	}
+	p.buffered += size
+	p.pending[fpath] = struct{}{}
+	p.mu.Unlock()
+
+	p.workers <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		err := fn()
+		<-p.workers
+
+		p.mu.Lock()
+		if err != nil && p.err == nil {
+			p.err = err
+		}
+		p.buffered -= size
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}()
+}
+
+// isPending returns true if a write to fpath has been submitted since the last
+// wait.
+func (p *extractPool) isPending(fpath string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.pending[fpath]
+	return ok
+}
+
+// error returns the first error encountered by a worker, if any.
+func (p *extractPool) error() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// wait blocks until all submitted writes have finished and returns the first
+// error encountered by any of them.
+func (p *extractPool) wait() error {
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = make(map[string]struct{})
+	return p.err
+}
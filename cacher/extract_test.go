@@ -0,0 +1,1115 @@
+package cacher
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/archiver/v4"
+)
+
+// testEntry is an entry of a test archive.
+type testEntry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	linkname string
+	content  string
+}
+
+// fileEntry, dirEntry, symlinkEntry, and hardlinkEntry return test entries of
+// each type.
+func fileEntry(name, content string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeReg, mode: 0644, content: content}
+}
+
+func dirEntry(name string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeDir, mode: 0755}
+}
+
+func symlinkEntry(name, linkname string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeSymlink, mode: 0777, linkname: linkname}
+}
+
+func hardlinkEntry(name, linkname string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeLink, mode: 0644, linkname: linkname}
+}
+
+// testArchive returns a gzip-compressed tar archive of the entries.
+func testArchive(tb testing.TB, entries []testEntry) []byte {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Typeflag: entry.typeflag,
+			Name:     entry.name,
+			Linkname: entry.linkname,
+			Mode:     entry.mode,
+			Size:     int64(len(entry.content)),
+			ModTime:  time.Unix(1600000000, 0),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testExtract extracts the archive into dir like Restore does once the object
+// is open.
+func testExtract(tb testing.TB, i *RestoreRequest, dir string, archive []byte) (*extractor, error) {
+	tb.Helper()
+
+	c := &Cacher{}
+	ex := c.newExtractor(i, dir, extractLimit(i, int64(len(archive))))
+	err := extractArchive(context.Background(), bytes.NewReader(archive), archiver.Gz{}, ex.handler())
+	if werr := ex.wait(); werr != nil && err == nil {
+		err = werr
+	}
+	if err != nil {
+		if errors.Is(err, ErrMaxSizeExceeded) || errors.Is(err, ErrMaxFilesExceeded) {
+			ex.removeCreated()
+		}
+		return ex, err
+	}
+	if err := ex.finishLinks(); err != nil {
+		return ex, err
+	}
+	if ex.contents != nil {
+		if err := ex.writeManifest(); err != nil {
+			return ex, err
+		}
+	}
+	return ex, ex.finishDirs()
+}
+
+// testDirs returns a restore directory inside a parent directory, so tests can
+// check nothing was written next to it.
+func testDirs(tb testing.TB) (parent, dir string) {
+	tb.Helper()
+
+	parent = tb.TempDir()
+	dir = filepath.Join(parent, "restore")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	return parent, dir
+}
+
+func TestExtract_escapes(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links require privileges on windows")
+	}
+
+	cases := []struct {
+		name    string
+		policy  SymlinkPolicy
+		entries []testEntry
+		err     string
+	}{
+		{
+			name:   "link_chain",
+			policy: SymlinkSkipEscaping,
+			entries: []testEntry{
+				symlinkEntry("a", "."),
+				symlinkEntry("a/a/a/l", "../../.."),
+				fileEntry("l/x", "pwned"),
+			},
+		},
+		{
+			name:   "link_chain_error",
+			policy: SymlinkError,
+			entries: []testEntry{
+				symlinkEntry("a", "."),
+				symlinkEntry("a/a/a/l", "../../.."),
+				fileEntry("l/x", "pwned"),
+			},
+			err: "escapes",
+		},
+		{
+			// Lexically, x/a/../.. is the restore directory, but x/a is a link
+			// to a sibling, so it is actually the parent one
+			name:   "link_through_link",
+			policy: SymlinkSkipEscaping,
+			entries: []testEntry{
+				dirEntry("x/"),
+				dirEntry("y/"),
+				symlinkEntry("x/a", "../y"),
+				symlinkEntry("b", "x/a/../.."),
+				fileEntry("b/x", "pwned"),
+			},
+		},
+		{
+			name:   "link_through_link_error",
+			policy: SymlinkError,
+			entries: []testEntry{
+				dirEntry("x/"),
+				dirEntry("y/"),
+				symlinkEntry("x/a", "../y"),
+				symlinkEntry("b", "x/a/../.."),
+				fileEntry("b/x", "pwned"),
+			},
+			err: "escapes",
+		},
+		{
+			name:   "write_through_allowed_link",
+			policy: SymlinkAllow,
+			entries: []testEntry{
+				symlinkEntry("l", ".."),
+				fileEntry("l/x", "pwned"),
+			},
+			err: "outside of",
+		},
+		{
+			name:   "hard_link_through_allowed_link",
+			policy: SymlinkAllow,
+			entries: []testEntry{
+				symlinkEntry("l", ".."),
+				hardlinkEntry("l/x", "y"),
+			},
+			err: "outside of",
+		},
+		{
+			name:   "parent_references",
+			policy: SymlinkSkipEscaping,
+			entries: []testEntry{
+				fileEntry("../x", "contained"),
+				fileEntry("/x", "contained"),
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// The links in the cases climb up to three levels, which must all
+			// exist to be resolved
+			parent, dir := testDirs(t)
+			dir = filepath.Join(dir, "one", "two")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := testExtract(t, &RestoreRequest{SymlinkPolicy: tc.policy}, dir, testArchive(t, tc.entries))
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("expected error containing %q, got %v", tc.err, err)
+			}
+
+			for _, pth := range []string{filepath.Join(parent, "x"), filepath.Join(parent, "restore", "x"), filepath.Join(parent, "restore", "one", "x")} {
+				if _, err := os.Lstat(pth); !os.IsNotExist(err) {
+					t.Errorf("expected nothing written outside of the restore directory, got %v", err)
+				}
+			}
+			if tc.policy != SymlinkAllow {
+				assertContained(t, dir)
+			}
+		})
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links require privileges on windows")
+	}
+
+	parent, dir := testDirs(t)
+	for _, pth := range []string{"x", "y", "sub"} {
+		if err := os.Mkdir(filepath.Join(dir, pth), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{
+		"x/a":  "../y",
+		"up":   "..",
+		"loop": "loop",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		linkname string
+		exp      bool
+	}{
+		{name: "safe", linkname: "sub/file", exp: false},
+		{name: "self", linkname: ".", exp: false},
+		{name: "missing", linkname: "new/dir/../file", exp: false},
+		{name: "parent", linkname: "../outside", exp: true},
+		{name: "absolute", linkname: filepath.Join(parent, "restore", "sub"), exp: true},
+		{name: "through_link", linkname: "x/a/file", exp: false},
+		{name: "back_through_link", linkname: "x/a/..", exp: false},
+		{name: "chained", linkname: "x/a/../..", exp: true},
+		{name: "into_dir_through_link", linkname: "up/restore/sub", exp: false},
+		{name: "out_through_link", linkname: "up/other", exp: true},
+		{name: "loop", linkname: "loop/file", exp: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := escapes(realDir, filepath.Join(realDir, "link"), tc.linkname); got != tc.exp {
+				t.Errorf("expected %t for %s, got %t", tc.exp, tc.linkname, got)
+			}
+		})
+	}
+}
+
+// assertContained fails if any symbolic link in dir resolves outside of it.
+func assertContained(tb testing.TB, dir string) {
+	tb.Helper()
+
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		target, err := filepath.EvalSymlinks(pth)
+		if err != nil {
+			return nil
+		}
+		if !within(realDir, target) {
+			tb.Errorf("expected %s to resolve inside of %s, got %s", pth, realDir, target)
+		}
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestExtract_replacesSymlink(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links require privileges on windows")
+	}
+
+	parent, dir := testDirs(t)
+	outside := filepath.Join(parent, "outside")
+	if err := ioutil.WriteFile(outside, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := testArchive(t, []testEntry{
+		symlinkEntry("f", "../outside"),
+		fileEntry("f", "replaced"),
+	})
+	if _, err := testExtract(t, &RestoreRequest{SymlinkPolicy: SymlinkAllow}, dir, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ioutil.ReadFile(outside); err != nil || string(b) != "original" {
+		t.Errorf("expected the link target to be unchanged, got %q (%v)", b, err)
+	}
+	fi, err := os.Lstat(filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.Mode().IsRegular() {
+		t.Errorf("expected f to be a regular file, got %s", fi.Mode())
+	}
+}
+
+func TestExtract_hardLinks(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		req     *RestoreRequest
+		entries []testEntry
+		link    string
+		target  string
+		err     bool
+	}{
+		{
+			name: "same_directory",
+			req:  &RestoreRequest{},
+			entries: []testEntry{
+				fileEntry("a/b", "content"),
+				hardlinkEntry("a/c", "a/b"),
+			},
+			link:   "a/c",
+			target: "a/b",
+		},
+		{
+			name: "other_directory",
+			req:  &RestoreRequest{},
+			entries: []testEntry{
+				fileEntry("a/b", "content"),
+				hardlinkEntry("d/e/f", "a/b"),
+			},
+			link:   "d/e/f",
+			target: "a/b",
+		},
+		{
+			name: "parent_references",
+			req:  &RestoreRequest{},
+			entries: []testEntry{
+				fileEntry("a/b", "content"),
+				hardlinkEntry("c", "../../a/b"),
+			},
+			link:   "c",
+			target: "a/b",
+		},
+		{
+			name: "strip_components",
+			req:  &RestoreRequest{StripComponents: 1},
+			entries: []testEntry{
+				fileEntry("top/a/b", "content"),
+				hardlinkEntry("top/c", "top/a/b"),
+			},
+			link:   "c",
+			target: "a/b",
+		},
+		{
+			name: "missing_target",
+			req:  &RestoreRequest{},
+			entries: []testEntry{
+				hardlinkEntry("c", "../../etc/passwd"),
+			},
+			err: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, dir := testDirs(t)
+			_, err := testExtract(t, tc.req, dir, testArchive(t, tc.entries))
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+			if tc.err {
+				return
+			}
+
+			link, err := os.Stat(filepath.Join(dir, filepath.FromSlash(tc.link)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			target, err := os.Stat(filepath.Join(dir, filepath.FromSlash(tc.target)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(link, target) {
+				t.Errorf("expected %s to be a hard link to %s", tc.link, tc.target)
+			}
+		})
+	}
+}
+
+func TestExtract_specialBits(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("special bits are not supported on windows")
+	}
+
+	cases := []struct {
+		name     string
+		preserve bool
+		mode     os.FileMode
+	}{
+		{
+			name: "dropped",
+			mode: 0755,
+		},
+		{
+			name:     "preserved",
+			preserve: true,
+			mode:     0755 | os.ModeSetuid | os.ModeSetgid,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			entry := fileEntry("bin", "#!/bin/sh\n")
+			entry.mode = 0755 | cISUID | cISGID
+
+			_, dir := testDirs(t)
+			i := &RestoreRequest{PreserveSpecialBits: tc.preserve}
+			if _, err := testExtract(t, i, dir, testArchive(t, []testEntry{entry})); err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(filepath.Join(dir, "bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mask := os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+			if got := fi.Mode() & mask; got != tc.mode {
+				t.Errorf("expected mode %s, got %s", tc.mode, got)
+			}
+		})
+	}
+}
+
+func TestExtract_fileMode(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		def  os.FileMode
+		mode os.FileMode
+		exp  os.FileMode
+	}{
+		{name: "archived", mode: 0600, exp: 0600},
+		{name: "missing", mode: 0, exp: 0644},
+		{name: "missing_default", def: 0640, mode: 0, exp: 0640},
+		{name: "special_bits", mode: 0755 | os.ModeSetuid | os.ModeSticky, exp: 0755},
+		{name: "special_bits_only", mode: os.ModeSetgid, exp: 0644},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			e := &extractor{i: &RestoreRequest{DefaultFileMode: tc.def}}
+			if got := e.fileMode(tc.mode); got != tc.exp {
+				t.Errorf("expected %s, got %s", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestExtract_lineEndingsLimit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("line endings are already converted to crlf on windows")
+	}
+
+	// Converting to CRLF grows each file by one byte per line
+	nativeCRLF = true
+	defer func() { nativeCRLF = false }()
+
+	entries := []testEntry{
+		fileEntry("a.txt", "1\n2\n3\n"),
+		fileEntry("b.bin", "1\n2\n3\n"),
+	}
+
+	cases := []struct {
+		name  string
+		limit int64
+		err   error
+	}{
+		{name: "within", limit: 15},
+		{name: "exceeded", limit: 14, err: ErrMaxSizeExceeded},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, dir := testDirs(t)
+			i := &RestoreRequest{
+				MaxUncompressedSize:  tc.limit,
+				NormalizeLineEndings: []string{"*.txt"},
+			}
+			_, err := testExtract(t, i, dir, testArchive(t, entries))
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if tc.err != nil {
+				return
+			}
+
+			b, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, exp := string(b), "1\r\n2\r\n3\r\n"; got != exp {
+				t.Errorf("expected %q, got %q", exp, got)
+			}
+		})
+	}
+}
+
+func TestExtractPool(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		workers     int
+		maxBuffered int64
+		size        int64
+	}{
+		{name: "serial", workers: 1, maxBuffered: 100, size: 10},
+		{name: "bounded_by_workers", workers: 3, maxBuffered: 1000, size: 10},
+		{name: "bounded_by_buffer", workers: 8, maxBuffered: 30, size: 10},
+		{name: "larger_than_buffer", workers: 4, maxBuffered: 5, size: 10},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := newExtractPool(tc.workers, tc.maxBuffered)
+
+			var mu sync.Mutex
+			var running, maxRunning int
+			var maxBuffered int64
+			for idx := 0; idx < 50; idx++ {
+				p.submit(fmt.Sprintf("file%d", idx), tc.size, func() error {
+					mu.Lock()
+					running++
+					if running > maxRunning {
+						maxRunning = running
+					}
+					mu.Unlock()
+
+					p.mu.Lock()
+					if p.buffered > maxBuffered {
+						maxBuffered = p.buffered
+					}
+					p.mu.Unlock()
+
+					time.Sleep(time.Millisecond)
+
+					mu.Lock()
+					running--
+					mu.Unlock()
+					return nil
+				})
+			}
+			if !p.isPending("file49") {
+				t.Error("expected a submitted file to be pending")
+			}
+			if err := p.wait(); err != nil {
+				t.Fatal(err)
+			}
+			if p.isPending("file49") {
+				t.Error("expected nothing to be pending after waiting")
+			}
+
+			if maxRunning > tc.workers {
+				t.Errorf("expected at most %d workers, got %d", tc.workers, maxRunning)
+			}
+			// A single file larger than the cap is still written
+			limit := tc.maxBuffered
+			if tc.size > limit {
+				limit = tc.size
+			}
+			if maxBuffered > limit {
+				t.Errorf("expected at most %d bytes buffered, got %d", limit, maxBuffered)
+			}
+		})
+	}
+}
+
+func TestExtractPool_error(t *testing.T) {
+	t.Parallel()
+
+	p := newExtractPool(4, 100)
+	errFirst := errors.New("first")
+	p.submit("a", 1, func() error { return errFirst })
+	if err := p.wait(); err != errFirst {
+		t.Fatalf("expected the error of the failed write, got %v", err)
+	}
+
+	p.submit("b", 1, func() error { return errors.New("second") })
+	if err := p.wait(); err != errFirst {
+		t.Errorf("expected the first error to be kept, got %v", err)
+	}
+	if err := p.error(); err != errFirst {
+		t.Errorf("expected the first error, got %v", err)
+	}
+}
+
+// listTree returns a line for each entry in dir, with the content of files and
+// the targets of links.
+func listTree(tb testing.TB, dir string) []string {
+	tb.Helper()
+
+	var lines []string
+	err := filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if err != nil || pth == dir {
+			return err
+		}
+		name := filepath.ToSlash(strings.TrimPrefix(pth, dir+string(filepath.Separator)))
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(pth)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("%s -> %s", name, target))
+		case info.IsDir():
+			lines = append(lines, fmt.Sprintf("%s/ %s", name, info.Mode().Perm()))
+		default:
+			b, err := ioutil.ReadFile(pth)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("%s %s %q", name, info.Mode().Perm(), b))
+		}
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return lines
+}
+
+func TestExtract_workers(t *testing.T) {
+	t.Parallel()
+
+	many := []testEntry{dirEntry("root/")}
+	for idx := 0; idx < 200; idx++ {
+		many = append(many, fileEntry(fmt.Sprintf("root/%02d/file%03d", idx%10, idx), strings.Repeat("x", idx)))
+	}
+
+	cases := []struct {
+		name    string
+		entries []testEntry
+	}{
+		{
+			name:    "many_files",
+			entries: many,
+		},
+		{
+			// The last entry for a path wins, however the writes are scheduled
+			name: "duplicates",
+			entries: []testEntry{
+				fileEntry("a", "first"),
+				fileEntry("b", "other"),
+				fileEntry("a", "second"),
+				fileEntry("a", "third"),
+			},
+		},
+		{
+			name: "hard_links",
+			entries: []testEntry{
+				fileEntry("dir/target", "shared"),
+				hardlinkEntry("dir/link", "dir/target"),
+			},
+		},
+		{
+			name: "symlinks",
+			entries: []testEntry{
+				fileEntry("dir/target", "linked"),
+				symlinkEntry("link", "dir"),
+				fileEntry("link/other", "through the link"),
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if runtime.GOOS == "windows" && tc.name == "symlinks" {
+				t.Skip("symbolic links require privileges on windows")
+			}
+
+			archive := testArchive(t, tc.entries)
+
+			serial := t.TempDir()
+			if _, err := testExtract(t, &RestoreRequest{}, serial, archive); err != nil {
+				t.Fatal(err)
+			}
+			exp := listTree(t, serial)
+
+			for _, workers := range []int{2, 8} {
+				dir := t.TempDir()
+				if _, err := testExtract(t, &RestoreRequest{ExtractWorkers: workers}, dir, archive); err != nil {
+					t.Fatal(err)
+				}
+				if got := listTree(t, dir); strings.Join(got, "\n") != strings.Join(exp, "\n") {
+					t.Errorf("expected the same tree as a serial extraction with %d workers\nexpected: %q\ngot:      %q", workers, exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestExtract_workersEscapes(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links require privileges on windows")
+	}
+
+	cases := []struct {
+		name    string
+		policy  SymlinkPolicy
+		entries []testEntry
+	}{
+		{
+			// The file is still being written when the link replaces its
+			// parent directory
+			name:   "link_replaces_parent",
+			policy: SymlinkAllow,
+			entries: []testEntry{
+				fileEntry("b/evil", "pwned"),
+				symlinkEntry("b", "../outside"),
+			},
+		},
+		{
+			name: "link_through_link",
+			entries: []testEntry{
+				dirEntry("x/"),
+				dirEntry("y/"),
+				symlinkEntry("x/a", "../y"),
+				fileEntry("b/evil", "pwned"),
+				symlinkEntry("b", "x/a/../.."),
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			archive := testArchive(t, tc.entries)
+
+			// The race is lost only occasionally, so the archive is extracted
+			// many times
+			for run := 0; run < 50; run++ {
+				parent, dir := testDirs(t)
+				if err := os.Mkdir(filepath.Join(parent, "outside"), 0755); err != nil {
+					t.Fatal(err)
+				}
+
+				// The link conflicts with the directory of the file, so failing
+				// is fine as long as nothing escapes
+				testExtract(t, &RestoreRequest{SymlinkPolicy: tc.policy, ExtractWorkers: 4}, dir, archive)
+
+				for _, pth := range []string{filepath.Join(parent, "outside", "evil"), filepath.Join(parent, "evil")} {
+					if _, err := os.Lstat(pth); !os.IsNotExist(err) {
+						t.Fatalf("expected nothing written outside of the restore directory in run %d, got %v", run, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkExtract(b *testing.B) {
+	entries := []testEntry{dirEntry("root/")}
+	for idx := 0; idx < 500; idx++ {
+		entries = append(entries, fileEntry(fmt.Sprintf("root/file%03d", idx), strings.Repeat("x", 4096)))
+	}
+	archive := testArchive(b, entries)
+
+	for _, workers := range []int{1, 4, 16} {
+		workers := workers
+
+		b.Run(fmt.Sprintf("workers_%d", workers), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(500 * 4096)
+			for i := 0; i < b.N; i++ {
+				if _, err := testExtract(b, &RestoreRequest{ExtractWorkers: workers}, b.TempDir(), archive); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestExtract_fileFilter(t *testing.T) {
+	t.Parallel()
+
+	errFilter := errors.New("filter failed")
+
+	cases := []struct {
+		name   string
+		filter func(f archiver.File) (bool, error)
+		exp    []string
+		err    error
+	}{
+		{
+			name: "none",
+			exp:  []string{`a/ -rwxr-xr-x`, `a/keep.txt -rw-r--r-- "keep"`, `a/skip.log -rw-r--r-- "a"`, `b/ -rwxr-xr-x`, `b/skip.log -rw-r--r-- "b"`},
+		},
+		{
+			name: "skip_pattern",
+			filter: func(f archiver.File) (bool, error) {
+				return path.Ext(f.NameInArchive) == ".log", nil
+			},
+			exp: []string{`a/ -rwxr-xr-x`, `a/keep.txt -rw-r--r-- "keep"`, `b/ -rwxr-xr-x`},
+		},
+		{
+			// Its contents are still restored, creating the directory
+			name: "skip_directory",
+			filter: func(f archiver.File) (bool, error) {
+				return f.NameInArchive == "b", nil
+			},
+			exp: []string{`a/ -rwxr-xr-x`, `a/keep.txt -rw-r--r-- "keep"`, `a/skip.log -rw-r--r-- "a"`, `b/ -rwxr-xr-x`, `b/skip.log -rw-r--r-- "b"`},
+		},
+		{
+			name: "error",
+			filter: func(f archiver.File) (bool, error) {
+				if f.NameInArchive == "a/skip.log" {
+					return false, errFilter
+				}
+				return false, nil
+			},
+			err: errFilter,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			archive := testArchive(t, []testEntry{
+				dirEntry("a"),
+				fileEntry("a/keep.txt", "keep"),
+				fileEntry("a/skip.log", "a"),
+				dirEntry("b"),
+				fileEntry("b/skip.log", "b"),
+			})
+			_, err := testExtract(t, &RestoreRequest{FileFilter: tc.filter}, dir, archive)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if tc.err != nil {
+				return
+			}
+
+			if got := listTree(t, dir); !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestExtract_remap(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links require privileges on windows")
+	}
+
+	remapDist := func(name string) (string, bool) {
+		if name == "dist" || strings.HasPrefix(name, "dist/") {
+			return "public" + strings.TrimPrefix(name, "dist"), false
+		}
+		return name, false
+	}
+
+	cases := []struct {
+		name  string
+		strip int
+		remap func(name string) (string, bool)
+		exp   []string
+	}{
+		{
+			name: "none",
+			exp: []string{
+				`dist/ -rwxr-xr-x`, `dist/app.js -rw-r--r-- "app"`, `dist/copy.js -rw-r--r-- "app"`,
+				`dist/css/ -rwxr-xr-x`, `dist/css/site.css -rw-r--r-- "css"`, `dist/latest -> app.js`,
+				`src/ -rwxr-xr-x`, `src/main.go -rw-r--r-- "main"`,
+			},
+		},
+		{
+			// Hard links follow their remapped target, symbolic links are
+			// relative and keep pointing next to themselves
+			name:  "subtree",
+			remap: remapDist,
+			exp: []string{
+				`public/ -rwxr-xr-x`, `public/app.js -rw-r--r-- "app"`, `public/copy.js -rw-r--r-- "app"`,
+				`public/css/ -rwxr-xr-x`, `public/css/site.css -rw-r--r-- "css"`, `public/latest -> app.js`,
+				`src/ -rwxr-xr-x`, `src/main.go -rw-r--r-- "main"`,
+			},
+		},
+		{
+			name: "skip",
+			remap: func(name string) (string, bool) {
+				return name, name == "src" || strings.HasPrefix(name, "src/")
+			},
+			exp: []string{
+				`dist/ -rwxr-xr-x`, `dist/app.js -rw-r--r-- "app"`, `dist/copy.js -rw-r--r-- "app"`,
+				`dist/css/ -rwxr-xr-x`, `dist/css/site.css -rw-r--r-- "css"`, `dist/latest -> app.js`,
+			},
+		},
+		{
+			// Remapped names are normalized like the names in the archive
+			name: "escape",
+			remap: func(name string) (string, bool) {
+				return "../../outside/" + name, false
+			},
+			exp: []string{
+				`outside/ -rwxr-xr-x`,
+				`outside/dist/ -rwxr-xr-x`, `outside/dist/app.js -rw-r--r-- "app"`, `outside/dist/copy.js -rw-r--r-- "app"`,
+				`outside/dist/css/ -rwxr-xr-x`, `outside/dist/css/site.css -rw-r--r-- "css"`, `outside/dist/latest -> app.js`,
+				`outside/src/ -rwxr-xr-x`, `outside/src/main.go -rw-r--r-- "main"`,
+			},
+		},
+		{
+			// Remap sees the names after StripComponents
+			name:  "stripped",
+			strip: 1,
+			remap: func(name string) (string, bool) {
+				return path.Join("out", name), name == "main.go"
+			},
+			exp: []string{
+				`out/ -rwxr-xr-x`, `out/app.js -rw-r--r-- "app"`, `out/copy.js -rw-r--r-- "app"`,
+				`out/css/ -rwxr-xr-x`, `out/css/site.css -rw-r--r-- "css"`, `out/latest -> app.js`,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			parent, dir := testDirs(t)
+			archive := testArchive(t, []testEntry{
+				dirEntry("dist"),
+				fileEntry("dist/app.js", "app"),
+				dirEntry("dist/css"),
+				fileEntry("dist/css/site.css", "css"),
+				symlinkEntry("dist/latest", "app.js"),
+				hardlinkEntry("dist/copy.js", "dist/app.js"),
+				dirEntry("src"),
+				fileEntry("src/main.go", "main"),
+			})
+			if _, err := testExtract(t, &RestoreRequest{StripComponents: tc.strip, Remap: tc.remap}, dir, archive); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := listTree(t, dir); !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+			if got := listTree(t, parent); len(got) != len(tc.exp)+1 {
+				t.Errorf("expected nothing to be written next to the restore directory, got %q", got)
+			}
+		})
+	}
+}
+
+func TestExtract_skipExisting(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links require privileges on windows")
+	}
+
+	cases := []struct {
+		name         string
+		skipExisting bool
+		exp          []string
+	}{
+		{
+			name:         "skip",
+			skipExisting: true,
+			exp: []string{
+				`a/ -rwxr-xr-x`,
+				`a/link -> local.txt`,
+				`a/local.txt -rw-r--r-- "modified"`,
+				`a/new.txt -rw-r--r-- "new"`,
+				`a/sub/ -rwxr-xr-x`,
+			},
+		},
+		{
+			name:         "overwrite",
+			skipExisting: false,
+			exp: []string{
+				`a/ -rwxr-xr-x`,
+				`a/link -> new.txt`,
+				`a/local.txt -rw-r--r-- "cached"`,
+				`a/new.txt -rw-r--r-- "new"`,
+				`a/sub/ -rwxr-xr-x`,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, "a"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "a", "local.txt"), []byte("modified"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("local.txt", filepath.Join(dir, "a", "link")); err != nil {
+				t.Fatal(err)
+			}
+
+			archive := testArchive(t, []testEntry{
+				dirEntry("a"),
+				fileEntry("a/local.txt", "cached"),
+				fileEntry("a/new.txt", "new"),
+				symlinkEntry("a/link", "new.txt"),
+				dirEntry("a/sub"),
+			})
+			if _, err := testExtract(t, &RestoreRequest{SkipExisting: tc.skipExisting}, dir, archive); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := listTree(t, dir); !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
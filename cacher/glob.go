@@ -0,0 +1,117 @@
+package cacher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// globStar is the path component which matches any number of directories.
+const globStar = "**"
+
+// glob returns the names of the files matching pattern. It behaves like
+// filepath.Glob, except that a path component of exactly "**" matches zero or
+// more directories, so "src/**/*.go" matches "src/a.go" and "src/a/b/c.go".
+// Patterns with "**" only match files and symbolic links, not directories, and
+// do not follow symbolic links to directories. Elsewhere in a component, "**"
+// is the same as "*". The matches are in lexical order.
+func glob(pattern string) ([]string, error) {
+	parts := strings.Split(filepath.ToSlash(pattern), "/")
+
+	star := -1
+	for idx, part := range parts {
+		if part == globStar {
+			star = idx
+			break
+		}
+	}
+	if star < 0 {
+		return filepath.Glob(pattern)
+	}
+
+	// Validate every component up front, like filepath.Glob
+	for _, part := range parts {
+		if _, err := filepath.Match(part, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	// Walk from the longest leading part without any pattern characters
+	static := 0
+	for static < star && !hasMeta(parts[static]) {
+		static++
+	}
+	root := strings.Join(parts[:static], "/")
+	if root == "" && static > 0 {
+		root = "/"
+	}
+	if static == 0 {
+		root = "."
+	}
+	rest := parts[static:]
+
+	var matches []string
+	err := filepath.Walk(filepath.FromSlash(root), func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(filepath.FromSlash(root), pth)
+		if err != nil {
+			return fmt.Errorf("failed to make %s relative: %w", pth, err)
+		}
+		if matchParts(rest, strings.Split(filepath.ToSlash(rel), "/")) {
+			matches = append(matches, pth)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// matchParts returns true if the path components name match the pattern
+// components, where "**" matches zero or more components.
+func matchParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == globStar {
+			// Collapse repeated stars, then try every possible number of
+			// components for this one
+			for len(pattern) > 0 && pattern[0] == globStar {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for idx := range name {
+				if matchParts(pattern, name[idx:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// hasMeta returns true if the path component contains any of the characters
+// recognized by filepath.Match.
+func hasMeta(part string) bool {
+	return strings.ContainsAny(part, `*?[\`)
+}
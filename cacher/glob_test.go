@@ -0,0 +1,151 @@
+package cacher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGlob(t *testing.T) {
+	t.Parallel()
+
+	dir := testFiles(t, map[string][]byte{
+		"go.sum":         nil,
+		"a/go.sum":       nil,
+		"a/b/c/go.sum":   nil,
+		"a/b/main.go":    nil,
+		"src/x.go":       nil,
+		"src/y/z.go":     nil,
+		"src/y/z_test.g": nil,
+	})
+	if err := os.Symlink(filepath.Join(dir, "a"), filepath.Join(dir, "src", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		pattern string
+		exp     []string
+		err     bool
+	}{
+		{
+			name:    "any_depth",
+			pattern: "**/go.sum",
+			exp:     []string{"a/b/c/go.sum", "a/go.sum", "go.sum"},
+		},
+		{
+			name:    "zero_directories",
+			pattern: "src/**/*.go",
+			exp:     []string{"src/x.go", "src/y/z.go"},
+		},
+		{
+			name:    "trailing",
+			pattern: "a/**",
+			exp:     []string{"a/b/c/go.sum", "a/b/main.go", "a/go.sum"},
+		},
+		{
+			name:    "repeated",
+			pattern: "a/**/**/go.sum",
+			exp:     []string{"a/b/c/go.sum", "a/go.sum"},
+		},
+		{
+			name:    "after_pattern",
+			pattern: "*/**/main.go",
+			exp:     []string{"a/b/main.go"},
+		},
+		{
+			// A star within a component does not cross directories
+			name:    "partial_star",
+			pattern: "a/**x/go.sum",
+			exp:     []string{},
+		},
+		{
+			// Symbolic links are matched, but not followed
+			name:    "symlink",
+			pattern: "src/**",
+			exp:     []string{"src/link", "src/x.go", "src/y/z.go", "src/y/z_test.g"},
+		},
+		{
+			name:    "symlink_not_followed",
+			pattern: "src/**/go.sum",
+			exp:     []string{},
+		},
+		{
+			name:    "without_star",
+			pattern: "*/go.sum",
+			exp:     []string{"a/go.sum"},
+		},
+		{
+			name:    "missing_root",
+			pattern: "missing/**/go.sum",
+			exp:     []string{},
+		},
+		{
+			name:    "invalid",
+			pattern: "**/[",
+			err:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			matches, err := glob(filepath.Join(dir, filepath.FromSlash(tc.pattern)))
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+			if tc.err {
+				return
+			}
+
+			got := make([]string, 0, len(matches))
+			for _, match := range matches {
+				rel, err := filepath.Rel(dir, match)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, filepath.ToSlash(rel))
+			}
+			if strings.Join(got, ",") != strings.Join(tc.exp, ",") {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestMatchParts(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		pattern string
+		path    string
+		exp     bool
+	}{
+		{name: "exact", pattern: "a/b", path: "a/b", exp: true},
+		{name: "star_zero", pattern: "**/b", path: "b", exp: true},
+		{name: "star_many", pattern: "**/b", path: "x/y/z/b", exp: true},
+		{name: "star_middle", pattern: "a/**/b", path: "a/x/b", exp: true},
+		{name: "star_only", pattern: "**", path: "a/b/c", exp: true},
+		{name: "too_short", pattern: "a/b/c", path: "a/b"},
+		{name: "too_long", pattern: "a/b", path: "a/b/c"},
+		{name: "star_then_mismatch", pattern: "**/b", path: "a/c"},
+		{name: "wildcard", pattern: "**/*.go", path: "a/main.go", exp: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := matchParts(strings.Split(tc.pattern, "/"), strings.Split(tc.path, "/")); got != tc.exp {
+				t.Errorf("expected %t, got %t", tc.exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package cacher
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// HashFileTimeout sets the maximum amount of time to spend hashing a single
+// file. This prevents a slow network filesystem from stalling the cache key
+// computation indefinitely. A value of zero means no per-file limit.
+func (c *Cacher) HashFileTimeout(d time.Duration) {
+	c.hashFileTimeout = d
+}
+
+// HashSkipMissing controls whether HashFiles and HashGlob skip files that no
+// longer exist when they are opened, such as transient build files deleted
+// between globbing and hashing. A skipped file contributes nothing to the
+// digest, so the result is the same as if the file had never been matched.
+// Other errors, like permission errors, still fail.
+func (c *Cacher) HashSkipMissing(val bool) {
+	c.hashSkipMissing = val
+}
+
+// EmptyHash is returned by HashFiles and HashGlob instead of a digest when no
+// files were hashed and HashAllowEmpty is set. It cannot be mistaken for a
+// digest, so a key derived from it is recognizable.
+const EmptyHash = "empty"
+
+// HashAllowEmpty controls whether HashFiles and HashGlob return EmptyHash when
+// there is nothing to hash, because no files were given, a pattern matched
+// nothing, or every file was skipped. Otherwise they fail with
+// ErrNoFilesToHash, since the digest of no input is the same for every such
+// key.
+func (c *Cacher) HashAllowEmpty(val bool) {
+	c.hashAllowEmpty = val
+}
+
+// HashSymlinkPolicy controls how HashFiles treats symbolic links.
+type HashSymlinkPolicy int
+
+const (
+	// HashSymlinkTarget hashes the content of the file a link points to, and
+	// skips links to directories. This is the default. If the target is outside
+	// of the repository, the hash can differ between machines.
+	HashSymlinkTarget HashSymlinkPolicy = iota
+
+	// HashSymlinkLinkname hashes the target path of each link, whether it points
+	// to a file or a directory, instead of its content. The hash only changes
+	// when a link is repointed, which is reproducible as long as the link
+	// targets are.
+	HashSymlinkLinkname
+
+	// HashSymlinkSkip skips links entirely, so they contribute nothing to the
+	// hash.
+	HashSymlinkSkip
+)
+
+// HashSymlinks sets how HashFiles and HashGlob treat symbolic links.
+func (c *Cacher) HashSymlinks(policy HashSymlinkPolicy) {
+	c.hashSymlinks = policy
+}
+
+// HashAlgorithm is the digest algorithm used by HashFiles.
+type HashAlgorithm int
+
+const (
+	// HashBlake2b128 is BLAKE2b with a 128-bit digest. This is the default.
+	HashBlake2b128 HashAlgorithm = iota
+
+	// HashSHA256 is SHA-256, for keys which have to match digests computed by
+	// other tools, like sha256sum.
+	HashSHA256
+)
+
+// HashAlgorithm sets the digest algorithm used by HashFiles and HashGlob.
+// Changing it changes every key derived from a hash.
+func (c *Cacher) HashAlgorithm(alg HashAlgorithm) {
+	c.hashAlgorithm = alg
+}
+
+// newHasher returns a new hash for the algorithm.
+func newHasher(alg HashAlgorithm) (hash.Hash, error) {
+	switch alg {
+	case HashBlake2b128:
+		return blake2b.New(16, nil)
+	case HashSHA256:
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %d", alg)
+	}
+}
+
+// HashGlob hashes the files matched by the given glob. Patterns follow
+// filepath.Match, and a path component of exactly "**" matches zero or more
+// directories, like "src/**/*.go". A pattern which matches nothing fails with
+// ErrNoFilesToHash, or returns EmptyHash with a warning if HashAllowEmpty is
+// set.
+func (c *Cacher) HashGlob(ctx context.Context, pattern string) (string, error) {
+	matches, err := glob(pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to glob: %w", err)
+	}
+	if len(matches) == 0 {
+		if !c.hashAllowEmpty {
+			return "", fmt.Errorf("pattern %s matched no files: %w", pattern, ErrNoFilesToHash)
+		}
+		c.warn("pattern %s matched no files", pattern)
+	}
+	return c.HashFiles(ctx, matches)
+}
+
+// HashGlobs hashes the files matched by any of the given globs as a single
+// digest. The combined list of matches is deduplicated and sorted, so a file
+// matched by several patterns is hashed once and the result does not depend on
+// the order of the patterns. Patterns support "**" like HashGlob. Patterns
+// which match nothing are skipped; a malformed pattern is an error. If no
+// pattern matches anything, it fails like HashGlob.
+//
+// Unlike HashGlob, HashGlobs cannot be cancelled; use HashGlobsContext for
+// that.
+func (c *Cacher) HashGlobs(patterns []string) (string, error) {
+	return c.HashGlobsContext(context.Background(), patterns)
+}
+
+// HashGlobsContext is like HashGlobs, but stops hashing when the context is
+// cancelled.
+func (c *Cacher) HashGlobsContext(ctx context.Context, patterns []string) (string, error) {
+	seen := make(map[string]struct{})
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := glob(pattern)
+		if err != nil {
+			return "", fmt.Errorf("failed to glob %s: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			c.log("pattern %s matched no files", pattern)
+		}
+
+		for _, match := range matches {
+			match = filepath.Clean(match)
+			if _, ok := seen[match]; ok {
+				continue
+			}
+			seen[match] = struct{}{}
+			files = append(files, match)
+		}
+	}
+	sort.Strings(files)
+
+	if len(files) == 0 {
+		if !c.hashAllowEmpty {
+			return "", fmt.Errorf("patterns %s matched no files: %w", strings.Join(patterns, ", "), ErrNoFilesToHash)
+		}
+		c.warn("patterns %s matched no files", strings.Join(patterns, ", "))
+	}
+	return c.HashFiles(ctx, files)
+}
+
+// KeySeparator separates the parts of a key built by KeyFromParts.
+const KeySeparator = "-"
+
+// KeyFromParts builds a key from the literal parts, like a job name and the
+// operating system, followed by the digest of the files matched by the globs
+// as computed by HashGlobs, all joined by KeySeparator:
+//
+//	KeyFromParts([]string{"go", "linux"}, []string{"go.sum"})
+//	// go-linux-3f9a...
+//
+// Without globs, the key consists of the literals only. Literals must not be
+// empty, since that would make different keys look alike. Like HashGlobs, it
+// cannot be cancelled; use KeyFromPartsContext for that.
+func (c *Cacher) KeyFromParts(literals []string, globs []string) (string, error) {
+	return c.KeyFromPartsContext(context.Background(), literals, globs)
+}
+
+// KeyFromPartsContext is like KeyFromParts, but stops hashing when the context
+// is cancelled.
+func (c *Cacher) KeyFromPartsContext(ctx context.Context, literals []string, globs []string) (string, error) {
+	parts := make([]string, 0, len(literals)+1)
+	for _, literal := range literals {
+		if literal == "" {
+			return "", validationErrorf("empty key part")
+		}
+		parts = append(parts, literal)
+	}
+
+	if len(globs) > 0 {
+		digest, err := c.HashGlobsContext(ctx, globs)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, digest)
+	}
+
+	if len(parts) == 0 {
+		return "", validationErrorf("missing key parts")
+	}
+	return strings.Join(parts, KeySeparator), nil
+}
+
+// HashFiles hashes the list of file and returns the hex-encoded digest of the
+// configured HashAlgorithm. It aborts if the context is cancelled or a single
+// file exceeds the configured HashFileTimeout, returning an error naming the
+// file. An unsupported algorithm fails before any file is opened. If no file
+// was hashed, it fails with ErrNoFilesToHash or returns EmptyHash, depending on
+// HashAllowEmpty.
+func (c *Cacher) HashFiles(ctx context.Context, files []string) (string, error) {
+	h, err := newHasher(c.hashAlgorithm)
+	if err != nil {
+		return "", fmt.Errorf("failed to create hash: %w", err)
+	}
+
+	// hashed counts the files and links which contributed to the digest
+	var hashed int
+	hashOne := func(name string, h hash.Hash) (retErr error) {
+		if c.hashSymlinks != HashSymlinkTarget {
+			stat, err := os.Lstat(name)
+			if err != nil {
+				if c.hashSkipMissing && os.IsNotExist(err) {
+					c.log("skipping %s (does not exist)", name)
+					return
+				}
+				retErr = fmt.Errorf("failed to stat file: %w", err)
+				return
+			}
+
+			if stat.Mode()&os.ModeSymlink != 0 {
+				if c.hashSymlinks == HashSymlinkSkip {
+					c.log("skipping %s (is a symbolic link)", name)
+					return
+				}
+
+				c.log("hashing link target of %s", name)
+				target, err := os.Readlink(name)
+				if err != nil {
+					retErr = fmt.Errorf("failed to read link: %w", err)
+					return
+				}
+				if _, err := io.WriteString(h, target); err != nil {
+					retErr = fmt.Errorf("failed to hash: %w", err)
+					return
+				}
+				hashed++
+				return
+			}
+		}
+
+		c.log("opening %s", name)
+		f, err := os.Open(name)
+		if err != nil {
+			if c.hashSkipMissing && os.IsNotExist(err) {
+				c.log("skipping %s (does not exist)", name)
+				return
+			}
+			retErr = fmt.Errorf("failed to open file: %w", err)
+			return
+		}
+		defer func() {
+			c.log("closing %s", name)
+			if cerr := f.Close(); cerr != nil {
+				if retErr != nil {
+					retErr = fmt.Errorf("%v: failed to close file: %w", retErr, cerr)
+					return
+				}
+				retErr = fmt.Errorf("failed to close file: %w", cerr)
+			}
+		}()
+
+		c.log("stating %s", name)
+		stat, err := f.Stat()
+		if err != nil {
+			retErr = fmt.Errorf("failed to stat file: %w", err)
+			return
+		}
+
+		if stat.IsDir() {
+			c.log("skipping %s (is a directory)", name)
+			return
+		}
+
+		c.log("hashing %s", name)
+		if _, err := copyBuffered(h, f); err != nil {
+			retErr = fmt.Errorf("failed to hash: %w", err)
+			return
+		}
+		hashed++
+
+		return
+	}
+
+	for _, name := range files {
+		if err := ctx.Err(); err != nil {
+			return "", fmt.Errorf("failed to hash %s: %w", name, err)
+		}
+
+		if err := c.withTimeout(ctx, c.hashFileTimeout, func() error {
+			return hashOne(name, h)
+		}); err != nil {
+			return "", fmt.Errorf("failed to hash %s: %w", name, err)
+		}
+	}
+
+	if hashed == 0 {
+		if !c.hashAllowEmpty {
+			return "", fmt.Errorf("failed to hash: %w", ErrNoFilesToHash)
+		}
+		return EmptyHash, nil
+	}
+
+	dig := h.Sum(nil)
+	return fmt.Sprintf("%x", dig), nil
+}
+
+// withTimeout runs fn, returning early with the context error if ctx is done
+// or the timeout elapses first. Filesystem calls cannot be interrupted, so fn
+// keeps running in the background after an early return and its result is
+// discarded; callers must not reuse any state fn touches. A timeout of zero
+// means no timeout.
+func (c *Cacher) withTimeout(ctx context.Context, timeout time.Duration, fn func() error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out: %w", ctx.Err())
+	}
+}
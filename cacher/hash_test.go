@@ -0,0 +1,363 @@
+package cacher
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashFiles_empty(t *testing.T) {
+	t.Parallel()
+
+	dir := testFiles(t, map[string][]byte{"a/file": []byte("content")})
+
+	cases := []struct {
+		name        string
+		allowEmpty  bool
+		skipMissing bool
+		hash        func(ctx context.Context, c *Cacher) (string, error)
+		exp         string
+		err         error
+	}{
+		{
+			name: "no_files",
+			hash: func(ctx context.Context, c *Cacher) (string, error) {
+				return c.HashFiles(ctx, nil)
+			},
+			err: ErrNoFilesToHash,
+		},
+		{
+			name:       "no_files_allowed",
+			allowEmpty: true,
+			hash: func(ctx context.Context, c *Cacher) (string, error) {
+				return c.HashFiles(ctx, nil)
+			},
+			exp: EmptyHash,
+		},
+		{
+			// Directories do not contribute to the digest
+			name: "only_directories",
+			hash: func(ctx context.Context, c *Cacher) (string, error) {
+				return c.HashFiles(ctx, []string{filepath.Join(dir, "a")})
+			},
+			err: ErrNoFilesToHash,
+		},
+		{
+			name:        "only_missing",
+			skipMissing: true,
+			hash: func(ctx context.Context, c *Cacher) (string, error) {
+				return c.HashFiles(ctx, []string{filepath.Join(dir, "missing")})
+			},
+			err: ErrNoFilesToHash,
+		},
+		{
+			name: "glob",
+			hash: func(ctx context.Context, c *Cacher) (string, error) {
+				return c.HashGlob(ctx, filepath.Join(dir, "*.lock"))
+			},
+			err: ErrNoFilesToHash,
+		},
+		{
+			name:       "glob_allowed",
+			allowEmpty: true,
+			hash: func(ctx context.Context, c *Cacher) (string, error) {
+				return c.HashGlob(ctx, filepath.Join(dir, "*.lock"))
+			},
+			exp: EmptyHash,
+		},
+		{
+			name: "globs",
+			hash: func(ctx context.Context, c *Cacher) (string, error) {
+				return c.HashGlobsContext(ctx, []string{filepath.Join(dir, "*.lock"), filepath.Join(dir, "**/*.sum")})
+			},
+			err: ErrNoFilesToHash,
+		},
+		{
+			name:       "globs_allowed",
+			allowEmpty: true,
+			hash: func(ctx context.Context, c *Cacher) (string, error) {
+				return c.HashGlobsContext(ctx, []string{filepath.Join(dir, "*.lock")})
+			},
+			exp: EmptyHash,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := &Cacher{}
+			c.HashAllowEmpty(tc.allowEmpty)
+			c.HashSkipMissing(tc.skipMissing)
+
+			got, err := tc.hash(context.Background(), c)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if got != tc.exp {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestHashFiles_missing(t *testing.T) {
+	t.Parallel()
+
+	dir := testFiles(t, map[string][]byte{"file": []byte("content")})
+	present := filepath.Join(dir, "file")
+	missing := filepath.Join(dir, "missing")
+
+	c := &Cacher{}
+	exp, err := c.HashFiles(context.Background(), []string{present})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.HashFiles(context.Background(), []string{present, missing}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+
+	c.HashSkipMissing(true)
+	got, err := c.HashFiles(context.Background(), []string{present, missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != exp {
+		t.Errorf("expected a missing file not to change the digest %s, got %s", exp, got)
+	}
+}
+
+func TestHashGlobs(t *testing.T) {
+	t.Parallel()
+
+	dir := testFiles(t, map[string][]byte{
+		"go.sum":   []byte("root"),
+		"a/go.sum": []byte("a"),
+		"b/go.sum": []byte("b"),
+	})
+	pattern := func(p string) string {
+		return filepath.Join(dir, filepath.FromSlash(p))
+	}
+
+	c := &Cacher{}
+	exp, err := c.HashFiles(context.Background(), []string{pattern("a/go.sum"), pattern("b/go.sum"), pattern("go.sum")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		patterns []string
+	}{
+		{name: "single", patterns: []string{pattern("**/go.sum")}},
+		{name: "several", patterns: []string{pattern("go.sum"), pattern("*/go.sum")}},
+		{name: "reordered", patterns: []string{pattern("*/go.sum"), pattern("go.sum")}},
+		{name: "overlapping", patterns: []string{pattern("**/go.sum"), pattern("a/go.sum"), pattern("go.sum")}},
+		{name: "unclean", patterns: []string{dir + string(filepath.Separator) + filepath.FromSlash("a/../go.sum"), pattern("*/go.sum")}},
+		{name: "some_empty", patterns: []string{pattern("*.lock"), pattern("**/go.sum")}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := c.HashGlobs(tc.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != exp {
+				t.Errorf("expected %s, got %s", exp, got)
+			}
+		})
+	}
+
+	if _, err := c.HashGlobs([]string{pattern("[")}); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.HashGlobsContext(ctx, []string{pattern("**/go.sum")}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestKeyFromParts(t *testing.T) {
+	t.Parallel()
+
+	dir := testFiles(t, map[string][]byte{"go.sum": []byte("content")})
+
+	c := &Cacher{}
+	digest, err := c.HashFiles(context.Background(), []string{filepath.Join(dir, "go.sum")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		literals []string
+		globs    []string
+		exp      string
+		err      error
+	}{
+		{
+			name:     "literals_and_globs",
+			literals: []string{"go", "linux"},
+			globs:    []string{filepath.Join(dir, "go.sum")},
+			exp:      "go-linux-" + digest,
+		},
+		{
+			name:     "literals_only",
+			literals: []string{"go", "linux"},
+			exp:      "go-linux",
+		},
+		{
+			name:  "globs_only",
+			globs: []string{filepath.Join(dir, "go.sum")},
+			exp:   digest,
+		},
+		{
+			name:     "empty_literal",
+			literals: []string{"go", ""},
+			err:      &ValidationError{},
+		},
+		{
+			name: "nothing",
+			err:  &ValidationError{},
+		},
+		{
+			name:     "no_matches",
+			literals: []string{"go"},
+			globs:    []string{filepath.Join(dir, "*.lock")},
+			err:      ErrNoFilesToHash,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := c.KeyFromParts(tc.literals, tc.globs)
+			switch exp := tc.err.(type) {
+			case nil:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case *ValidationError:
+				if !errors.As(err, &exp) {
+					t.Fatalf("expected a validation error, got %v", err)
+				}
+			default:
+				if !errors.Is(err, exp) {
+					t.Fatalf("expected error %v, got %v", exp, err)
+				}
+			}
+			if got != tc.exp {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestKeyFromParts_changes(t *testing.T) {
+	t.Parallel()
+
+	dir := testFiles(t, map[string][]byte{"go.sum": []byte("before")})
+	literals := []string{"go", "linux"}
+	globs := []string{filepath.Join(dir, "go.sum")}
+
+	c := &Cacher{}
+	before, err := c.KeyFromParts(literals, globs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(globs[0], []byte("after"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	after, err := c.KeyFromPartsContext(context.Background(), literals, globs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before == after {
+		t.Errorf("expected the key to change with the file, got %s twice", before)
+	}
+	if prefix := "go-linux-"; !strings.HasPrefix(before, prefix) || !strings.HasPrefix(after, prefix) {
+		t.Errorf("expected both keys to start with %s, got %s and %s", prefix, before, after)
+	}
+}
+
+func TestNewHasher(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		alg  HashAlgorithm
+		size int
+		exp  string
+		err  bool
+	}{
+		{name: "default", alg: HashBlake2b128, size: 16, exp: "cf4ab791c62b8d2b2109c90275287816"},
+		{name: "sha256", alg: HashSHA256, size: 32, exp: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{name: "unsupported", alg: HashSHA256 + 1, err: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			h, err := newHasher(tc.alg)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+
+				// HashFiles fails before opening any file, so a missing one is not
+				// reported
+				c := &Cacher{}
+				c.HashAlgorithm(tc.alg)
+				if _, err := c.HashFiles(context.Background(), []string{"missing"}); err == nil || errors.Is(err, os.ErrNotExist) {
+					t.Errorf("expected unsupported algorithm error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h.Size() != tc.size {
+				t.Errorf("expected %d byte digest, got %d", tc.size, h.Size())
+			}
+			h.Write([]byte("abc"))
+			if got := hex.EncodeToString(h.Sum(nil)); got != tc.exp {
+				t.Errorf("expected digest %s, got %s", tc.exp, got)
+			}
+
+			// HashFiles uses the same hash
+			dir := testFiles(t, map[string][]byte{"file": []byte("abc")})
+			c := &Cacher{}
+			c.HashAlgorithm(tc.alg)
+			got, err := c.HashFiles(context.Background(), []string{filepath.Join(dir, "file")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.exp {
+				t.Errorf("expected file digest %s, got %s", tc.exp, got)
+			}
+		})
+	}
+}
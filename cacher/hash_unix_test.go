@@ -0,0 +1,126 @@
+//go:build !windows
+// +build !windows
+
+package cacher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHashFiles_blocked(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		timeout time.Duration
+		cancel  time.Duration
+		err     error
+	}{
+		{name: "cancelled", cancel: 50 * time.Millisecond, err: context.Canceled},
+		{name: "file_timeout", timeout: 50 * time.Millisecond, err: context.DeadlineExceeded},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			c.HashFileTimeout(tc.timeout)
+
+			// Opening a FIFO blocks until there is a writer, which there never
+			// is until the test ends
+			dir := testFiles(t, map[string][]byte{"a": []byte("content")})
+			fifo := filepath.Join(dir, "fifo")
+			if err := syscall.Mkfifo(fifo, 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				f, err := os.OpenFile(fifo, os.O_RDWR, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel > 0 {
+				time.AfterFunc(tc.cancel, cancel)
+			}
+
+			start := time.Now()
+			_, err := c.HashFiles(ctx, []string{filepath.Join(dir, "a"), fifo})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("expected to return promptly, took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestHashFiles_symlinks(t *testing.T) {
+	t.Parallel()
+
+	// The expected digests are those of hashing equivalent regular files with
+	// the default policy: "linkname" holds the text of the link target.
+	cases := []struct {
+		name   string
+		policy HashSymlinkPolicy
+		target string
+		exp    []string
+	}{
+		{name: "target_file", policy: HashSymlinkTarget, target: "lib.txt", exp: []string{"lib.txt", "lib.txt"}},
+		{name: "target_dir", policy: HashSymlinkTarget, target: "vendor", exp: []string{"lib.txt"}},
+		{name: "linkname_file", policy: HashSymlinkLinkname, target: "lib.txt", exp: []string{"lib.txt", "linkname"}},
+		{name: "linkname_dir", policy: HashSymlinkLinkname, target: "vendor", exp: []string{"lib.txt", "linkname"}},
+		{name: "skip_file", policy: HashSymlinkSkip, target: "lib.txt", exp: []string{"lib.txt"}},
+		{name: "skip_dir", policy: HashSymlinkSkip, target: "vendor", exp: []string{"lib.txt"}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := testFiles(t, map[string][]byte{
+				"lib.txt":        []byte("library"),
+				"vendor/dep.txt": []byte("dependency"),
+				"linkname":       []byte(tc.target),
+			})
+			link := filepath.Join(dir, "link")
+			if err := os.Symlink(tc.target, link); err != nil {
+				t.Fatal(err)
+			}
+
+			var exp []string
+			for _, name := range tc.exp {
+				exp = append(exp, filepath.Join(dir, name))
+			}
+			want, err := (&Cacher{}).HashFiles(context.Background(), exp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := &Cacher{}
+			c.HashSymlinks(tc.policy)
+			got, err := c.HashFiles(context.Background(), []string{filepath.Join(dir, "lib.txt"), link})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("expected digest of %q, got %s", tc.exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package cacher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// copyBufferSize is the size of the buffers used to copy file content.
+const copyBufferSize = 32 << 10
+
+// limitWriter is an io.Writer which fails once more than limit bytes would be
+// written to the underlying writer.
+type limitWriter struct {
+	w     io.Writer
+	limit int64
+	n     int64
+}
+
+// Write writes p to the underlying writer, unless doing so would exceed the
+// limit.
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.n+int64(len(p)) > l.limit {
+		return 0, fmt.Errorf("%w: archive is larger than %d bytes", ErrMaxSizeExceeded, l.limit)
+	}
+
+	n, err := l.w.Write(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// countingWriter is an io.Writer which counts the bytes written to the
+// underlying writer.
+type countingWriter struct {
+	// n is accessed atomically, so it is first to keep it aligned.
+	n int64
+	w io.Writer
+}
+
+// Write writes p to the underlying writer.
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// count returns the number of bytes written so far. It is safe to call
+// concurrently with Write.
+func (c *countingWriter) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// bestEffortWriter is an io.Writer which never fails. After the first error
+// from the underlying writer, it stops writing to it and records the error.
+type bestEffortWriter struct {
+	w   io.Writer
+	err error
+}
+
+// Write writes p to the underlying writer, unless an earlier write failed.
+func (b *bestEffortWriter) Write(p []byte) (int, error) {
+	if b.err == nil {
+		if _, err := b.w.Write(p); err != nil {
+			b.err = err
+		}
+	}
+	return len(p), nil
+}
+
+// md5Reader is an io.Reader which computes the MD5 of the bytes read from the
+// underlying reader.
+type md5Reader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+}
+
+// newMD5Reader creates an md5Reader expecting the given digest.
+func newMD5Reader(r io.Reader, want []byte) *md5Reader {
+	return &md5Reader{
+		r:    r,
+		h:    md5.New(),
+		want: want,
+	}
+}
+
+// Read reads from the underlying reader.
+func (m *md5Reader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.h.Write(p[:n])
+	return n, err
+}
+
+// verify reads the rest of the underlying reader, which decompressors may not
+// have consumed, and compares the digest against the expected one.
+func (m *md5Reader) verify() error {
+	if _, err := copyBuffered(io.Discard, m); err != nil {
+		return fmt.Errorf("failed to read: %w", err)
+	}
+
+	if got := m.h.Sum(nil); !bytes.Equal(got, m.want) {
+		return fmt.Errorf("MD5 mismatch (expected %x, got %x)", m.want, got)
+	}
+	return nil
+}
+
+// copyBufferPool is a pool of buffers used to copy file content, which avoids
+// allocating a fresh buffer for every file when processing many files.
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// copyBuffered copies from src to dst like io.Copy, but using a pooled buffer.
+// The reader and writer are wrapped so that io.ReaderFrom and io.WriterTo
+// implementations, which would allocate their own buffers, are not used.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	bp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bp)
+
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *bp)
+}
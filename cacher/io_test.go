@@ -0,0 +1,180 @@
+package cacher
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCopyBuffered(t *testing.T) {
+	t.Parallel()
+
+	content := randomBytes(3*copyBufferSize + 17)
+	errRead := errors.New("read failed")
+
+	cases := []struct {
+		name string
+		src  func() io.Reader
+		exp  []byte
+		err  error
+	}{
+		{
+			// bytes.Reader implements io.WriterTo, which must not be used
+			name: "writer_to",
+			src:  func() io.Reader { return bytes.NewReader(content) },
+			exp:  content,
+		},
+		{
+			name: "one_byte_reads",
+			src:  func() io.Reader { return iotest.OneByteReader(bytes.NewReader(content[:1000])) },
+			exp:  content[:1000],
+		},
+		{
+			name: "empty",
+			src:  func() io.Reader { return strings.NewReader("") },
+			exp:  []byte{},
+		},
+		{
+			name: "error",
+			src: func() io.Reader {
+				return io.MultiReader(bytes.NewReader(content[:100]), iotest.ErrReader(errRead))
+			},
+			exp: content[:100],
+			err: errRead,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// bytes.Buffer implements io.ReaderFrom, which must not be used either
+			var dst bytes.Buffer
+			n, err := copyBuffered(&dst, tc.src())
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if n != int64(len(tc.exp)) || !bytes.Equal(dst.Bytes(), tc.exp) {
+				t.Errorf("expected %d bytes copied, got %d and %d bytes written", len(tc.exp), n, dst.Len())
+			}
+		})
+	}
+}
+
+func TestCopyBuffered_allocs(t *testing.T) {
+	content := randomBytes(64 << 10)
+
+	// The wrappers hide io.WriterTo and io.ReaderFrom, so io.Copy allocates a
+	// buffer for every copy
+	r := bytes.NewReader(content)
+	src, dst := struct{ io.Reader }{r}, struct{ io.Writer }{ioutil.Discard}
+
+	cases := []struct {
+		name string
+		copy func(dst io.Writer, src io.Reader) (int64, error)
+		max  uint64
+	}{
+		// The race detector randomly drops pooled buffers, so this allows for
+		// some to be allocated again
+		{name: "pooled", copy: copyBuffered, max: copyBufferSize / 2},
+		{name: "io_copy", copy: io.Copy},
+	}
+
+	for _, tc := range cases {
+		const runs = 100
+
+		// Warm up the pool, then measure the bytes allocated per copy, like
+		// testing.AllocsPerRun does for the number of allocations
+		if _, err := tc.copy(dst, src); err != nil {
+			t.Fatal(err)
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for i := 0; i < runs; i++ {
+			r.Reset(content)
+			if _, err := tc.copy(dst, src); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runtime.ReadMemStats(&after)
+
+		perCopy := (after.TotalAlloc - before.TotalAlloc) / runs
+		t.Logf("%s: %d bytes allocated per copy", tc.name, perCopy)
+		if tc.max > 0 && perCopy > tc.max {
+			t.Errorf("%s: expected at most %d bytes allocated per copy, got %d", tc.name, tc.max, perCopy)
+		}
+		if tc.max == 0 && perCopy < copyBufferSize {
+			t.Errorf("%s: expected a buffer to be allocated per copy, got %d bytes", tc.name, perCopy)
+		}
+	}
+}
+
+func BenchmarkCopyBuffered(b *testing.B) {
+	content := randomBytes(64 << 10)
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(content)))
+		for i := 0; i < b.N; i++ {
+			if _, err := copyBuffered(ioutil.Discard, struct{ io.Reader }{bytes.NewReader(content)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("io_copy", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(content)))
+		for i := 0; i < b.N; i++ {
+			if _, err := io.Copy(struct{ io.Writer }{ioutil.Discard}, struct{ io.Reader }{bytes.NewReader(content)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// failingWriter fails every write after the first n bytes.
+type failingWriter struct {
+	n   int
+	err error
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.n {
+		n := f.n
+		f.n = 0
+		return n, f.err
+	}
+	f.n -= len(p)
+	return len(p), nil
+}
+
+func TestBestEffortWriter(t *testing.T) {
+	t.Parallel()
+
+	errWrite := errors.New("disk full")
+	w := &bestEffortWriter{w: &failingWriter{n: 10, err: errWrite}}
+
+	// The upload keeps receiving every byte after the tee file fails
+	var upload bytes.Buffer
+	mw := io.MultiWriter(&upload, w)
+	for i := 0; i < 4; i++ {
+		if _, err := mw.Write([]byte("chunk")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := upload.String(); got != strings.Repeat("chunk", 4) {
+		t.Errorf("expected every chunk to be uploaded, got %q", got)
+	}
+	if !errors.Is(w.err, errWrite) {
+		t.Errorf("expected %v to be recorded, got %v", errWrite, w.err)
+	}
+}
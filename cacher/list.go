@@ -0,0 +1,90 @@
+package cacher
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// partSuffix matches the suffix of the part objects of a sharded cache, with
+// the upload ID of newer parts.
+var partSuffix = regexp.MustCompile(`(\.[0-9a-f]{16})?\.part\d{4,}$`)
+
+// KeySummary describes the objects stored for a single logical cache key.
+type KeySummary struct {
+	// Key is the cache key, without the KeyPrefix of the cacher.
+	Key string
+
+	// Objects is the number of objects stored for the key. A sharded cache
+	// counts its manifest and each of its parts.
+	Objects int
+
+	// Size is the total size of the objects in storage, in bytes.
+	Size int64
+
+	// Updated is the time the most recently updated object was updated.
+	Updated time.Time
+}
+
+// ListKeys lists the cache keys under prefix, grouping the objects which make
+// up a single cache, like the parts of a sharded cache, under its key. Keys are
+// returned in lexical order. An empty prefix lists the whole bucket.
+func (c *Cacher) ListKeys(ctx context.Context, bucket, prefix string) ([]KeySummary, error) {
+	if bucket == "" {
+		return nil, validationErrorf("missing bucket")
+	}
+
+	prefix = c.objectName(prefix)
+	c.log("listing objects with prefix %s", prefix)
+
+	summaries := make(map[string]*KeySummary)
+	it := c.client.Bucket(bucket).Objects(ctx, &storage.Query{
+		Prefix: prefix,
+	})
+
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, &StorageError{Msg: "failed to list " + prefix, Err: err}
+		}
+
+		key := canonicalKey(attrs)
+		s, ok := summaries[key]
+		if !ok {
+			s = &KeySummary{Key: strings.TrimPrefix(key, c.keyPrefix)}
+			summaries[key] = s
+		}
+		s.Objects++
+		s.Size += attrs.Size
+		if attrs.Updated.After(s.Updated) {
+			s.Updated = attrs.Updated
+		}
+	}
+
+	result := make([]KeySummary, 0, len(summaries))
+	for _, s := range summaries {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+// canonicalKey returns the name of the cache the object belongs to. Parts of a
+// sharded cache record it in their metadata, which may be missing on parts
+// copied by other tools, so the part suffix is stripped otherwise.
+func canonicalKey(attrs *storage.ObjectAttrs) string {
+	if key, ok := attrs.Metadata[metadataShardOf]; ok {
+		return key
+	}
+	return partSuffix.ReplaceAllString(attrs.Name, "")
+}
@@ -0,0 +1,109 @@
+package cacher
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCacher_ListKeys(t *testing.T) {
+	t.Parallel()
+
+	shardOf := func(key string) *fakeObject {
+		return &fakeObject{Metadata: map[string]string{metadataShardOf: key}}
+	}
+
+	cases := []struct {
+		name    string
+		objects map[string]*fakeObject
+		prefix  string
+		exp     []KeySummary
+	}{
+		{
+			name: "plain",
+			objects: map[string]*fakeObject{
+				"go-1":   nil,
+				"go-2":   nil,
+				"ruby-1": nil,
+			},
+			exp: []KeySummary{
+				{Key: "go-1", Objects: 1, Size: 4},
+				{Key: "go-2", Objects: 1, Size: 4},
+				{Key: "ruby-1", Objects: 1, Size: 6},
+			},
+		},
+		{
+			name: "sharded",
+			objects: map[string]*fakeObject{
+				"go-1":                                 {ContentType: manifestContentType},
+				"go-1.0123456789abcdef.part0000":       shardOf("go-1"),
+				"go-1.0123456789abcdef.part0001":       shardOf("go-1"),
+				"go-1.fedcba9876543210.compose00-0000": shardOf("go-1"),
+			},
+			exp: []KeySummary{
+				{Key: "go-1", Objects: 4, Size: 4 + 30 + 30 + 36},
+			},
+		},
+		{
+			// Parts copied by other tools may have lost their metadata
+			name: "parts_without_metadata",
+			objects: map[string]*fakeObject{
+				"go-1":                           nil,
+				"go-1.part0000":                  nil,
+				"go-1.0123456789abcdef.part0001": nil,
+				"go-1.part":                      nil,
+			},
+			exp: []KeySummary{
+				{Key: "go-1", Objects: 3, Size: 4 + 13 + 30},
+				{Key: "go-1.part", Objects: 1, Size: 9},
+			},
+		},
+		{
+			name: "prefix",
+			objects: map[string]*fakeObject{
+				"go-1":   nil,
+				"ruby-1": nil,
+			},
+			prefix: "ruby-",
+			exp: []KeySummary{
+				{Key: "ruby-1", Objects: 1, Size: 6},
+			},
+		},
+		{
+			name:    "empty",
+			objects: map[string]*fakeObject{},
+			exp:     []KeySummary{},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			for name, attrs := range tc.objects {
+				fs.put("bucket", name, []byte(name), attrs)
+			}
+
+			got, err := c.ListKeys(context.Background(), "bucket", tc.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tc.exp) {
+				t.Fatalf("expected %d keys, got %+v", len(tc.exp), got)
+			}
+			for idx, summary := range got {
+				if summary.Updated.IsZero() || time.Since(summary.Updated) > time.Minute {
+					t.Errorf("expected %s to be updated recently, got %s", summary.Key, summary.Updated)
+				}
+				summary.Updated = time.Time{}
+				if summary != tc.exp[idx] {
+					t.Errorf("expected %+v, got %+v", tc.exp[idx], summary)
+				}
+			}
+		})
+	}
+}
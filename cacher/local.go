@@ -0,0 +1,172 @@
+package cacher
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+)
+
+// LocalCacheDir enables keeping a copy of each object restored in dir, such as
+// on a scratch disk of a runner which restores the same cache repeatedly.
+// Restore reads a local copy of the matched generation instead of downloading
+// it, and otherwise stores the downloaded bytes there once the restore
+// succeeds, replacing copies of older generations. The directory is created if
+// it does not exist. An empty dir, the default, disables the local cache.
+func (c *Cacher) LocalCacheDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to make local cache directory: %w", err)
+		}
+		f, err := os.CreateTemp(dir, ".gcs-cacher-check-")
+		if err != nil {
+			return fmt.Errorf("local cache directory is not writable: %w", err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	c.localCacheDir = dir
+	return nil
+}
+
+// localCachePrefix returns the prefix of the names of the local copies of the
+// object, which are followed by the generation.
+func (c *Cacher) localCachePrefix(bucket string, attrs *storage.ObjectAttrs) string {
+	sum := sha256.Sum256([]byte(bucket + "/" + attrs.Name))
+	return filepath.Join(c.localCacheDir, fmt.Sprintf("%x", sum[:16]))
+}
+
+// localCachePath returns the path of the local copy of the object generation.
+func (c *Cacher) localCachePath(bucket string, attrs *storage.ObjectAttrs) string {
+	return fmt.Sprintf("%s-%d", c.localCachePrefix(bucket, attrs), attrs.Generation)
+}
+
+// openLocal opens the local copy of the object generation, if there is one of
+// the expected size. It returns nil otherwise.
+func (c *Cacher) openLocal(bucket string, attrs *storage.ObjectAttrs) *os.File {
+	if c.localCacheDir == "" {
+		return nil
+	}
+
+	pth := c.localCachePath(bucket, attrs)
+	f, err := os.Open(pth)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.warn("failed to open local copy %s: %s", pth, err)
+		}
+		return nil
+	}
+
+	// A copy of the wrong size is corrupt, and replaced by the next download
+	fi, err := f.Stat()
+	if err != nil || fi.Size() != compressedSize(attrs) {
+		c.warn("ignoring local copy %s (unexpected size)", pth)
+		f.Close()
+		os.Remove(pth)
+		return nil
+	}
+
+	c.log("reading local copy %s of %s", pth, attrs.Name)
+	return f
+}
+
+// localCopy stores the bytes of a download in the local cache directory. The
+// bytes are written to a temporary file, which is only moved into place by
+// commit once the download is complete.
+type localCopy struct {
+	c      *Cacher
+	f      *os.File
+	w      *bestEffortWriter
+	prefix string
+	path   string
+	size   int64
+	done   bool
+}
+
+// createLocal creates a localCopy for the object generation. Since the local
+// cache is best effort, it returns nil with a warning on failure.
+func (c *Cacher) createLocal(bucket string, attrs *storage.ObjectAttrs) *localCopy {
+	if c.localCacheDir == "" {
+		return nil
+	}
+
+	f, err := os.CreateTemp(c.localCacheDir, ".gcs-cacher-local-")
+	if err != nil {
+		c.warn("failed to create local copy: %s", err)
+		return nil
+	}
+	return &localCopy{
+		c:      c,
+		f:      f,
+		w:      &bestEffortWriter{w: f},
+		prefix: c.localCachePrefix(bucket, attrs),
+		path:   c.localCachePath(bucket, attrs),
+		size:   compressedSize(attrs),
+	}
+}
+
+// Write writes p to the temporary file. It never fails, so a failing local disk
+// does not fail the download.
+func (l *localCopy) Write(p []byte) (int, error) {
+	return l.w.Write(p)
+}
+
+// commit reads the rest of src, which must be the reader writing to l, and
+// moves the complete copy into place, removing the copies of other
+// generations.
+func (l *localCopy) commit(src io.Reader) {
+	l.done = true
+	if _, err := copyBuffered(io.Discard, src); err != nil {
+		l.fail(fmt.Errorf("failed to read: %w", err))
+		return
+	}
+
+	if err := l.f.Close(); err != nil && l.w.err == nil {
+		l.w.err = err
+	}
+	if l.w.err != nil {
+		l.fail(l.w.err)
+		return
+	}
+
+	fi, err := os.Stat(l.f.Name())
+	if err != nil || fi.Size() != l.size {
+		l.fail(fmt.Errorf("unexpected size"))
+		return
+	}
+
+	if err := os.Rename(l.f.Name(), l.path); err != nil {
+		l.fail(err)
+		return
+	}
+	l.c.log("stored local copy %s", l.path)
+
+	stale, _ := filepath.Glob(l.prefix + "-*")
+	for _, pth := range stale {
+		if pth != l.path {
+			l.c.log("removing stale local copy %s", pth)
+			os.Remove(pth)
+		}
+	}
+}
+
+// discard removes the temporary file, unless the copy was committed.
+func (l *localCopy) discard() {
+	if l.done {
+		return
+	}
+	l.done = true
+	l.f.Close()
+	os.Remove(l.f.Name())
+}
+
+// fail removes the temporary file with a warning.
+func (l *localCopy) fail(err error) {
+	l.c.warn("failed to store local copy %s: %s", l.path, err)
+	l.f.Close()
+	os.Remove(l.f.Name())
+}
@@ -0,0 +1,176 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestCacher_LocalCacheDir(t *testing.T) {
+	t.Parallel()
+
+	t.Run("not_a_directory", func(t *testing.T) {
+		t.Parallel()
+
+		pth := filepath.Join(testFiles(t, map[string][]byte{"file": nil}), "file")
+		c, _ := newTestCacher(t)
+		if err := c.LocalCacheDir(pth); err == nil {
+			t.Error("expected an error for a file")
+		}
+	})
+
+	v1, v2 := []byte("first version"), []byte("second version, which is longer")
+
+	cases := []struct {
+		name string
+		// prepare runs after saving v1 and before the restore under test
+		prepare func(t *testing.T, c *Cacher, fs *fakeStorage, local string)
+		// blockDownloads fails every download of the restore under test
+		blockDownloads bool
+		err            bool
+		exp            []byte
+	}{
+		{
+			name: "miss",
+			exp:  v1,
+		},
+		{
+			name: "hit",
+			prepare: func(t *testing.T, c *Cacher, fs *fakeStorage, local string) {
+				assertRestores(t, c, "cache", "data", v1)
+			},
+			blockDownloads: true,
+			exp:            v1,
+		},
+		{
+			name: "new_generation",
+			prepare: func(t *testing.T, c *Cacher, fs *fakeStorage, local string) {
+				assertRestores(t, c, "cache", "data", v1)
+				if _, err := c.Save(context.Background(), &SaveRequest{
+					Bucket: "bucket",
+					Key:    "other",
+					Dirs:   map[string]string{testFiles(t, map[string][]byte{"data": v2}) + string(filepath.Separator): ""},
+				}); err != nil {
+					t.Fatal(err)
+				}
+				other := fs.get("bucket", "other")
+				fs.put("bucket", "cache", other.data, other)
+			},
+			exp: v2,
+		},
+		{
+			name: "wrong_size",
+			prepare: func(t *testing.T, c *Cacher, fs *fakeStorage, local string) {
+				assertRestores(t, c, "cache", "data", v1)
+				copies := localCopies(t, local)
+				if len(copies) != 1 {
+					t.Fatalf("expected a local copy, got %q", copies)
+				}
+				if err := os.Truncate(filepath.Join(local, copies[0]), 10); err != nil {
+					t.Fatal(err)
+				}
+			},
+			exp: v1,
+		},
+		{
+			name:           "download_fails",
+			blockDownloads: true,
+			err:            true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			local := filepath.Join(t.TempDir(), "local")
+			c, fs := newTestCacher(t)
+			if err := c.LocalCacheDir(local); err != nil {
+				t.Fatal(err)
+			}
+
+			src := testFiles(t, map[string][]byte{"data": v1})
+			if _, err := c.Save(context.Background(), &SaveRequest{
+				Bucket: "bucket",
+				Key:    "cache",
+				Dirs:   map[string]string{src + string(filepath.Separator): ""},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if tc.prepare != nil {
+				tc.prepare(t, c, fs, local)
+			}
+			if tc.blockDownloads {
+				fs.setFailures(http.MethodGet, "/bucket/cache", 100, http.StatusForbidden)
+			}
+
+			dir := t.TempDir()
+			_, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket: "bucket",
+				Keys:   []string{"cache"},
+				Dir:    dir,
+			})
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+
+			// Only a complete copy of the current generation is left behind
+			copies := localCopies(t, local)
+			if tc.err {
+				if len(copies) != 0 {
+					t.Errorf("expected no local copies after a failed restore, got %q", copies)
+				}
+				return
+			}
+
+			got, err := ioutil.ReadFile(filepath.Join(dir, "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.exp) {
+				t.Errorf("expected %q to be restored, got %q", tc.exp, got)
+			}
+
+			obj := fs.get("bucket", "cache")
+			gen, err := strconv.ParseInt(obj.Generation, 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exp := filepath.Base(c.localCachePath("bucket", &storage.ObjectAttrs{Name: "cache", Generation: gen}))
+			if len(copies) != 1 || copies[0] != exp {
+				t.Fatalf("expected only local copy %s, got %q", exp, copies)
+			}
+			data, err := ioutil.ReadFile(filepath.Join(local, exp))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, obj.data) {
+				t.Errorf("expected the local copy to have the %d bytes of the object, got %d bytes", len(obj.data), len(data))
+			}
+		})
+	}
+}
+
+// localCopies returns the names of the files in the local cache directory.
+func localCopies(tb testing.TB, dir string) []string {
+	tb.Helper()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
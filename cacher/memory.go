@@ -0,0 +1,148 @@
+package cacher
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/mholt/archiver/v4"
+)
+
+// defaultMemoryRestoreLimit is the default maximum total size of the files
+// restored by RestoreToMemory.
+const defaultMemoryRestoreLimit = 64 << 20
+
+// MemoryRestoreLimit sets the maximum total size, in bytes, of the file
+// contents RestoreToMemory holds in memory. Restores exceeding it fail with
+// ErrMaxSizeExceeded. Values less than one use the default of 64 MiB.
+func (c *Cacher) MemoryRestoreLimit(n int64) {
+	c.memoryRestoreLimit = n
+}
+
+// RestoreToMemory finds the newest object matching one of the keys, using the
+// same fallback rules as Restore, and returns the contents of its files keyed by
+// their name in the archive instead of writing them to disk. Directories are
+// skipped. Symbolic links are skipped too, since they only have meaning on a
+// filesystem; hard links are returned as a copy of the file they link to.
+func (c *Cacher) RestoreToMemory(ctx context.Context, bucket string, keys []string) (files map[string][]byte, retErr error) {
+	if bucket == "" {
+		retErr = validationErrorf("missing bucket")
+		return
+	}
+
+	if err := validateKeys(keys, 0); err != nil {
+		retErr = err
+		return
+	}
+
+	limit := c.memoryRestoreLimit
+	if limit < 1 {
+		limit = defaultMemoryRestoreLimit
+	}
+
+	ctx, finish := withOperationTimeout(ctx, "restore", c.restoreTimeout)
+	defer func() {
+		retErr = finish(retErr)
+	}()
+
+	// Wait for a transfer slot, if limited
+	release, err := c.acquireTransfer(ctx)
+	if err != nil {
+		retErr = err
+		return
+	}
+	defer release()
+
+	bucketHandle := c.client.Bucket(bucket)
+
+	_, match, err := c.findMatch(ctx, bucketHandle, c.objectNames(keys), nil)
+	if err != nil {
+		retErr = err
+		return
+	}
+	if match == nil {
+		retErr = &NotFoundError{Keys: keys}
+		return
+	}
+
+	gcsr, err := openArchive(ctx, bucketHandle, match, false)
+	if err != nil {
+		retErr = err
+		return
+	}
+	defer func() {
+		c.log("closing gcs reader")
+		if cerr := gcsr.Close(); cerr != nil {
+			if retErr != nil {
+				retErr = fmt.Errorf("%v: %w", retErr, &StorageError{Msg: "failed to close gcs reader", Err: cerr})
+				return
+			}
+			retErr = &StorageError{Msg: "failed to close gcs reader", Err: cerr}
+		}
+	}()
+
+	br := bufio.NewReader(gcsr)
+	compression, err := detectCompression(match, br, c.zstdDecoder())
+	if err != nil {
+		retErr = fmt.Errorf("failed to detect compression: %w", err)
+		return
+	}
+
+	result := make(map[string][]byte)
+	var total int64
+	err = extractArchive(ctx, br, compression, func(ctx context.Context, f archiver.File) error {
+		hdr, ok := f.Header.(*tar.Header)
+		if !ok {
+			return nil
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			in, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("%s: opening file: %v", f.NameInArchive, err)
+			}
+			defer in.Close()
+
+			// Read one byte past the remaining budget to detect going over it
+			b, err := io.ReadAll(io.LimitReader(in, limit-total+1))
+			if err != nil {
+				return fmt.Errorf("%s: reading file: %v", f.NameInArchive, err)
+			}
+			total += int64(len(b))
+			if total > limit {
+				return fmt.Errorf("%w: files are larger than %d bytes", ErrMaxSizeExceeded, limit)
+			}
+
+			result[f.NameInArchive] = b
+			return nil
+
+		case tar.TypeLink:
+			b, ok := result[hdr.Linkname]
+			if !ok {
+				c.log("skipping %s (link target %s not restored)", f.NameInArchive, hdr.Linkname)
+				return nil
+			}
+			total += int64(len(b))
+			if total > limit {
+				return fmt.Errorf("%w: files are larger than %d bytes", ErrMaxSizeExceeded, limit)
+			}
+
+			result[f.NameInArchive] = b
+			return nil
+
+		default:
+			c.log("skipping %s (not a regular file)", f.NameInArchive)
+			return nil
+		}
+	})
+	if err != nil {
+		retErr = fmt.Errorf("failed to extract archive: %w", err)
+		return
+	}
+
+	files = result
+	return
+}
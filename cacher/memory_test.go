@@ -0,0 +1,115 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCacher_RestoreToMemory(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		entries []testEntry
+		limit   int64
+		keys    []string
+		exp     map[string][]byte
+		err     error
+	}{
+		{
+			name: "files",
+			entries: []testEntry{
+				dirEntry("deps"),
+				fileEntry("deps/a.txt", "alpha"),
+				dirEntry("deps/sub"),
+				fileEntry("deps/sub/b.txt", "bravo"),
+			},
+			exp: map[string][]byte{"deps/a.txt": []byte("alpha"), "deps/sub/b.txt": []byte("bravo")},
+		},
+		{
+			name: "links",
+			entries: []testEntry{
+				fileEntry("a.txt", "alpha"),
+				symlinkEntry("symlink", "a.txt"),
+				hardlinkEntry("hardlink", "a.txt"),
+			},
+			exp: map[string][]byte{"a.txt": []byte("alpha"), "hardlink": []byte("alpha")},
+		},
+		{
+			name:    "empty_file",
+			entries: []testEntry{fileEntry("empty", "")},
+			exp:     map[string][]byte{"empty": {}},
+		},
+		{
+			name:    "at_limit",
+			entries: []testEntry{fileEntry("a", "12345"), fileEntry("b", "12345")},
+			limit:   10,
+			exp:     map[string][]byte{"a": []byte("12345"), "b": []byte("12345")},
+		},
+		{
+			name:    "over_limit",
+			entries: []testEntry{fileEntry("a", "12345"), fileEntry("b", "123456")},
+			limit:   10,
+			err:     ErrMaxSizeExceeded,
+		},
+		{
+			name:    "hard_links_count",
+			entries: []testEntry{fileEntry("a", "123456"), hardlinkEntry("b", "a")},
+			limit:   10,
+			err:     ErrMaxSizeExceeded,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			c.MemoryRestoreLimit(tc.limit)
+			fs.put("bucket", "cache", testArchive(t, tc.entries), nil)
+
+			files, err := c.RestoreToMemory(context.Background(), "bucket", []string{"cache"})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if tc.err != nil {
+				return
+			}
+			if !reflect.DeepEqual(files, tc.exp) {
+				t.Errorf("expected %q, got %q", tc.exp, files)
+			}
+		})
+	}
+}
+
+func TestCacher_RestoreToMemory_saved(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newTestCacher(t)
+	content := randomBytes(1024)
+	src := testFiles(t, map[string][]byte{"a.txt": []byte("alpha"), "sub/random": content})
+	if _, err := c.Save(context.Background(), &SaveRequest{Bucket: "bucket", Key: "cache", Dir: src}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := c.RestoreToMemory(context.Background(), "bucket", []string{"missing", "cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Base(src)
+	exp := map[string][]byte{base + "/a.txt": []byte("alpha"), base + "/sub/random": content}
+	if !reflect.DeepEqual(files, exp) {
+		t.Errorf("expected %d files, got %q", len(exp), files)
+	}
+
+	var nerr *NotFoundError
+	if _, err := c.RestoreToMemory(context.Background(), "bucket", []string{"missing"}); !errors.As(err, &nerr) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package cacher
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+// modulePath is the import path of this module, used to find its version in the
+// build info.
+const modulePath = "github.com/sethvargo/gcs-cacher"
+
+// Option is an option to New or NewWithClient.
+type Option func(cfg *config)
+
+// config is the collection of options given to New or NewWithClient.
+type config struct {
+	userAgent       string
+	endpoint        string
+	unauthenticated bool
+	credentialsFile string
+	credentialsJSON []byte
+	clock           func() time.Time
+}
+
+// WithUserAgent appends the given product to the user agent sent to Cloud
+// Storage, for example "my-ci/2.3". This makes it possible to distinguish
+// multiple tools running against the same bucket in audit logs.
+func WithUserAgent(userAgent string) Option {
+	return func(cfg *config) {
+		cfg.userAgent = userAgent
+	}
+}
+
+// WithEndpoint sends requests to the given Cloud Storage endpoint instead of the
+// public one, for example a private endpoint or a local emulator such as
+// "http://localhost:4443/storage/v1/". Emulators typically also require
+// WithoutAuthentication.
+//
+// The STORAGE_EMULATOR_HOST environment variable is also honored, in which case
+// authentication is disabled automatically. An explicit endpoint takes
+// precedence.
+func WithEndpoint(endpoint string) Option {
+	return func(cfg *config) {
+		cfg.endpoint = endpoint
+	}
+}
+
+// WithoutAuthentication disables authentication, which is useful when talking
+// to a local emulator.
+func WithoutAuthentication() Option {
+	return func(cfg *config) {
+		cfg.unauthenticated = true
+	}
+}
+
+// WithCredentialsFile authenticates with the service account or other
+// credentials in the JSON file at path, instead of the application default
+// credentials. This scopes a cacher to a specific identity, for example when
+// accessing buckets in different projects.
+func WithCredentialsFile(path string) Option {
+	return func(cfg *config) {
+		cfg.credentialsFile = path
+	}
+}
+
+// WithCredentialsJSON authenticates with the given service account or other
+// credentials JSON, instead of the application default credentials.
+func WithCredentialsJSON(b []byte) Option {
+	return func(cfg *config) {
+		cfg.credentialsJSON = b
+	}
+}
+
+// WithClock makes the cacher read the current time from clock instead of
+// time.Now, for example to test time-dependent behavior like the CustomTime
+// check or the age of the caches deleted by Prune deterministically.
+func WithClock(clock func() time.Time) Option {
+	return func(cfg *config) {
+		cfg.clock = clock
+	}
+}
+
+// validate checks the options for errors which would otherwise only surface on
+// the first request.
+func (cfg *config) validate() error {
+	if cfg.credentialsFile != "" && cfg.credentialsJSON != nil {
+		return fmt.Errorf("credentials file and credentials JSON are mutually exclusive")
+	}
+
+	if cfg.credentialsFile != "" {
+		f, err := os.Open(cfg.credentialsFile)
+		if err != nil {
+			return fmt.Errorf("failed to read credentials file: %w", err)
+		}
+		f.Close()
+	}
+
+	if cfg.credentialsJSON != nil && !json.Valid(cfg.credentialsJSON) {
+		return fmt.Errorf("credentials JSON is not valid JSON")
+	}
+	return nil
+}
+
+// clientOptions returns the options for creating the storage client.
+func (cfg *config) clientOptions() []option.ClientOption {
+	userAgent := defaultUserAgent()
+	if cfg.userAgent != "" {
+		userAgent = cfg.userAgent + " " + userAgent
+	}
+
+	opts := []option.ClientOption{
+		option.WithUserAgent(userAgent),
+	}
+	if cfg.endpoint != "" {
+		opts = append(opts, option.WithEndpoint(cfg.endpoint))
+	}
+	if cfg.unauthenticated {
+		opts = append(opts, option.WithoutAuthentication())
+	}
+	if cfg.credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.credentialsFile))
+	}
+	if cfg.credentialsJSON != nil {
+		opts = append(opts, option.WithCredentialsJSON(cfg.credentialsJSON))
+	}
+	return opts
+}
+
+// defaultUserAgent returns the user agent identifying this package, including
+// the module version when it is known from the build info.
+func defaultUserAgent() string {
+	version := "1.0"
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		mod := &info.Main
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				mod = dep
+				break
+			}
+		}
+
+		if mod.Path == modulePath && mod.Version != "" && mod.Version != "(devel)" {
+			version = strings.TrimPrefix(mod.Version, "v")
+		}
+	}
+
+	return "gcs-cacher/" + version
+}
@@ -0,0 +1,205 @@
+package cacher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+// userAgents records the user agent of each request before passing it on.
+type userAgents struct {
+	mu     sync.Mutex
+	agents []string
+	next   http.Handler
+}
+
+func (u *userAgents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.agents = append(u.agents, r.UserAgent())
+	u.mu.Unlock()
+	u.next.ServeHTTP(w, r)
+}
+
+// newTestServer returns a fakeStorage served by a new test server.
+func newTestServer(tb testing.TB, wrap func(http.Handler) http.Handler) (*fakeStorage, *httptest.Server) {
+	tb.Helper()
+
+	fs := &fakeStorage{objects: make(map[string]*fakeObject)}
+	var h http.Handler = fs
+	if wrap != nil {
+		h = wrap(h)
+	}
+	srv := httptest.NewServer(h)
+	tb.Cleanup(srv.Close)
+	return fs, srv
+}
+
+func TestWithUserAgent(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		userAgent string
+		exp       string
+	}{
+		{name: "default", exp: "gcs-cacher/"},
+		{name: "custom", userAgent: "my-ci/2.3", exp: "my-ci/2.3 gcs-cacher/"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			agents := &userAgents{}
+			_, srv := newTestServer(t, func(h http.Handler) http.Handler {
+				agents.next = h
+				return agents
+			})
+
+			opts := []Option{WithEndpoint(srv.URL + "/storage/v1/"), WithoutAuthentication()}
+			if tc.userAgent != "" {
+				opts = append(opts, WithUserAgent(tc.userAgent))
+			}
+			c, err := New(context.Background(), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if _, _, _, err := c.FindMatch(context.Background(), "bucket", []string{"cache"}); err != nil {
+				t.Fatal(err)
+			}
+
+			agents.mu.Lock()
+			defer agents.mu.Unlock()
+			if len(agents.agents) == 0 {
+				t.Fatal("expected a request")
+			}
+			for _, agent := range agents.agents {
+				if !strings.HasPrefix(agent, tc.exp) {
+					t.Errorf("expected user agent starting with %q, got %q", tc.exp, agent)
+				}
+			}
+		})
+	}
+}
+
+func TestWithEndpoint(t *testing.T) {
+	cases := []struct {
+		name     string
+		emulator bool
+	}{
+		{name: "option", emulator: false},
+		{name: "emulator_host", emulator: true},
+	}
+
+	// The emulator host is read from the environment, so these cases cannot run
+	// in parallel
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			fs, srv := newTestServer(t, nil)
+
+			var opts []Option
+			if tc.emulator {
+				prev, ok := os.LookupEnv("STORAGE_EMULATOR_HOST")
+				os.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+				defer func() {
+					if ok {
+						os.Setenv("STORAGE_EMULATOR_HOST", prev)
+						return
+					}
+					os.Unsetenv("STORAGE_EMULATOR_HOST")
+				}()
+			} else {
+				opts = append(opts, WithEndpoint(srv.URL+"/storage/v1/"), WithoutAuthentication())
+			}
+
+			c, err := New(context.Background(), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.Retries(1, 0)
+
+			src := testFiles(t, map[string][]byte{"data": []byte("content")})
+			if _, err := c.Save(context.Background(), &SaveRequest{
+				Bucket: "bucket",
+				Key:    "cache",
+				Dir:    src,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if fs.get("bucket", "cache") == nil {
+				t.Fatal("expected the cache to be saved to the endpoint")
+			}
+
+			assertRestores(t, c, "cache", filepath.Base(src)+"/data", []byte("content"))
+		})
+	}
+}
+
+func TestWithCredentials(t *testing.T) {
+	t.Parallel()
+
+	credentials := []byte(`{"type": "service_account"}`)
+	dir := testFiles(t, map[string][]byte{"key.json": credentials})
+	file := filepath.Join(dir, "key.json")
+
+	cases := []struct {
+		name string
+		opts []Option
+		exp  option.ClientOption
+		err  string
+	}{
+		{name: "file", opts: []Option{WithCredentialsFile(file)}, exp: option.WithCredentialsFile(file)},
+		{name: "json", opts: []Option{WithCredentialsJSON(credentials)}, exp: option.WithCredentialsJSON(credentials)},
+		{name: "missing_file", opts: []Option{WithCredentialsFile(filepath.Join(dir, "missing.json"))}, err: "failed to read credentials file"},
+		{name: "invalid_json", opts: []Option{WithCredentialsJSON([]byte("{"))}, err: "not valid JSON"},
+		{name: "both", opts: []Option{WithCredentialsFile(file), WithCredentialsJSON(credentials)}, err: "mutually exclusive"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := new(config)
+			for _, opt := range tc.opts {
+				opt(cfg)
+			}
+
+			if err := cfg.validate(); tc.err != "" || err != nil {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+
+				// New fails the same way, before creating a client
+				if _, err := New(context.Background(), tc.opts...); err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected New to fail with %q, got %v", tc.err, err)
+				}
+				return
+			}
+
+			var found bool
+			for _, opt := range cfg.clientOptions() {
+				found = found || reflect.DeepEqual(opt, tc.exp)
+			}
+			if !found {
+				t.Errorf("expected the client options to include %#v, got %#v", tc.exp, cfg.clientOptions())
+			}
+		})
+	}
+}
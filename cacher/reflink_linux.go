@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package cacher
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, which makes a file share the extents of
+// another.
+const ficlone = 0x40049409
+
+// reflink makes dst a copy-on-write clone of src. It fails if the filesystem
+// does not support it, or the files are on different filesystems.
+func reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
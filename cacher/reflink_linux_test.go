@@ -0,0 +1,192 @@
+//go:build linux
+// +build linux
+
+package cacher
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// reflinkError returns the error of cloning a file in dir, which is nil if
+// the filesystem of dir supports reflinks.
+func reflinkError(tb testing.TB, dir string) error {
+	tb.Helper()
+
+	src, err := ioutil.TempFile(dir, "src-")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	if _, err := src.Write([]byte("content")); err != nil {
+		tb.Fatal(err)
+	}
+
+	dst, err := ioutil.TempFile(dir, "dst-")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+	return reflink(dst, src)
+}
+
+func TestReflink(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	if err := reflinkError(t, dir); err != nil {
+		t.Skipf("the filesystem of %s does not support reflinks: %s", dir, err)
+	}
+
+	srcPath, dstPath := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(srcPath, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if err := reflink(dst, src); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing to the clone copies the shared extents, and leaves the source
+	// alone
+	if _, err := dst.WriteAt([]byte("O"), 0); err != nil {
+		t.Fatal(err)
+	}
+	for pth, exp := range map[string]string{srcPath: "original", dstPath: "Original"} {
+		got, err := ioutil.ReadFile(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != exp {
+			t.Errorf("expected %s to contain %q, got %q", pth, exp, got)
+		}
+	}
+}
+
+func TestCacher_Restore_useReflink(t *testing.T) {
+	t.Parallel()
+
+	// The files are too large to be buffered, so the clone sources are
+	// written before the files cloned from them
+	shared := bytes.Repeat([]byte("shared"), maxPooledFileSize/4)
+	other := bytes.Repeat([]byte("other"), maxPooledFileSize/4)
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{name: "a", content: shared},
+		{name: "b", content: other},
+		{name: "dir/a", content: shared},
+		{name: "dir/b", content: other},
+		{name: "empty", content: nil},
+		{name: "empty_copy", content: nil},
+	}
+
+	cases := []struct {
+		name      string
+		checksums bool
+		reflink   bool
+		// tried expects cloning to be tried, which only fails if the
+		// filesystem does not support reflinks
+		tried bool
+	}{
+		{name: "cloned", checksums: true, reflink: true, tried: true},
+		{name: "no_checksums", checksums: false, reflink: true},
+		{name: "disabled", checksums: true, reflink: false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(gz)
+			for _, f := range files {
+				hdr := &tar.Header{
+					Typeflag: tar.TypeReg,
+					Name:     f.name,
+					Mode:     0644,
+					Size:     int64(len(f.content)),
+					ModTime:  time.Unix(1600000000, 0),
+					Format:   tar.FormatPAX,
+				}
+				if tc.checksums {
+					sum := blake2b.Sum256(f.content)
+					hdr.PAXRecords = map[string]string{paxChecksumKey: hex.EncodeToString(sum[:])}
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tw.Write(f.content); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := gz.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			supported := reflinkError(t, dir) == nil
+			ex, err := testExtract(t, &RestoreRequest{UseReflink: tc.reflink, WriteManifest: true}, dir, buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Cloning falls back to writing the files, and is only tried once
+			// on a filesystem without reflinks
+			if exp := tc.tried && !supported; ex.noReflink != exp {
+				t.Errorf("expected cloning to have failed: %t, got %t", exp, ex.noReflink)
+			}
+			if exp := tc.tried; (len(ex.clones) > 0) != exp {
+				t.Errorf("expected clone sources to be recorded: %t, got %v", exp, ex.clones)
+			}
+
+			entries := make(map[string]ContentsEntry)
+			for _, entry := range ex.contents.Files {
+				entries[entry.Name] = entry
+			}
+			for _, f := range files {
+				got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(f.name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, f.content) {
+					t.Errorf("expected %s to have %d bytes of content, got %d different bytes", f.name, len(f.content), len(got))
+				}
+
+				// Cloned files are recorded like written files
+				sum := blake2b.Sum256(f.content)
+				if entry := entries[f.name]; entry.Checksum != hex.EncodeToString(sum[:]) || entry.Size != int64(len(f.content)) {
+					t.Errorf("expected %s to be recorded with its size and checksum, got %+v", f.name, entry)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package cacher
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is not supported on platforms other than Linux.
+func reflink(dst, src *os.File) error {
+	return errors.New("reflinks are not supported on this platform")
+}
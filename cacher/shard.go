@@ -0,0 +1,447 @@
+package cacher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// manifestContentType is the content type of the object listing the parts
+	// of a sharded cache.
+	manifestContentType = "application/vnd.gcs-cacher.manifest+json"
+
+	// metadataShardOf is the object metadata key marking an object as a part of
+	// the sharded cache with the given key. Parts are never restored directly.
+	metadataShardOf = "gcs-cacher-shard-of"
+
+	// metadataCompressedSize is the object metadata key in which the manifest of
+	// a sharded cache records the total size of its parts.
+	metadataCompressedSize = "gcs-cacher-compressed-size"
+
+	// defaultPendingParts is the number of full parts finalized in the
+	// background at once when MaxConcurrentTransfers is unlimited. Each holds
+	// the buffered chunk of its writer until it is finalized.
+	defaultPendingParts = 4
+)
+
+// manifest lists the parts of a sharded cache. Concatenated in order, the parts
+// form the compressed archive.
+type manifest struct {
+	Parts []manifestPart `json:"parts"`
+}
+
+// manifestPart is a single part of a sharded cache. The MD5 is missing from
+// manifests written before it was recorded.
+type manifestPart struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+	Size       int64  `json:"size"`
+	MD5        []byte `json:"md5,omitempty"`
+}
+
+// shardWriter is an io.Writer which splits the stream into part objects of a
+// fixed size, named after the key with a random upload ID and a ".partNNNN"
+// suffix, so concurrent uploads of the same key never share parts. The stream
+// is written to one part at a time; when a part is full, it is finalized in the
+// background while the next one is written, with a bounded number of parts
+// pending at once.
+type shardWriter struct {
+	ctx      context.Context
+	c        *Cacher
+	bucket   *storage.BucketHandle
+	key      string
+	id       string
+	size     int64
+	attrs    storage.ObjectAttrs
+	progress func(soFar int64)
+
+	// pending limits the number of parts being finalized in the background.
+	pending chan struct{}
+
+	cur   *storage.Writer
+	n     int64
+	total int64
+
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	parts []manifestPart
+	err   error
+}
+
+// newShardWriter creates a shardWriter uploading parts of the given size. The
+// parts and the manifest are created with the given attributes. The progress
+// function receives the total number of bytes uploaded so far.
+func (c *Cacher) newShardWriter(ctx context.Context, bucket *storage.BucketHandle, key string, size int64, attrs storage.ObjectAttrs, progress func(soFar int64)) (*shardWriter, error) {
+	id, err := newUploadID()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := defaultPendingParts
+	if n := cap(c.transfers); n > 0 {
+		pending = n
+	}
+
+	return &shardWriter{
+		ctx:      ctx,
+		c:        c,
+		bucket:   bucket,
+		key:      key,
+		id:       id,
+		size:     size,
+		attrs:    attrs,
+		progress: progress,
+		pending:  make(chan struct{}, pending),
+	}, nil
+}
+
+// newUploadID returns a random ID distinguishing the objects of one upload from
+// those of other uploads of the same key.
+func newUploadID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate upload id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Write writes p to the current part, starting new parts as needed.
+func (s *shardWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if err := s.error(); err != nil {
+			return written, err
+		}
+
+		if s.cur == nil {
+			s.open()
+		}
+
+		chunk := p
+		if remaining := s.size - s.n; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		n, err := s.cur.Write(chunk)
+		written += n
+		s.n += int64(n)
+		s.total += int64(n)
+		if err != nil {
+			return written, &StorageError{Msg: "failed to write part", Err: err}
+		}
+		p = p[n:]
+
+		if s.n == s.size {
+			s.closePart()
+		}
+	}
+	return written, nil
+}
+
+// open starts the next part.
+func (s *shardWriter) open() {
+	s.mu.Lock()
+	idx := len(s.parts)
+	name := fmt.Sprintf("%s.%s.part%04d", s.key, s.id, idx)
+	s.parts = append(s.parts, manifestPart{Name: name})
+	s.mu.Unlock()
+
+	s.c.log("starting part %s", name)
+
+	base := s.total
+	w := s.bucket.Object(name).If(storage.Conditions{DoesNotExist: true}).NewWriter(s.ctx)
+	w.ContentType = contentType
+	w.CacheControl = s.attrs.CacheControl
+	w.PredefinedACL = s.attrs.PredefinedACL
+	w.Metadata = map[string]string{
+		metadataShardOf: s.key,
+	}
+	w.ProgressFunc = func(soFar int64) {
+		s.progress(base + soFar)
+	}
+
+	s.cur = w
+	s.n = 0
+}
+
+// closePart finalizes the current part in the background. It blocks while the
+// maximum number of parts are already pending.
+func (s *shardWriter) closePart() {
+	w, size := s.cur, s.n
+	s.mu.Lock()
+	idx := len(s.parts) - 1
+	s.mu.Unlock()
+
+	s.cur = nil
+	s.n = 0
+
+	s.pending <- struct{}{}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.pending }()
+
+		err := w.Close()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err != nil {
+			if s.err == nil {
+				s.err = &StorageError{Msg: "failed to close part " + s.parts[idx].Name, Err: err}
+			}
+			return
+		}
+		s.parts[idx].Generation = w.Attrs().Generation
+		s.parts[idx].Size = size
+		s.parts[idx].MD5 = w.Attrs().MD5
+	}()
+}
+
+// error returns the first error encountered finalizing a part, if any.
+func (s *shardWriter) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// finish finalizes the remaining parts and then writes the manifest to obj. The
+// manifest is written last, so a cache is never visible before all of its parts
+// are.
+func (s *shardWriter) finish(ctx context.Context, obj *storage.ObjectHandle) error {
+	if s.cur != nil {
+		s.closePart()
+	}
+	s.wg.Wait()
+
+	if err := s.error(); err != nil {
+		s.deleteParts()
+		return err
+	}
+
+	b, err := json.Marshal(&manifest{Parts: s.parts})
+	if err != nil {
+		s.deleteParts()
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	c := s.c
+	c.log("writing manifest for %d parts", len(s.parts))
+
+	w := obj.NewWriter(ctx)
+	w.ContentType = manifestContentType
+	w.CacheControl = s.attrs.CacheControl
+	w.CustomTime = s.attrs.CustomTime
+	w.PredefinedACL = s.attrs.PredefinedACL
+	w.EventBasedHold = s.attrs.EventBasedHold
+	w.Metadata = make(map[string]string, len(s.attrs.Metadata)+1)
+	for k, v := range s.attrs.Metadata {
+		w.Metadata[k] = v
+	}
+	w.Metadata[metadataCompressedSize] = strconv.FormatInt(s.total, 10)
+
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		s.deleteParts()
+		return &StorageError{Msg: "failed to write manifest", Err: err}
+	}
+	if err := w.Close(); err != nil {
+		s.deleteParts()
+		return &StorageError{Msg: "failed to close manifest writer", Err: err}
+	}
+
+	// Parts are only held once the manifest exists, so a failed upload can
+	// still delete them
+	if s.attrs.EventBasedHold {
+		c.log("placing holds on %d parts", len(s.parts))
+		return setPartHolds(ctx, s.bucket, s.parts, true)
+	}
+	return nil
+}
+
+// abort stops the upload, whose context the caller must have cancelled already,
+// and deletes the parts finalized so far.
+func (s *shardWriter) abort() {
+	if s.cur != nil {
+		if err := s.cur.Close(); err != nil {
+			s.c.log("aborted part writer: %s", err)
+		}
+		s.cur = nil
+	}
+	s.wg.Wait()
+	s.deleteParts()
+}
+
+// deleteParts deletes the parts on a best-effort basis. Each deletion of a
+// finalized part is conditioned on the generation written, so parts replaced by
+// someone else are left alone.
+func (s *shardWriter) deleteParts() {
+	s.deleteObjects(s.parts)
+}
+
+// deleteObjects deletes the objects on a best-effort basis. An object without a
+// generation was still being uploaded and may have been created even though
+// its writer failed, for example when the upload was cancelled after the
+// service stored it but before the response arrived. Since its name is unique
+// to this upload, it is deleted unconditionally.
+func (s *shardWriter) deleteObjects(parts []manifestPart) {
+	ctx, done := context.WithTimeout(context.Background(), attrsTimeout)
+	defer done()
+
+	for _, part := range parts {
+		obj := s.bucket.Object(part.Name)
+		if part.Generation != 0 {
+			obj = obj.If(storage.Conditions{GenerationMatch: part.Generation})
+		}
+
+		s.c.log("deleting part %s", part.Name)
+		if err := obj.Delete(ctx); err != nil {
+			if part.Generation == 0 && errors.Is(err, storage.ErrObjectNotExist) {
+				continue
+			}
+			s.c.log("failed to delete part %s: %s", part.Name, err)
+		}
+	}
+}
+
+// compressedSize returns the size of the compressed archive in the object,
+// which for the manifest of a sharded cache is the total size of its parts.
+func compressedSize(attrs *storage.ObjectAttrs) int64 {
+	if attrs.ContentType == manifestContentType {
+		return parseMetadataInt(attrs.Metadata, metadataCompressedSize)
+	}
+	return attrs.Size
+}
+
+// openArchive returns a reader for the content of the matched object, pinned to
+// its generation. For the manifest of a sharded cache, the reader streams the
+// parts in order and, unless skipMD5 is set, fails if a part does not match the
+// MD5 recorded in the manifest.
+func openArchive(ctx context.Context, bucket *storage.BucketHandle, match *storage.ObjectAttrs, skipMD5 bool) (io.ReadCloser, error) {
+	if match.ContentType != manifestContentType {
+		r, err := bucket.Object(match.Name).Generation(match.Generation).NewReader(ctx)
+		if err != nil {
+			return nil, &StorageError{Msg: "failed to create object reader", Err: err}
+		}
+		return r, nil
+	}
+
+	m, err := readManifest(ctx, bucket, match)
+	if err != nil {
+		return nil, err
+	}
+
+	return &partsReader{
+		ctx:     ctx,
+		bucket:  bucket,
+		parts:   m.Parts,
+		skipMD5: skipMD5,
+	}, nil
+}
+
+// readManifest reads the manifest of a sharded cache.
+func readManifest(ctx context.Context, bucket *storage.BucketHandle, attrs *storage.ObjectAttrs) (*manifest, error) {
+	r, err := bucket.Object(attrs.Name).Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, &StorageError{Msg: "failed to create object reader", Err: err}
+	}
+
+	var m manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if err := r.Close(); err != nil {
+		return nil, &StorageError{Msg: "failed to close manifest reader", Err: err}
+	}
+	return &m, nil
+}
+
+// setPartHolds places or releases the event-based hold on each of the parts.
+func setPartHolds(ctx context.Context, bucket *storage.BucketHandle, parts []manifestPart, hold bool) error {
+	for _, part := range parts {
+		obj := bucket.Object(part.Name).If(storage.Conditions{GenerationMatch: part.Generation})
+		if _, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{EventBasedHold: hold}); err != nil {
+			return &StorageError{Msg: "failed to update hold on part " + part.Name, Err: err}
+		}
+	}
+	return nil
+}
+
+// partsReader is an io.ReadCloser which reads the parts of a sharded cache one
+// after another. The MD5 of each part is verified once it is read, if the
+// manifest records one.
+type partsReader struct {
+	ctx     context.Context
+	bucket  *storage.BucketHandle
+	parts   []manifestPart
+	skipMD5 bool
+
+	cur  io.ReadCloser
+	src  io.Reader
+	name string
+	md5r *md5Reader
+}
+
+// Read reads from the current part, moving on to the next one when it is
+// exhausted.
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.cur == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+
+			part := p.parts[0]
+			r, err := p.bucket.Object(part.Name).Generation(part.Generation).NewReader(p.ctx)
+			if err != nil {
+				return 0, &StorageError{Msg: "failed to create reader for part " + part.Name, Err: err}
+			}
+			p.cur, p.src, p.name, p.md5r = r, r, part.Name, nil
+			if !p.skipMD5 && len(part.MD5) > 0 {
+				p.md5r = newMD5Reader(r, part.MD5)
+				p.src = p.md5r
+			}
+			p.parts = p.parts[1:]
+		}
+
+		n, err := p.src.Read(b)
+		if err == io.EOF {
+			if p.md5r != nil {
+				if err := p.md5r.verify(); err != nil {
+					return n, fmt.Errorf("part %s: %w", p.name, err)
+				}
+			}
+
+			cerr := p.cur.Close()
+			p.cur = nil
+			if cerr != nil {
+				return n, &StorageError{Msg: "failed to close part reader", Err: cerr}
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the current part, if any.
+func (p *partsReader) Close() error {
+	if p.cur == nil {
+		return nil
+	}
+
+	err := p.cur.Close()
+	p.cur = nil
+	return err
+}
@@ -0,0 +1,191 @@
+package cacher
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+// partNames returns the names of the parts of key among names.
+func partNames(names []string, key string) []string {
+	var parts []string
+	for _, name := range names {
+		if strings.HasPrefix(name, key+".") {
+			parts = append(parts, name)
+		}
+	}
+	return parts
+}
+
+func TestShardWriter_roundTrip(t *testing.T) {
+	t.Parallel()
+
+	partName := regexp.MustCompile(`^cache\.[0-9a-f]{16}\.part\d{4}$`)
+
+	cases := []struct {
+		name      string
+		size      int
+		shardSize int64
+		minParts  int
+	}{
+		{name: "single_part", size: 1000, shardSize: 1 << 20, minParts: 1},
+		{name: "many_parts", size: 200000, shardSize: 30000, minParts: 7},
+		{name: "tiny_parts", size: 5000, shardSize: 512, minParts: 10},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			content := randomBytes(tc.size)
+			src := testFiles(t, map[string][]byte{"data": content})
+
+			result, err := c.Save(context.Background(), &SaveRequest{
+				Bucket:    "bucket",
+				Key:       "cache",
+				Dir:       src,
+				ShardSize: tc.shardSize,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Uploaded {
+				t.Fatal("expected the cache to be uploaded")
+			}
+
+			parts := partNames(fs.names("bucket"), "cache")
+			if len(parts) < tc.minParts {
+				t.Errorf("expected at least %d parts, got %q", tc.minParts, parts)
+			}
+			for _, name := range parts {
+				if !partName.MatchString(name) {
+					t.Errorf("expected part name with an upload id, got %s", name)
+				}
+				if got := fs.get("bucket", name).Metadata[metadataShardOf]; got != "cache" {
+					t.Errorf("expected %s to be marked as a part of cache, got %q", name, got)
+				}
+			}
+
+			manifest := fs.get("bucket", "cache")
+			if manifest == nil || manifest.ContentType != manifestContentType {
+				t.Fatalf("expected a manifest at the key, got %+v", manifest)
+			}
+
+			assertRestores(t, c, "cache", filepath.Base(src)+"/data", content)
+		})
+	}
+}
+
+func TestShardWriter_existingKey(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		req  func(src string) *SaveRequest
+	}{
+		{
+			name: "skip_existence_check",
+			req: func(src string) *SaveRequest {
+				return &SaveRequest{Bucket: "bucket", Key: "cache", Dir: src, ShardSize: 1000, SkipExistenceCheck: true}
+			},
+		},
+		{
+			name: "existence_check",
+			req: func(src string) *SaveRequest {
+				return &SaveRequest{Bucket: "bucket", Key: "cache", Dir: src, ShardSize: 1000}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			ctx := context.Background()
+
+			// The first save wins and the second must leave it intact
+			first := randomBytes(5000)
+			src := testFiles(t, map[string][]byte{"data": first})
+			if _, err := c.Save(ctx, tc.req(src)); err != nil {
+				t.Fatal(err)
+			}
+			before := fs.names("bucket")
+
+			second := testFiles(t, map[string][]byte{"data": randomBytes(6000)})
+			result, err := c.Save(ctx, tc.req(second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Uploaded {
+				t.Error("expected the second save to be skipped")
+			}
+
+			if got := fs.names("bucket"); strings.Join(got, ",") != strings.Join(before, ",") {
+				t.Errorf("expected objects %q to be unchanged, got %q", before, got)
+			}
+			assertRestores(t, c, "cache", filepath.Base(src)+"/data", first)
+		})
+	}
+}
+
+func TestShardWriter_uniqueNames(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newTestCacher(t)
+	bucket := c.client.Bucket("bucket")
+
+	seen := make(map[string]bool)
+	for idx := 0; idx < 10; idx++ {
+		s, err := c.newShardWriter(context.Background(), bucket, "cache", 100, storage.ObjectAttrs{}, func(int64) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[s.id] {
+			t.Fatalf("expected unique upload ids, got %s twice", s.id)
+		}
+		seen[s.id] = true
+	}
+}
+
+func TestShardWriter_pendingParts(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		transfers int
+		exp       int
+	}{
+		{name: "unlimited", transfers: 0, exp: defaultPendingParts},
+		{name: "limited", transfers: 2, exp: 2},
+		{name: "serial", transfers: 1, exp: 1},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			c.MaxConcurrentTransfers(tc.transfers)
+
+			s, err := c.newShardWriter(context.Background(), c.client.Bucket("bucket"), "cache", 100, storage.ObjectAttrs{}, func(int64) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cap(s.pending); got != tc.exp {
+				t.Errorf("expected %d pending parts, got %d", tc.exp, got)
+			}
+		})
+	}
+}
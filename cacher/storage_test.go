@@ -0,0 +1,629 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// fakeObject is an object stored by fakeStorage.
+type fakeObject struct {
+	Bucket         string            `json:"bucket"`
+	Name           string            `json:"name"`
+	Generation     string            `json:"generation"`
+	Metageneration string            `json:"metageneration"`
+	Size           string            `json:"size"`
+	ContentType    string            `json:"contentType,omitempty"`
+	CacheControl   string            `json:"cacheControl,omitempty"`
+	MD5Hash        string            `json:"md5Hash,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	EventBasedHold bool              `json:"eventBasedHold,omitempty"`
+	CustomTime     string            `json:"customTime,omitempty"`
+	Updated        string            `json:"updated"`
+
+	// acl is the predefined ACL the object was created with, if any.
+	acl  string
+	data []byte
+}
+
+// fakeStorage is an in-memory implementation of the parts of the Cloud Storage
+// JSON and XML APIs used by the cacher. It only supports single-request
+// uploads, so tests must upload less than a chunk at a time.
+type fakeStorage struct {
+	mu         sync.Mutex
+	objects    map[string]*fakeObject
+	generation int64
+
+	// versioning keeps the generations of objects which were replaced in
+	// noncurrent, where they can still be read by generation like in a bucket
+	// with object versioning. noncurrent is keyed by bucket, name, and
+	// generation.
+	versioning bool
+	noncurrent map[string]*fakeObject
+	requests   int
+
+	// delay is how long to wait before serving each request.
+	delay time.Duration
+
+	// bucketDelays are how long to wait before serving each request of a kind,
+	// "json" or "download", to a bucket, keyed by kind and bucket.
+	bucketDelays map[string]time.Duration
+
+	// failures are how many of the next requests with a method and path to fail,
+	// and with which status, keyed by method and unescaped path.
+	failures map[string]fakeFailure
+}
+
+// fakeFailure is a number of requests to fail with a status, after skipping
+// some.
+type fakeFailure struct {
+	skip      int
+	remaining int
+	status    int
+}
+
+// newTestCacher returns a cacher backed by a new fakeStorage.
+func newTestCacher(tb testing.TB, opts ...Option) (*Cacher, *fakeStorage) {
+	tb.Helper()
+
+	fs := &fakeStorage{objects: make(map[string]*fakeObject)}
+	srv := httptest.NewServer(fs)
+	tb.Cleanup(srv.Close)
+
+	client, err := storage.NewClient(context.Background(),
+		option.WithEndpoint(srv.URL+"/storage/v1/"),
+		option.WithoutAuthentication())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { client.Close() })
+
+	c := NewWithClient(client, opts...)
+	c.Retries(1, 0)
+	return c, fs
+}
+
+// put stores an object directly and returns its generation. The update time
+// in attrs is kept, if set.
+func (fs *fakeStorage) put(bucket, name string, data []byte, attrs *fakeObject) int64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	obj := &fakeObject{}
+	if attrs != nil {
+		*obj = *attrs
+	}
+	obj.Bucket, obj.Name = bucket, name
+	generation := fs.store(obj, data)
+	if attrs != nil && attrs.Updated != "" {
+		obj.Updated = attrs.Updated
+	}
+	return generation
+}
+
+// store records obj with the given content under a new generation. The caller
+// must hold mu.
+func (fs *fakeStorage) store(obj *fakeObject, data []byte) int64 {
+	fs.generation++
+	sum := md5.Sum(data)
+	obj.Generation = strconv.FormatInt(fs.generation, 10)
+	obj.Metageneration = "1"
+	obj.Size = strconv.Itoa(len(data))
+	obj.MD5Hash = base64.StdEncoding.EncodeToString(sum[:])
+	obj.Updated = time.Now().UTC().Format(time.RFC3339Nano)
+	obj.data = data
+
+	key := obj.Bucket + "/" + obj.Name
+	if prev, ok := fs.objects[key]; ok && fs.versioning {
+		if fs.noncurrent == nil {
+			fs.noncurrent = make(map[string]*fakeObject)
+		}
+		fs.noncurrent[key+"#"+prev.Generation] = prev
+	}
+	fs.objects[key] = obj
+	return fs.generation
+}
+
+// object returns the object, or the noncurrent generation given in q. The
+// caller must hold mu.
+func (fs *fakeStorage) object(bucket, name string, q url.Values) (*fakeObject, bool) {
+	key := bucket + "/" + name
+	obj, ok := fs.objects[key]
+	if generation := q.Get("generation"); generation != "" && (!ok || generation != obj.Generation) {
+		obj, ok = fs.noncurrent[key+"#"+generation]
+	}
+	return obj, ok
+}
+
+// setDelay sets how long to wait before serving each request.
+func (fs *fakeStorage) setDelay(d time.Duration) {
+	fs.mu.Lock()
+	fs.delay = d
+	fs.mu.Unlock()
+}
+
+// setBucketDelay sets how long to wait before serving each request of the
+// given kind, "json" or "download", to bucket, in addition to the delay.
+func (fs *fakeStorage) setBucketDelay(bucket, kind string, d time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.bucketDelays == nil {
+		fs.bucketDelays = make(map[string]time.Duration)
+	}
+	fs.bucketDelays[kind+":"+bucket] = d
+}
+
+// setFailures fails the next n requests with method to path, such as
+// "/storage/v1/b/bucket/o/key", with status.
+func (fs *fakeStorage) setFailures(method, path string, n, status int) {
+	fs.setFailuresAfter(method, path, 0, n, status)
+}
+
+// setFailuresAfter is like setFailures, but first serves skip requests
+// normally.
+func (fs *fakeStorage) setFailuresAfter(method, path string, skip, n, status int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.failures == nil {
+		fs.failures = make(map[string]fakeFailure)
+	}
+	fs.failures[method+" "+path] = fakeFailure{skip: skip, remaining: n, status: status}
+}
+
+// get returns a copy of the object and its content, or nil if it does not
+// exist.
+func (fs *fakeStorage) get(bucket, name string) *fakeObject {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	obj, ok := fs.objects[bucket+"/"+name]
+	if !ok {
+		return nil
+	}
+	cp := *obj
+	return &cp
+}
+
+// update calls fn with the stored object, to change it behind the back of the
+// cacher. It fails if the object does not exist.
+func (fs *fakeStorage) update(tb testing.TB, bucket, name string, fn func(obj *fakeObject)) {
+	tb.Helper()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	obj, ok := fs.objects[bucket+"/"+name]
+	if !ok {
+		tb.Fatalf("no such object: %s/%s", bucket, name)
+	}
+	fn(obj)
+}
+
+// names returns the sorted names of the objects in bucket.
+func (fs *fakeStorage) names(bucket string) []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var names []string
+	for _, obj := range fs.objects {
+		if obj.Bucket == bucket {
+			names = append(names, obj.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServeHTTP implements http.Handler.
+func (fs *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for idx, part := range parts {
+		parts[idx], _ = url.PathUnescape(part)
+	}
+	q := r.URL.Query()
+
+	var kind string
+	switch {
+	case len(parts) >= 4 && parts[0] == "storage":
+		kind = "json:" + parts[3]
+	case len(parts) >= 2 && parts[0] != "upload":
+		kind = "download:" + parts[0]
+	}
+
+	fs.mu.Lock()
+	delay := fs.delay + fs.bucketDelays[kind]
+	fs.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.requests++
+
+	failKey := r.Method + " /" + strings.Join(parts, "/")
+	if f, ok := fs.failures[failKey]; ok {
+		switch {
+		case f.skip > 0:
+			f.skip--
+			fs.failures[failKey] = f
+		case f.remaining > 0:
+			f.remaining--
+			fs.failures[failKey] = f
+			writeError(w, f.status, "injected failure")
+			return
+		}
+	}
+
+	switch {
+	case len(parts) == 6 && parts[0] == "upload" && parts[3] == "b" && parts[5] == "o" && r.Method == http.MethodPost:
+		fs.insert(w, r, parts[4], q)
+	case len(parts) >= 4 && parts[0] == "storage" && parts[2] == "b":
+		fs.serveJSON(w, r, parts[3:], q)
+	case len(parts) >= 2 && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		fs.download(w, r, parts[0], strings.Join(parts[1:], "/"), q)
+	default:
+		http.Error(w, "unsupported request "+r.Method+" "+r.URL.String(), http.StatusNotImplemented)
+	}
+}
+
+// serveJSON serves the JSON API requests under /storage/v1/b/.
+func (fs *fakeStorage) serveJSON(w http.ResponseWriter, r *http.Request, parts []string, q url.Values) {
+	bucket := parts[0]
+	switch {
+	case len(parts) == 2 && parts[1] == "o" && r.Method == http.MethodGet:
+		fs.list(w, bucket, q)
+	case len(parts) == 3 && parts[1] == "o" && r.Method == http.MethodGet:
+		obj, ok := fs.lookup(w, bucket, parts[2], q)
+		if ok {
+			writeJSON(w, obj)
+		}
+	case len(parts) == 3 && parts[1] == "o" && r.Method == http.MethodDelete:
+		if obj, ok := fs.lookup(w, bucket, parts[2], q); ok {
+			if obj.EventBasedHold {
+				writeError(w, http.StatusForbidden, "Object '"+bucket+"/"+obj.Name+"' is under active Event-Based hold and cannot be deleted, overwritten or archived until hold is removed.")
+				return
+			}
+			key := bucket + "/" + parts[2]
+			if fs.objects[key] == obj {
+				delete(fs.objects, key)
+			} else {
+				delete(fs.noncurrent, key+"#"+obj.Generation)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case len(parts) == 3 && parts[1] == "o" && r.Method == http.MethodPatch:
+		fs.patch(w, r, bucket, parts[2], q)
+	case len(parts) == 4 && parts[1] == "o" && parts[3] == "compose" && r.Method == http.MethodPost:
+		fs.compose(w, r, bucket, parts[2], q)
+	case len(parts) == 8 && parts[1] == "o" && parts[3] == "rewriteTo" && r.Method == http.MethodPost:
+		fs.rewrite(w, r, bucket, parts[2], parts[5], parts[7], q)
+	default:
+		http.Error(w, "unsupported request "+r.Method+" "+r.URL.String(), http.StatusNotImplemented)
+	}
+}
+
+// lookup returns the object, checking the generation and preconditions in q.
+// It writes an error response and returns false if that fails.
+func (fs *fakeStorage) lookup(w http.ResponseWriter, bucket, name string, q url.Values) (*fakeObject, bool) {
+	obj, ok := fs.object(bucket, name, q)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such object: "+bucket+"/"+name)
+		return nil, false
+	}
+	if !fs.preconditions(w, obj, q) {
+		return nil, false
+	}
+	return obj, true
+}
+
+// preconditions checks the generation preconditions in q against obj, which
+// is nil if the object does not exist.
+func (fs *fakeStorage) preconditions(w http.ResponseWriter, obj *fakeObject, q url.Values) bool {
+	if match := q.Get("ifGenerationMatch"); match != "" {
+		if (match == "0" && obj != nil) || (match != "0" && (obj == nil || obj.Generation != match)) {
+			writeError(w, http.StatusPreconditionFailed, "precondition failed")
+			return false
+		}
+	}
+	if match := q.Get("ifMetagenerationMatch"); match != "" && (obj == nil || obj.Metageneration != match) {
+		writeError(w, http.StatusPreconditionFailed, "precondition failed")
+		return false
+	}
+	return true
+}
+
+// list lists the objects of bucket with the prefix in q.
+func (fs *fakeStorage) list(w http.ResponseWriter, bucket string, q url.Values) {
+	var items []*fakeObject
+	for _, obj := range fs.objects {
+		if obj.Bucket == bucket && strings.HasPrefix(obj.Name, q.Get("prefix")) {
+			items = append(items, obj)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+	writeJSON(w, map[string]interface{}{"kind": "storage#objects", "items": items})
+}
+
+// insert stores the object of a multipart upload.
+func (fs *fakeStorage) insert(w http.ResponseWriter, r *http.Request, bucket string, q url.Values) {
+	if q.Get("uploadType") != "multipart" {
+		http.Error(w, "only multipart uploads are supported", http.StatusNotImplemented)
+		return
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	meta, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	obj := &fakeObject{}
+	if err := json.NewDecoder(meta).Decode(obj); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	media, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(media)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if obj.Name == "" {
+		obj.Name = q.Get("name")
+	}
+	obj.Bucket = bucket
+	obj.acl = q.Get("predefinedAcl")
+
+	if !fs.preconditions(w, fs.objects[bucket+"/"+obj.Name], q) {
+		return
+	}
+	fs.store(obj, data)
+	writeJSON(w, obj)
+}
+
+// patch updates the attributes of an object.
+func (fs *fakeStorage) patch(w http.ResponseWriter, r *http.Request, bucket, name string, q url.Values) {
+	obj, ok := fs.lookup(w, bucket, name, q)
+	if !ok {
+		return
+	}
+
+	var update map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v, ok := update["eventBasedHold"]; ok {
+		json.Unmarshal(v, &obj.EventBasedHold)
+	}
+	if v, ok := update["metadata"]; ok {
+		var metadata map[string]*string
+		json.Unmarshal(v, &metadata)
+		if obj.Metadata == nil {
+			obj.Metadata = make(map[string]string)
+		}
+		for k, v := range metadata {
+			if v == nil {
+				delete(obj.Metadata, k)
+				continue
+			}
+			obj.Metadata[k] = *v
+		}
+	}
+	if v, ok := update["customTime"]; ok {
+		json.Unmarshal(v, &obj.CustomTime)
+	}
+	metageneration, _ := strconv.Atoi(obj.Metageneration)
+	obj.Metageneration = strconv.Itoa(metageneration + 1)
+	writeJSON(w, obj)
+}
+
+// compose concatenates the source objects into a new object.
+func (fs *fakeStorage) compose(w http.ResponseWriter, r *http.Request, bucket, name string, q url.Values) {
+	var req struct {
+		Destination   *fakeObject `json:"destination"`
+		SourceObjects []struct {
+			Name       string `json:"name"`
+			Generation string `json:"generation"`
+		} `json:"sourceObjects"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.SourceObjects) > maxComposeComponents {
+		writeError(w, http.StatusBadRequest, "The number of source components provided exceeds the maximum")
+		return
+	}
+
+	var data []byte
+	for _, src := range req.SourceObjects {
+		obj, ok := fs.lookup(w, bucket, src.Name, url.Values{"generation": {src.Generation}})
+		if !ok {
+			return
+		}
+		data = append(data, obj.data...)
+	}
+
+	if !fs.preconditions(w, fs.objects[bucket+"/"+name], q) {
+		return
+	}
+	obj := &fakeObject{}
+	if req.Destination != nil {
+		*obj = *req.Destination
+	}
+	obj.Bucket, obj.Name = bucket, name
+	obj.acl = q.Get("destinationPredefinedAcl")
+	fs.store(obj, data)
+	obj.MD5Hash = ""
+	writeJSON(w, obj)
+}
+
+// rewrite copies an object in a single call.
+func (fs *fakeStorage) rewrite(w http.ResponseWriter, r *http.Request, srcBucket, srcName, dstBucket, dstName string, q url.Values) {
+	src, ok := fs.lookup(w, srcBucket, srcName, url.Values{"generation": {q.Get("sourceGeneration")}})
+	if !ok {
+		return
+	}
+	if !fs.preconditions(w, fs.objects[dstBucket+"/"+dstName], q) {
+		return
+	}
+
+	obj := &fakeObject{}
+	if err := json.NewDecoder(r.Body).Decode(obj); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if obj.ContentType == "" {
+		obj.ContentType = src.ContentType
+	}
+	if obj.Metadata == nil {
+		obj.Metadata = src.Metadata
+	}
+	obj.Bucket, obj.Name = dstBucket, dstName
+	obj.acl = q.Get("destinationPredefinedAcl")
+	fs.store(obj, append([]byte(nil), src.data...))
+	writeJSON(w, map[string]interface{}{
+		"kind":                "storage#rewriteResponse",
+		"done":                true,
+		"totalBytesRewritten": obj.Size,
+		"objectSize":          obj.Size,
+		"resource":            obj,
+	})
+}
+
+// download serves the content of an object through the XML API.
+func (fs *fakeStorage) download(w http.ResponseWriter, r *http.Request, bucket, name string, q url.Values) {
+	obj, ok := fs.object(bucket, name, q)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	data := obj.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-", &start); err != nil || start > len(data) {
+			http.Error(w, "unsupported range "+rng, http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		data = data[start:]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Goog-Generation", obj.Generation)
+	w.Header().Set("X-Goog-Metageneration", obj.Metageneration)
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+// writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a JSON API error response.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": msg},
+	})
+}
+
+// testFiles writes the files, keyed by slash-separated name, into a new
+// directory and returns it.
+func testFiles(tb testing.TB, files map[string][]byte) string {
+	tb.Helper()
+
+	dir := tb.TempDir()
+	for name, content := range files {
+		pth := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pth, content, 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// randomBytes returns n bytes which do not compress.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// assertRestores restores key into a new directory and checks the file at
+// name has the given content.
+func assertRestores(tb testing.TB, c *Cacher, key, name string, content []byte) {
+	tb.Helper()
+
+	dir := tb.TempDir()
+	if _, err := c.Restore(context.Background(), &RestoreRequest{
+		Bucket: "bucket",
+		Keys:   []string{key},
+		Dir:    dir,
+	}); err != nil {
+		tb.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		tb.Errorf("expected %s to have %d bytes of the saved content, got %d bytes", name, len(content), len(got))
+	}
+}
@@ -0,0 +1,107 @@
+package cacher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestOperationTimeout(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		timeout time.Duration
+		cancel  bool
+		timeOut bool
+		op      func(ctx context.Context, c *Cacher) error
+	}{
+		{
+			name:    "download",
+			timeout: 50 * time.Millisecond,
+			timeOut: true,
+			op: func(ctx context.Context, c *Cacher) error {
+				_, err := c.Download(ctx, "bucket", "cache", ioutil.Discard)
+				return err
+			},
+		},
+		{
+			name:    "upload",
+			timeout: 50 * time.Millisecond,
+			timeOut: true,
+			op: func(ctx context.Context, c *Cacher) error {
+				_, err := c.Upload(ctx, "bucket", "new", bytes.NewReader([]byte("data")))
+				return err
+			},
+		},
+		{
+			name:    "save_reader",
+			timeout: 50 * time.Millisecond,
+			timeOut: true,
+			op: func(ctx context.Context, c *Cacher) error {
+				return c.SaveReader(ctx, "bucket", "new", bytes.NewReader([]byte("data")))
+			},
+		},
+		{
+			name:    "restore_to_memory",
+			timeout: 50 * time.Millisecond,
+			timeOut: true,
+			op: func(ctx context.Context, c *Cacher) error {
+				_, err := c.RestoreToMemory(ctx, "bucket", []string{"cache"})
+				return err
+			},
+		},
+		{
+			name:    "cancelled_by_caller",
+			timeout: time.Minute,
+			cancel:  true,
+			op: func(ctx context.Context, c *Cacher) error {
+				_, err := c.Download(ctx, "bucket", "cache", ioutil.Discard)
+				return err
+			},
+		},
+		{
+			name: "no_timeout",
+			op: func(ctx context.Context, c *Cacher) error {
+				_, err := c.Download(ctx, "bucket", "cache", ioutil.Discard)
+				return err
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			fs.put("bucket", "cache", testArchive(t, []testEntry{fileEntry("a", "a")}), &fakeObject{ContentType: "application/gzip"})
+			c.SaveTimeout(tc.timeout)
+			c.RestoreTimeout(tc.timeout)
+			if tc.timeout > 0 {
+				fs.setDelay(500 * time.Millisecond)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+
+			err := tc.op(ctx, c)
+			if got := errors.Is(err, ErrTimeout); got != tc.timeOut {
+				t.Errorf("expected timeout %t, got %v", tc.timeOut, err)
+			}
+			if tc.cancel && err == nil {
+				t.Error("expected an error when cancelled")
+			}
+			if !tc.cancel && !tc.timeOut && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package cacher
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// defaultVersionPattern matches a semantic version like 1.2.3 in an object
+// name.
+var defaultVersionPattern = regexp.MustCompile(`v?\d+\.\d+\.\d+`)
+
+// version is a parsed major.minor.patch version.
+type version [3]int
+
+// compare returns -1, 0, or 1 if v is less than, equal to, or greater than o.
+func (v version) compare(o version) int {
+	for i := range v {
+		switch {
+		case v[i] < o[i]:
+			return -1
+		case v[i] > o[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// parseVersion parses a version like "1.2.3" or "v1.2". Missing minor or patch
+// components are zero.
+func parseVersion(s string) (version, bool) {
+	var v version
+
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) > len(v) {
+		return v, false
+	}
+
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// extractVersion finds and parses the version in name using re. If re contains
+// a group named "version", that group is parsed; otherwise the whole match is.
+func extractVersion(re *regexp.Regexp, name string) (version, bool) {
+	match := re.FindStringSubmatch(name)
+	if match == nil {
+		return version{}, false
+	}
+
+	s := match[0]
+	if idx := re.SubexpIndex("version"); idx >= 0 {
+		s = match[idx]
+	}
+	return parseVersion(s)
+}
+
+// newerVersion returns a candidate selector which prefers the object with the
+// highest version in its name, breaking ties by the most recently updated.
+// Objects without a version are never selected. If compatible is non-nil, only
+// objects with the same major version that are not newer than it are selected.
+func (c *Cacher) newerVersion(re *regexp.Regexp, compatible *version) func(candidate, best *storage.ObjectAttrs) bool {
+	if re == nil {
+		re = defaultVersionPattern
+	}
+
+	return func(candidate, best *storage.ObjectAttrs) bool {
+		cv, ok := extractVersion(re, candidate.Name)
+		if !ok {
+			c.log("skipping %s (no version in name)", candidate.Name)
+			return false
+		}
+
+		if compatible != nil && (cv[0] != compatible[0] || cv.compare(*compatible) > 0) {
+			c.log("skipping %s (version is not compatible)", candidate.Name)
+			return false
+		}
+
+		if best == nil {
+			return true
+		}
+
+		// The current best was already accepted, so its version parses.
+		bv, _ := extractVersion(re, best.Name)
+		switch cv.compare(bv) {
+		case 1:
+			return true
+		case 0:
+			return candidate.Updated.After(best.Updated)
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package cacher
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestCacher_Restore_versionAware(t *testing.T) {
+	t.Parallel()
+
+	// Objects are saved in order, each one newer than the last
+	cases := []struct {
+		name       string
+		objects    []string
+		pattern    *regexp.Regexp
+		compatible string
+		exp        string
+		miss       bool
+	}{
+		{
+			name:    "highest_version",
+			objects: []string{"deps-1.10.0-a", "deps-1.2.3-b", "deps-1.9.9-c"},
+			exp:     "deps-1.10.0-a",
+		},
+		{
+			name:    "tie_newest",
+			objects: []string{"deps-1.2.3-a", "deps-1.2.3-b"},
+			exp:     "deps-1.2.3-b",
+		},
+		{
+			name:    "unversioned_ignored",
+			objects: []string{"deps-1.0.0-a", "deps-latest"},
+			exp:     "deps-1.0.0-a",
+		},
+		{
+			name:    "only_unversioned",
+			objects: []string{"deps-latest"},
+			miss:    true,
+		},
+		{
+			name:       "compatible",
+			objects:    []string{"deps-1.3.0-a", "deps-1.5.0-b", "deps-2.0.0-c"},
+			compatible: "1.4.0",
+			exp:        "deps-1.3.0-a",
+		},
+		{
+			name:       "none_compatible",
+			objects:    []string{"deps-2.0.0-a", "deps-1.5.0-b"},
+			compatible: "1.4",
+			miss:       true,
+		},
+		{
+			name:    "pattern_group",
+			objects: []string{"deps-go1.20-1.0.0", "deps-go1.19-2.0.0"},
+			pattern: regexp.MustCompile(`go(?P<version>\d+\.\d+)`),
+			exp:     "deps-go1.20-1.0.0",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			start := time.Now().Add(-time.Hour)
+			for idx, name := range tc.objects {
+				saveAt(t, c, fs, name, start.Add(time.Duration(idx)*time.Minute))
+			}
+
+			result, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket:                "bucket",
+				Keys:                  []string{"deps-"},
+				Dir:                   t.TempDir(),
+				DryRun:                true,
+				VersionAware:          true,
+				VersionPattern:        tc.pattern,
+				VersionCompatibleWith: tc.compatible,
+			})
+			if tc.miss {
+				var nerr *NotFoundError
+				if !errors.As(err, &nerr) {
+					t.Fatalf("expected a miss, got %v (%s)", err, result.ObjectName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.ObjectName != tc.exp {
+				t.Errorf("expected %s, got %s", tc.exp, result.ObjectName)
+			}
+		})
+	}
+}
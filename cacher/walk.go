@@ -0,0 +1,300 @@
+package cacher
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/archiver/v4"
+)
+
+// walkOptions controls how files are gathered from disk.
+type walkOptions struct {
+	// followSymlinks dereferences symlinks and archives the content they point
+	// to instead of the link itself.
+	followSymlinks bool
+
+	// xattrs records the extended attributes of each file and directory.
+	xattrs bool
+
+	// concurrency is the number of directories read concurrently. Values less
+	// than two walk serially.
+	concurrency int
+
+	// maxFileSize skips regular files larger than this many bytes, or zero for
+	// no limit.
+	maxFileSize int64
+
+	// skipSpecial skips sockets, named pipes, and devices instead of failing
+	// on them.
+	skipSpecial bool
+}
+
+// specialFileModes are the file modes which cannot be archived meaningfully.
+// Reading a named pipe blocks until another process writes to it, and sockets
+// and devices have no content of their own.
+const specialFileModes = os.ModeSocket | os.ModeNamedPipe | os.ModeDevice | os.ModeCharDevice | os.ModeIrregular
+
+// specialFileKind describes the kind of a special file for messages.
+func specialFileKind(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&(os.ModeDevice|os.ModeCharDevice) != 0:
+		return "device"
+	default:
+		return "irregular file"
+	}
+}
+
+// filesFromDisk walks each root on disk and returns the list of files to
+// archive. The keys of roots are paths on disk and the values are the name of
+// that directory in the archive; an empty value uses the base name of the path.
+// Like archiver.FilesFromDisk, a path ending in a separator drops the first
+// component of the name instead, so the contents of "dir/" with an empty name
+// are at the top of the archive. Roots are walked in sorted order so the result
+// is stable.
+func (c *Cacher) filesFromDisk(roots map[string]string, opts *walkOptions) ([]archiver.File, error) {
+	if opts == nil {
+		opts = new(walkOptions)
+	}
+
+	rootsOnDisk := make([]string, 0, len(roots))
+	for root := range roots {
+		rootsOnDisk = append(rootsOnDisk, root)
+	}
+	sort.Strings(rootsOnDisk)
+
+	w := &walker{
+		c:    c,
+		opts: opts,
+	}
+	if opts.concurrency > 1 {
+		// The walking goroutine holds a slot too
+		w.sem = make(chan struct{}, opts.concurrency-1)
+	}
+
+	var files []archiver.File
+	for _, root := range rootsOnDisk {
+		rootInArchive := strings.Trim(filepath.ToSlash(roots[root]), "/")
+		switch {
+		case hasTrailingSeparator(root):
+			rootInArchive = trimTopDir(rootInArchive)
+		case rootInArchive == "":
+			rootInArchive = filepath.Base(root)
+		}
+
+		rootFiles, err := w.walk(root, rootInArchive, nil)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, rootFiles...)
+	}
+	return files, nil
+}
+
+// hasTrailingSeparator returns true if pth ends in a path separator.
+func hasTrailingSeparator(pth string) bool {
+	return len(pth) > 1 && os.IsPathSeparator(pth[len(pth)-1])
+}
+
+// trimTopDir removes the first component of the slash-separated path name,
+// like archiver does for paths on disk ending in a separator.
+func trimTopDir(name string) string {
+	if idx := strings.Index(name, "/"); idx >= 0 {
+		return name[idx+1:]
+	}
+	return ""
+}
+
+// walker gathers files from disk.
+type walker struct {
+	c    *Cacher
+	opts *walkOptions
+
+	// sem limits the number of additional goroutines walking directories, or is
+	// nil to walk serially.
+	sem chan struct{}
+}
+
+// walk returns filename and, if it is a directory, all of its children, in
+// the same order regardless of concurrency. ancestors is the list of
+// directories above filename, which is used to detect symlink loops when
+// following symlinks.
+func (w *walker) walk(filename, nameInArchive string, ancestors []os.FileInfo) ([]archiver.File, error) {
+	info, err := os.Lstat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", filename, err)
+	}
+
+	var linkTarget string
+	if info.Mode()&os.ModeSymlink != 0 {
+		linkTarget, err = os.Readlink(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read symlink %s: %w", filename, err)
+		}
+
+		if w.opts.followSymlinks {
+			target, err := os.Stat(filename)
+			switch {
+			case os.IsNotExist(err):
+				w.c.log("not following %s (target %s does not exist)", filename, linkTarget)
+			case err != nil:
+				return nil, fmt.Errorf("failed to resolve symlink %s: %w", filename, err)
+			default:
+				info = target
+				linkTarget = ""
+			}
+		}
+	}
+
+	if mode := info.Mode(); mode&specialFileModes != 0 {
+		if !w.opts.skipSpecial {
+			return nil, fmt.Errorf("cannot archive %s: %s is not supported", filename, specialFileKind(mode))
+		}
+		w.c.log("skipping %s (%s)", filename, specialFileKind(mode))
+		return nil, nil
+	}
+
+	if w.opts.maxFileSize > 0 && info.Mode().IsRegular() && info.Size() > w.opts.maxFileSize {
+		w.c.warn("skipping %s (%d bytes is larger than the maximum file size)", filename, info.Size())
+		return nil, nil
+	}
+
+	// A directory which is also one of its own ancestors can only be reached
+	// through a symlink, and would otherwise recurse forever.
+	if info.IsDir() {
+		for _, ancestor := range ancestors {
+			if os.SameFile(ancestor, info) {
+				w.c.log("skipping %s (symlink loop)", filename)
+				return nil, nil
+			}
+		}
+	}
+
+	// Extended attributes are carried to the tar writer as PAX records on a
+	// partial header.
+	var hdr *tar.Header
+	if w.opts.xattrs && linkTarget == "" {
+		xattrs, err := listXattrs(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list extended attributes of %s: %w", filename, err)
+		}
+		if len(xattrs) > 0 {
+			hdr = &tar.Header{PAXRecords: make(map[string]string, len(xattrs))}
+			for k, v := range xattrs {
+				hdr.PAXRecords[paxXattrPrefix+k] = v
+			}
+		}
+	}
+
+	// Every directory gets its own entry, even if it is empty, so that it is
+	// recreated on restore. Some tooling relies on directories like tmp/ or logs/
+	// existing. A root at the top of the archive has no name of its own.
+	var files []archiver.File
+	if nameInArchive != "" {
+		files = append(files, archiver.File{
+			FileInfo:      info,
+			Header:        hdr,
+			NameInArchive: nameInArchive,
+			LinkTarget:    linkTarget,
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(filename)
+			},
+		})
+	}
+
+	if !info.IsDir() {
+		return files, nil
+	}
+
+	entries, err := os.ReadDir(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", filename, err)
+	}
+
+	// Children may be walked concurrently, so each gets its own copy of the
+	// ancestors
+	ancestors = append(ancestors[:len(ancestors):len(ancestors)], info)
+
+	children := make([][]archiver.File, len(entries))
+	errs := make([]error, len(entries))
+	var wg sync.WaitGroup
+	for idx, entry := range entries {
+		idx := idx
+		childFilename := filepath.Join(filename, entry.Name())
+		childName := path.Join(nameInArchive, entry.Name())
+
+		// Hand subdirectories to another goroutine if one is free, and walk
+		// everything else inline
+		if w.sem != nil && entry.IsDir() {
+			select {
+			case w.sem <- struct{}{}:
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() { <-w.sem }()
+					children[idx], errs[idx] = w.walk(childFilename, childName, ancestors)
+				}()
+				continue
+			default:
+			}
+		}
+
+		children[idx], errs[idx] = w.walk(childFilename, childName, ancestors)
+		if errs[idx] != nil && w.sem == nil {
+			return nil, errs[idx]
+		}
+	}
+	wg.Wait()
+
+	for idx := range entries {
+		if errs[idx] != nil {
+			return nil, errs[idx]
+		}
+		files = append(files, children[idx]...)
+	}
+	return files, nil
+}
+
+// newestModTime returns the most recent modification time of the files.
+func newestModTime(files []archiver.File) time.Time {
+	var newest time.Time
+	for _, f := range files {
+		if t := f.ModTime(); t.After(newest) {
+			newest = t
+		}
+	}
+	return newest
+}
+
+// hasFiles returns true if any of the files is not a directory.
+func hasFiles(files []archiver.File) bool {
+	for _, f := range files {
+		if !f.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// contentSize returns the total size of the regular files, which is the size of
+// the content written to the archive.
+func contentSize(files []archiver.File) int64 {
+	var size int64
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			size += f.Size()
+		}
+	}
+	return size
+}
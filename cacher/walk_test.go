@@ -0,0 +1,285 @@
+package cacher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// walkNames walks dir, named "root" in the archive, and describes each entry:
+// directories end in a slash and links name their target.
+func walkNames(tb testing.TB, c *Cacher, dir string, opts *walkOptions) ([]string, error) {
+	tb.Helper()
+
+	files, err := c.filesFromDisk(map[string]string{dir: "root"}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		switch {
+		case f.IsDir():
+			names = append(names, f.NameInArchive+"/")
+		case f.LinkTarget != "":
+			names = append(names, f.NameInArchive+" -> "+f.LinkTarget)
+		default:
+			names = append(names, f.NameInArchive)
+		}
+	}
+	return names, nil
+}
+
+func TestFilesFromDisk_roots(t *testing.T) {
+	t.Parallel()
+
+	dir := testFiles(t, map[string][]byte{"sub/file": []byte("content")})
+	sep := string(filepath.Separator)
+
+	cases := []struct {
+		name  string
+		root  string
+		inArc string
+		exp   []string
+	}{
+		{name: "base_name", root: dir, exp: []string{filepath.Base(dir) + "/", filepath.Base(dir) + "/sub/", filepath.Base(dir) + "/sub/file"}},
+		{name: "named", root: dir, inArc: "a/b", exp: []string{"a/b/", "a/b/sub/", "a/b/sub/file"}},
+		{name: "separator", root: dir + sep, exp: []string{"sub/", "sub/file"}},
+		{name: "separator_named", root: dir + sep, inArc: "a/b", exp: []string{"b/", "b/sub/", "b/sub/file"}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			files, err := (&Cacher{}).filesFromDisk(map[string]string{tc.root: tc.inArc}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(files))
+			for _, f := range files {
+				name := f.NameInArchive
+				if f.IsDir() {
+					name += "/"
+				}
+				got = append(got, name)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.exp, ",") {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestFilesFromDisk_followSymlinks(t *testing.T) {
+	t.Parallel()
+
+	dir := testFiles(t, map[string][]byte{
+		"a/file":   []byte("content"),
+		"b/nested": []byte("nested"),
+	})
+	for link, target := range map[string]string{
+		"a/file-link": "file",
+		"a/loop":      "..",
+		"a/dangling":  "missing",
+		"a/b":         "../b",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name   string
+		follow bool
+		exp    []string
+	}{
+		{
+			name: "links",
+			exp: []string{
+				"root/", "root/a/", "root/a/b -> ../b", "root/a/dangling -> missing", "root/a/file",
+				"root/a/file-link -> file", "root/a/loop -> ..", "root/b/", "root/b/nested",
+			},
+		},
+		{
+			// The loop back to the root is skipped, and links which do not
+			// resolve are kept as links
+			name:   "follow",
+			follow: true,
+			exp: []string{
+				"root/", "root/a/", "root/a/b/", "root/a/b/nested", "root/a/dangling -> missing", "root/a/file",
+				"root/a/file-link", "root/b/", "root/b/nested",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := walkNames(t, &Cacher{}, dir, &walkOptions{followSymlinks: tc.follow})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.exp, "\n") {
+				t.Errorf("expected\n%s\n\ngot\n%s", strings.Join(tc.exp, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestFilesFromDisk_maxFileSize(t *testing.T) {
+	t.Parallel()
+
+	dir := testFiles(t, map[string][]byte{
+		"small": []byte("small"),
+		"exact": []byte("0123456789"),
+		"large": []byte("0123456789!"),
+	})
+	if err := os.Symlink("large", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		max    int64
+		follow bool
+		exp    []string
+	}{
+		{
+			name: "no_limit",
+			exp:  []string{"root/", "root/exact", "root/large", "root/link -> large", "root/small"},
+		},
+		{
+			// Links are kept, since they have no content of their own
+			name: "limit",
+			max:  10,
+			exp:  []string{"root/", "root/exact", "root/link -> large", "root/small"},
+		},
+		{
+			name:   "limit_followed",
+			max:    10,
+			follow: true,
+			exp:    []string{"root/", "root/exact", "root/small"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := walkNames(t, &Cacher{}, dir, &walkOptions{maxFileSize: tc.max, followSymlinks: tc.follow})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.exp, ",") {
+				t.Errorf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+// testTree writes a tree of width directories per level, depth levels deep,
+// with a few files in each directory, and returns its root.
+func testTree(tb testing.TB, width, depth int) string {
+	tb.Helper()
+
+	files := make(map[string][]byte)
+	var fill func(prefix string, level int)
+	fill = func(prefix string, level int) {
+		for idx := 0; idx < 3; idx++ {
+			files[prefix+"file"+string(rune('a'+idx))] = []byte(prefix)
+		}
+		if level == depth {
+			return
+		}
+		for idx := 0; idx < width; idx++ {
+			fill(prefix+"dir"+string(rune('a'+idx))+"/", level+1)
+		}
+	}
+	fill("", 0)
+	return testFiles(tb, files)
+}
+
+func TestFilesFromDisk_concurrency(t *testing.T) {
+	t.Parallel()
+
+	dir := testTree(t, 4, 3)
+	exp, err := walkNames(t, &Cacher{}, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		concurrency int
+	}{
+		{name: "serial", concurrency: 1},
+		{name: "two", concurrency: 2},
+		{name: "many", concurrency: 32},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := walkNames(t, &Cacher{}, dir, &walkOptions{concurrency: tc.concurrency})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != strings.Join(exp, ",") {
+				t.Errorf("expected the same order as a serial walk, got %q", got)
+			}
+		})
+	}
+
+}
+
+func TestFilesFromDisk_concurrencyError(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("directories cannot be made unreadable")
+	}
+
+	// Errors are reported regardless of which goroutine finds them
+	dir := testTree(t, 4, 3)
+	unreadable := filepath.Join(dir, "dirb", "dirc")
+	if err := os.Chmod(unreadable, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(unreadable, 0755)
+
+	if _, err := walkNames(t, &Cacher{}, dir, &walkOptions{concurrency: 8}); err == nil {
+		t.Error("expected an error for an unreadable directory")
+	}
+}
+
+func BenchmarkFilesFromDisk(b *testing.B) {
+	dir := testTree(b, 6, 3)
+
+	for _, concurrency := range []int{1, 4, 16} {
+		concurrency := concurrency
+
+		b.Run(fmt.Sprintf("concurrency_%d", concurrency), func(b *testing.B) {
+			c := &Cacher{}
+			opts := &walkOptions{concurrency: concurrency}
+			for i := 0; i < b.N; i++ {
+				if _, err := c.filesFromDisk(map[string]string{dir: "root"}, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
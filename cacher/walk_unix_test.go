@@ -0,0 +1,87 @@
+//go:build !windows
+// +build !windows
+
+package cacher
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSave_specialFiles(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		skip bool
+		err  string
+	}{
+		{name: "skip", skip: true},
+		{name: "fail", skip: false, err: "is not supported"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, fs := newTestCacher(t)
+			c.SkipSpecialFiles(tc.skip)
+
+			content := []byte("content")
+			src := testFiles(t, map[string][]byte{"data": content})
+			if err := syscall.Mkfifo(filepath.Join(src, "fifo"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			l, err := net.Listen("unix", filepath.Join(src, "sock"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			_, err = c.Save(context.Background(), &SaveRequest{
+				Bucket: "bucket",
+				Key:    "cache",
+				Dir:    src,
+			})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				if obj := fs.get("bucket", "cache"); obj != nil {
+					t.Errorf("expected no object to be uploaded, got %s", obj.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			if _, err := c.Restore(context.Background(), &RestoreRequest{
+				Bucket: "bucket",
+				Keys:   []string{"cache"},
+				Dir:    dir,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := os.ReadDir(filepath.Join(dir, filepath.Base(src)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Name() != "data" {
+				var names []string
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+				t.Errorf("expected only data to be restored, got %q", names)
+			}
+		})
+	}
+}
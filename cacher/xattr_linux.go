@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package cacher
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+// listXattrs returns the extended attributes of the file at pth. If the
+// filesystem does not support extended attributes, it returns nil.
+func listXattrs(pth string) (map[string]string, error) {
+	sz, err := syscall.Listxattr(pth, nil)
+	if err != nil {
+		if xattrUnsupported(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if sz == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, sz)
+	sz, err = syscall.Listxattr(pth, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range strings.Split(string(buf[:sz]), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		vsz, err := syscall.Getxattr(pth, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		val := make([]byte, vsz)
+		vsz, err = syscall.Getxattr(pth, name, val)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[name] = string(val[:vsz])
+	}
+	return xattrs, nil
+}
+
+// setXattr sets the extended attribute on the file at pth.
+func setXattr(pth, name, value string) error {
+	return syscall.Setxattr(pth, name, []byte(value), 0)
+}
+
+// xattrUnsupported returns true if the error indicates the filesystem does not
+// support the attribute, or the process is not permitted to set it (as is the
+// case for security.* attributes when not running as root).
+func xattrUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package cacher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacher_Restore_xattrs(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		save    bool
+		restore bool
+		exp     bool
+	}{
+		{name: "preserved", save: true, restore: true, exp: true},
+		{name: "not_saved", save: false, restore: true, exp: false},
+		{name: "not_restored", save: true, restore: false, exp: false},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, _ := newTestCacher(t)
+			src := testFiles(t, map[string][]byte{"dir/file": []byte("content")})
+			for _, name := range []string{"dir", "dir/file"} {
+				if err := setXattr(filepath.Join(src, name), "user.origin", name); err != nil {
+					if xattrUnsupported(err) {
+						t.Skipf("extended attributes are not supported: %s", err)
+					}
+					t.Fatal(err)
+				}
+			}
+
+			dst := t.TempDir()
+			if _, err := roundTrip(t, c, src,
+				SaveRequest{PreserveXattrs: tc.save},
+				RestoreRequest{Dir: dst, PreserveXattrs: tc.restore}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range []string{"dir", "dir/file"} {
+				xattrs, err := listXattrs(filepath.Join(dst, filepath.Base(src), filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got, ok := xattrs["user.origin"]
+				if ok != tc.exp {
+					t.Fatalf("expected %s to have the attribute: %t, got %v", name, tc.exp, xattrs)
+				}
+				if ok && got != name {
+					t.Errorf("expected %s to have the attribute %q, got %q", name, name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestListXattrs_missing(t *testing.T) {
+	t.Parallel()
+
+	if _, err := listXattrs(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+}
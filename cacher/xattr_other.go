@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package cacher
+
+// listXattrs is a no-op on platforms without extended attribute support.
+func listXattrs(pth string) (map[string]string, error) {
+	return nil, nil
+}
+
+// setXattr is a no-op on platforms without extended attribute support.
+func setXattr(pth, name, value string) error {
+	return nil
+}
+
+// xattrUnsupported always returns true on platforms without extended attribute
+// support.
+func xattrUnsupported(err error) bool {
+	return true
+}
@@ -0,0 +1,193 @@
+package cacher
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+
+	"github.com/mholt/archiver/v4"
+)
+
+const (
+	// zstdMagic is the magic number at the beginning of every zstd frame, in
+	// little-endian order.
+	zstdMagic = 0xFD2FB528
+
+	// maxZstdBlockSize is the largest block a zstd frame can contain.
+	maxZstdBlockSize = 128 << 10
+
+	// rawFrameWindow is the window descriptor of raw frames, declaring a window
+	// of exactly one block (2^(10+7) bytes).
+	rawFrameWindow = 7 << 3
+)
+
+// PrecompressedPatterns are file name patterns of common formats which are
+// already compressed, for use with SaveRequest.StoreUncompressed.
+var PrecompressedPatterns = []string{
+	"*.7z", "*.br", "*.bz2", "*.gz", "*.jar", "*.lz4", "*.tgz", "*.war", "*.xz",
+	"*.zip", "*.zst",
+	"*.avif", "*.gif", "*.jpeg", "*.jpg", "*.png", "*.webp",
+	"*.mkv", "*.mov", "*.mp3", "*.mp4", "*.ogg", "*.webm",
+	"*.woff", "*.woff2",
+}
+
+// matchAny returns true if the base name of the archive path name matches any
+// of the patterns. The patterns were checked by Validate.
+func matchAny(patterns []string, name string) bool {
+	base := path.Base(name)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// frameWriter writes a zstd stream of concatenated frames, where some of the
+// data bypasses the compressor in frames of raw blocks. Decoders read
+// concatenated frames as a single stream, so the result is a regular zstd
+// stream.
+type frameWriter struct {
+	w          io.Writer
+	compressor archiver.Compressor
+
+	// Exactly one of cw and raw is set at a time.
+	cw  io.WriteCloser
+	raw *rawFrameWriter
+}
+
+// newFrameWriter creates a frameWriter writing to w, starting with a
+// compressed frame.
+func newFrameWriter(w io.Writer, compressor archiver.Compressor) (*frameWriter, error) {
+	cw, err := compressor.OpenWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &frameWriter{w: w, compressor: compressor, cw: cw}, nil
+}
+
+// Write writes p to the current frame.
+func (f *frameWriter) Write(p []byte) (int, error) {
+	if f.raw != nil {
+		return f.raw.Write(p)
+	}
+	return f.cw.Write(p)
+}
+
+// storeRaw ends the compressed frame, so that following writes are stored
+// uncompressed.
+func (f *frameWriter) storeRaw() error {
+	if f.raw != nil {
+		return nil
+	}
+
+	if err := f.cw.Close(); err != nil {
+		return fmt.Errorf("failed to close compressor: %w", err)
+	}
+	f.cw = nil
+	f.raw = &rawFrameWriter{w: f.w}
+	return nil
+}
+
+// compress ends the raw frame, so that following writes are compressed again.
+func (f *frameWriter) compress() error {
+	if f.raw == nil {
+		return nil
+	}
+
+	if err := f.raw.Close(); err != nil {
+		return err
+	}
+	f.raw = nil
+
+	cw, err := f.compressor.OpenWriter(f.w)
+	if err != nil {
+		return fmt.Errorf("failed to create compressor: %w", err)
+	}
+	f.cw = cw
+	return nil
+}
+
+// Close ends the current frame.
+func (f *frameWriter) Close() error {
+	if f.raw != nil {
+		return f.raw.Close()
+	}
+	return f.cw.Close()
+}
+
+// rawFrameWriter writes a single zstd frame consisting of raw blocks, which
+// store data without compressing it.
+type rawFrameWriter struct {
+	w       io.Writer
+	buf     []byte
+	started bool
+}
+
+// Write buffers p, writing a block whenever a full one is buffered.
+func (r *rawFrameWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if r.buf == nil {
+			r.buf = make([]byte, 0, maxZstdBlockSize)
+		}
+
+		chunk := maxZstdBlockSize - len(r.buf)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		r.buf = append(r.buf, p[:chunk]...)
+		p = p[chunk:]
+
+		// A full block is only written once more data follows it, since the
+		// last block of the frame has to be marked as such
+		if len(r.buf) == maxZstdBlockSize && len(p) > 0 {
+			if err := r.writeBlock(false); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the remaining buffered data as the last block of the frame.
+func (r *rawFrameWriter) Close() error {
+	if len(r.buf) == maxZstdBlockSize {
+		if err := r.writeBlock(false); err != nil {
+			return err
+		}
+	}
+	return r.writeBlock(true)
+}
+
+// writeBlock writes the buffered data as a raw block, preceded by the frame
+// header for the first block.
+func (r *rawFrameWriter) writeBlock(last bool) error {
+	if !r.started {
+		// No content size, checksum, or dictionary
+		var hdr [6]byte
+		binary.LittleEndian.PutUint32(hdr[:4], zstdMagic)
+		hdr[5] = rawFrameWindow
+		if _, err := r.w.Write(hdr[:]); err != nil {
+			return fmt.Errorf("failed to write frame header: %w", err)
+		}
+		r.started = true
+	}
+
+	// The block header is the last flag, the block type (zero for raw), and
+	// the size in 3 little-endian bytes
+	bh := uint32(len(r.buf)) << 3
+	if last {
+		bh |= 1
+	}
+	if _, err := r.w.Write([]byte{byte(bh), byte(bh >> 8), byte(bh >> 16)}); err != nil {
+		return fmt.Errorf("failed to write block header: %w", err)
+	}
+	if _, err := r.w.Write(r.buf); err != nil {
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+	r.buf = r.buf[:0]
+	return nil
+}
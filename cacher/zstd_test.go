@@ -0,0 +1,161 @@
+package cacher
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mholt/archiver/v4"
+)
+
+func TestRawFrameWriter(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		size   int
+		writes int
+	}{
+		{name: "empty", size: 0, writes: 1},
+		{name: "one_byte", size: 1, writes: 1},
+		{name: "full_block", size: maxZstdBlockSize, writes: 1},
+		{name: "full_block_split", size: maxZstdBlockSize, writes: 7},
+		{name: "over_block", size: maxZstdBlockSize + 1, writes: 1},
+		{name: "several_blocks", size: 3*maxZstdBlockSize + 17, writes: 5},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			data := randomBytes(tc.size)
+			var buf bytes.Buffer
+			r := &rawFrameWriter{w: &buf}
+			chunk := tc.size/tc.writes + 1
+			for p := data; ; {
+				n := chunk
+				if n > len(p) {
+					n = len(p)
+				}
+				if _, err := r.Write(p[:n]); err != nil {
+					t.Fatal(err)
+				}
+				if p = p[n:]; len(p) == 0 {
+					break
+				}
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Each block adds a 3 byte header to the 6 byte frame header. The last
+			// block is never full, so it is empty for a multiple of the block size.
+			blocks := tc.size/maxZstdBlockSize + 1
+			if exp := 6 + 3*blocks + tc.size; buf.Len() != exp {
+				t.Errorf("expected %d bytes, got %d", exp, buf.Len())
+			}
+
+			zr, err := zstd.NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			got, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("expected %d bytes to round trip, got %d different bytes", len(data), len(got))
+			}
+		})
+	}
+}
+
+func TestFrameWriter(t *testing.T) {
+	t.Parallel()
+
+	text := []byte(strings.Repeat("compressible text ", 10000))
+	stored := randomBytes(200 << 10)
+
+	var buf bytes.Buffer
+	fw, err := newFrameWriter(&buf, archiver.Zstd{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []func() error{
+		func() error { _, err := fw.Write(text); return err },
+		fw.storeRaw,
+		fw.storeRaw,
+		func() error { _, err := fw.Write(stored); return err },
+		fw.compress,
+		fw.compress,
+		func() error { _, err := fw.Write(text); return err },
+		fw.storeRaw,
+		fw.Close,
+	}
+	for idx, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %v", idx, err)
+		}
+	}
+
+	// Stored content is in the stream verbatim, up to block headers; the text
+	// is not
+	if !bytes.Contains(buf.Bytes(), stored[:maxZstdBlockSize]) {
+		t.Error("expected stored content to be uncompressed")
+	}
+	if buf.Len() > len(stored)+len(text)/10 {
+		t.Errorf("expected text to be compressed, got %d bytes", buf.Len())
+	}
+
+	zr, err := zstd.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := append(append(append([]byte(nil), text...), stored...), text...)
+	if !bytes.Equal(got, exp) {
+		t.Errorf("expected %d bytes as one stream, got %d different bytes", len(exp), len(got))
+	}
+}
+
+func BenchmarkFrameWriter(b *testing.B) {
+	data := randomBytes(8 << 20)
+
+	for _, raw := range []bool{false, true} {
+		raw := raw
+
+		name := "compressed"
+		if raw {
+			name = "stored"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				fw, err := newFrameWriter(io.Discard, archiver.Zstd{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if raw {
+					if err := fw.storeRaw(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if _, err := fw.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				if err := fw.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
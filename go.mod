@@ -7,7 +7,7 @@ require (
 	cloud.google.com/go/storage v1.28.0
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/jstemmer/go-junit-report v1.0.0 // indirect
-	github.com/klauspost/compress v1.15.12 // indirect
+	github.com/klauspost/compress v1.15.12
 	github.com/mholt/archiver/v4 v4.0.0-alpha.7
 	github.com/pierrec/lz4/v4 v4.1.17 // indirect
 	github.com/sethvargo/go-signalcontext v0.1.0
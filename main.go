@@ -9,6 +9,7 @@ import (
 	"os"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/sethvargo/gcs-cacher/cacher"
 	"github.com/sethvargo/go-signalcontext"
@@ -38,6 +39,18 @@ var (
 	// hash is the glob pattern to hash.
 	hash string
 
+	// hashTimeout is the maximum time to spend hashing a single file.
+	hashTimeout time.Duration
+
+	// hashAllowEmpty allows hashing no files.
+	hashAllowEmpty bool
+
+	// timeout is the maximum time to spend saving or restoring.
+	timeout time.Duration
+
+	// heartbeat is the interval at which to log progress during transfers.
+	heartbeat time.Duration
+
 	// debug enables debug logging.
 	debug bool
 )
@@ -50,6 +63,11 @@ func init() {
 	flag.Var(&restore, "restore", "Keys to search to restore (can use multiple times).")
 	flag.BoolVar(&allowFailure, "allow-failure", false, "Allow the command to fail.")
 	flag.StringVar(&hash, "hash", "", "Glob pattern to hash.")
+	flag.DurationVar(&hashTimeout, "hash-timeout", 0, "Maximum time to spend hashing a single file.")
+	flag.BoolVar(&hashAllowEmpty, "hash-allow-empty", false, "Allow hashing no files, producing the key part \"empty\".")
+
+	flag.DurationVar(&timeout, "timeout", 0, "Maximum time to spend saving or restoring (0 for no limit).")
+	flag.DurationVar(&heartbeat, "heartbeat", 30*time.Second, "Interval at which to log progress during transfers (0 to disable).")
 
 	flag.BoolVar(&debug, "debug", false, "Print verbose debug logs.")
 }
@@ -93,16 +111,22 @@ func realMain(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	defer c.Close()
 	c.Debug(debug)
+	c.HashFileTimeout(hashTimeout)
+	c.HashAllowEmpty(hashAllowEmpty)
+	c.SaveTimeout(timeout)
+	c.RestoreTimeout(timeout)
+	c.Heartbeat(heartbeat)
 
 	switch {
 	case cache != "":
-		parsed, err := parseTemplate(c, cache)
+		parsed, err := parseTemplate(ctx, c, cache)
 		if err != nil {
 			return err
 		}
 
-		if err := c.Save(ctx, &cacher.SaveRequest{
+		if _, err := c.Save(ctx, &cacher.SaveRequest{
 			Bucket: bucket,
 			Dir:    dir,
 			Key:    parsed,
@@ -115,14 +139,14 @@ func realMain(ctx context.Context) error {
 	case restore != nil:
 		keys := make([]string, len(restore))
 		for i, key := range restore {
-			parsed, err := parseTemplate(c, key)
+			parsed, err := parseTemplate(ctx, c, key)
 			if err != nil {
 				return err
 			}
 			keys[i] = parsed
 		}
 
-		if err := c.Restore(ctx, &cacher.RestoreRequest{
+		if _, err := c.Restore(ctx, &cacher.RestoreRequest{
 			Bucket: bucket,
 			Dir:    dir,
 			Keys:   keys,
@@ -137,10 +161,10 @@ func realMain(ctx context.Context) error {
 	}
 }
 
-func parseTemplate(c *cacher.Cacher, key string) (string, error) {
+func parseTemplate(ctx context.Context, c *cacher.Cacher, key string) (string, error) {
 	tmpl, err := template.New("").
 		Option("missingkey=error").
-		Funcs(templateFuncs(c)).
+		Funcs(templateFuncs(ctx, c)).
 		Parse(key)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse template: %w", err)
@@ -153,10 +177,13 @@ func parseTemplate(c *cacher.Cacher, key string) (string, error) {
 	return b.String(), nil
 }
 
-func templateFuncs(c *cacher.Cacher) template.FuncMap {
+func templateFuncs(ctx context.Context, c *cacher.Cacher) template.FuncMap {
 	return template.FuncMap{
 		"hashGlob": func(key string) (string, error) {
-			return c.HashGlob(key)
+			return c.HashGlob(ctx, key)
+		},
+		"hashGlobs": func(keys ...string) (string, error) {
+			return c.HashGlobsContext(ctx, keys)
 		},
 	}
 }